@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+	logFormatGCP  = "gcp"
+)
+
+type logFieldsKey struct{}
+
+// requestLogFields are the fields added to the access log of a request by
+// the handlers that serve it, like the prefix of mappings.
+type requestLogFields struct {
+	mu     sync.Mutex
+	fields logrus.Fields
+}
+
+// addLogFields adds the given fields to the access log of the request of
+// the given context, and to its slow request log. It does nothing when both
+// are disabled.
+func addLogFields(ctx context.Context, fields logrus.Fields) {
+	rf, ok := ctx.Value(logFieldsKey{}).(*requestLogFields)
+	if !ok {
+		return
+	}
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	for key, value := range fields {
+		rf.fields[key] = value
+	}
+}
+
+// addLogDuration adds the given duration, in seconds, to the given field of
+// the logs of the request of the given context (see addLogFields), so the
+// durations of operations repeated within a request, like signing, are
+// summed.
+func addLogDuration(ctx context.Context, key string, d time.Duration) {
+	rf, ok := ctx.Value(logFieldsKey{}).(*requestLogFields)
+	if !ok {
+		return
+	}
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	seconds, _ := rf.fields[key].(float64)
+	rf.fields[key] = seconds + d.Seconds()
+}
+
+// accessLogHandler wraps the given handler, logging every request it serves
+// (except health checks) when GCS_HELPER_ACCESS_LOG is set. Errors are
+// always logged, but only one in GCS_HELPER_ACCESS_LOG_SAMPLING successful
+// requests when it's greater than 1, and none when the level of their
+// handler in GCS_HELPER_LOG_LEVELS is higher than info.
+func accessLogHandler(c Config, logger *logrus.Logger, handler http.HandlerFunc) http.HandlerFunc {
+	if !c.AccessLog {
+		return handler
+	}
+	levels := make(map[string]logrus.Level, len(c.LogLevels))
+	for name, level := range c.LogLevels {
+		levels[name], _ = logrus.ParseLevel(level)
+	}
+	sampling := uint64(c.AccessLogSampling)
+	var successes uint64
+	return func(w http.ResponseWriter, r *http.Request) {
+		if isHealthCheck(c, r) {
+			handler(w, r)
+			return
+		}
+		start := time.Now()
+		// the path is logged before it's modified by the routes and
+		// handlers.
+		path := requestPath(r)
+		rf := &requestLogFields{fields: make(logrus.Fields)}
+		sw := &statusWriter{ResponseWriter: w}
+		handler(sw, r.WithContext(context.WithValue(r.Context(), logFieldsKey{}, rf)))
+		rf.mu.Lock()
+		defer rf.mu.Unlock()
+		fields := rf.fields
+		status := sw.code()
+		if status < http.StatusBadRequest {
+			if name, ok := fields["handler"].(string); ok {
+				if level, ok := levels[name]; ok && level < logrus.InfoLevel {
+					return
+				}
+			}
+			if sampling > 1 {
+				if (atomic.AddUint64(&successes, 1)-1)%sampling != 0 {
+					return
+				}
+				fields["sampling"] = sampling
+			}
+		}
+		fields["method"] = r.Method
+		fields["path"] = path
+		fields["status"] = status
+		fields["bytes"] = sw.size
+		duration := time.Since(start)
+		fields["duration"] = duration.Seconds()
+		ip := c.clientIP(r)
+		fields["clientIp"] = ip
+		if c.LogFormat == logFormatGCP {
+			fields["httpRequest"] = newCloudLoggingRequest(r, sw, duration, ip)
+		}
+		requestLogger(r.Context(), logger).WithFields(fields).Info("handled request")
+	}
+}
+
+// requestPath returns the path of the request, as sent by the client.
+func requestPath(r *http.Request) string {
+	if r.RequestURI == "" {
+		return r.URL.Path
+	}
+	if u, err := url.ParseRequestURI(r.RequestURI); err == nil {
+		return u.Path
+	}
+	return r.URL.Path
+}
+
+// clientIP returns the address of the client. Behind load balancers or
+// proxies, it's the address of X-Forwarded-For at GCS_HELPER_TRUSTED_PROXY_HOPS
+// from the right, as the addresses on its left are sent by the client and
+// can be forged. Google Cloud load balancers append the address of the client
+// and their own, so it should be 2 behind them. The address of the connection
+// is used when the header doesn't have enough addresses or hops is 0, the
+// default, as the header can't be trusted without a proxy.
+func (c Config) clientIP(r *http.Request) string {
+	if c.TrustedProxyHops > 0 {
+		addrs := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+		if len(addrs) >= c.TrustedProxyHops {
+			if addr := strings.TrimSpace(addrs[len(addrs)-c.TrustedProxyHops]); addr != "" {
+				return addr
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fsouza/fake-gcs-server/fakestorage"
+	"github.com/sirupsen/logrus"
+)
+
+func TestAccessLog(t *testing.T) {
+	server := fakestorage.NewServer(getObjects())
+	defer server.Stop()
+	var buf bytes.Buffer
+	logger := logrus.New()
+	logger.Out = &buf
+	logger.Formatter = &logrus.JSONFormatter{}
+	config := Config{
+		BucketName:       "my-bucket",
+		LogLevel:         "error",
+		AccessLog:        true,
+		TrustedProxyHops: 2,
+		MapPrefix:        "/map/",
+		ProxyPrefix:      "/proxy/",
+		ProxyTimeout:     time.Second,
+	}
+	// the handler logs to stdout, so the access logs of the test are added
+	// on top of it.
+	inner := config
+	inner.AccessLog = false
+	handler := requestIDHandler(accessLogHandler(config, logger, getHandler(inner, server.Client(), fakeHTTPClient(server))))
+
+	req := httptest.NewRequest(http.MethodGet, "/map/videos/video/?extra=", nil)
+	req.RemoteAddr = "10.0.0.1:51234"
+	req.Header.Set("X-Forwarded-For", "203.0.113.7, 10.0.0.1")
+	req.Header.Set("X-Request-ID", "some-request")
+	w := httptest.NewRecorder()
+	handler(w, req)
+	req = httptest.NewRequest(http.MethodGet, "/proxy/musics/music/music3.txt", nil)
+	req.RemoteAddr = "10.0.0.2:51234"
+	handler(httptest.NewRecorder(), req)
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	decoder := json.NewDecoder(&buf)
+	var entries []map[string]interface{}
+	for decoder.More() {
+		var entry map[string]interface{}
+		if err := decoder.Decode(&entry); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("wrong number of access logs, health checks shouldn't be logged\nwant 2\ngot  %d: %v", len(entries), entries)
+	}
+	mapEntry := entries[0]
+	expected := map[string]interface{}{
+		"msg":       "handled request",
+		"level":     "info",
+		"handler":   "map",
+		"method":    "GET",
+		"path":      "/map/videos/video/",
+		"status":    float64(200),
+		"bytes":     float64(w.Body.Len()),
+		"prefix":    "videos/video/",
+		"objects":   float64(5),
+		"clientIp":  "203.0.113.7",
+		"requestId": "some-request",
+	}
+	for key, value := range expected {
+		if mapEntry[key] != value {
+			t.Errorf("wrong %s\nwant %#v\ngot  %#v", key, value, mapEntry[key])
+		}
+	}
+	if _, ok := mapEntry["duration"].(float64); !ok {
+		t.Errorf("missing duration in %v", mapEntry)
+	}
+	proxyEntry := entries[1]
+	if proxyEntry["handler"] != "proxy" || proxyEntry["clientIp"] != "10.0.0.2" || proxyEntry["bytes"] != float64(len("some even nicer music")) {
+		t.Errorf("wrong proxy access log %v", proxyEntry)
+	}
+	if requestID, _ := proxyEntry["requestId"].(string); len(requestID) != 32 {
+		t.Errorf("missing generated request id in %v", proxyEntry)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	var tests = []struct {
+		testCase  string
+		hops      int
+		forwarded []string
+		expected  string
+	}{
+		{"load balancer", 2, []string{"203.0.113.7, 10.0.0.1"}, "203.0.113.7"},
+		{"forged address", 2, []string{"198.51.100.1, 203.0.113.7, 10.0.0.1"}, "203.0.113.7"},
+		{"multiple headers", 2, []string{"198.51.100.1", "203.0.113.7, 10.0.0.1"}, "203.0.113.7"},
+		{"proxy", 1, []string{"198.51.100.1, 203.0.113.7"}, "203.0.113.7"},
+		{"not enough addresses", 2, []string{"198.51.100.1"}, "192.0.2.1"},
+		{"no header", 1, nil, "192.0.2.1"},
+		{"empty address", 1, []string{"203.0.113.7, "}, "192.0.2.1"},
+		{"no trusted proxies", 0, []string{"203.0.113.7, 10.0.0.1"}, "192.0.2.1"},
+	}
+	for _, test := range tests {
+		t.Run(test.testCase, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = "192.0.2.1:51234"
+			for _, value := range test.forwarded {
+				req.Header.Add("X-Forwarded-For", value)
+			}
+			if ip := (Config{TrustedProxyHops: test.hops}).clientIP(req); ip != test.expected {
+				t.Errorf("wrong client address\nwant %q\ngot  %q", test.expected, ip)
+			}
+		})
+	}
+}
+
+func TestAccessLogDisabled(t *testing.T) {
+	var buf bytes.Buffer
+	logger := logrus.New()
+	logger.Out = &buf
+	handler := accessLogHandler(Config{}, logger, func(w http.ResponseWriter, r *http.Request) {
+		addLogFields(r.Context(), logrus.Fields{"prefix": "videos/"})
+	})
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/map/videos/", nil))
+	if buf.Len() > 0 {
+		t.Errorf("unexpected access log %q", buf.String())
+	}
+}
+
+func TestAccessLogSampling(t *testing.T) {
+	var buf bytes.Buffer
+	logger := logrus.New()
+	logger.Out = &buf
+	logger.Formatter = &logrus.JSONFormatter{}
+	handler := accessLogHandler(Config{AccessLog: true, AccessLogSampling: 3}, logger, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/proxy/missing.mp4" {
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	})
+	for i := 0; i < 6; i++ {
+		handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/proxy/video.mp4", nil))
+	}
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/proxy/missing.mp4", nil))
+	entries := decodeLogEntries(t, &buf)
+	if len(entries) != 3 {
+		t.Fatalf("wrong number of access logs\nwant 3\ngot  %d: %v", len(entries), entries)
+	}
+	for _, entry := range entries[:2] {
+		if entry["status"] != float64(200) || entry["level"] != "info" || entry["sampling"] != float64(3) {
+			t.Errorf("wrong sampled access log %v", entry)
+		}
+	}
+	// errors are always logged.
+	if entry := entries[2]; entry["status"] != float64(404) || entry["sampling"] != nil {
+		t.Errorf("wrong error access log %v", entry)
+	}
+}
+
+func TestAccessLogHandlerLevels(t *testing.T) {
+	var buf bytes.Buffer
+	logger := logrus.New()
+	logger.Out = &buf
+	logger.Formatter = &logrus.JSONFormatter{}
+	config := Config{AccessLog: true, LogLevels: LevelMap{"proxy": "warning", "map": "debug"}}
+	handler := accessLogHandler(config, logger, func(w http.ResponseWriter, r *http.Request) {
+		name := strings.Split(strings.Trim(r.URL.Path, "/"), "/")[0]
+		addLogFields(r.Context(), logrus.Fields{"handler": name})
+		if strings.HasSuffix(r.URL.Path, "/missing.mp4") {
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	})
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/proxy/video.mp4", nil))
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/proxy/missing.mp4", nil))
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/map/video.mp4", nil))
+	entries := decodeLogEntries(t, &buf)
+	if len(entries) != 2 {
+		t.Fatalf("wrong number of access logs\nwant 2\ngot  %d: %v", len(entries), entries)
+	}
+	if entries[0]["path"] != "/proxy/missing.mp4" || entries[0]["status"] != float64(404) {
+		t.Errorf("wrong proxy access log %v", entries[0])
+	}
+	if entries[1]["path"] != "/map/video.mp4" || entries[1]["status"] != float64(200) {
+		t.Errorf("wrong map access log %v", entries[1])
+	}
+}
+
+func decodeLogEntries(t *testing.T, r io.Reader) []map[string]interface{} {
+	decoder := json.NewDecoder(r)
+	var entries []map[string]interface{}
+	for decoder.More() {
+		var entry map[string]interface{}
+		if err := decoder.Decode(&entry); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxSigningKeySize is the maximum size of the body of requests that replace
+// the signing key.
+const maxSigningKeySize = 64 << 10
+
+type signingKeyStatus struct {
+	GoogleAccessID string     `json:"googleAccessID"`
+	Fingerprint    string     `json:"fingerprint,omitempty"`
+	NotAfter       *time.Time `json:"notAfter,omitempty"`
+	Active         bool       `json:"active"`
+	Expired        bool       `json:"expired"`
+}
+
+type signingKeysStatus struct {
+	Mode string             `json:"mode"`
+	Keys []signingKeyStatus `json:"keys"`
+}
+
+// getAdminHandler returns the handler for the administrative endpoints,
+// authenticated with GCS_HELPER_ADMIN_TOKEN.
+func getAdminHandler(c Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		if !authorized(r, c.AdminToken) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		path := strings.Trim(r.URL.Path, "/")
+		if c.AdminPprof && (path == pprofPath || strings.HasPrefix(path, pprofPath+"/")) {
+			servePprof(w, r, path)
+			return
+		}
+		switch path {
+		case "signing-keys":
+			if r.Method != http.MethodGet {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(newSigningKeysStatus(c.SignConfig, time.Now()))
+		case "debug/config":
+			if r.Method != http.MethodGet {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(effectiveConfig(c))
+		case "debug/vars":
+			if r.Method != http.MethodGet {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			expvar.Handler().ServeHTTP(w, r)
+		case "signing-key":
+			if r.Method != http.MethodPut {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			if c.setSigningKey == nil {
+				http.Error(w, "replacing the signing key isn't supported", http.StatusNotImplemented)
+				return
+			}
+			if c.SignConfig.Mode == signModeIAM || c.SignConfig.PrivateKeySecret != "" {
+				http.Error(w, "the signing key can only be replaced when using GCS_HELPER_SIGN_PRIVATE_KEY or GCS_HELPER_SIGN_KEYS", http.StatusConflict)
+				return
+			}
+			var key SigningKey
+			if err := json.NewDecoder(io.LimitReader(r.Body, maxSigningKeySize)).Decode(&key); err != nil {
+				http.Error(w, "invalid signing key: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if key.GoogleAccessID == "" || key.PrivateKey == "" {
+				http.Error(w, "invalid signing key: googleAccessID and privateKey are required", http.StatusBadRequest)
+				return
+			}
+			if err := c.setSigningKey(key); err != nil {
+				http.Error(w, "invalid signing key: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(signingKeyStatus{
+				GoogleAccessID: key.GoogleAccessID,
+				Fingerprint:    keyFingerprint(key.PrivateKey),
+				Active:         true,
+			})
+		case "bucket":
+			if r.Method != http.MethodGet {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(newBucketStatus(c))
+		case "bucket/primary", "bucket/candidate":
+			if r.Method != http.MethodPost {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			if c.switchBucket == nil {
+				http.Error(w, "switching buckets isn't supported", http.StatusNotImplemented)
+				return
+			}
+			status, err := c.switchBucket(path == "bucket/candidate")
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(status)
+		case "reload":
+			if r.Method != http.MethodPost {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			if c.reload == nil {
+				http.Error(w, "reloading isn't supported", http.StatusNotImplemented)
+				return
+			}
+			if err := c.reload(); err != nil {
+				requestLogger(r.Context(), c.forHandler("admin").logger()).WithError(err).Error("failed to reload configuration")
+				http.Error(w, "failed to reload configuration: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	}
+}
+
+// newSigningKeysStatus describes the configured signing keys, and which one
+// is used for signing new URLs.
+func newSigningKeysStatus(c SignConfig, now time.Time) signingKeysStatus {
+	status := signingKeysStatus{Mode: c.Mode, Keys: []signingKeyStatus{}}
+	if len(c.Keys) == 0 {
+		if c.enabled() {
+			key := signingKeyStatus{GoogleAccessID: c.GoogleAccessID, Active: true}
+			if c.PrivateKey != "" {
+				key.Fingerprint = keyFingerprint(c.PrivateKey)
+			}
+			status.Keys = append(status.Keys, key)
+		}
+		return status
+	}
+	active := c.Keys.active(now)
+	for i, key := range c.Keys {
+		keyStatus := signingKeyStatus{
+			GoogleAccessID: key.GoogleAccessID,
+			Fingerprint:    keyFingerprint(key.PrivateKey),
+			Active:         i == active,
+		}
+		if !key.NotAfter.IsZero() {
+			notAfter := key.NotAfter
+			keyStatus.NotAfter = &notAfter
+			keyStatus.Expired = !notAfter.After(now)
+		}
+		status.Keys = append(status.Keys, keyStatus)
+	}
+	return status
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Kinds of audit events.
+const (
+	auditKindURL    = "url"
+	auditKindCookie = "cookie"
+	auditKindUpload = "upload"
+)
+
+const (
+	auditBatchSize     = 500
+	auditQueueSize     = 4096
+	auditFlushInterval = 5 * time.Second
+	auditExportTimeout = 10 * time.Second
+)
+
+// Base URLs of the APIs of the audit sinks.
+var (
+	pubSubEndpoint   = "https://pubsub.googleapis.com/v1/"
+	bigQueryEndpoint = "https://bigquery.googleapis.com/bigquery/v2/"
+)
+
+// auditEvents is updated by the auditor (see auditor.record).
+var auditEvents = newCounterVec(
+	"gcs_helper_audit_events_total",
+	"Number of signed URL audit events, by result (exported, dropped or failed).",
+	"result",
+)
+
+// AuditConfig contains the configuration of the audit of signed URLs, which
+// is enabled when any of its sinks is set.
+type AuditConfig struct {
+	File          string `envconfig:"GCS_HELPER_AUDIT_FILE"`
+	PubSubTopic   string `envconfig:"GCS_HELPER_AUDIT_PUBSUB_TOPIC"`
+	BigQueryTable string `envconfig:"GCS_HELPER_AUDIT_BIGQUERY_TABLE"`
+
+	// auditor is set up on startup (see setupAudit), and shared by all
+	// routes and configurations.
+	auditor *auditor
+}
+
+func (c AuditConfig) validate() error {
+	if c.PubSubTopic != "" {
+		parts := strings.Split(c.PubSubTopic, "/")
+		if len(parts) != 4 || parts[0] != "projects" || parts[1] == "" || parts[2] != "topics" || parts[3] == "" {
+			return fmt.Errorf("invalid GCS_HELPER_AUDIT_PUBSUB_TOPIC %q: must be like %q", c.PubSubTopic, "projects/my-project/topics/my-topic")
+		}
+	}
+	if c.BigQueryTable != "" {
+		if _, _, _, err := splitBigQueryTable(c.BigQueryTable); err != nil {
+			return fmt.Errorf("invalid GCS_HELPER_AUDIT_BIGQUERY_TABLE %q: %v", c.BigQueryTable, err)
+		}
+	}
+	return nil
+}
+
+// audit records the issuance of a signed URL or cookie for the given
+// request, when auditing is enabled.
+func (c Config) audit(r *http.Request, event auditEvent) {
+	event.ClientIP = c.clientIP(r)
+	c.AuditConfig.record(r, event)
+}
+
+// record records the issuance of a signed URL or cookie for the given
+// request, when auditing is enabled.
+func (c AuditConfig) record(r *http.Request, event auditEvent) {
+	if c.auditor == nil {
+		return
+	}
+	event.ID = newRequestID()
+	event.Time = time.Now().UTC()
+	event.Expires = event.Expires.UTC()
+	event.RequestID = requestIDFromContext(r.Context())
+	c.auditor.queue(event)
+}
+
+// auditEvent is the record of the issuance of a signed URL or cookie. For
+// cookies, Object is the URL prefix the cookie grants access to.
+type auditEvent struct {
+	ID        string    `json:"id"`
+	Time      time.Time `json:"time"`
+	Kind      string    `json:"kind"`
+	Signer    string    `json:"signer"`
+	Method    string    `json:"method,omitempty"`
+	Bucket    string    `json:"bucket,omitempty"`
+	Object    string    `json:"object"`
+	Expires   time.Time `json:"expires"`
+	ClientIP  string    `json:"clientIp"`
+	RequestID string    `json:"requestId,omitempty"`
+}
+
+// auditSink stores audit events.
+type auditSink interface {
+	write(events []auditEvent) error
+}
+
+// auditor queues audit events, and writes them to the sink in batches in the
+// background, like the tracer.
+type auditor struct {
+	sink   auditSink
+	logger *logrus.Logger
+	events chan auditEvent
+}
+
+func newAuditor(sink auditSink, logger *logrus.Logger) *auditor {
+	return &auditor{
+		sink:   sink,
+		logger: logger,
+		events: make(chan auditEvent, auditQueueSize),
+	}
+}
+
+// queue queues the event. Events are dropped, and counted in the metrics,
+// when the queue is full, so a slow sink doesn't slow down requests.
+func (a *auditor) queue(event auditEvent) {
+	select {
+	case a.events <- event:
+	default:
+		auditEvents.inc("dropped")
+	}
+}
+
+// run writes the queued events in batches, until the queue is closed.
+func (a *auditor) run() {
+	ticker := time.NewTicker(auditFlushInterval)
+	defer ticker.Stop()
+	batch := make([]auditEvent, 0, auditBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := a.sink.write(batch); err != nil {
+			auditEvents.add(float64(len(batch)), "failed")
+			a.logger.WithError(err).WithField("events", len(batch)).Error("failed to write audit events")
+		} else {
+			auditEvents.add(float64(len(batch)), "exported")
+		}
+		batch = make([]auditEvent, 0, auditBatchSize)
+	}
+	for {
+		select {
+		case event, ok := <-a.events:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, event)
+			if len(batch) >= auditBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// fileAuditSink appends events to a file, as one JSON object per line.
+type fileAuditSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *fileAuditSink) write(events []auditEvent) error {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, event := range events {
+		if err := encoder.Encode(event); err != nil {
+			return err
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.w.Write(buf.Bytes())
+	return err
+}
+
+// pubSubAuditSink publishes events to a Pub/Sub topic, one message per
+// event, with the kind of the event as an attribute.
+//
+// See https://cloud.google.com/pubsub/docs/reference/rest/v1/projects.topics/publish.
+type pubSubAuditSink struct {
+	topic  string
+	client *http.Client
+}
+
+type pubSubMessage struct {
+	Data       string            `json:"data"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+func (s *pubSubAuditSink) write(events []auditEvent) error {
+	body := struct {
+		Messages []pubSubMessage `json:"messages"`
+	}{Messages: make([]pubSubMessage, len(events))}
+	for i, event := range events {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		body.Messages[i] = pubSubMessage{
+			Data:       base64.StdEncoding.EncodeToString(data),
+			Attributes: map[string]string{"kind": event.Kind},
+		}
+	}
+	resp, err := postJSON(s.client, pubSubEndpoint+s.topic+":publish", body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to publish audit events: Pub/Sub API returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// bigQueryAuditSink streams events to a BigQuery table, with the ID of the
+// events as insert IDs, so retried inserts aren't duplicated. The table must
+// have the columns of auditEvent.
+//
+// See https://cloud.google.com/bigquery/docs/reference/rest/v2/tabledata/insertAll.
+type bigQueryAuditSink struct {
+	table  string
+	client *http.Client
+}
+
+type bigQueryRow struct {
+	InsertID string     `json:"insertId"`
+	JSON     auditEvent `json:"json"`
+}
+
+// splitBigQueryTable splits the given table, in the "project.dataset.table"
+// format.
+func splitBigQueryTable(table string) (project, dataset, name string, err error) {
+	parts := strings.Split(table, ".")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return "", "", "", errors.New(`must be like "my-project.my_dataset.my_table"`)
+	}
+	return parts[0], parts[1], parts[2], nil
+}
+
+func (s *bigQueryAuditSink) write(events []auditEvent) error {
+	// the table is validated when loading the configuration.
+	project, dataset, table, _ := splitBigQueryTable(s.table)
+	body := struct {
+		Rows []bigQueryRow `json:"rows"`
+	}{Rows: make([]bigQueryRow, len(events))}
+	for i, event := range events {
+		body.Rows[i] = bigQueryRow{InsertID: event.ID, JSON: event}
+	}
+	endpoint := bigQueryEndpoint + "projects/" + url.PathEscape(project) + "/datasets/" + url.PathEscape(dataset) + "/tables/" + url.PathEscape(table) + "/insertAll"
+	resp, err := postJSON(s.client, endpoint, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		return fmt.Errorf("failed to insert audit events: BigQuery API returned %d", resp.StatusCode)
+	}
+	// rows can be rejected even when the request succeeds.
+	var result struct {
+		InsertErrors []struct {
+			Index int `json:"index"`
+		} `json:"insertErrors"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return err
+	}
+	if len(result.InsertErrors) > 0 {
+		return fmt.Errorf("failed to insert audit events: BigQuery rejected %d rows", len(result.InsertErrors))
+	}
+	return nil
+}
+
+// multiAuditSink writes events to several sinks.
+type multiAuditSink []auditSink
+
+func (m multiAuditSink) write(events []auditEvent) error {
+	var errs []string
+	for _, s := range m {
+		if err := s.write(events); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func postJSON(client *http.Client, endpoint string, body interface{}) (*http.Response, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	return client.Post(endpoint, "application/json", bytes.NewReader(data))
+}
+
+// setupAudit creates the auditor when any audit sink is set, and starts
+// writing events in the background.
+func setupAudit(ctx context.Context, c *Config, logger *logrus.Logger) error {
+	var sinks multiAuditSink
+	if c.AuditConfig.File != "" {
+		f, err := os.OpenFile(c.AuditConfig.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return fmt.Errorf("failed to open audit file: %v", err)
+		}
+		sinks = append(sinks, &fileAuditSink{w: f})
+	}
+	if c.AuditConfig.PubSubTopic != "" || c.AuditConfig.BigQueryTable != "" {
+		gc, err := googleClient(ctx, auditExportTimeout)
+		if err != nil {
+			return fmt.Errorf("failed to create client for audit sinks: %v", err)
+		}
+		if c.AuditConfig.PubSubTopic != "" {
+			sinks = append(sinks, &pubSubAuditSink{topic: c.AuditConfig.PubSubTopic, client: gc})
+		}
+		if c.AuditConfig.BigQueryTable != "" {
+			sinks = append(sinks, &bigQueryAuditSink{table: c.AuditConfig.BigQueryTable, client: gc})
+		}
+	}
+	var sink auditSink
+	switch len(sinks) {
+	case 0:
+		return nil
+	case 1:
+		sink = sinks[0]
+	default:
+		sink = sinks
+	}
+	c.AuditConfig.auditor = newAuditor(sink, logger)
+	go c.AuditConfig.auditor.run()
+	return nil
+}
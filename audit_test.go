@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestAuditSignedURLs(t *testing.T) {
+	a := newAuditor(nil, logrus.New())
+	config := Config{
+		BucketName:       "my-bucket",
+		Signer:           signerGCS,
+		SignConfig:       testSignConfig(t),
+		AuditConfig:      AuditConfig{auditor: a},
+		TrustedProxyHops: 1,
+	}
+	req := httptest.NewRequest(http.MethodGet, "/videos/video/video1_720p.mp4?method=HEAD", nil)
+	req.RemoteAddr = "10.0.0.1:51234"
+	req.Header.Set("X-Forwarded-For", "203.0.113.7")
+	req.Header.Set("X-Request-ID", "some-request")
+	start := time.Now()
+	w := httptest.NewRecorder()
+	requestIDHandler(getSignHandler(config))(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong status %d: %s", w.Code, w.Body.String())
+	}
+	if len(a.events) != 1 {
+		t.Fatalf("wrong number of audit events\nwant 1\ngot  %d", len(a.events))
+	}
+	event := <-a.events
+	if event.ID == "" || event.Time.Before(start.Truncate(time.Second)) {
+		t.Errorf("wrong id %q or time %v", event.ID, event.Time)
+	}
+	expected := auditEvent{
+		ID:        event.ID,
+		Time:      event.Time,
+		Kind:      auditKindURL,
+		Signer:    signerGCS,
+		Method:    http.MethodHead,
+		Bucket:    "my-bucket",
+		Object:    "videos/video/video1_720p.mp4",
+		Expires:   event.Expires,
+		ClientIP:  "203.0.113.7",
+		RequestID: "some-request",
+	}
+	if event != expected {
+		t.Errorf("wrong audit event\nwant %#v\ngot  %#v", expected, event)
+	}
+	if expires := event.Expires.Sub(start); expires < time.Hour-time.Second || expires > time.Hour+time.Second {
+		t.Errorf("wrong expiration %v", event.Expires)
+	}
+
+	// failed requests aren't recorded.
+	requestIDHandler(getSignHandler(config))(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/videos/video.mp4?expires=abc", nil))
+	if len(a.events) != 0 {
+		t.Errorf("unexpected audit event %#v", <-a.events)
+	}
+}
+
+func TestAuditSignedCookies(t *testing.T) {
+	a := newAuditor(nil, logrus.New())
+	config := Config{
+		CDNConfig: CDNConfig{
+			Type:       cdnTypeCloudCDN,
+			URLPrefix:  "https://cdn.example.com/",
+			KeyName:    "my-key",
+			Key:        testCDNKey,
+			Expiration: time.Hour,
+		},
+		AuditConfig: AuditConfig{auditor: a},
+	}
+	getSignCookieHandler(config)(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/videos/video1/", nil))
+	if len(a.events) != 1 {
+		t.Fatalf("wrong number of audit events\nwant 1\ngot  %d", len(a.events))
+	}
+	event := <-a.events
+	if event.Kind != auditKindCookie || event.Signer != signerCDN || event.Object != "https://cdn.example.com/videos/video1/" || event.ClientIP != "192.0.2.1" {
+		t.Errorf("wrong audit event %#v", event)
+	}
+}
+
+func TestAuditDisabled(t *testing.T) {
+	// recording without an auditor is a no-op.
+	AuditConfig{}.record(httptest.NewRequest(http.MethodGet, "/", nil), auditEvent{Kind: auditKindURL})
+}
+
+type recordingAuditSink struct {
+	batches [][]auditEvent
+}
+
+func (s *recordingAuditSink) write(events []auditEvent) error {
+	s.batches = append(s.batches, events)
+	return nil
+}
+
+func TestAuditorRun(t *testing.T) {
+	sink := &recordingAuditSink{}
+	a := newAuditor(sink, logrus.New())
+	exported := auditEvents.value("exported")
+	for i := 0; i < auditBatchSize+1; i++ {
+		a.queue(auditEvent{Object: "video.mp4"})
+	}
+	close(a.events)
+	a.run()
+	if len(sink.batches) != 2 || len(sink.batches[0]) != auditBatchSize || len(sink.batches[1]) != 1 {
+		t.Errorf("wrong batches, got %d batches", len(sink.batches))
+	}
+	if got := auditEvents.value("exported") - exported; got != auditBatchSize+1 {
+		t.Errorf("wrong number of exported events\nwant %d\ngot  %v", auditBatchSize+1, got)
+	}
+}
+
+func TestAuditorQueueFull(t *testing.T) {
+	a := newAuditor(nil, logrus.New())
+	dropped := auditEvents.value("dropped")
+	for i := 0; i < auditQueueSize+2; i++ {
+		a.queue(auditEvent{})
+	}
+	if got := auditEvents.value("dropped") - dropped; got != 2 {
+		t.Errorf("wrong number of dropped events\nwant 2\ngot  %v", got)
+	}
+}
+
+func TestFileAuditSink(t *testing.T) {
+	var buf bytes.Buffer
+	sink := &fileAuditSink{w: &buf}
+	events := []auditEvent{{ID: "1", Object: "video1.mp4"}, {ID: "2", Object: "video2.mp4"}}
+	if err := sink.write(events); err != nil {
+		t.Fatal(err)
+	}
+	decoder := json.NewDecoder(&buf)
+	for _, expected := range events {
+		var event auditEvent
+		if err := decoder.Decode(&event); err != nil {
+			t.Fatal(err)
+		}
+		if event != expected {
+			t.Errorf("wrong event\nwant %#v\ngot  %#v", expected, event)
+		}
+	}
+}
+
+func TestPubSubAuditSink(t *testing.T) {
+	var path string
+	var body struct {
+		Messages []pubSubMessage `json:"messages"`
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		json.NewDecoder(r.Body).Decode(&body)
+		w.Write([]byte(`{"messageIds":["1"]}`))
+	}))
+	defer server.Close()
+	originalEndpoint := pubSubEndpoint
+	pubSubEndpoint = server.URL + "/"
+	defer func() {
+		pubSubEndpoint = originalEndpoint
+	}()
+
+	sink := &pubSubAuditSink{topic: "projects/my-project/topics/audit", client: server.Client()}
+	event := auditEvent{ID: "1", Kind: auditKindURL, Object: "video.mp4"}
+	if err := sink.write([]auditEvent{event}); err != nil {
+		t.Fatal(err)
+	}
+	if path != "/projects/my-project/topics/audit:publish" {
+		t.Errorf("wrong path %q", path)
+	}
+	if len(body.Messages) != 1 || body.Messages[0].Attributes["kind"] != auditKindURL {
+		t.Fatalf("wrong request body %#v", body)
+	}
+	data, err := base64.StdEncoding.DecodeString(body.Messages[0].Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got auditEvent
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got != event {
+		t.Errorf("wrong event\nwant %#v\ngot  %#v", event, got)
+	}
+}
+
+func TestBigQueryAuditSink(t *testing.T) {
+	var path string
+	var body struct {
+		Rows []bigQueryRow `json:"rows"`
+	}
+	response := `{"kind":"bigquery#tableDataInsertAllResponse"}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		json.NewDecoder(r.Body).Decode(&body)
+		w.Write([]byte(response))
+	}))
+	defer server.Close()
+	originalEndpoint := bigQueryEndpoint
+	bigQueryEndpoint = server.URL + "/"
+	defer func() {
+		bigQueryEndpoint = originalEndpoint
+	}()
+
+	sink := &bigQueryAuditSink{table: "my-project.audit.signed_urls", client: server.Client()}
+	event := auditEvent{ID: "1", Kind: auditKindURL, Object: "video.mp4"}
+	if err := sink.write([]auditEvent{event}); err != nil {
+		t.Fatal(err)
+	}
+	if path != "/projects/my-project/datasets/audit/tables/signed_urls/insertAll" {
+		t.Errorf("wrong path %q", path)
+	}
+	if len(body.Rows) != 1 || body.Rows[0].InsertID != "1" || body.Rows[0].JSON != event {
+		t.Errorf("wrong request body %#v", body)
+	}
+
+	response = `{"insertErrors":[{"index":0,"errors":[{"reason":"invalid"}]}]}`
+	if err := sink.write([]auditEvent{event}); err == nil {
+		t.Error("unexpected <nil> error for rejected rows")
+	}
+}
+
+func TestAuditConfigValidate(t *testing.T) {
+	var tests = []struct {
+		config AuditConfig
+		valid  bool
+	}{
+		{AuditConfig{}, true},
+		{AuditConfig{File: "/var/log/audit.jsonl"}, true},
+		{AuditConfig{PubSubTopic: "projects/my-project/topics/audit"}, true},
+		{AuditConfig{PubSubTopic: "audit"}, false},
+		{AuditConfig{PubSubTopic: "projects/my-project/subscriptions/audit"}, false},
+		{AuditConfig{BigQueryTable: "my-project.audit.signed_urls"}, true},
+		{AuditConfig{BigQueryTable: "audit.signed_urls"}, false},
+	}
+	for _, test := range tests {
+		err := test.config.validate()
+		if test.valid && err != nil {
+			t.Errorf("%#v: unexpected error: %v", test.config, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%#v: unexpected <nil> error", test.config)
+		}
+	}
+}
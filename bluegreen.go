@@ -0,0 +1,32 @@
+package main
+
+import "errors"
+
+var errNoCandidateBucket = errors.New("GCS_HELPER_CANDIDATE_BUCKET_NAME isn't set")
+
+type bucketStatus struct {
+	Active     string `json:"active"`
+	BucketName string `json:"bucketName"`
+}
+
+// withActiveBucket returns the configuration with the bucket that should
+// serve the requests: GCS_HELPER_CANDIDATE_BUCKET_NAME when traffic is
+// switched to it, or GCS_HELPER_BUCKET_NAME otherwise.
+func (c Config) withActiveBucket() Config {
+	if c.useCandidate && c.CandidateBucketName != "" {
+		c.BucketName = c.CandidateBucketName
+	} else {
+		c.useCandidate = false
+	}
+	return c
+}
+
+// newBucketStatus reports which bucket serves the requests, given the
+// configuration returned by withActiveBucket.
+func newBucketStatus(c Config) bucketStatus {
+	status := bucketStatus{Active: "primary", BucketName: c.BucketName}
+	if c.useCandidate {
+		status.Active = "candidate"
+	}
+	return status
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fsouza/fake-gcs-server/fakestorage"
+)
+
+func TestServerAdminSwitchBucket(t *testing.T) {
+	server := fakestorage.NewServer(getObjects())
+	defer server.Stop()
+	config := Config{
+		BucketName:          "my-bucket",
+		CandidateBucketName: "your-bucket",
+		LogLevel:            "error",
+		AdminPrefix:         "/admin/",
+		AdminToken:          "admin-secret",
+		ProxyPrefix:         "/proxy/",
+		ProxyTimeout:        time.Second,
+	}
+	handler := newReloadableHandler(config, func() (Config, error) {
+		return config, nil
+	}, func(c Config) http.Handler {
+		return getHandler(c, server.Client(), fakeHTTPClient(server))
+	})
+	httpServer := httptest.NewServer(handler)
+	defer httpServer.Close()
+	addr := httpServer.URL
+	auth := http.Header{"Authorization": []string{"Bearer admin-secret"}}
+	var tests = []serverTest{
+		{
+			testCase:       "primary",
+			method:         http.MethodGet,
+			addr:           addr + "/proxy/musics/music/music3.txt",
+			expectedStatus: http.StatusOK,
+			expectedBody:   "some even nicer music",
+		},
+		{
+			testCase:       "primary status",
+			method:         http.MethodGet,
+			addr:           addr + "/admin/bucket",
+			reqHeader:      auth,
+			expectedStatus: http.StatusOK,
+			expectedBody:   map[string]interface{}{"active": "primary", "bucketName": "my-bucket"},
+		},
+		{
+			testCase:       "wrong method",
+			method:         http.MethodGet,
+			addr:           addr + "/admin/bucket/candidate",
+			reqHeader:      auth,
+			expectedStatus: http.StatusMethodNotAllowed,
+		},
+		{
+			testCase:       "switch to candidate",
+			method:         http.MethodPost,
+			addr:           addr + "/admin/bucket/candidate",
+			reqHeader:      auth,
+			expectedStatus: http.StatusOK,
+			expectedBody:   map[string]interface{}{"active": "candidate", "bucketName": "your-bucket"},
+		},
+		{
+			testCase:       "candidate",
+			method:         http.MethodGet,
+			addr:           addr + "/proxy/musics/music/music3.txt",
+			expectedStatus: http.StatusOK,
+			expectedBody:   "wait what",
+		},
+		{
+			testCase:       "reload",
+			method:         http.MethodPost,
+			addr:           addr + "/admin/reload",
+			reqHeader:      auth,
+			expectedStatus: http.StatusNoContent,
+		},
+		{
+			testCase:       "candidate after reload",
+			method:         http.MethodGet,
+			addr:           addr + "/admin/bucket",
+			reqHeader:      auth,
+			expectedStatus: http.StatusOK,
+			expectedBody:   map[string]interface{}{"active": "candidate", "bucketName": "your-bucket"},
+		},
+		{
+			testCase:       "roll back",
+			method:         http.MethodPost,
+			addr:           addr + "/admin/bucket/primary",
+			reqHeader:      auth,
+			expectedStatus: http.StatusOK,
+			expectedBody:   map[string]interface{}{"active": "primary", "bucketName": "my-bucket"},
+		},
+		{
+			testCase:       "primary after roll back",
+			method:         http.MethodGet,
+			addr:           addr + "/proxy/musics/music/music3.txt",
+			expectedStatus: http.StatusOK,
+			expectedBody:   "some even nicer music",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.testCase, test.run)
+	}
+}
+
+func TestServerAdminSwitchBucketWithoutCandidate(t *testing.T) {
+	config := Config{
+		BucketName:  "my-bucket",
+		LogLevel:    "error",
+		AdminPrefix: "/admin/",
+		AdminToken:  "admin-secret",
+	}
+	handler := newReloadableHandler(config, func() (Config, error) {
+		return config, nil
+	}, func(c Config) http.Handler {
+		return getHandler(c, nil, nil)
+	})
+	req := httptest.NewRequest(http.MethodPost, "/admin/bucket/candidate", nil)
+	req.Header.Set("Authorization", "Bearer admin-secret")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusConflict {
+		t.Errorf("wrong status code\nwant %d\ngot  %d", http.StatusConflict, w.Code)
+	}
+	if handler.config.useCandidate {
+		t.Error("traffic shouldn't be switched without a candidate bucket")
+	}
+}
+
+func TestLoadConfigRoutesCandidateBucket(t *testing.T) {
+	setEnvs(map[string]string{
+		"GCS_HELPER_BUCKET_NAME":                      "default-bucket",
+		"GCS_HELPER_CANDIDATE_BUCKET_NAME":            "default-reencoded",
+		"GCS_HELPER_ROUTES":                           "vod,live,clips",
+		"GCS_HELPER_ROUTE_VOD_BUCKET_NAME":            "vod-bucket",
+		"GCS_HELPER_ROUTE_LIVE_BUCKET_NAME":           "live-bucket",
+		"GCS_HELPER_ROUTE_LIVE_CANDIDATE_BUCKET_NAME": "live-reencoded",
+	})
+	config, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"vod":   "",
+		"live":  "live-reencoded",
+		"clips": "default-reencoded",
+	}
+	for _, rt := range config.routes {
+		if rt.config.CandidateBucketName != expected[rt.name] {
+			t.Errorf("%s: wrong candidate bucket\nwant %q\ngot  %q", rt.name, expected[rt.name], rt.config.CandidateBucketName)
+		}
+	}
+}
+
+func TestLoadConfigCandidateBucketSameAsBucket(t *testing.T) {
+	setEnvs(map[string]string{
+		"GCS_HELPER_BUCKET_NAME":           "some-bucket",
+		"GCS_HELPER_CANDIDATE_BUCKET_NAME": "some-bucket",
+	})
+	_, err := loadConfig()
+	if err == nil {
+		t.Fatal("unexpected <nil> error")
+	}
+	expected := "GCS_HELPER_CANDIDATE_BUCKET_NAME must be different from GCS_HELPER_BUCKET_NAME"
+	if err.Error() != expected {
+		t.Errorf("wrong error\nwant %q\ngot  %q", expected, err.Error())
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"hash/fnv"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// canaryKey returns the prefix that selects the bucket of a map or proxy
+// request, given its path without the handler prefix: the "directory" of the
+// requested object or prefix, so a mapping and the files it references are
+// served from the same bucket.
+func canaryKey(p string) string {
+	p = strings.TrimPrefix(p, "/")
+	if strings.HasSuffix(p, "/") {
+		return strings.TrimSuffix(p, "/")
+	}
+	if dir := path.Dir(p); dir != "." {
+		return dir
+	}
+	return ""
+}
+
+// isCanary returns whether the requests for the given prefix should be
+// served from GCS_HELPER_CANARY_BUCKET_NAME. The selection is based on the
+// hash of the prefix, so it's sticky: all requests for a prefix use the same
+// bucket, and raising the percentage only moves prefixes to the canary.
+func (c Config) isCanary(prefix string) bool {
+	if c.CanaryBucketName == "" || c.CanaryPercent <= 0 {
+		return false
+	}
+	h := fnv.New32a()
+	h.Write([]byte(prefix))
+	return float64(h.Sum32()%10000) < c.CanaryPercent*100
+}
+
+// canaryHandler returns a handler that serves GCS_HELPER_CANARY_PERCENT of
+// the prefixes with the handler built for the canary bucket, and the
+// remaining ones with the given handler.
+func canaryHandler(c Config, handler, canary http.HandlerFunc) http.HandlerFunc {
+	if c.CanaryBucketName == "" || c.CanaryPercent <= 0 {
+		return handler
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if c.isCanary(canaryKey(r.URL.Path)) {
+			canary(w, r)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// canaryConfig returns the configuration used for the requests served from
+// the canary bucket.
+func (c Config) canaryConfig() Config {
+	c.BucketName = c.CanaryBucketName
+	c.CanaryBucketName = ""
+	return c
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCanaryKey(t *testing.T) {
+	var tests = []struct {
+		path     string
+		expected string
+	}{
+		{"/movie/", "movie"},
+		{"movie/", "movie"},
+		{"movie/720p.mp4", "movie"},
+		{"/movie/720p", "movie"},
+		{"shows/episode1/subtitles.vtt", "shows/episode1"},
+		{"file.txt", ""},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if key := canaryKey(test.path); key != test.expected {
+			t.Errorf("%q: wrong key\nwant %q\ngot  %q", test.path, test.expected, key)
+		}
+	}
+}
+
+func TestIsCanary(t *testing.T) {
+	const prefixes = 10000
+	count := func(percent float64) int {
+		c := Config{CanaryBucketName: "canary-bucket", CanaryPercent: percent}
+		var n int
+		for i := 0; i < prefixes; i++ {
+			if c.isCanary(fmt.Sprintf("videos/%d", i)) {
+				n++
+			}
+		}
+		return n
+	}
+	if n := count(0); n != 0 {
+		t.Errorf("no prefixes should use the canary with 0%%, got %d", n)
+	}
+	if n := count(100); n != prefixes {
+		t.Errorf("all prefixes should use the canary with 100%%, got %d", n)
+	}
+	if n := count(10); n < prefixes*8/100 || n > prefixes*12/100 {
+		t.Errorf("about 10%% of the prefixes should use the canary, got %d", n)
+	}
+
+	low := Config{CanaryBucketName: "canary-bucket", CanaryPercent: 10}
+	high := Config{CanaryBucketName: "canary-bucket", CanaryPercent: 50}
+	for i := 0; i < prefixes; i++ {
+		prefix := fmt.Sprintf("videos/%d", i)
+		if low.isCanary(prefix) && !high.isCanary(prefix) {
+			t.Fatalf("%q: raising the percentage shouldn't move prefixes out of the canary", prefix)
+		}
+	}
+}
+
+func TestCanaryHandler(t *testing.T) {
+	var tests = []struct {
+		percent      float64
+		expectedBody string
+	}{
+		{0, "some even nicer music"},
+		{100, "wait what"},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%v%%", test.percent), func(t *testing.T) {
+			addr, cleanup := startServer(t, Config{
+				BucketName:       "my-bucket",
+				CanaryBucketName: "your-bucket",
+				CanaryPercent:    test.percent,
+				ProxyPrefix:      "/proxy/",
+				ProxyTimeout:     time.Second,
+			})
+			defer cleanup()
+			st := serverTest{
+				testCase:       "proxy",
+				method:         http.MethodGet,
+				addr:           addr + "/proxy/musics/music/music3.txt",
+				expectedStatus: http.StatusOK,
+				expectedBody:   test.expectedBody,
+			}
+			st.run(t)
+		})
+	}
+}
+
+func TestLoadConfigCanaryErrors(t *testing.T) {
+	var tests = []struct {
+		envs     map[string]string
+		expected string
+	}{
+		{
+			map[string]string{"GCS_HELPER_CANARY_PERCENT": "10"},
+			"GCS_HELPER_CANARY_PERCENT requires GCS_HELPER_CANARY_BUCKET_NAME",
+		},
+		{
+			map[string]string{"GCS_HELPER_CANARY_BUCKET_NAME": "canary-bucket", "GCS_HELPER_CANARY_PERCENT": "120"},
+			"invalid GCS_HELPER_CANARY_PERCENT 120: must be between 0 and 100",
+		},
+	}
+	for _, test := range tests {
+		test.envs["GCS_HELPER_BUCKET_NAME"] = "some-bucket"
+		setEnvs(test.envs)
+		_, err := loadConfig()
+		if err == nil {
+			t.Errorf("%v: unexpected <nil> error", test.envs)
+			continue
+		}
+		if err.Error() != test.expected {
+			t.Errorf("wrong error\nwant %q\ngot  %q", test.expected, err.Error())
+		}
+	}
+}
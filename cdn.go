@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+const (
+	cdnTypeCloudCDN = "cloud-cdn"
+	cdnTypeMediaCDN = "media-cdn"
+)
+
+// CDNConfig contains the configuration used for signing requests to Cloud
+// CDN or Media CDN.
+type CDNConfig struct {
+	Type          string        `envconfig:"GCS_HELPER_CDN_TYPE" default:"cloud-cdn"`
+	URLPrefix     string        `envconfig:"GCS_HELPER_CDN_URL_PREFIX"`
+	KeyName       string        `envconfig:"GCS_HELPER_CDN_KEY_NAME"`
+	Key           string        `envconfig:"GCS_HELPER_CDN_KEY"`
+	Expiration    time.Duration `envconfig:"GCS_HELPER_CDN_EXPIRATION" default:"1h"`
+	MaxExpiration time.Duration `envconfig:"GCS_HELPER_CDN_MAX_EXPIRATION"`
+	CookieDomain  string        `envconfig:"GCS_HELPER_CDN_COOKIE_DOMAIN"`
+}
+
+func (c CDNConfig) enabled() bool {
+	return c.URLPrefix != "" && c.KeyName != "" && c.Key != ""
+}
+
+func (c CDNConfig) validate() error {
+	if c.Type != cdnTypeCloudCDN && c.Type != cdnTypeMediaCDN {
+		return fmt.Errorf("invalid GCS_HELPER_CDN_TYPE %q: must be %q or %q", c.Type, cdnTypeCloudCDN, cdnTypeMediaCDN)
+	}
+	if c.Key == "" {
+		return nil
+	}
+	if !strings.HasPrefix(c.URLPrefix, "https://") && !strings.HasPrefix(c.URLPrefix, "http://") {
+		return errors.New("GCS_HELPER_CDN_URL_PREFIX must be an absolute URL")
+	}
+	_, err := c.sign("test")
+	return err
+}
+
+// sign returns the signature of the given policy, base64url-encoded: an
+// HMAC-SHA1 signature for Cloud CDN or an Ed25519 signature for Media CDN.
+func (c CDNConfig) sign(policy string) (string, error) {
+	key, err := base64.URLEncoding.DecodeString(c.Key)
+	if err != nil {
+		return "", fmt.Errorf("invalid GCS_HELPER_CDN_KEY: %v", err)
+	}
+	var signature []byte
+	switch c.Type {
+	case cdnTypeMediaCDN:
+		if len(key) != ed25519.SeedSize {
+			return "", fmt.Errorf("invalid GCS_HELPER_CDN_KEY: Ed25519 seeds must have %d bytes", ed25519.SeedSize)
+		}
+		signature = ed25519.Sign(ed25519.NewKeyFromSeed(key), []byte(policy))
+	default:
+		mac := hmac.New(sha1.New, key)
+		mac.Write([]byte(policy))
+		signature = mac.Sum(nil)
+	}
+	return base64.URLEncoding.EncodeToString(signature), nil
+}
+
+// signedURL returns a URL for the given object in the CDN, signed with the
+// URLPrefix format, which is supported by both Cloud CDN and Media CDN.
+//
+// See https://cloud.google.com/cdn/docs/using-signed-urls.
+func (c CDNConfig) signedURL(objectName string, expires time.Time) (signed string, err error) {
+	defer func() { signOperations.inc("cdn", signResult(err)) }()
+	objectURL := strings.TrimRight(c.URLPrefix, "/") + "/" + escapePath(objectName)
+	policy := "URLPrefix=" + base64.URLEncoding.EncodeToString([]byte(objectURL)) +
+		"&Expires=" + strconv.FormatInt(expires.Unix(), 10) +
+		"&KeyName=" + c.KeyName
+	signature, err := c.sign(policy)
+	if err != nil {
+		return "", err
+	}
+	return objectURL + "?" + policy + "&Signature=" + signature, nil
+}
+
+// cookieName returns the name of the cookie validated by the CDN.
+func (c CDNConfig) cookieName() string {
+	if c.Type == cdnTypeMediaCDN {
+		return "Edge-Cache-Cookie"
+	}
+	return "Cloud-CDN-Cookie"
+}
+
+// signedCookieValue returns the value of a signed cookie that grants access
+// to all URLs starting with urlPrefix until the given time.
+//
+// See https://cloud.google.com/cdn/docs/using-signed-cookies.
+func (c CDNConfig) signedCookieValue(urlPrefix string, expires time.Time) (string, error) {
+	policy := "URLPrefix=" + base64.URLEncoding.EncodeToString([]byte(urlPrefix)) +
+		":Expires=" + strconv.FormatInt(expires.Unix(), 10) +
+		":KeyName=" + c.KeyName
+	signature, err := c.sign(policy)
+	if err != nil {
+		return "", err
+	}
+	return policy + ":Signature=" + signature, nil
+}
+
+type signedCookie struct {
+	Name      string    `json:"name"`
+	Value     string    `json:"value"`
+	URLPrefix string    `json:"urlPrefix"`
+	Expires   time.Time `json:"expires"`
+}
+
+// getSignCookieHandler returns a handler that sets a signed CDN cookie
+// scoped to the path of the request, under GCS_HELPER_CDN_URL_PREFIX. The
+// cookie is also returned as JSON, for clients that need to forward it.
+func getSignCookieHandler(c Config) http.HandlerFunc {
+	logger := c.logger()
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		expiration, err := parseExpiration(r, c.CDNConfig.Expiration, c.CDNConfig.MaxExpiration)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		urlPrefix := strings.TrimRight(c.CDNConfig.URLPrefix, "/") + "/" + strings.TrimLeft(r.URL.Path, "/")
+		expires := time.Now().Add(expiration).UTC().Truncate(time.Second)
+		value, err := c.CDNConfig.signedCookieValue(urlPrefix, expires)
+		if err != nil {
+			requestLogger(r.Context(), logger).WithError(err).WithField("url", r.URL.RequestURI()).Error("failed to sign cookie")
+			http.Error(w, "failed to sign cookie", http.StatusInternalServerError)
+			return
+		}
+		c.audit(r, auditEvent{Kind: auditKindCookie, Signer: signerCDN, Object: urlPrefix, Expires: expires})
+		cookie := signedCookie{
+			Name:      c.CDNConfig.cookieName(),
+			Value:     value,
+			URLPrefix: urlPrefix,
+			Expires:   expires,
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     cookie.Name,
+			Value:    cookie.Value,
+			Path:     "/",
+			Domain:   c.CDNConfig.CookieDomain,
+			Expires:  expires,
+			Secure:   strings.HasPrefix(urlPrefix, "https://"),
+			HttpOnly: true,
+		})
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(cookie)
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+const testCDNKey = "nZtRohdNF9m3cKM24IcK4w=="
+
+func TestSignedCookieValue(t *testing.T) {
+	c := CDNConfig{Type: cdnTypeCloudCDN, KeyName: "my-key", Key: testCDNKey}
+	expires := time.Unix(1520692812, 0)
+	value, err := c.signedCookieValue("https://cdn.example.com/videos/", expires)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := "URLPrefix=aHR0cHM6Ly9jZG4uZXhhbXBsZS5jb20vdmlkZW9zLw==:Expires=1520692812:KeyName=my-key"
+	if !strings.HasPrefix(value, policy+":Signature=") {
+		t.Fatalf("wrong cookie value\nwant prefix %q\ngot          %q", policy, value)
+	}
+	key, _ := base64.URLEncoding.DecodeString(testCDNKey)
+	mac := hmac.New(sha1.New, key)
+	mac.Write([]byte(policy))
+	expectedSignature := base64.URLEncoding.EncodeToString(mac.Sum(nil))
+	if signature := strings.TrimPrefix(value, policy+":Signature="); signature != expectedSignature {
+		t.Errorf("wrong signature\nwant %q\ngot  %q", expectedSignature, signature)
+	}
+}
+
+func TestCDNSignedURL(t *testing.T) {
+	c := CDNConfig{Type: cdnTypeCloudCDN, URLPrefix: "https://cdn.example.com/", KeyName: "my-key", Key: testCDNKey}
+	signed, err := c.signedURL("videos/video 1.mp4", time.Unix(1520692812, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := "URLPrefix=aHR0cHM6Ly9jZG4uZXhhbXBsZS5jb20vdmlkZW9zL3ZpZGVvJTIwMS5tcDQ=&Expires=1520692812&KeyName=my-key"
+	expectedPrefix := "https://cdn.example.com/videos/video%201.mp4?" + policy + "&Signature="
+	if !strings.HasPrefix(signed, expectedPrefix) {
+		t.Fatalf("wrong signed url\nwant prefix %q\ngot          %q", expectedPrefix, signed)
+	}
+	key, _ := base64.URLEncoding.DecodeString(testCDNKey)
+	mac := hmac.New(sha1.New, key)
+	mac.Write([]byte(policy))
+	expectedSignature := base64.URLEncoding.EncodeToString(mac.Sum(nil))
+	if signature := strings.TrimPrefix(signed, expectedPrefix); signature != expectedSignature {
+		t.Errorf("wrong signature\nwant %q\ngot  %q", expectedSignature, signature)
+	}
+	expires, err := signedURLExpiration(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !expires.Equal(time.Unix(1520692812, 0)) {
+		t.Errorf("wrong expiration\nwant %s\ngot  %s", time.Unix(1520692812, 0).UTC(), expires)
+	}
+}
+
+func TestServerSignHandlerCDNSigner(t *testing.T) {
+	addr, cleanup := startServer(t, Config{
+		BucketName:   "my-bucket",
+		SignPrefix:   "/sign/",
+		Signer:       signerCDN,
+		ProxyTimeout: time.Second,
+		CDNConfig: CDNConfig{
+			Type:       cdnTypeCloudCDN,
+			URLPrefix:  "https://cdn.example.com/",
+			KeyName:    "my-key",
+			Key:        testCDNKey,
+			Expiration: time.Hour,
+		},
+	})
+	defer cleanup()
+	resp, err := http.Get(addr + "/sign/videos/video/video1_720p.mp4?expires=10m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("wrong status code\nwant %d\ngot  %d", http.StatusOK, resp.StatusCode)
+	}
+	var signed signedObjectURL
+	if err := json.NewDecoder(resp.Body).Decode(&signed); err != nil {
+		t.Fatal(err)
+	}
+	expectedPrefix := "https://cdn.example.com/videos/video/video1_720p.mp4?URLPrefix="
+	if !strings.HasPrefix(signed.URL, expectedPrefix) {
+		t.Errorf("wrong signed url\nwant prefix %q\ngot          %q", expectedPrefix, signed.URL)
+	}
+	if ttl := time.Until(signed.Expires); ttl > 10*time.Minute || ttl < 9*time.Minute {
+		t.Errorf("wrong expiration: %s", signed.Expires)
+	}
+}
+
+func TestSignedCookieValueMediaCDN(t *testing.T) {
+	seed := make([]byte, ed25519.SeedSize)
+	for i := range seed {
+		seed[i] = byte(i)
+	}
+	c := CDNConfig{Type: cdnTypeMediaCDN, KeyName: "my-keyset", Key: base64.URLEncoding.EncodeToString(seed)}
+	value, err := c.signedCookieValue("https://media.example.com/", time.Unix(1520692812, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pos := strings.Index(value, ":Signature=")
+	if pos < 0 {
+		t.Fatalf("missing signature in %q", value)
+	}
+	signature, err := base64.URLEncoding.DecodeString(value[pos+len(":Signature="):])
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey := ed25519.NewKeyFromSeed(seed).Public().(ed25519.PublicKey)
+	if !ed25519.Verify(publicKey, []byte(value[:pos]), signature) {
+		t.Errorf("invalid signature in %q", value)
+	}
+}
+
+func TestCDNConfigValidate(t *testing.T) {
+	var tests = []struct {
+		testCase string
+		config   CDNConfig
+		valid    bool
+	}{
+		{
+			"valid cloud cdn config",
+			CDNConfig{Type: cdnTypeCloudCDN, URLPrefix: "https://cdn.example.com/", KeyName: "my-key", Key: testCDNKey},
+			true,
+		},
+		{
+			"no key",
+			CDNConfig{Type: cdnTypeCloudCDN},
+			true,
+		},
+		{
+			"invalid type",
+			CDNConfig{Type: "akamai"},
+			false,
+		},
+		{
+			"relative url prefix",
+			CDNConfig{Type: cdnTypeCloudCDN, URLPrefix: "/videos/", KeyName: "my-key", Key: testCDNKey},
+			false,
+		},
+		{
+			"invalid key",
+			CDNConfig{Type: cdnTypeCloudCDN, URLPrefix: "https://cdn.example.com/", KeyName: "my-key", Key: "not base64!"},
+			false,
+		},
+		{
+			"invalid ed25519 seed",
+			CDNConfig{Type: cdnTypeMediaCDN, URLPrefix: "https://cdn.example.com/", KeyName: "my-key", Key: testCDNKey},
+			false,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.testCase, func(t *testing.T) {
+			err := test.config.validate()
+			if test.valid && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if !test.valid && err == nil {
+				t.Error("unexpected <nil> error")
+			}
+		})
+	}
+}
+
+func TestServerSignCookieHandler(t *testing.T) {
+	addr, cleanup := startServer(t, Config{
+		BucketName:       "my-bucket",
+		SignCookiePrefix: "/sign-cookie/",
+		ProxyTimeout:     time.Second,
+		CDNConfig: CDNConfig{
+			Type:         cdnTypeCloudCDN,
+			URLPrefix:    "https://cdn.example.com/",
+			KeyName:      "my-key",
+			Key:          testCDNKey,
+			Expiration:   time.Hour,
+			CookieDomain: "example.com",
+		},
+	})
+	defer cleanup()
+	var tests = []struct {
+		testCase          string
+		method            string
+		path              string
+		expectedStatus    int
+		expectedURLPrefix string
+		expectedTTL       time.Duration
+	}{
+		{
+			"sign cookie",
+			http.MethodGet,
+			"/sign-cookie/videos/video1/",
+			http.StatusOK,
+			"https://cdn.example.com/videos/video1/",
+			time.Hour,
+		},
+		{
+			"custom expiration",
+			http.MethodGet,
+			"/sign-cookie/videos/?expires=10m",
+			http.StatusOK,
+			"https://cdn.example.com/videos/",
+			10 * time.Minute,
+		},
+		{
+			"expiration too long",
+			http.MethodGet,
+			"/sign-cookie/videos/?expires=2h",
+			http.StatusBadRequest,
+			"",
+			0,
+		},
+		{
+			"method not allowed",
+			http.MethodPost,
+			"/sign-cookie/videos/",
+			http.StatusMethodNotAllowed,
+			"",
+			0,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.testCase, func(t *testing.T) {
+			req, _ := http.NewRequest(test.method, addr+test.path, nil)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != test.expectedStatus {
+				t.Fatalf("wrong status code\nwant %d\ngot  %d", test.expectedStatus, resp.StatusCode)
+			}
+			if test.expectedStatus != http.StatusOK {
+				return
+			}
+			var cookie signedCookie
+			if err := json.NewDecoder(resp.Body).Decode(&cookie); err != nil {
+				t.Fatal(err)
+			}
+			if cookie.URLPrefix != test.expectedURLPrefix {
+				t.Errorf("wrong url prefix\nwant %q\ngot  %q", test.expectedURLPrefix, cookie.URLPrefix)
+			}
+			if ttl := time.Until(cookie.Expires); ttl > test.expectedTTL || ttl < test.expectedTTL-time.Minute {
+				t.Errorf("wrong expiration: %s", cookie.Expires)
+			}
+			cookies := resp.Cookies()
+			if len(cookies) != 1 {
+				t.Fatalf("wrong number of cookies\nwant 1\ngot  %d", len(cookies))
+			}
+			if cookies[0].Name != "Cloud-CDN-Cookie" {
+				t.Errorf("wrong cookie name\nwant %q\ngot  %q", "Cloud-CDN-Cookie", cookies[0].Name)
+			}
+			if cookies[0].Value != cookie.Value {
+				t.Errorf("wrong cookie value\nwant %q\ngot  %q", cookie.Value, cookies[0].Value)
+			}
+			if cookies[0].Domain != "example.com" {
+				t.Errorf("wrong cookie domain\nwant %q\ngot  %q", "example.com", cookies[0].Domain)
+			}
+		})
+	}
+}
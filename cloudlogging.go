@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// The fields of the Cloud Logging structured format that link logs to
+// traces. See https://cloud.google.com/logging/docs/structured-logging.
+const (
+	cloudLoggingTraceKey        = "logging.googleapis.com/trace"
+	cloudLoggingSpanIDKey       = "logging.googleapis.com/spanId"
+	cloudLoggingTraceSampledKey = "logging.googleapis.com/trace_sampled"
+)
+
+type remoteSpanKey struct{}
+
+// cloudLoggingFormatter formats logs in the structured format of Cloud
+// Logging (GCS_HELPER_LOG_FORMAT=gcp), so the logs written to stdout on
+// Cloud Run or GKE get their severity, are linked to their traces in the Logs
+// Explorer, and access logs are displayed as requests.
+type cloudLoggingFormatter struct {
+	project string
+}
+
+var cloudLoggingSeverities = map[logrus.Level]string{
+	logrus.DebugLevel: "DEBUG",
+	logrus.InfoLevel:  "INFO",
+	logrus.WarnLevel:  "WARNING",
+	logrus.ErrorLevel: "ERROR",
+	logrus.FatalLevel: "CRITICAL",
+	logrus.PanicLevel: "ALERT",
+}
+
+func (f *cloudLoggingFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	data := make(logrus.Fields, len(entry.Data)+3)
+	for key, value := range entry.Data {
+		switch value := value.(type) {
+		case error:
+			data[key] = value.Error()
+		default:
+			data[key] = value
+		}
+	}
+	if traceID, ok := data["traceId"].(string); ok {
+		delete(data, "traceId")
+		data[cloudLoggingTraceKey] = traceID
+		if f.project != "" {
+			data[cloudLoggingTraceKey] = "projects/" + f.project + "/traces/" + traceID
+		}
+	}
+	if spanID, ok := data["spanId"]; ok {
+		delete(data, "spanId")
+		data[cloudLoggingSpanIDKey] = spanID
+	}
+	if sampled, ok := data["traceSampled"]; ok {
+		delete(data, "traceSampled")
+		data[cloudLoggingTraceSampledKey] = sampled
+	}
+	data["severity"] = cloudLoggingSeverities[entry.Level]
+	data["message"] = entry.Message
+	data["time"] = entry.Time.Format(time.RFC3339Nano)
+	serialized, err := json.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal fields to JSON: %v", err)
+	}
+	return append(serialized, '\n'), nil
+}
+
+// cloudLoggingRequest is the httpRequest field of access logs in the Cloud
+// Logging format.
+type cloudLoggingRequest struct {
+	RequestMethod string `json:"requestMethod"`
+	RequestURL    string `json:"requestUrl"`
+	Status        int    `json:"status"`
+	ResponseSize  string `json:"responseSize"`
+	UserAgent     string `json:"userAgent,omitempty"`
+	RemoteIP      string `json:"remoteIp,omitempty"`
+	Referer       string `json:"referer,omitempty"`
+	Latency       string `json:"latency"`
+	Protocol      string `json:"protocol"`
+}
+
+func newCloudLoggingRequest(r *http.Request, sw *statusWriter, duration time.Duration, clientIP string) *cloudLoggingRequest {
+	return &cloudLoggingRequest{
+		RequestMethod: r.Method,
+		RequestURL:    r.RequestURI,
+		Status:        sw.code(),
+		ResponseSize:  strconv.FormatInt(sw.size, 10),
+		UserAgent:     r.UserAgent(),
+		RemoteIP:      clientIP,
+		Referer:       r.Referer(),
+		Latency:       strconv.FormatFloat(duration.Seconds(), 'f', 9, 64) + "s",
+		Protocol:      r.Proto,
+	}
+}
+
+// contextWithRemoteSpan returns a copy of the given context with the trace
+// context sent with the given request, if any, so the logs of the request
+// are linked to its trace even when it isn't traced by gcs-helper.
+func contextWithRemoteSpan(ctx context.Context, r *http.Request) context.Context {
+	sc, _, err := remoteSpanContext(r)
+	if err != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, remoteSpanKey{}, sc)
+}
+
+// traceLogFields returns the fields that identify the trace of the given
+// context in the logs: the current span, or the span of the client.
+func traceLogFields(ctx context.Context) logrus.Fields {
+	sc, ok := ctx.Value(remoteSpanKey{}).(spanContext)
+	if s := spanFromContext(ctx); s != nil {
+		sc, ok = s.context, true
+	}
+	if !ok {
+		return nil
+	}
+	fields := logrus.Fields{
+		"traceId":      hex.EncodeToString(sc.traceID[:]),
+		"traceSampled": sc.sampled,
+	}
+	// X-Cloud-Trace-Context headers may only have a trace ID.
+	if sc.spanID != ([8]byte{}) {
+		fields["spanId"] = hex.EncodeToString(sc.spanID[:])
+	}
+	return fields
+}
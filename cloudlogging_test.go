@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestCloudLoggingFormatter(t *testing.T) {
+	var tests = []struct {
+		testCase string
+		project  string
+		level    logrus.Level
+		fields   logrus.Fields
+		expected map[string]interface{}
+	}{
+		{
+			"warning with trace",
+			"my-project",
+			logrus.WarnLevel,
+			logrus.Fields{"traceId": "105445aa7843bc8bf206b12000100000", "spanId": "00f067aa0ba902b7", "traceSampled": true, "prefix": "videos/"},
+			map[string]interface{}{
+				"severity":                             "WARNING",
+				"message":                              "something happened",
+				"time":                                 "2024-03-01T10:00:00.5Z",
+				"prefix":                               "videos/",
+				"logging.googleapis.com/trace":         "projects/my-project/traces/105445aa7843bc8bf206b12000100000",
+				"logging.googleapis.com/spanId":        "00f067aa0ba902b7",
+				"logging.googleapis.com/trace_sampled": true,
+			},
+		},
+		{
+			"error without project",
+			"",
+			logrus.ErrorLevel,
+			logrus.Fields{"traceId": "105445aa7843bc8bf206b12000100000", "error": errors.New("failed")},
+			map[string]interface{}{
+				"severity":                     "ERROR",
+				"message":                      "something happened",
+				"time":                         "2024-03-01T10:00:00.5Z",
+				"error":                        "failed",
+				"logging.googleapis.com/trace": "105445aa7843bc8bf206b12000100000",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.testCase, func(t *testing.T) {
+			entry := logrus.NewEntry(logrus.New()).WithFields(test.fields)
+			entry.Level = test.level
+			entry.Message = "something happened"
+			entry.Time = time.Date(2024, 3, 1, 10, 0, 0, 5e8, time.UTC)
+			formatter := cloudLoggingFormatter{project: test.project}
+			data, err := formatter.Format(entry)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got map[string]interface{}
+			if err = json.Unmarshal(data, &got); err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(test.expected) {
+				t.Errorf("wrong fields\nwant %v\ngot  %v", test.expected, got)
+			}
+			for key, value := range test.expected {
+				if got[key] != value {
+					t.Errorf("wrong %s\nwant %#v\ngot  %#v", key, value, got[key])
+				}
+			}
+		})
+	}
+}
+
+func TestCloudLoggingAccessLog(t *testing.T) {
+	var buf bytes.Buffer
+	logger := logrus.New()
+	logger.Out = &buf
+	logger.Formatter = &cloudLoggingFormatter{project: "my-project"}
+	config := Config{AccessLog: true, LogFormat: logFormatGCP}
+	handler := requestIDHandler(accessLogHandler(config, logger, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("not found"))
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/proxy/missing.mp4?v=1", nil)
+	req.RemoteAddr = "10.0.0.1:51234"
+	req.Header.Set("User-Agent", "some-player/1.0")
+	req.Header.Set("X-Cloud-Trace-Context", "105445aa7843bc8bf206b12000100000/1;o=1")
+	handler(httptest.NewRecorder(), req)
+
+	var entry struct {
+		Severity     string              `json:"severity"`
+		Trace        string              `json:"logging.googleapis.com/trace"`
+		SpanID       string              `json:"logging.googleapis.com/spanId"`
+		TraceSampled bool                `json:"logging.googleapis.com/trace_sampled"`
+		HTTPRequest  cloudLoggingRequest `json:"httpRequest"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("%v: %s", err, buf.String())
+	}
+	if entry.Severity != "INFO" {
+		t.Errorf("wrong severity %q", entry.Severity)
+	}
+	if entry.Trace != "projects/my-project/traces/105445aa7843bc8bf206b12000100000" || entry.SpanID != "0000000000000001" || !entry.TraceSampled {
+		t.Errorf("wrong trace %q, span id %q (sampled: %v)", entry.Trace, entry.SpanID, entry.TraceSampled)
+	}
+	got := entry.HTTPRequest
+	got.Latency = ""
+	expected := cloudLoggingRequest{
+		RequestMethod: "GET",
+		RequestURL:    "/proxy/missing.mp4?v=1",
+		Status:        http.StatusNotFound,
+		ResponseSize:  "9",
+		UserAgent:     "some-player/1.0",
+		RemoteIP:      "10.0.0.1",
+		Protocol:      "HTTP/1.1",
+	}
+	if got != expected {
+		t.Errorf("wrong httpRequest\nwant %#v\ngot  %#v", expected, got)
+	}
+	if len(entry.HTTPRequest.Latency) < 2 || entry.HTTPRequest.Latency[len(entry.HTTPRequest.Latency)-1] != 's' {
+		t.Errorf("wrong latency %q", entry.HTTPRequest.Latency)
+	}
+}
+
+func TestTraceLogFields(t *testing.T) {
+	var tests = []struct {
+		testCase string
+		header   string
+		value    string
+		expected logrus.Fields
+	}{
+		{
+			"traceparent",
+			"traceparent",
+			"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			logrus.Fields{"traceId": "4bf92f3577b34da6a3ce929d0e0e4736", "spanId": "00f067aa0ba902b7", "traceSampled": true},
+		},
+		{
+			"cloud trace context without span",
+			"X-Cloud-Trace-Context",
+			"105445aa7843bc8bf206b12000100000",
+			logrus.Fields{"traceId": "105445aa7843bc8bf206b12000100000", "traceSampled": false},
+		},
+		{
+			"invalid header",
+			"traceparent",
+			"invalid",
+			nil,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.testCase, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set(test.header, test.value)
+			got := traceLogFields(detachedContext(contextWithRemoteSpan(req.Context(), req)))
+			if len(got) != len(test.expected) {
+				t.Fatalf("wrong fields\nwant %v\ngot  %v", test.expected, got)
+			}
+			for key, value := range test.expected {
+				if got[key] != value {
+					t.Errorf("wrong %s\nwant %#v\ngot  %#v", key, value, got[key])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cloudTraceEndpoint is the base URL of the Cloud Trace API.
+var cloudTraceEndpoint = "https://cloudtrace.googleapis.com/v2/"
+
+var cloudTraceSpanKinds = map[int]string{
+	spanKindInternal: "INTERNAL",
+	spanKindServer:   "SERVER",
+	spanKindClient:   "CLIENT",
+}
+
+// parseCloudTraceContext parses the X-Cloud-Trace-Context header set by
+// Google Cloud load balancers and services, in the
+// "TRACE_ID/SPAN_ID;o=OPTIONS" format, where the span ID is a decimal
+// number. It also returns whether the header has a sampling decision, as
+// the options are optional.
+//
+// See https://cloud.google.com/trace/docs/trace-context#legacy-http-header.
+func parseCloudTraceContext(value string) (sc spanContext, decided bool, err error) {
+	value = strings.TrimSpace(value)
+	if i := strings.Index(value, ";"); i >= 0 {
+		options := value[i+1:]
+		value = value[:i]
+		switch options {
+		case "o=0":
+			decided = true
+		case "o=1":
+			sc.sampled = true
+			decided = true
+		}
+	}
+	parts := strings.SplitN(value, "/", 2)
+	traceID, err := hex.DecodeString(parts[0])
+	if err != nil || len(traceID) != len(sc.traceID) {
+		return sc, false, errors.New("invalid trace id")
+	}
+	copy(sc.traceID[:], traceID)
+	if sc.traceID == [16]byte{} {
+		return sc, false, errors.New("invalid trace id")
+	}
+	if len(parts) == 2 && parts[1] != "" {
+		spanID, err := strconv.ParseUint(parts[1], 10, 64)
+		if err != nil {
+			return sc, false, errors.New("invalid span id")
+		}
+		binary.BigEndian.PutUint64(sc.spanID[:], spanID)
+	}
+	return sc, decided, nil
+}
+
+// cloudTraceContext returns the X-Cloud-Trace-Context header of the span.
+func (sc spanContext) cloudTraceContext() string {
+	options := "0"
+	if sc.sampled {
+		options = "1"
+	}
+	return hex.EncodeToString(sc.traceID[:]) + "/" + strconv.FormatUint(binary.BigEndian.Uint64(sc.spanID[:]), 10) + ";o=" + options
+}
+
+// cloudTraceExporter sends spans to Cloud Trace, using the batchWrite
+// method of the Cloud Trace API.
+//
+// See https://cloud.google.com/trace/docs/reference/v2/rest/v2/projects.traces/batchWrite.
+type cloudTraceExporter struct {
+	project string
+	client  *http.Client
+}
+
+type cloudTraceSpan struct {
+	Name         string                `json:"name"`
+	SpanID       string                `json:"spanId"`
+	ParentSpanID string                `json:"parentSpanId,omitempty"`
+	DisplayName  cloudTraceString      `json:"displayName"`
+	StartTime    string                `json:"startTime"`
+	EndTime      string                `json:"endTime"`
+	SpanKind     string                `json:"spanKind"`
+	Attributes   *cloudTraceAttributes `json:"attributes,omitempty"`
+	Status       *cloudTraceStatus     `json:"status,omitempty"`
+}
+
+type cloudTraceString struct {
+	Value string `json:"value"`
+}
+
+type cloudTraceAttributes struct {
+	AttributeMap map[string]cloudTraceAttributeValue `json:"attributeMap"`
+}
+
+type cloudTraceAttributeValue struct {
+	StringValue *cloudTraceString `json:"stringValue,omitempty"`
+	IntValue    *string           `json:"intValue,omitempty"`
+	BoolValue   *bool             `json:"boolValue,omitempty"`
+}
+
+type cloudTraceStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+// cloudTraceStatusUnknown is the UNKNOWN code of google.rpc.Code, used for
+// failed spans.
+const cloudTraceStatusUnknown = 2
+
+func cloudTraceValue(value interface{}) cloudTraceAttributeValue {
+	switch v := value.(type) {
+	case string:
+		return cloudTraceAttributeValue{StringValue: &cloudTraceString{Value: v}}
+	case int:
+		s := strconv.Itoa(v)
+		return cloudTraceAttributeValue{IntValue: &s}
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		return cloudTraceAttributeValue{IntValue: &s}
+	case bool:
+		return cloudTraceAttributeValue{BoolValue: &v}
+	}
+	return cloudTraceAttributeValue{StringValue: &cloudTraceString{Value: fmt.Sprint(value)}}
+}
+
+func (e *cloudTraceExporter) newSpan(s *span) cloudTraceSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	traceID := hex.EncodeToString(s.context.traceID[:])
+	spanID := hex.EncodeToString(s.context.spanID[:])
+	result := cloudTraceSpan{
+		Name:        "projects/" + e.project + "/traces/" + traceID + "/spans/" + spanID,
+		SpanID:      spanID,
+		DisplayName: cloudTraceString{Value: s.name},
+		StartTime:   s.start.UTC().Format(time.RFC3339Nano),
+		EndTime:     s.end.UTC().Format(time.RFC3339Nano),
+		SpanKind:    cloudTraceSpanKinds[s.kind],
+	}
+	if s.parentID != [8]byte{} {
+		result.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	if len(s.attributes) > 0 {
+		result.Attributes = &cloudTraceAttributes{AttributeMap: make(map[string]cloudTraceAttributeValue, len(s.attributes))}
+		for key, value := range s.attributes {
+			result.Attributes.AttributeMap[key] = cloudTraceValue(value)
+		}
+	}
+	if s.err != nil {
+		result.Status = &cloudTraceStatus{Code: cloudTraceStatusUnknown, Message: s.err.Error()}
+	}
+	return result
+}
+
+func (e *cloudTraceExporter) export(spans []*span) error {
+	body := struct {
+		Spans []cloudTraceSpan `json:"spans"`
+	}{Spans: make([]cloudTraceSpan, len(spans))}
+	for i, s := range spans {
+		body.Spans[i] = e.newSpan(s)
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	endpoint := cloudTraceEndpoint + "projects/" + url.PathEscape(e.project) + "/traces:batchWrite"
+	resp, err := e.client.Post(endpoint, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to write spans: Cloud Trace API returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// multiExporter sends spans to several exporters.
+type multiExporter []spanExporter
+
+func (m multiExporter) export(spans []*span) error {
+	var errs []string
+	for _, e := range m {
+		if err := e.export(spans); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
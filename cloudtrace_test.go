@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestParseCloudTraceContext(t *testing.T) {
+	var tests = []struct {
+		input   string
+		traceID string
+		spanID  string
+		sampled bool
+		decided bool
+		valid   bool
+	}{
+		{"105445aa7843bc8bf206b12000100000/1;o=1", "105445aa7843bc8bf206b12000100000", "0000000000000001", true, true, true},
+		{"105445aa7843bc8bf206b12000100000/18446744073709551615;o=0", "105445aa7843bc8bf206b12000100000", "ffffffffffffffff", false, true, true},
+		{"105445aa7843bc8bf206b12000100000/123", "105445aa7843bc8bf206b12000100000", "000000000000007b", false, false, true},
+		{"105445aa7843bc8bf206b12000100000", "105445aa7843bc8bf206b12000100000", "0000000000000000", false, false, true},
+		{"", "", "", false, false, false},
+		{"105445aa7843bc8b/1;o=1", "", "", false, false, false},
+		{"00000000000000000000000000000000/1;o=1", "", "", false, false, false},
+		{"105445aa7843bc8bf206b12000100000/abc;o=1", "", "", false, false, false},
+	}
+	for _, test := range tests {
+		sc, decided, err := parseCloudTraceContext(test.input)
+		if !test.valid {
+			if err == nil {
+				t.Errorf("%q: unexpected <nil> error", test.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", test.input, err)
+			continue
+		}
+		if traceID := hex.EncodeToString(sc.traceID[:]); traceID != test.traceID {
+			t.Errorf("%q: wrong trace id\nwant %q\ngot  %q", test.input, test.traceID, traceID)
+		}
+		if spanID := hex.EncodeToString(sc.spanID[:]); spanID != test.spanID {
+			t.Errorf("%q: wrong span id\nwant %q\ngot  %q", test.input, test.spanID, spanID)
+		}
+		if sc.sampled != test.sampled || decided != test.decided {
+			t.Errorf("%q: wrong sampling\nwant %v (decided: %v)\ngot  %v (decided: %v)", test.input, test.sampled, test.decided, sc.sampled, decided)
+		}
+	}
+}
+
+func TestCloudTraceContextRoundTrip(t *testing.T) {
+	header := "105445aa7843bc8bf206b12000100000/1234567890;o=1"
+	sc, _, err := parseCloudTraceContext(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := sc.cloudTraceContext(); got != header {
+		t.Errorf("wrong header\nwant %q\ngot  %q", header, got)
+	}
+}
+
+func TestTraceHandlerCloudTraceContext(t *testing.T) {
+	tr := newTracer(nil, 0, logrus.New())
+	handler := traceHandler(Config{TraceConfig: TraceConfig{tracer: tr}}, "proxy", func(w http.ResponseWriter, r *http.Request) {})
+	var tests = []struct {
+		header  string
+		sampled bool
+	}{
+		{"105445aa7843bc8bf206b12000100000/1;o=1", true},
+		// without options, the sample ratio is used.
+		{"105445aa7843bc8bf206b12000100000/1", false},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/proxy/video.mp4", nil)
+		req.Header.Set("X-Cloud-Trace-Context", test.header)
+		handler(httptest.NewRecorder(), req)
+		if !test.sampled {
+			if len(tr.spans) > 0 {
+				t.Errorf("%q: the span shouldn't be sampled", test.header)
+			}
+			continue
+		}
+		if len(tr.spans) != 1 {
+			t.Fatalf("%q: the span should be sampled", test.header)
+		}
+		s := <-tr.spans
+		if traceID := hex.EncodeToString(s.context.traceID[:]); traceID != "105445aa7843bc8bf206b12000100000" {
+			t.Errorf("%q: wrong trace id %q", test.header, traceID)
+		}
+		if parentID := hex.EncodeToString(s.parentID[:]); parentID != "0000000000000001" {
+			t.Errorf("%q: wrong parent span id %q", test.header, parentID)
+		}
+	}
+}
+
+func TestCloudTraceExporter(t *testing.T) {
+	var body struct {
+		Spans []cloudTraceSpan `json:"spans"`
+	}
+	var path string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		json.NewDecoder(r.Body).Decode(&body)
+		w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+	originalEndpoint := cloudTraceEndpoint
+	cloudTraceEndpoint = server.URL + "/"
+	defer func() {
+		cloudTraceEndpoint = originalEndpoint
+	}()
+
+	tr := newTracer(nil, 1, logrus.New())
+	parent, _, _ := parseCloudTraceContext("105445aa7843bc8bf206b12000100000/1;o=1")
+	s := tr.newSpan("GET www.googleapis.com", spanKindClient, parent, true)
+	s.start = time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	s.setAttribute("http.status_code", int64(503))
+	s.setError(errors.New("503 Service Unavailable"))
+	s.finish()
+	exporter := &cloudTraceExporter{project: "my-project", client: server.Client()}
+	if err := exporter.export([]*span{<-tr.spans}); err != nil {
+		t.Fatal(err)
+	}
+	if path != "/projects/my-project/traces:batchWrite" {
+		t.Errorf("wrong path %q", path)
+	}
+	if len(body.Spans) != 1 {
+		t.Fatalf("wrong request body %#v", body)
+	}
+	got := body.Spans[0]
+	spanID := hex.EncodeToString(s.context.spanID[:])
+	if got.Name != "projects/my-project/traces/105445aa7843bc8bf206b12000100000/spans/"+spanID || got.SpanID != spanID {
+		t.Errorf("wrong span name %q", got.Name)
+	}
+	if got.ParentSpanID != "0000000000000001" || got.SpanKind != "CLIENT" || got.DisplayName.Value != "GET www.googleapis.com" {
+		t.Errorf("wrong span %#v", got)
+	}
+	if got.StartTime != "2024-03-01T10:00:00Z" {
+		t.Errorf("wrong start time %q", got.StartTime)
+	}
+	if got.Attributes == nil || got.Attributes.AttributeMap["http.status_code"].IntValue == nil || *got.Attributes.AttributeMap["http.status_code"].IntValue != "503" {
+		t.Errorf("wrong attributes %#v", got.Attributes)
+	}
+	if got.Status == nil || got.Status.Code != cloudTraceStatusUnknown {
+		t.Errorf("wrong status %#v", got.Status)
+	}
+}
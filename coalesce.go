@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// mappingGroup coalesces concurrent requests for the same mapping, so a
+// single GCS listing is performed for each key at a time, and its result is
+// shared by all requests waiting for it. Shared mappings must not be
+// modified.
+type mappingGroup struct {
+	mu    sync.Mutex
+	calls map[string]*mappingCall
+}
+
+type mappingCall struct {
+	done    chan struct{}
+	cancel  context.CancelFunc
+	waiters int
+	m       mapping
+	err     error
+}
+
+func newMappingGroup() *mappingGroup {
+	return &mappingGroup{calls: make(map[string]*mappingCall)}
+}
+
+// do calls fn, unless there's already a call in progress for the given key,
+// in which case it waits for that call instead. The context passed to fn is
+// canceled once all the requests waiting for it are gone, so listings don't
+// outlive their clients.
+func (g *mappingGroup) do(ctx context.Context, key string, fn func(context.Context) (mapping, error)) (mapping, error) {
+	g.mu.Lock()
+	call, ok := g.calls[key]
+	if !ok {
+		// the call is traced and logged as part of the request that
+		// started it.
+		callCtx, cancel := context.WithCancel(detachedContext(ctx))
+		call = &mappingCall{done: make(chan struct{}), cancel: cancel}
+		g.calls[key] = call
+		go func() {
+			call.m, call.err = fn(callCtx)
+			g.forget(key, call)
+			cancel()
+			close(call.done)
+		}()
+	}
+	call.waiters++
+	g.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.m, call.err
+	case <-ctx.Done():
+		g.mu.Lock()
+		call.waiters--
+		if call.waiters == 0 {
+			call.cancel()
+			if g.calls[key] == call {
+				delete(g.calls, key)
+			}
+		}
+		g.mu.Unlock()
+		return mapping{}, ctx.Err()
+	}
+}
+
+func (g *mappingGroup) forget(key string, call *mappingCall) {
+	g.mu.Lock()
+	if g.calls[key] == call {
+		delete(g.calls, key)
+	}
+	g.mu.Unlock()
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMappingGroupCoalescesCalls(t *testing.T) {
+	g := newMappingGroup()
+	var calls int32
+	release := make(chan struct{})
+	fn := func(context.Context) (mapping, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return mapping{Sequences: []sequence{{Clips: []clip{{Type: "source", Path: "/my-bucket/video.mp4"}}}}}, nil
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m, err := g.do(context.Background(), "videos/video", fn)
+			if err != nil {
+				t.Error(err)
+			}
+			if len(m.Sequences) != 1 {
+				t.Errorf("wrong number of sequences\nwant 1\ngot  %d", len(m.Sequences))
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("wrong number of calls\nwant 1\ngot  %d", n)
+	}
+
+	// calls that finished aren't reused.
+	if _, err := g.do(context.Background(), "videos/video", fn); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("wrong number of calls\nwant 2\ngot  %d", n)
+	}
+}
+
+func TestMappingGroupCancelsAbandonedCalls(t *testing.T) {
+	g := newMappingGroup()
+	canceled := make(chan struct{})
+	fn := func(ctx context.Context) (mapping, error) {
+		<-ctx.Done()
+		close(canceled)
+		return mapping{}, ctx.Err()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	if _, err := g.do(ctx, "videos/video", fn); err != context.Canceled {
+		t.Errorf("wrong error\nwant %v\ngot  %v", context.Canceled, err)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Error("call wasn't canceled after all requests were gone")
+	}
+}
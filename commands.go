@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+// commands are the subcommands of gcs-helper, run instead of the server when
+// their name is the first argument. They return the exit code.
+var commands = map[string]func(args []string, stdout, stderr io.Writer) int{
+	"validate-config": validateConfigCommand,
+	"sign":            signCommand,
+	"map":             mapCommand,
+	"version":         versionCommand,
+}
+
+// newStorageClient creates the client used by the subcommands to access GCS.
+var newStorageClient = func(ctx context.Context, c ClientConfig) (*storage.Client, error) {
+	hc, err := httpClient(c)
+	if err != nil {
+		return nil, err
+	}
+	return storage.NewClient(ctx, option.WithHTTPClient(hc))
+}
+
+// newCommandFlagSet returns the flag set of a subcommand, including the
+// configuration flags. Usage errors are reported by parseCommandFlags.
+func newCommandFlagSet(name string, stderr io.Writer) (*flag.FlagSet, func() (Config, error), error) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	load, err := defineLoadFlags(fs)
+	return fs, load, err
+}
+
+// parseCommandFlags parses the arguments of a subcommand, returning the
+// positional arguments, which may be mixed with flags, and the exit code to
+// use when it shouldn't run: 0 when help was requested, and 2 for invalid
+// arguments.
+func parseCommandFlags(fs *flag.FlagSet, args []string) ([]string, int, bool) {
+	var positional []string
+	for {
+		err := fs.Parse(args)
+		if err == flag.ErrHelp {
+			return nil, 0, false
+		}
+		if err != nil {
+			return nil, 2, false
+		}
+		if fs.NArg() == 0 {
+			return positional, 0, true
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+// validateConfigCommand loads the configuration like the server does,
+// running the signing self-test, and optionally checks access to the bucket
+// and that the private keys are published keys of their service accounts.
+// Signing with the iam mode or with keys loaded from Secret Manager requires
+// access to Google APIs, so it's only tested with -check-access.
+func validateConfigCommand(args []string, stdout, stderr io.Writer) int {
+	fs, load, err := newCommandFlagSet("validate-config", stderr)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	checkAccess := fs.Bool("check-access", false, "also check access to the bucket and to the APIs used for signing")
+	if _, code, ok := parseCommandFlags(fs, args); !ok {
+		return code
+	}
+	config, err := load()
+	if err != nil {
+		fmt.Fprintf(stderr, "invalid configuration: %v\n", err)
+		return 1
+	}
+	ctx := context.Background()
+	if *checkAccess {
+		if err = setupSigner(ctx, &config); err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		client, err := newStorageClient(ctx, config.ClientConfig)
+		if err != nil {
+			fmt.Fprintf(stderr, "failed to create storage client: %v\n", err)
+			return 1
+		}
+		if err = checkBucketAccess(ctx, &config, client); err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		if err = checkPublishedKeys(ctx, config, &http.Client{Timeout: config.ClientConfig.Timeout}); err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+	} else if config.SignConfig.Mode == signModeIAM || config.SignConfig.PrivateKeySecret != "" {
+		fmt.Fprintln(stdout, "skipping the signing self-test of GCS_HELPER_SIGN_*, use -check-access to run it")
+		config.SignConfig = SignConfig{}
+	}
+	if err = signingSelfTest(config); err != nil {
+		fmt.Fprintf(stderr, "signing self-test failed: %v\n", err)
+		return 1
+	}
+	fmt.Fprintln(stdout, "configuration is valid")
+	return 0
+}
+
+// checkBucketAccess lists an object of the configured bucket, which is what
+// map mode needs and implies the bucket exists.
+func checkBucketAccess(ctx context.Context, c *Config, client *storage.Client) error {
+	iter := bucketHandle(c, client, c.BucketName).Objects(withListFields(ctx, mapListFields(*c)), nil)
+	iter.PageInfo().MaxSize = 1
+	if _, err := iter.Next(); err != nil && err != iterator.Done {
+		return fmt.Errorf("failed to list objects in bucket %q: %v", c.BucketName, err)
+	}
+	return nil
+}
+
+// signCommand prints signed URLs for the given objects, with the signer
+// configured in GCS_HELPER_SIGNER, one per line. Objects are referenced by
+// gs:// URLs, or by their names in GCS_HELPER_BUCKET_NAME.
+func signCommand(args []string, stdout, stderr io.Writer) int {
+	fs, load, err := newCommandFlagSet("sign", stderr)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	ttl := fs.Duration("ttl", 0, "how long the URLs are valid for, up to the maximum expiration of the signer (defaults to its expiration)")
+	method := fs.String("method", "", "method the URLs are valid for, GET or HEAD (defaults to GCS_HELPER_SIGN_METHOD)")
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: gcs-helper sign [flags] gs://bucket/object|object...")
+		fs.PrintDefaults()
+	}
+	objects, code, ok := parseCommandFlags(fs, args)
+	if !ok {
+		return code
+	}
+	if len(objects) == 0 {
+		fs.Usage()
+		return 2
+	}
+	config, err := load()
+	if err != nil {
+		fmt.Fprintf(stderr, "invalid configuration: %v\n", err)
+		return 1
+	}
+	if !config.signerEnabled() {
+		fmt.Fprintf(stderr, "signing requires the %s configuration\n", config.signerConfig())
+		return 1
+	}
+	if *method == "" {
+		*method = config.SignConfig.Method
+	}
+	if *method != http.MethodGet && *method != http.MethodHead {
+		fmt.Fprintf(stderr, "invalid -method: %s\n", *method)
+		return 2
+	}
+	if err = setupSigner(context.Background(), &config); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	// the expiration is checked like the "expires" parameter of the sign
+	// mode.
+	query := url.Values{}
+	if *ttl != 0 {
+		query.Set("expires", ttl.String())
+	}
+	r, err := http.NewRequest(http.MethodGet, "/?"+query.Encode(), nil)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	for _, object := range objects {
+		bucketName, objectName := config.BucketName, object
+		if strings.HasPrefix(object, "gs://") {
+			parts := strings.SplitN(strings.TrimPrefix(object, "gs://"), "/", 2)
+			if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+				fmt.Fprintf(stderr, "invalid object %q\n", object)
+				return 2
+			}
+			bucketName, objectName = parts[0], parts[1]
+		}
+		signed, status, err := signObjectURL(&config, r, *method, bucketName, objectName)
+		if err != nil {
+			if status == http.StatusBadRequest {
+				fmt.Fprintf(stderr, "invalid -ttl: %v\n", err)
+				return 2
+			}
+			fmt.Fprintf(stderr, "failed to sign %s: %v\n", object, err)
+			return 1
+		}
+		fmt.Fprintln(stdout, signed)
+	}
+	return 0
+}
+
+// mapCommand prints the mapping of the given prefix, resolved by the map
+// handler as in a request to GCS_HELPER_MAP_PREFIX, for debugging the
+// filters without running the server. JSON mappings are indented.
+func mapCommand(args []string, stdout, stderr io.Writer) int {
+	fs, load, err := newCommandFlagSet("map", stderr)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	format := fs.String("format", mapFormatJSON, "output format: json, v2, hls, dash, ism or template (hls, dash and ism URLs are signed)")
+	query := fs.String("query", "", `query string of the map request, like "clipFrom=1000&filter=hd"`)
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: gcs-helper map [flags] prefix")
+		fs.PrintDefaults()
+	}
+	prefixes, code, ok := parseCommandFlags(fs, args)
+	if !ok {
+		return code
+	}
+	if len(prefixes) != 1 {
+		fs.Usage()
+		return 2
+	}
+	config, err := load()
+	if err != nil {
+		fmt.Fprintf(stderr, "invalid configuration: %v\n", err)
+		return 1
+	}
+	r, err := http.NewRequest(http.MethodGet, "/", http.NoBody)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	r.URL.Path = "/" + strings.TrimLeft(prefixes[0], "/")
+	r.URL.RawQuery = *query
+	switch *format {
+	case mapFormatJSON:
+	case mapFormatV2:
+		r.Header.Set("Accept", mappingV2ContentType)
+	case mapFormatHLS, mapFormatDASH, mapFormatISM:
+		if !config.signerEnabled() {
+			fmt.Fprintf(stderr, "%s output requires the %s configuration\n", *format, config.signerConfig())
+			return 1
+		}
+		r = withMapFormat(r, *format)
+	case mapFormatTemplate:
+		if config.MapTemplate == "" {
+			fmt.Fprintln(stderr, "template output requires GCS_HELPER_MAP_TEMPLATE")
+			return 1
+		}
+		r = withMapFormat(r, *format)
+	default:
+		fmt.Fprintf(stderr, "invalid -format: %s\n", *format)
+		return 2
+	}
+	ctx := context.Background()
+	if *format != mapFormatJSON && *format != mapFormatV2 {
+		if err = setupSigner(ctx, &config); err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+	}
+	client, err := newStorageClient(ctx, config.ClientConfig)
+	if err != nil {
+		fmt.Fprintf(stderr, "failed to create storage client: %v\n", err)
+		return 1
+	}
+	w := httptest.NewRecorder()
+	getMapHandler(config, client)(w, r)
+	if w.Code != http.StatusOK {
+		fmt.Fprintf(stderr, "map request failed with status %d: %s", w.Code, w.Body.String())
+		return 1
+	}
+	body := w.Body.Bytes()
+	if *format == mapFormatJSON || *format == mapFormatV2 {
+		var buf bytes.Buffer
+		if err = json.Indent(&buf, body, "", "  "); err == nil {
+			body = buf.Bytes()
+		}
+	}
+	stdout.Write(body)
+	return 0
+}
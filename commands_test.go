@@ -0,0 +1,449 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/fsouza/fake-gcs-server/fakestorage"
+)
+
+func TestValidateConfigCommand(t *testing.T) {
+	signConfig := testSignConfig(t)
+	var tests = []struct {
+		testCase       string
+		envs           map[string]string
+		args           []string
+		expectedCode   int
+		expectedStdout string
+		expectedStderr string
+	}{
+		{
+			"valid configuration",
+			map[string]string{"GCS_HELPER_BUCKET_NAME": "some-bucket"},
+			nil,
+			0,
+			"configuration is valid\n",
+			"",
+		},
+		{
+			"configuration from flags",
+			nil,
+			[]string{"-bucket-name", "some-bucket"},
+			0,
+			"configuration is valid\n",
+			"",
+		},
+		{
+			"valid signing key",
+			map[string]string{
+				"GCS_HELPER_BUCKET_NAME":           "some-bucket",
+				"GCS_HELPER_SIGN_GOOGLE_ACCESS_ID": signConfig.GoogleAccessID,
+				"GCS_HELPER_SIGN_PRIVATE_KEY":      signConfig.PrivateKey,
+			},
+			nil,
+			0,
+			"configuration is valid\n",
+			"",
+		},
+		{
+			"iam mode without access check",
+			map[string]string{
+				"GCS_HELPER_BUCKET_NAME":           "some-bucket",
+				"GCS_HELPER_SIGN_GOOGLE_ACCESS_ID": signConfig.GoogleAccessID,
+				"GCS_HELPER_SIGN_MODE":             "iam",
+			},
+			nil,
+			0,
+			"skipping the signing self-test of GCS_HELPER_SIGN_*, use -check-access to run it\nconfiguration is valid\n",
+			"",
+		},
+		{
+			"invalid regex",
+			map[string]string{
+				"GCS_HELPER_BUCKET_NAME":      "some-bucket",
+				"GCS_HELPER_MAP_REGEX_FILTER": "(",
+			},
+			nil,
+			1,
+			"",
+			"invalid configuration: invalid GCS_HELPER_MAP_REGEX_FILTER: error parsing regexp: missing closing ): `(`\n",
+		},
+		{
+			"invalid signing key",
+			map[string]string{
+				"GCS_HELPER_BUCKET_NAME":           "some-bucket",
+				"GCS_HELPER_SIGN_GOOGLE_ACCESS_ID": signConfig.GoogleAccessID,
+				"GCS_HELPER_SIGN_PRIVATE_KEY":      "not a key",
+			},
+			nil,
+			1,
+			"",
+			"signing self-test failed: failed to sign url with signer@project.iam.gserviceaccount.com: ",
+		},
+		{
+			"unknown flag",
+			map[string]string{"GCS_HELPER_BUCKET_NAME": "some-bucket"},
+			[]string{"-bucket-nmae", "typo"},
+			2,
+			"",
+			"flag provided but not defined: -bucket-nmae\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.testCase, func(t *testing.T) {
+			setEnvs(test.envs)
+			var stdout, stderr bytes.Buffer
+			code := validateConfigCommand(test.args, &stdout, &stderr)
+			if code != test.expectedCode {
+				t.Errorf("wrong exit code\nwant %d\ngot  %d", test.expectedCode, code)
+			}
+			if stdout.String() != test.expectedStdout {
+				t.Errorf("wrong output\nwant %q\ngot  %q", test.expectedStdout, stdout.String())
+			}
+			if !strings.HasPrefix(stderr.String(), test.expectedStderr) {
+				t.Errorf("wrong error output\nwant prefix %q\ngot  %q", test.expectedStderr, stderr.String())
+			}
+		})
+	}
+}
+
+func TestCheckBucketAccess(t *testing.T) {
+	server := fakestorage.NewServer(getObjects())
+	defer server.Stop()
+	var tests = []struct {
+		testCase string
+		bucket   string
+		expected string
+	}{
+		{"existing bucket", "my-bucket", ""},
+		{"missing bucket", "missing-bucket", `failed to list objects in bucket "missing-bucket": `},
+	}
+	for _, test := range tests {
+		t.Run(test.testCase, func(t *testing.T) {
+			err := checkBucketAccess(context.Background(), &Config{BucketName: test.bucket}, server.Client())
+			if test.expected == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+			} else if err == nil || !strings.HasPrefix(err.Error(), test.expected) {
+				t.Errorf("wrong error\nwant prefix %q\ngot  %v", test.expected, err)
+			}
+		})
+	}
+}
+
+func TestSignCommand(t *testing.T) {
+	signConfig := testSignConfig(t)
+	keyEnvs := map[string]string{
+		"GCS_HELPER_BUCKET_NAME":           "some-bucket",
+		"GCS_HELPER_SIGN_GOOGLE_ACCESS_ID": signConfig.GoogleAccessID,
+		"GCS_HELPER_SIGN_PRIVATE_KEY":      signConfig.PrivateKey,
+		"GCS_HELPER_SIGN_MAX_EXPIRATION":   "24h",
+	}
+	var tests = []struct {
+		testCase        string
+		envs            map[string]string
+		args            []string
+		expectedCode    int
+		expectedURLs    []string
+		expectedExpires time.Duration
+		expectedStderr  string
+	}{
+		{
+			"object in the configured bucket",
+			keyEnvs,
+			[]string{"videos/video1.mp4"},
+			0,
+			[]string{"https://storage.googleapis.com/some-bucket/videos/video1.mp4"},
+			time.Hour,
+			"",
+		},
+		{
+			"gs url with ttl after the object",
+			keyEnvs,
+			[]string{"gs://other-bucket/videos/video1.mp4", "-ttl", "2h"},
+			0,
+			[]string{"https://storage.googleapis.com/other-bucket/videos/video1.mp4"},
+			2 * time.Hour,
+			"",
+		},
+		{
+			"multiple objects",
+			keyEnvs,
+			[]string{"-ttl=10m", "a.mp4", "b.mp4"},
+			0,
+			[]string{
+				"https://storage.googleapis.com/some-bucket/a.mp4",
+				"https://storage.googleapis.com/some-bucket/b.mp4",
+			},
+			10 * time.Minute,
+			"",
+		},
+		{
+			"token signer",
+			map[string]string{
+				"GCS_HELPER_BUCKET_NAME":      "some-bucket",
+				"GCS_HELPER_SIGNER":           "token",
+				"GCS_HELPER_TOKEN_URL_PREFIX": "https://edge.example.com",
+				"GCS_HELPER_TOKEN_KEY":        "secret",
+			},
+			[]string{"videos/video1.mp4"},
+			0,
+			[]string{"https://edge.example.com/videos/video1.mp4"},
+			0,
+			"",
+		},
+		{
+			"ttl above the maximum",
+			keyEnvs,
+			[]string{"-ttl", "48h", "videos/video1.mp4"},
+			2,
+			nil,
+			0,
+			"invalid -ttl: expires must be at most 24h0m0s\n",
+		},
+		{
+			"invalid method",
+			keyEnvs,
+			[]string{"-method", "PUT", "videos/video1.mp4"},
+			2,
+			nil,
+			0,
+			"invalid -method: PUT\n",
+		},
+		{
+			"invalid gs url",
+			keyEnvs,
+			[]string{"gs://some-bucket"},
+			2,
+			nil,
+			0,
+			"invalid object \"gs://some-bucket\"\n",
+		},
+		{
+			"missing object",
+			keyEnvs,
+			nil,
+			2,
+			nil,
+			0,
+			"usage: gcs-helper sign [flags] gs://bucket/object|object...\n",
+		},
+		{
+			"signer not configured",
+			map[string]string{"GCS_HELPER_BUCKET_NAME": "some-bucket"},
+			[]string{"videos/video1.mp4"},
+			1,
+			nil,
+			0,
+			"signing requires the GCS_HELPER_SIGN_* configuration\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.testCase, func(t *testing.T) {
+			setEnvs(test.envs)
+			var stdout, stderr bytes.Buffer
+			now := time.Now()
+			code := signCommand(test.args, &stdout, &stderr)
+			if code != test.expectedCode {
+				t.Errorf("wrong exit code\nwant %d\ngot  %d", test.expectedCode, code)
+			}
+			if !strings.HasPrefix(stderr.String(), test.expectedStderr) {
+				t.Errorf("wrong error output\nwant prefix %q\ngot  %q", test.expectedStderr, stderr.String())
+			}
+			lines := strings.Fields(stdout.String())
+			if len(lines) != len(test.expectedURLs) {
+				t.Fatalf("wrong number of urls\nwant %d\ngot  %d (%q)", len(test.expectedURLs), len(lines), stdout.String())
+			}
+			for i, line := range lines {
+				if !strings.HasPrefix(line, test.expectedURLs[i]+"?") {
+					t.Errorf("wrong url\nwant prefix %q\ngot  %q", test.expectedURLs[i]+"?", line)
+				}
+				if test.expectedExpires == 0 {
+					continue
+				}
+				expires, err := signedURLExpiration(line)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if d := expires.Sub(now.Add(test.expectedExpires)); d < -2*time.Second || d > 2*time.Second {
+					t.Errorf("wrong expiration\nwant %s\ngot  %s", now.Add(test.expectedExpires), expires)
+				}
+			}
+		})
+	}
+}
+
+func TestMapCommand(t *testing.T) {
+	server := fakestorage.NewServer(getObjects())
+	defer server.Stop()
+	defer func(f func(context.Context, ClientConfig) (*storage.Client, error)) { newStorageClient = f }(newStorageClient)
+	newStorageClient = func(context.Context, ClientConfig) (*storage.Client, error) {
+		return server.Client(), nil
+	}
+	envs := map[string]string{
+		"GCS_HELPER_BUCKET_NAME":      "my-bucket",
+		"GCS_HELPER_MAP_REGEX_FILTER": `\.txt$`,
+	}
+	var tests = []struct {
+		testCase       string
+		envs           map[string]string
+		args           []string
+		expectedCode   int
+		expectedStdout string
+		expectedStderr string
+	}{
+		{
+			"json mapping",
+			envs,
+			[]string{"musics/music/music"},
+			0,
+			`{
+  "sequences": [
+    {
+      "clips": [
+        {
+          "type": "source",
+          "path": "/my-bucket/musics/music/music1.txt"
+        }
+      ]
+    },
+    {
+      "clips": [
+        {
+          "type": "source",
+          "path": "/my-bucket/musics/music/music2.txt"
+        }
+      ]
+    },
+    {
+      "clips": [
+        {
+          "type": "source",
+          "path": "/my-bucket/musics/music/music3.txt"
+        }
+      ]
+    }
+  ]
+}
+`,
+			"",
+		},
+		{
+			"filters from flags and query",
+			envs,
+			[]string{"-map-regex-filter", `\.mp3$`, "/musics/music/music", "-query", "clipTo=5000"},
+			0,
+			`{
+  "clipTo": 5000,
+  "sequences": [
+    {
+      "clips": [
+        {
+          "type": "source",
+          "path": "/my-bucket/musics/music/music4.mp3"
+        }
+      ]
+    }
+  ]
+}
+`,
+			"",
+		},
+		{
+			"empty mapping",
+			envs,
+			[]string{"missing/"},
+			0,
+			"{\n  \"sequences\": []\n}\n",
+			"",
+		},
+		{
+			"invalid query",
+			envs,
+			[]string{"-query", "clipFrom=abc", "musics/"},
+			1,
+			"",
+			"map request failed with status 400: invalid clipFrom\n",
+		},
+		{
+			"signed format without signer",
+			envs,
+			[]string{"-format", "hls", "musics/"},
+			1,
+			"",
+			"hls output requires the GCS_HELPER_SIGN_* configuration\n",
+		},
+		{
+			"template format without template",
+			envs,
+			[]string{"-format", "template", "musics/"},
+			1,
+			"",
+			"template output requires GCS_HELPER_MAP_TEMPLATE\n",
+		},
+		{
+			"invalid format",
+			envs,
+			[]string{"-format", "xml", "musics/"},
+			2,
+			"",
+			"invalid -format: xml\n",
+		},
+		{
+			"missing prefix",
+			envs,
+			nil,
+			2,
+			"",
+			"usage: gcs-helper map [flags] prefix\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.testCase, func(t *testing.T) {
+			setEnvs(test.envs)
+			var stdout, stderr bytes.Buffer
+			code := mapCommand(test.args, &stdout, &stderr)
+			if code != test.expectedCode {
+				t.Errorf("wrong exit code\nwant %d\ngot  %d", test.expectedCode, code)
+			}
+			if stdout.String() != test.expectedStdout {
+				t.Errorf("wrong output\nwant %q\ngot  %q", test.expectedStdout, stdout.String())
+			}
+			if !strings.HasPrefix(stderr.String(), test.expectedStderr) {
+				t.Errorf("wrong error output\nwant prefix %q\ngot  %q", test.expectedStderr, stderr.String())
+			}
+		})
+	}
+}
+
+func TestMapCommandSignedFormat(t *testing.T) {
+	server := fakestorage.NewServer(getObjects())
+	defer server.Stop()
+	defer func(f func(context.Context, ClientConfig) (*storage.Client, error)) { newStorageClient = f }(newStorageClient)
+	newStorageClient = func(context.Context, ClientConfig) (*storage.Client, error) {
+		return server.Client(), nil
+	}
+	setEnvs(map[string]string{
+		"GCS_HELPER_BUCKET_NAME":      "my-bucket",
+		"GCS_HELPER_MAP_REGEX_FILTER": `music1\.txt$`,
+		"GCS_HELPER_SIGNER":           "token",
+		"GCS_HELPER_TOKEN_URL_PREFIX": "https://edge.example.com/",
+		"GCS_HELPER_TOKEN_KEY":        "secret",
+	})
+	var stdout, stderr bytes.Buffer
+	code := mapCommand([]string{"-format", "hls", "musics/music/music"}, &stdout, &stderr)
+	if code != 0 {
+		t.Fatalf("wrong exit code\nwant 0\ngot  %d (%s)", code, stderr.String())
+	}
+	if !strings.HasPrefix(stdout.String(), "#EXTM3U\n") {
+		t.Errorf("output isn't an HLS playlist: %q", stdout.String())
+	}
+	if !strings.Contains(stdout.String(), "https://edge.example.com/musics/music/music1.txt?token=") {
+		t.Errorf("output doesn't include the signed url: %q", stdout.String())
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"cloud.google.com/go/storage"
+)
+
+// maxComposeSources is the maximum number of source objects accepted by GCS
+// in a single compose request.
+const maxComposeSources = 32
+
+type composeRequest struct {
+	Sources      []string `json:"sources"`
+	ContentType  string   `json:"contentType"`
+	CacheControl string   `json:"cacheControl"`
+}
+
+// getComposeHandler returns a handler that concatenates source objects into
+// the destination object referenced by the request path. The names of the
+// source objects, in order, are sent in the JSON request body.
+func getComposeHandler(c Config, client *storage.Client) http.HandlerFunc {
+	logger := c.logger()
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !authorized(r, c.UploadToken) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		bucketName, objectName, err := objectLocation(&c, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var req composeRequest
+		if err = json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request body", http.StatusBadRequest)
+			return
+		}
+		if objectName == "" || len(req.Sources) == 0 {
+			http.Error(w, "destination and sources are required", http.StatusBadRequest)
+			return
+		}
+		if len(req.Sources) > maxComposeSources {
+			http.Error(w, fmt.Sprintf("at most %d sources can be composed", maxComposeSources), http.StatusBadRequest)
+			return
+		}
+		bucket := bucketHandle(&c, client, bucketName)
+		sources := make([]*storage.ObjectHandle, len(req.Sources))
+		for i, name := range req.Sources {
+			name = strings.TrimLeft(name, "/")
+			if name == "" {
+				http.Error(w, "invalid source name", http.StatusBadRequest)
+				return
+			}
+			sources[i] = bucket.Object(name)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), c.ProxyTimeout)
+		defer cancel()
+		composer := bucket.Object(objectName).ComposerFrom(sources...)
+		composer.ContentType = req.ContentType
+		if composer.ContentType == "" {
+			composer.ContentType = contentType(&c, &storage.ObjectAttrs{Name: objectName})
+		}
+		composer.CacheControl = req.CacheControl
+		attrs, err := composer.Run(ctx)
+		if err != nil {
+			if objectNotFound(err) {
+				http.Error(w, storage.ErrObjectNotExist.Error(), http.StatusNotFound)
+				return
+			}
+			requestLogger(r.Context(), logger).WithError(err).WithField("url", r.URL.RequestURI()).Error("failed to compose object")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(newObjectMetadata(&c, attrs))
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fsouza/fake-gcs-server/fakestorage"
+)
+
+func TestComposeHandlerValidation(t *testing.T) {
+	server := fakestorage.NewServer(getObjects())
+	defer server.Stop()
+	handler := getComposeHandler(Config{
+		BucketName:   "my-bucket",
+		UploadToken:  "secret",
+		ProxyTimeout: time.Second,
+	}, server.Client())
+	tooManySources := `{"sources":["0"` + strings.Repeat(`,"0"`, maxComposeSources) + `]}`
+
+	var tests = []struct {
+		testCase       string
+		method         string
+		token          string
+		body           string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			"invalid body",
+			http.MethodPost,
+			"secret",
+			"sources",
+			http.StatusBadRequest,
+			"invalid request body\n",
+		},
+		{
+			"no sources",
+			http.MethodPost,
+			"secret",
+			`{"sources":[]}`,
+			http.StatusBadRequest,
+			"destination and sources are required\n",
+		},
+		{
+			"too many sources",
+			http.MethodPost,
+			"secret",
+			tooManySources,
+			http.StatusBadRequest,
+			"at most 32 sources can be composed\n",
+		},
+		{
+			"empty source name",
+			http.MethodPost,
+			"secret",
+			`{"sources":["segments/1.ts",""]}`,
+			http.StatusBadRequest,
+			"invalid source name\n",
+		},
+		{
+			"wrong token",
+			http.MethodPost,
+			"not-secret",
+			`{"sources":["segments/1.ts"]}`,
+			http.StatusUnauthorized,
+			"unauthorized\n",
+		},
+		{
+			"method not allowed",
+			http.MethodPut,
+			"secret",
+			`{"sources":["segments/1.ts"]}`,
+			http.StatusMethodNotAllowed,
+			"method not allowed\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.testCase, func(t *testing.T) {
+			r := httptest.NewRequest(test.method, "/segments/all.ts", strings.NewReader(test.body))
+			r.Header.Set("Authorization", "Bearer "+test.token)
+			recorder := httptest.NewRecorder()
+			handler(recorder, r)
+			if recorder.Code != test.expectedStatus {
+				t.Errorf("wrong status code\nwant %d\ngot  %d", test.expectedStatus, recorder.Code)
+			}
+			if body := recorder.Body.String(); body != test.expectedBody {
+				t.Errorf("wrong body\nwant %q\ngot  %q", test.expectedBody, body)
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// compressHandler wraps the given handler, compressing responses with gzip
+// when the client supports it and the response has one of the configured
+// content types and at least CompressMinSize bytes. Brotli isn't supported,
+// as there's no encoder in the standard library.
+func compressHandler(c Config, handler http.HandlerFunc) http.HandlerFunc {
+	if !c.Compress {
+		return handler
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			handler(w, r)
+			return
+		}
+		gw := gzipResponseWriter{
+			ResponseWriter: w,
+			minSize:        c.CompressMinSize,
+			types:          c.CompressTypes,
+			accepted:       acceptsEncoding(r, "gzip"),
+		}
+		defer gw.Close()
+		handler(&gw, r)
+	}
+}
+
+// acceptsEncoding reports whether the Accept-Encoding header in the request
+// includes the given encoding with a non-zero quality.
+func acceptsEncoding(r *http.Request, encoding string) bool {
+	for _, value := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(value, ";")
+		name := strings.TrimSpace(parts[0])
+		if name != encoding && name != "*" {
+			continue
+		}
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil && q == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// gzipResponseWriter decides whether to compress the response once the
+// headers are written. When the length of the response isn't known in
+// advance, it buffers up to minSize bytes before making the decision.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	minSize  int
+	types    []string
+	accepted bool
+
+	status      int
+	wroteHeader bool
+	decided     bool
+	buf         []byte
+	gz          *gzip.Writer
+}
+
+func (w *gzipResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.status = code
+	if !w.eligible() {
+		w.passthrough()
+		return
+	}
+	if length := w.Header().Get("Content-Length"); length != "" {
+		if size, err := strconv.Atoi(length); err == nil && size < w.minSize {
+			w.passthrough()
+		} else {
+			w.startCompression()
+		}
+	}
+}
+
+func (w *gzipResponseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.decided {
+		if w.gz != nil {
+			return w.gz.Write(p)
+		}
+		return w.ResponseWriter.Write(p)
+	}
+	w.buf = append(w.buf, p...)
+	if len(w.buf) >= w.minSize {
+		w.startCompression()
+		if _, err := w.gz.Write(w.buf); err != nil {
+			return 0, err
+		}
+		w.buf = nil
+	}
+	return len(p), nil
+}
+
+func (w *gzipResponseWriter) Flush() {
+	if w.wroteHeader && !w.decided {
+		w.startCompression()
+		w.gz.Write(w.buf)
+		w.buf = nil
+	}
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Close flushes any buffered data and terminates the gzip stream.
+func (w *gzipResponseWriter) Close() error {
+	if !w.wroteHeader {
+		return nil
+	}
+	if !w.decided {
+		w.Header().Set("Content-Length", strconv.Itoa(len(w.buf)))
+		w.passthrough()
+		_, err := w.ResponseWriter.Write(w.buf)
+		return err
+	}
+	if w.gz != nil {
+		return w.gz.Close()
+	}
+	return nil
+}
+
+func (w *gzipResponseWriter) eligible() bool {
+	if w.status != http.StatusOK || w.Header().Get("Content-Encoding") != "" {
+		return false
+	}
+	contentType := w.Header().Get("Content-Type")
+	if i := strings.Index(contentType, ";"); i > -1 {
+		contentType = contentType[:i]
+	}
+	contentType = strings.ToLower(strings.TrimSpace(contentType))
+	for _, t := range w.types {
+		if strings.ToLower(t) == contentType {
+			w.Header().Add("Vary", "Accept-Encoding")
+			return w.accepted
+		}
+	}
+	return false
+}
+
+func (w *gzipResponseWriter) passthrough() {
+	w.decided = true
+	w.ResponseWriter.WriteHeader(w.status)
+}
+
+func (w *gzipResponseWriter) startCompression() {
+	w.decided = true
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Encoding", "gzip")
+	// the compressed body isn't byte-for-byte the object the strong ETag
+	// identifies, so caches must not mix it up with the uncompressed one.
+	if etag := w.Header().Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		w.Header().Set("ETag", "W/"+etag)
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	w.gz = gzip.NewWriter(w.ResponseWriter)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestCompressHandler(t *testing.T) {
+	body := strings.Repeat("WEBVTT caption line\n", 100)
+	var tests = []struct {
+		testCase         string
+		method           string
+		acceptEncoding   string
+		contentType      string
+		contentLength    bool
+		status           int
+		body             string
+		expectCompressed bool
+		expectVary       bool
+	}{
+		{
+			"compressible type with known length",
+			http.MethodGet, "gzip, deflate", "text/vtt", true, http.StatusOK, body, true, true,
+		},
+		{
+			"compressible type with unknown length",
+			http.MethodGet, "gzip", "application/json; charset=utf-8", false, http.StatusOK, body, true, true,
+		},
+		{
+			"client doesn't support gzip",
+			http.MethodGet, "br", "text/vtt", true, http.StatusOK, body, false, true,
+		},
+		{
+			"client refuses gzip",
+			http.MethodGet, "gzip;q=0", "text/vtt", true, http.StatusOK, body, false, true,
+		},
+		{
+			"small response with known length",
+			http.MethodGet, "gzip", "text/vtt", true, http.StatusOK, "WEBVTT", false, true,
+		},
+		{
+			"small response with unknown length",
+			http.MethodGet, "gzip", "application/json", false, http.StatusOK, `{"sequences":[]}`, false, true,
+		},
+		{
+			"non compressible type",
+			http.MethodGet, "gzip", "video/mp4", true, http.StatusOK, body, false, false,
+		},
+		{
+			"partial content",
+			http.MethodGet, "gzip", "text/vtt", true, http.StatusPartialContent, body, false, false,
+		},
+		{
+			"head request",
+			http.MethodHead, "gzip", "text/vtt", true, http.StatusOK, "", false, false,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.testCase, func(t *testing.T) {
+			handler := compressHandler(Config{
+				Compress:        true,
+				CompressMinSize: 1024,
+				CompressTypes:   []string{"application/json", "text/vtt"},
+			}, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", test.contentType)
+				w.Header().Set("ETag", `"deadbeef"`)
+				if test.contentLength {
+					w.Header().Set("Content-Length", strconv.Itoa(len(test.body)))
+				}
+				w.WriteHeader(test.status)
+				w.Write([]byte(test.body))
+			})
+			r := httptest.NewRequest(test.method, "/", nil)
+			r.Header.Set("Accept-Encoding", test.acceptEncoding)
+			recorder := httptest.NewRecorder()
+			handler(recorder, r)
+			if recorder.Code != test.status {
+				t.Errorf("wrong status code\nwant %d\ngot  %d", test.status, recorder.Code)
+			}
+			if vary := recorder.Header().Get("Vary") == "Accept-Encoding"; vary != test.expectVary {
+				t.Errorf("wrong Vary header %q", recorder.Header().Get("Vary"))
+			}
+			data := recorder.Body.Bytes()
+			if test.expectCompressed {
+				if encoding := recorder.Header().Get("Content-Encoding"); encoding != "gzip" {
+					t.Fatalf("wrong Content-Encoding\nwant %q\ngot  %q", "gzip", encoding)
+				}
+				if etag := recorder.Header().Get("ETag"); etag != `W/"deadbeef"` {
+					t.Errorf("wrong ETag for the compressed response\nwant %q\ngot  %q", `W/"deadbeef"`, etag)
+				}
+				reader, err := gzip.NewReader(bytes.NewReader(data))
+				if err != nil {
+					t.Fatal(err)
+				}
+				data, err = ioutil.ReadAll(reader)
+				if err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				if encoding := recorder.Header().Get("Content-Encoding"); encoding != "" {
+					t.Errorf("unexpected Content-Encoding %q", encoding)
+				}
+				if etag := recorder.Header().Get("ETag"); etag != `"deadbeef"` {
+					t.Errorf("wrong ETag for the uncompressed response\nwant %q\ngot  %q", `"deadbeef"`, etag)
+				}
+			}
+			if string(data) != test.body {
+				t.Errorf("wrong body\nwant %q\ngot  %q", test.body, string(data))
+			}
+		})
+	}
+}
+
+func TestCompressHandlerDisabled(t *testing.T) {
+	called := false
+	handler := func(w http.ResponseWriter, r *http.Request) { called = true }
+	compressHandler(Config{}, handler)(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if !called {
+		t.Error("handler wasn't called")
+	}
+}
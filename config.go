@@ -1,7 +1,14 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/kelseyhightower/envconfig"
@@ -11,29 +18,289 @@ import (
 // Config represents the gcs-helper configuration that is loaded from the
 // environment.
 type Config struct {
-	Listen              string        `default:":8080"`
-	BucketName          string        `envconfig:"BUCKET_NAME" required:"true"`
-	LogLevel            string        `envconfig:"LOG_LEVEL" default:"debug"`
-	ProxyLogHeaders     []string      `envconfig:"PROXY_LOG_HEADERS"`
-	ProxyPrefix         string        `envconfig:"PROXY_PREFIX"`
-	ProxyTimeout        time.Duration `envconfig:"PROXY_TIMEOUT" default:"10s"`
-	MapPrefix           string        `envconfig:"MAP_PREFIX"`
-	ExtraResourcesToken string        `envconfig:"EXTRA_RESOURCES_TOKEN"`
-	MapRegexFilter      string        `envconfig:"MAP_REGEX_FILTER"`
-	MapRegexHDFilter    string        `envconfig:"MAP_REGEX_HD_FILTER"`
-	MapExtraPrefixes    []string      `envconfig:"MAP_EXTRA_PREFIXES"`
-	MapExtensionSplit   bool          `envconfig:"MAP_EXTENSION_SPLIT"`
-	ProxyBucketOnPath   bool          `envconfig:"PROXY_BUCKET_ON_PATH"`
-	ClientConfig        ClientConfig
+	Listen                 string        `default:":8080"`
+	BucketName             string        `envconfig:"BUCKET_NAME" required:"true"`
+	CandidateBucketName    string        `envconfig:"CANDIDATE_BUCKET_NAME"`
+	CanaryBucketName       string        `envconfig:"CANARY_BUCKET_NAME"`
+	CanaryPercent          float64       `envconfig:"CANARY_PERCENT"`
+	BillingProject         string        `envconfig:"BILLING_PROJECT"`
+	HostBuckets            HostMap       `envconfig:"HOST_BUCKETS"`
+	LogLevel               string        `envconfig:"LOG_LEVEL" default:"debug"`
+	LogLevels              LevelMap      `envconfig:"LOG_LEVELS"`
+	LogFormat              string        `envconfig:"LOG_FORMAT" default:"text"`
+	LogProject             string        `envconfig:"LOG_PROJECT"`
+	AccessLog              bool          `envconfig:"ACCESS_LOG"`
+	AccessLogSampling      int           `envconfig:"ACCESS_LOG_SAMPLING" default:"1"`
+	TrustedProxyHops       int           `envconfig:"TRUSTED_PROXY_HOPS"`
+	SlowRequestThreshold   time.Duration `envconfig:"SLOW_REQUEST_THRESHOLD"`
+	StrictConfig           bool          `envconfig:"STRICT_CONFIG" default:"true"`
+	Routes                 []string      `envconfig:"ROUTES"`
+	TenantHeader           string        `envconfig:"TENANT_HEADER"`
+	RateLimit              float64       `envconfig:"RATE_LIMIT"`
+	RateLimitBurst         int           `envconfig:"RATE_LIMIT_BURST"`
+	ProxyLogHeaders        []string      `envconfig:"PROXY_LOG_HEADERS"`
+	ProxyPrefix            string        `envconfig:"PROXY_PREFIX"`
+	ProxyTimeout           time.Duration `envconfig:"PROXY_TIMEOUT" default:"10s"`
+	ProxyChunkSize         int           `envconfig:"PROXY_CHUNK_SIZE" default:"65536"`
+	ProxyGzip              string        `envconfig:"PROXY_GZIP" default:"passthrough"`
+	MapPrefix              string        `envconfig:"MAP_PREFIX"`
+	MapHLSPrefix           string        `envconfig:"MAP_HLS_PREFIX"`
+	MapDASHPrefix          string        `envconfig:"MAP_DASH_PREFIX"`
+	MapISMPrefix           string        `envconfig:"MAP_ISM_PREFIX"`
+	MapTemplatePrefix      string        `envconfig:"MAP_TEMPLATE_PREFIX"`
+	MapTemplate            string        `envconfig:"MAP_TEMPLATE"`
+	MapTemplateContentType string        `envconfig:"MAP_TEMPLATE_CONTENT_TYPE" default:"application/json"`
+	MetaPrefix             string        `envconfig:"META_PREFIX"`
+	RedirectPrefix         string        `envconfig:"REDIRECT_PREFIX"`
+	SignPrefix             string        `envconfig:"SIGN_PREFIX"`
+	SignCookiePrefix       string        `envconfig:"SIGN_COOKIE_PREFIX"`
+	Signer                 string        `envconfig:"SIGNER" default:"gcs"`
+	ListPrefix             string        `envconfig:"LIST_PREFIX"`
+	UploadPrefix           string        `envconfig:"UPLOAD_PREFIX"`
+	UploadSessionPrefix    string        `envconfig:"UPLOAD_SESSION_PREFIX"`
+	SignUploadPrefix       string        `envconfig:"SIGN_UPLOAD_PREFIX"`
+	DeletePrefix           string        `envconfig:"DELETE_PREFIX"`
+	DeleteAllowedPrefixes  []string      `envconfig:"DELETE_ALLOWED_PREFIXES"`
+	CopyPrefix             string        `envconfig:"COPY_PREFIX"`
+	ComposePrefix          string        `envconfig:"COMPOSE_PREFIX"`
+	AdminPrefix            string        `envconfig:"ADMIN_PREFIX"`
+	AdminToken             string        `envconfig:"ADMIN_TOKEN"`
+	AdminPprof             bool          `envconfig:"ADMIN_PPROF"`
+	VersionPath            string        `envconfig:"VERSION_PATH"`
+	MetricsPath            string        `envconfig:"METRICS_PATH"`
+	LivenessPath           string        `envconfig:"LIVENESS_PATH"`
+	ReadinessPath          string        `envconfig:"READINESS_PATH"`
+	ReadinessTimeout       time.Duration `envconfig:"READINESS_TIMEOUT" default:"2s"`
+	UploadToken            string        `envconfig:"UPLOAD_TOKEN"`
+	UploadMaxSize          int64         `envconfig:"UPLOAD_MAX_SIZE" default:"104857600"`
+	ExtraResourcesToken    string        `envconfig:"EXTRA_RESOURCES_TOKEN"`
+	MapRegexFilter         string        `envconfig:"MAP_REGEX_FILTER"`
+	MapRegexHDFilter       string        `envconfig:"MAP_REGEX_HD_FILTER"`
+	MapRegexExclude        string        `envconfig:"MAP_REGEX_EXCLUDE"`
+	MapRegexLabel          string        `envconfig:"MAP_REGEX_LABEL"`
+	MapRenditionFilters    TokenMap      `envconfig:"MAP_RENDITION_FILTERS"`
+	MapPrefixFilters       PrefixMap     `envconfig:"MAP_PREFIX_FILTERS"`
+	MapExtraPrefixes       []string      `envconfig:"MAP_EXTRA_PREFIXES"`
+	MapDelimiter           string        `envconfig:"MAP_DELIMITER" default:"/"`
+	MapRecursive           bool          `envconfig:"MAP_RECURSIVE"`
+	MapMaxDepth            int           `envconfig:"MAP_MAX_DEPTH" default:"3"`
+	MapMaxObjects          int           `envconfig:"MAP_MAX_OBJECTS"`
+	MapDedupe              string        `envconfig:"MAP_DEDUPE"`
+	MapSort                string        `envconfig:"MAP_SORT"`
+	MapSortOrder           []string      `envconfig:"MAP_SORT_ORDER"`
+	MapExtensionSplit      bool          `envconfig:"MAP_EXTENSION_SPLIT"`
+	MapTimeout             time.Duration `envconfig:"MAP_TIMEOUT" default:"10s"`
+	Map404OnEmpty          bool          `envconfig:"MAP_404_ON_EMPTY"`
+	MapEmptyStatus         int           `envconfig:"MAP_EMPTY_STATUS" default:"404"`
+	MapClipTypes           ExtensionMap  `envconfig:"MAP_CLIP_TYPES"`
+	MapVerbose             bool          `envconfig:"MAP_VERBOSE"`
+	MapProbeDurations      bool          `envconfig:"MAP_PROBE_DURATIONS"`
+	MapProbeSize           int64         `envconfig:"MAP_PROBE_SIZE" default:"65536"`
+	MapProbeCacheSize      int           `envconfig:"MAP_PROBE_CACHE_SIZE" default:"10000"`
+	MapCacheSize           int           `envconfig:"MAP_CACHE_SIZE"`
+	MapCacheTTL            time.Duration `envconfig:"MAP_CACHE_TTL" default:"1m"`
+	MapCacheNegativeTTL    time.Duration `envconfig:"MAP_CACHE_NEGATIVE_TTL" default:"10s"`
+	MapCacheBackend        string        `envconfig:"MAP_CACHE_BACKEND" default:"memory"`
+	MapCacheRedisAddr      string        `envconfig:"MAP_CACHE_REDIS_ADDR"`
+	MapCacheRedisPassword  string        `envconfig:"MAP_CACHE_REDIS_PASSWORD"`
+	MapCacheRedisKeyPrefix string        `envconfig:"MAP_CACHE_REDIS_KEY_PREFIX" default:"gcs-helper:map:"`
+	ProxyBucketOnPath      bool          `envconfig:"PROXY_BUCKET_ON_PATH"`
+	CacheControl           ExtensionMap  `envconfig:"CACHE_CONTROL"`
+	ContentTypes           ExtensionMap  `envconfig:"CONTENT_TYPES"`
+	Compress               bool          `envconfig:"COMPRESS"`
+	CompressMinSize        int           `envconfig:"COMPRESS_MIN_SIZE" default:"1024"`
+	CompressTypes          []string      `envconfig:"COMPRESS_TYPES" default:"application/json,text/vtt,application/x-subrip,application/vnd.apple.mpegurl,application/dash+xml"`
+	ClientConfig           ClientConfig
+	ServerConfig           ServerConfig
+	TLSConfig              TLSConfig
+	SignConfig             SignConfig
+	CDNConfig              CDNConfig
+	TokenConfig            TokenConfig
+	TraceConfig            TraceConfig
+	AuditConfig            AuditConfig
+	JWTConfig              JWTConfig
+	IAPConfig              IAPConfig
+
+	// reload reloads the configuration of the server, and is nil when
+	// reloading isn't supported (see reloadableHandler).
+	reload func() error
+
+	// setSigningKey replaces the signing key at runtime, and is nil when
+	// it isn't supported, like reload.
+	setSigningKey func(SigningKey) error
+
+	// useCandidate is set when traffic is switched to
+	// GCS_HELPER_CANDIDATE_BUCKET_NAME, and switchBucket switches it at
+	// runtime (see withActiveBucket).
+	useCandidate bool
+	switchBucket func(candidate bool) (bucketStatus, error)
+
+	// routes are the routes listed in GCS_HELPER_ROUTES (see route).
+	routes []route
 }
 
 // ClientConfig contains configuration for the GCS client communication.
 //
 // It contains options related to timeouts and keep-alive connections.
 type ClientConfig struct {
-	Timeout         time.Duration `envconfig:"GCS_CLIENT_TIMEOUT" default:"2s"`
-	IdleConnTimeout time.Duration `envconfig:"GCS_CLIENT_IDLE_CONN_TIMEOUT" default:"120s"`
-	MaxIdleConns    int           `envconfig:"GCS_CLIENT_MAX_IDLE_CONNS" default:"10"`
+	Timeout             time.Duration `envconfig:"GCS_CLIENT_TIMEOUT" default:"2s"`
+	IdleConnTimeout     time.Duration `envconfig:"GCS_CLIENT_IDLE_CONN_TIMEOUT" default:"120s"`
+	MaxIdleConns        int           `envconfig:"GCS_CLIENT_MAX_IDLE_CONNS" default:"10"`
+	DialTimeout         time.Duration `envconfig:"GCS_CLIENT_DIAL_TIMEOUT" default:"30s"`
+	TLSHandshakeTimeout time.Duration `envconfig:"GCS_CLIENT_TLS_HANDSHAKE_TIMEOUT" default:"10s"`
+	Proxy               string        `envconfig:"GCS_CLIENT_PROXY"`
+	CAFile              string        `envconfig:"GCS_CLIENT_CA_FILE"`
+	UserAgent           string        `envconfig:"GCS_CLIENT_USER_AGENT"`
+	QuotaProject        string        `envconfig:"GCS_HELPER_QUOTA_PROJECT"`
+	Endpoint            string        `envconfig:"GCS_HELPER_STORAGE_ENDPOINT"`
+	Anonymous           bool          `envconfig:"GCS_CLIENT_ANONYMOUS"`
+}
+
+// ServerConfig contains the configuration of the HTTP server.
+//
+// It contains options related to timeouts and limits of client connections.
+// Write and read timeouts are disabled by default, as they apply to whole
+// responses and request bodies, which may take long to stream.
+type ServerConfig struct {
+	ReadHeaderTimeout time.Duration `envconfig:"GCS_HELPER_SERVER_READ_HEADER_TIMEOUT" default:"10s"`
+	ReadTimeout       time.Duration `envconfig:"GCS_HELPER_SERVER_READ_TIMEOUT"`
+	WriteTimeout      time.Duration `envconfig:"GCS_HELPER_SERVER_WRITE_TIMEOUT"`
+	IdleTimeout       time.Duration `envconfig:"GCS_HELPER_SERVER_IDLE_TIMEOUT" default:"120s"`
+	MaxHeaderBytes    int           `envconfig:"GCS_HELPER_SERVER_MAX_HEADER_BYTES" default:"1048576"`
+}
+
+// ExtensionMap maps file extensions to configuration values.
+//
+// It's loaded from a comma separated list of extension=value pairs, like
+// ".m3u8=max-age=5,.mp4=max-age=86400". Values may contain commas as long as
+// the following item doesn't start with a dot, so
+// ".mp4=public, max-age=86400" is also valid.
+type ExtensionMap map[string]string
+
+// Decode parses the given value into the map.
+func (m *ExtensionMap) Decode(value string) error {
+	result := make(ExtensionMap)
+	var lastExt string
+	for _, item := range strings.Split(value, ",") {
+		trimmed := strings.TrimSpace(item)
+		if !strings.HasPrefix(trimmed, ".") {
+			if lastExt == "" {
+				return fmt.Errorf("invalid extension map item: %q", item)
+			}
+			result[lastExt] += "," + item
+			continue
+		}
+		parts := strings.SplitN(trimmed, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return fmt.Errorf("invalid extension map item: %q", item)
+		}
+		lastExt = strings.ToLower(parts[0])
+		result[lastExt] = parts[1]
+	}
+	*m = result
+	return nil
+}
+
+// TokenMap maps rendition tokens to regular expressions, in the format
+// "__SD=(240|360)p\.mp4$,__4K=2160p\.mp4$". Tokens must start with "__",
+// and, as in ExtensionMap, values may contain commas as long as the
+// following item doesn't start with a token, so "__SD=\d{3}p\.mp4$" is
+// also valid.
+type TokenMap map[string]string
+
+// Decode parses the given value into the map.
+func (m *TokenMap) Decode(value string) error {
+	result := make(TokenMap)
+	var lastToken string
+	for _, item := range strings.Split(value, ",") {
+		trimmed := strings.TrimSpace(item)
+		if !strings.HasPrefix(trimmed, "__") {
+			if lastToken == "" {
+				return fmt.Errorf("invalid token map item: %q", item)
+			}
+			result[lastToken] += "," + item
+			continue
+		}
+		parts := strings.SplitN(trimmed, "=", 2)
+		if len(parts) != 2 || parts[0] == "__" || parts[1] == "" {
+			return fmt.Errorf("invalid token map item: %q", item)
+		}
+		lastToken = parts[0]
+		result[lastToken] = parts[1]
+	}
+	*m = result
+	return nil
+}
+
+// PrefixMap maps object prefixes to regular expressions, in the format
+// "movies/=\d{3,4}p\.mp4$,trailers/=_trailer\.mp4$". Prefixes must end with
+// "/", and, as in ExtensionMap, values may contain commas as long as the
+// following item doesn't start with a prefix.
+type PrefixMap map[string]string
+
+// Decode parses the given value into the map.
+func (m *PrefixMap) Decode(value string) error {
+	result := make(PrefixMap)
+	var lastPrefix string
+	for _, item := range strings.Split(value, ",") {
+		trimmed := strings.TrimSpace(item)
+		parts := strings.SplitN(trimmed, "=", 2)
+		if len(parts) != 2 || !strings.HasSuffix(parts[0], "/") {
+			if lastPrefix == "" {
+				return fmt.Errorf("invalid prefix map item: %q", item)
+			}
+			result[lastPrefix] += "," + item
+			continue
+		}
+		if parts[1] == "" {
+			return fmt.Errorf("invalid prefix map item: %q", item)
+		}
+		lastPrefix = strings.TrimLeft(parts[0], "/")
+		result[lastPrefix] = parts[1]
+	}
+	*m = result
+	return nil
+}
+
+// lookup returns the value configured for the extension of the given file
+// name.
+func (m ExtensionMap) lookup(name string) (string, bool) {
+	ext := strings.ToLower(path.Ext(name))
+	if ext == "" {
+		return "", false
+	}
+	value, ok := m[ext]
+	return value, ok
+}
+
+// validateLabelRegex checks that the given pattern compiles and defines at
+// least one of the named groups used for labeling sequences.
+func validateLabelRegex(pattern string) error {
+	if pattern == "" {
+		return nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return err
+	}
+	for _, name := range re.SubexpNames() {
+		switch name {
+		case "lang", "language", "label":
+			return nil
+		}
+	}
+	return errors.New(`missing named group "lang", "language" or "label"`)
+}
+
+// renditionFilters returns the filters of the rendition tokens, including
+// the __HD token bound to GCS_HELPER_MAP_REGEX_HD_FILTER, unless overridden
+// in GCS_HELPER_MAP_RENDITION_FILTERS.
+func (c Config) renditionFilters() TokenMap {
+	filters := TokenMap{hdToken: c.MapRegexHDFilter}
+	for token, pattern := range c.MapRenditionFilters {
+		filters[token] = pattern
+	}
+	return filters
 }
 
 func (c Config) logger() *logrus.Logger {
@@ -45,11 +312,351 @@ func (c Config) logger() *logrus.Logger {
 	logger := logrus.New()
 	logger.Out = os.Stdout
 	logger.Level = level
+	switch c.LogFormat {
+	case logFormatJSON:
+		logger.Formatter = &logrus.JSONFormatter{}
+	case logFormatGCP:
+		project := c.LogProject
+		if project == "" {
+			project = c.TraceConfig.CloudProject
+		}
+		logger.Formatter = &cloudLoggingFormatter{project: project}
+	}
 	return logger
 }
 
 func loadConfig() (Config, error) {
+	return loadConfigFrom("", "", nil)
+}
+
+// loadConfigFrom loads the configuration from the environment, the given
+// YAML or TOML file (see readConfigFile), if any, and the variables set by
+// command-line flags (see defineConfigFlags). Flags override the
+// environment, which overrides the values in the file. When envPrefix is
+// set, the environment variables are read from its namespace (see
+// applyEnvPrefix).
+func loadConfigFrom(filename, envPrefix string, flags map[string]string) (Config, error) {
 	var c Config
+	env := make(envOverlay)
+	defer env.restore()
+	if err := applyConfigAliases(env); err != nil {
+		return c, err
+	}
+	if err := applyEnvPrefix(envPrefix, env); err != nil {
+		return c, err
+	}
+	if filename != "" {
+		values, err := readConfigFile(filename)
+		if err != nil {
+			return c, err
+		}
+		if err = applyConfigFile(values, env); err != nil {
+			return c, err
+		}
+	}
+	for name, value := range flags {
+		if err := env.set(name, value); err != nil {
+			return c, err
+		}
+		if err := env.unset(name + "_FILE"); err != nil {
+			return c, err
+		}
+	}
 	err := envconfig.Process("gcs_helper", &c)
+	if err != nil {
+		return c, err
+	}
+	if c.ClientConfig.Endpoint == "" {
+		if host := os.Getenv("STORAGE_EMULATOR_HOST"); host != "" {
+			// like the Google client libraries, requests to the emulator
+			// aren't authenticated.
+			c.ClientConfig.Endpoint = host
+			c.ClientConfig.Anonymous = true
+		}
+	}
+	if c.TraceConfig.OTLPEndpoint == "" {
+		c.TraceConfig.OTLPEndpoint = os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	}
+	err = c.loadSecretFiles()
+	if err != nil {
+		return c, err
+	}
+	if err = c.validate(); err != nil {
+		return c, err
+	}
+	c.SignConfig.parseKeys()
+	c.routes, err = loadRoutes(c)
 	return c, err
 }
+
+// configAliases maps other names accepted for some variables, like the
+// GCS_SIGNER_* names used when the options were proposed, to the variables.
+var configAliases = map[string]string{
+	"GCS_SIGNER_SCHEME":             "GCS_HELPER_SIGN_SCHEME",
+	"GCS_SIGNER_PRIVATE_KEY_SECRET": "GCS_HELPER_SIGN_PRIVATE_KEY_SECRET",
+}
+
+// applyConfigAliases sets the variables in configAliases from their aliases.
+// Setting both names is an error, as their values could differ.
+//
+// GCS_SIGNER_RETURN_ABSOLUTE_URL has no variable, as signed URLs are always
+// absolute, so only disabling it is an error.
+func applyConfigAliases(env envOverlay) error {
+	if value, ok := os.LookupEnv("GCS_SIGNER_RETURN_ABSOLUTE_URL"); ok {
+		if absolute, err := strconv.ParseBool(value); err != nil || !absolute {
+			return fmt.Errorf("invalid GCS_SIGNER_RETURN_ABSOLUTE_URL %q: signed URLs are always absolute (see GCS_HELPER_SIGN_URL_SCHEME and GCS_HELPER_SIGN_URL_HOST)", value)
+		}
+	}
+	for alias, name := range configAliases {
+		value, ok := os.LookupEnv(alias)
+		if !ok {
+			continue
+		}
+		if _, ok = os.LookupEnv(name); ok {
+			return fmt.Errorf("%s and %s can't be used together", alias, name)
+		}
+		if err := env.set(name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadSecretFiles loads sensitive values from the files referenced by the
+// <name>_FILE variables, so secrets mounted as files don't need to be copied
+// into the environment. New sensitive options should be added here (and to
+// redactedConfigVars), along with options that are too long for the
+// environment (like the map template).
+func (c *Config) loadSecretFiles() error {
+	secrets := []struct {
+		name  string
+		value envconfig.Decoder
+	}{
+		{"GCS_HELPER_UPLOAD_TOKEN", (*secretString)(&c.UploadToken)},
+		{"GCS_HELPER_EXTRA_RESOURCES_TOKEN", (*secretString)(&c.ExtraResourcesToken)},
+		{"GCS_HELPER_ADMIN_TOKEN", (*secretString)(&c.AdminToken)},
+		{"GCS_HELPER_SIGN_GOOGLE_ACCESS_ID", (*secretString)(&c.SignConfig.GoogleAccessID)},
+		{"GCS_HELPER_SIGN_PRIVATE_KEY", (*secretString)(&c.SignConfig.PrivateKey)},
+		{"GCS_HELPER_SIGN_KEYS", &c.SignConfig.Keys},
+		{"GCS_HELPER_CDN_KEY", (*secretString)(&c.CDNConfig.Key)},
+		{"GCS_HELPER_TOKEN_KEY", (*secretString)(&c.TokenConfig.Key)},
+		{"GCS_HELPER_MAP_CACHE_REDIS_PASSWORD", (*secretString)(&c.MapCacheRedisPassword)},
+		{"GCS_HELPER_MAP_TEMPLATE", (*secretString)(&c.MapTemplate)},
+	}
+	for _, secret := range secrets {
+		filename := os.Getenv(secret.name + "_FILE")
+		if filename == "" {
+			continue
+		}
+		if os.Getenv(secret.name) != "" {
+			return fmt.Errorf("%s and %s_FILE can't be used together", secret.name, secret.name)
+		}
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return fmt.Errorf("failed to load %s_FILE: %v", secret.name, err)
+		}
+		if err = secret.value.Decode(strings.TrimRight(string(data), "\r\n")); err != nil {
+			return fmt.Errorf("failed to load %s_FILE: %v", secret.name, err)
+		}
+	}
+	return nil
+}
+
+// secretString is a string value loaded by loadSecretFiles.
+type secretString string
+
+func (s *secretString) Decode(value string) error {
+	*s = secretString(value)
+	return nil
+}
+
+// signerEnabled reports whether the signer configured in GCS_HELPER_SIGNER,
+// used by the redirect and sign modes, is properly configured.
+func (c Config) signerEnabled() bool {
+	switch c.Signer {
+	case signerCDN:
+		return c.CDNConfig.enabled()
+	case signerToken:
+		return c.TokenConfig.enabled()
+	}
+	return c.SignConfig.enabled()
+}
+
+func (c Config) signerConfig() string {
+	switch c.Signer {
+	case signerCDN:
+		return "GCS_HELPER_CDN_*"
+	case signerToken:
+		return "GCS_HELPER_TOKEN_*"
+	}
+	return "GCS_HELPER_SIGN_*"
+}
+
+func (c Config) validate() error {
+	if (c.UploadPrefix != "" || c.UploadSessionPrefix != "" || c.SignUploadPrefix != "" || c.DeletePrefix != "" || c.CopyPrefix != "" || c.ComposePrefix != "") && c.UploadToken == "" {
+		return errors.New("upload mode requires GCS_HELPER_UPLOAD_TOKEN")
+	}
+	if c.AdminPrefix != "" && c.AdminToken == "" {
+		return errors.New("admin endpoints require GCS_HELPER_ADMIN_TOKEN")
+	}
+	if c.LogFormat != logFormatText && c.LogFormat != logFormatJSON && c.LogFormat != logFormatGCP {
+		return fmt.Errorf("invalid GCS_HELPER_LOG_FORMAT %q: must be %q, %q or %q", c.LogFormat, logFormatText, logFormatJSON, logFormatGCP)
+	}
+	if c.AccessLogSampling < 0 {
+		return fmt.Errorf("invalid GCS_HELPER_ACCESS_LOG_SAMPLING %d: can't be negative", c.AccessLogSampling)
+	}
+	if c.TrustedProxyHops < 0 {
+		return fmt.Errorf("invalid GCS_HELPER_TRUSTED_PROXY_HOPS %d: can't be negative", c.TrustedProxyHops)
+	}
+	if c.CandidateBucketName != "" && c.CandidateBucketName == c.BucketName {
+		return errors.New("GCS_HELPER_CANDIDATE_BUCKET_NAME must be different from GCS_HELPER_BUCKET_NAME")
+	}
+	if c.CanaryPercent < 0 || c.CanaryPercent > 100 {
+		return fmt.Errorf("invalid GCS_HELPER_CANARY_PERCENT %v: must be between 0 and 100", c.CanaryPercent)
+	}
+	if c.CanaryPercent > 0 && c.CanaryBucketName == "" {
+		return errors.New("GCS_HELPER_CANARY_PERCENT requires GCS_HELPER_CANARY_BUCKET_NAME")
+	}
+	if c.DeletePrefix != "" && len(c.DeleteAllowedPrefixes) == 0 {
+		return errors.New("delete mode requires GCS_HELPER_DELETE_ALLOWED_PREFIXES")
+	}
+	if c.SignUploadPrefix != "" && !c.SignConfig.enabled() {
+		return errors.New("signed uploads require the GCS_HELPER_SIGN_* configuration")
+	}
+	if _, err := regexp.Compile(c.MapRegexFilter); err != nil {
+		return fmt.Errorf("invalid GCS_HELPER_MAP_REGEX_FILTER: %v", err)
+	}
+	if _, err := regexp.Compile(c.MapRegexHDFilter); err != nil {
+		return fmt.Errorf("invalid GCS_HELPER_MAP_REGEX_HD_FILTER: %v", err)
+	}
+	if c.MapDelimiter == "" {
+		return errors.New("GCS_HELPER_MAP_DELIMITER can't be empty, use GCS_HELPER_MAP_RECURSIVE for recursive listings")
+	}
+	if c.MapMaxDepth < 0 {
+		return errors.New("GCS_HELPER_MAP_MAX_DEPTH can't be negative")
+	}
+	if c.MapMaxObjects < 0 {
+		return errors.New("GCS_HELPER_MAP_MAX_OBJECTS can't be negative")
+	}
+	switch c.MapDedupe {
+	case "", mapDedupeFirst, mapDedupeLast:
+	default:
+		return fmt.Errorf("invalid GCS_HELPER_MAP_DEDUPE %q: must be %q or %q", c.MapDedupe, mapDedupeFirst, mapDedupeLast)
+	}
+	switch c.MapSort {
+	case "", mapSortNatural, mapSortResolution:
+	case mapSortCustom:
+		if len(c.MapSortOrder) == 0 {
+			return errors.New("the custom map sort requires GCS_HELPER_MAP_SORT_ORDER")
+		}
+	default:
+		return fmt.Errorf("invalid GCS_HELPER_MAP_SORT %q: must be %q, %q or %q", c.MapSort, mapSortNatural, mapSortResolution, mapSortCustom)
+	}
+	if _, err := regexp.Compile(c.MapRegexExclude); err != nil {
+		return fmt.Errorf("invalid GCS_HELPER_MAP_REGEX_EXCLUDE: %v", err)
+	}
+	for token, pattern := range c.MapRenditionFilters {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("invalid GCS_HELPER_MAP_RENDITION_FILTERS filter for %s: %v", token, err)
+		}
+	}
+	for prefix, pattern := range c.MapPrefixFilters {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("invalid GCS_HELPER_MAP_PREFIX_FILTERS filter for %s: %v", prefix, err)
+		}
+	}
+	if err := validateLabelRegex(c.MapRegexLabel); err != nil {
+		return fmt.Errorf("invalid GCS_HELPER_MAP_REGEX_LABEL: %v", err)
+	}
+	if c.MapCacheBackend != mapCacheMemory && c.MapCacheBackend != mapCacheRedis {
+		return fmt.Errorf("invalid GCS_HELPER_MAP_CACHE_BACKEND %q: must be %q or %q", c.MapCacheBackend, mapCacheMemory, mapCacheRedis)
+	}
+	if c.MapCacheBackend == mapCacheRedis && c.MapCacheRedisAddr == "" {
+		return errors.New("the redis mapping cache requires GCS_HELPER_MAP_CACHE_REDIS_ADDR")
+	}
+	if c.MapCacheSize < 0 || ((c.MapCacheSize > 0 || c.MapCacheBackend == mapCacheRedis) && c.MapCacheTTL <= 0) {
+		return errors.New("GCS_HELPER_MAP_CACHE_SIZE can't be negative, and GCS_HELPER_MAP_CACHE_TTL must be positive when caching is enabled")
+	}
+	if c.Map404OnEmpty && (c.MapEmptyStatus < 400 || c.MapEmptyStatus > 599) {
+		return fmt.Errorf("invalid GCS_HELPER_MAP_EMPTY_STATUS %d: must be an HTTP error status", c.MapEmptyStatus)
+	}
+	if c.MapProbeDurations && c.MapProbeSize < 16 {
+		return fmt.Errorf("invalid GCS_HELPER_MAP_PROBE_SIZE %d: must be at least 16 bytes", c.MapProbeSize)
+	}
+	if c.MapCacheNegativeTTL < 0 {
+		return errors.New("GCS_HELPER_MAP_CACHE_NEGATIVE_TTL can't be negative")
+	}
+	if _, err := c.ClientConfig.endpointURL(); err != nil {
+		return fmt.Errorf("invalid GCS_HELPER_STORAGE_ENDPOINT (or STORAGE_EMULATOR_HOST): %v", err)
+	}
+	if _, err := c.ClientConfig.proxyFunc(); err != nil {
+		return fmt.Errorf("invalid GCS_CLIENT_PROXY: %v", err)
+	}
+	if _, err := c.ClientConfig.rootCAs(); err != nil {
+		return fmt.Errorf("invalid GCS_CLIENT_CA_FILE: %v", err)
+	}
+	if c.ServerConfig.ReadHeaderTimeout < 0 || c.ServerConfig.ReadTimeout < 0 || c.ServerConfig.WriteTimeout < 0 || c.ServerConfig.IdleTimeout < 0 || c.ServerConfig.MaxHeaderBytes < 0 {
+		return errors.New("the GCS_HELPER_SERVER_* timeouts and limits can't be negative")
+	}
+	if c.RateLimit < 0 || c.RateLimitBurst < 0 {
+		return errors.New("GCS_HELPER_RATE_LIMIT and GCS_HELPER_RATE_LIMIT_BURST can't be negative")
+	}
+	if c.TenantHeader != "" && len(c.Routes) == 0 {
+		return errors.New("GCS_HELPER_TENANT_HEADER requires GCS_HELPER_ROUTES")
+	}
+	if c.ProxyGzip != gzipPassthrough && c.ProxyGzip != gzipDecompress {
+		return fmt.Errorf("invalid GCS_HELPER_PROXY_GZIP %q: must be %q or %q", c.ProxyGzip, gzipPassthrough, gzipDecompress)
+	}
+	if c.Signer != signerGCS && c.Signer != signerCDN && c.Signer != signerToken {
+		return fmt.Errorf("invalid GCS_HELPER_SIGNER %q: must be %q, %q or %q", c.Signer, signerGCS, signerCDN, signerToken)
+	}
+	if c.RedirectPrefix != "" && !c.signerEnabled() {
+		return fmt.Errorf("redirect mode requires the %s configuration", c.signerConfig())
+	}
+	if c.SignPrefix != "" && !c.signerEnabled() {
+		return fmt.Errorf("sign mode requires the %s configuration", c.signerConfig())
+	}
+	if c.MapHLSPrefix != "" && !c.signerEnabled() {
+		return fmt.Errorf("hls map output requires the %s configuration", c.signerConfig())
+	}
+	if c.MapDASHPrefix != "" && !c.signerEnabled() {
+		return fmt.Errorf("dash map output requires the %s configuration", c.signerConfig())
+	}
+	if c.MapISMPrefix != "" && !c.signerEnabled() {
+		return fmt.Errorf("ism map output requires the %s configuration", c.signerConfig())
+	}
+	if c.MapTemplatePrefix != "" && c.MapTemplate == "" {
+		return errors.New("template map output requires GCS_HELPER_MAP_TEMPLATE")
+	}
+	if _, err := parseMapTemplate(c); err != nil {
+		return fmt.Errorf("invalid GCS_HELPER_MAP_TEMPLATE: %v", err)
+	}
+	if c.SignCookiePrefix != "" && !c.CDNConfig.enabled() {
+		return errors.New("signed cookies require GCS_HELPER_CDN_URL_PREFIX, GCS_HELPER_CDN_KEY_NAME and GCS_HELPER_CDN_KEY")
+	}
+	if err := c.CDNConfig.validate(); err != nil {
+		return err
+	}
+	if err := c.TokenConfig.validate(); err != nil {
+		return err
+	}
+	if err := c.TraceConfig.validate(); err != nil {
+		return err
+	}
+	if err := c.AuditConfig.validate(); err != nil {
+		return err
+	}
+	if err := c.TLSConfig.validate(); err != nil {
+		return err
+	}
+	if err := c.JWTConfig.validate(); err != nil {
+		return err
+	}
+	if err := c.IAPConfig.validate(); err != nil {
+		return err
+	}
+	if err := c.SignConfig.validate(); err != nil {
+		return err
+	}
+	return c.validateStrict()
+}
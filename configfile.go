@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/kelseyhightower/envconfig"
+)
+
+// readConfigFile reads the configuration file passed with -config. The
+// format is picked by the extension of the file: .yaml and .yml files are
+// parsed as YAML, and .toml files as TOML. Only a subset of both languages is
+// supported: strings, numbers, booleans, lists and nested sections.
+//
+// Keys are the names of the environment variables, without the GCS_HELPER_
+// prefix and case-insensitive, with sections joined by "_", so
+//
+//	map:
+//	  regex_filter: \d{3,4}p\.mp4$
+//
+// sets GCS_HELPER_MAP_REGEX_FILTER. Lists are joined with commas, as in the
+// environment.
+func readConfigFile(filename string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var values map[string]string
+	switch ext := strings.ToLower(filepath.Ext(filename)); ext {
+	case ".yaml", ".yml":
+		values, err = parseYAMLConfig(string(data))
+	case ".toml":
+		values, err = parseTOMLConfig(string(data))
+	default:
+		return nil, fmt.Errorf("unsupported configuration file format %q", ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	return values, nil
+}
+
+// applyConfigFile sets the environment variables configured in the file that
+// aren't set in the environment, so the environment overrides the file.
+func applyConfigFile(values map[string]string, env envOverlay) error {
+	vars, err := configVars()
+	if err != nil {
+		return err
+	}
+	names := make(map[string]bool, len(vars))
+	for _, v := range vars {
+		names[v.name] = true
+	}
+	for key, value := range values {
+		name, ok := resolveConfigKey(names, key)
+		if !ok {
+			return fmt.Errorf("unknown configuration key %q", strings.ToLower(key))
+		}
+		base := strings.TrimSuffix(name, "_FILE")
+		if _, ok := os.LookupEnv(base); ok {
+			continue
+		}
+		if _, ok := os.LookupEnv(base + "_FILE"); ok {
+			continue
+		}
+		if err := env.set(name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// configVar is an environment variable read by loadConfig.
+type configVar struct {
+	// name is the name of the variable, as documented in the README.
+	name   string
+	isBool bool
+}
+
+// configVars returns the environment variables read by loadConfig.
+func configVars() ([]configVar, error) {
+	var buf bytes.Buffer
+	format := "{{range .}}{{.Key}}\t{{.Alt}}\t{{.Field.Kind}}\n{{end}}"
+	if err := envconfig.Usagef("gcs_helper", &Config{}, &buf, format); err != nil {
+		return nil, err
+	}
+	var vars []configVar
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 3 {
+			continue
+		}
+		v := configVar{name: fields[0], isBool: fields[2] == "bool"}
+		// variables of the nested configs use the full name as their
+		// alternative name.
+		if strings.HasPrefix(fields[1], "GCS_") {
+			v.name = fields[1]
+		}
+		vars = append(vars, v)
+	}
+	return vars, nil
+}
+
+// envOverlay holds the previous values of the environment variables set
+// while loading the configuration from a file or flags, so the environment
+// can be restored afterwards. Variables that weren't set map to nil.
+type envOverlay map[string]*string
+
+func (o envOverlay) save(name string) {
+	if _, ok := o[name]; ok {
+		return
+	}
+	if value, ok := os.LookupEnv(name); ok {
+		o[name] = &value
+	} else {
+		o[name] = nil
+	}
+}
+
+func (o envOverlay) set(name, value string) error {
+	o.save(name)
+	return os.Setenv(name, value)
+}
+
+func (o envOverlay) unset(name string) error {
+	o.save(name)
+	return os.Unsetenv(name)
+}
+
+func (o envOverlay) restore() {
+	for name, value := range o {
+		if value == nil {
+			os.Unsetenv(name)
+		} else {
+			os.Setenv(name, *value)
+		}
+	}
+}
+
+func resolveConfigKey(names map[string]bool, key string) (string, bool) {
+	key = strings.ToUpper(strings.Replace(key, "-", "_", -1))
+	for _, name := range []string{"GCS_HELPER_" + key, key} {
+		if names[name] || names[strings.TrimSuffix(name, "_FILE")] || isRouteConfigVar(names, name) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+type configSection struct {
+	indent int
+	key    string
+}
+
+func parseYAMLConfig(data string) (map[string]string, error) {
+	values := make(map[string]string)
+	lists := make(map[string][]string)
+	var sections []configSection
+	lines := strings.Split(strings.Replace(data, "\r\n", "\n", -1), "\n")
+	for i := 0; i < len(lines); i++ {
+		lineno := i + 1
+		line := strings.TrimRight(stripConfigComment(lines[i]), " ")
+		content := strings.TrimLeft(line, " ")
+		if content == "" || line == "---" {
+			continue
+		}
+		if strings.HasPrefix(content, "\t") {
+			return nil, fmt.Errorf("line %d: tabs can't be used for indentation", lineno)
+		}
+		indent := len(line) - len(content)
+		if content == "-" || strings.HasPrefix(content, "- ") {
+			for len(sections) > 0 && sections[len(sections)-1].indent > indent {
+				sections = sections[:len(sections)-1]
+			}
+			if len(sections) == 0 {
+				return nil, fmt.Errorf("line %d: list item without a key", lineno)
+			}
+			item, err := parseConfigScalar(strings.TrimSpace(content[1:]))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineno, err)
+			}
+			key := sections[len(sections)-1].key
+			lists[key] = append(lists[key], item)
+			continue
+		}
+		for len(sections) > 0 && sections[len(sections)-1].indent >= indent {
+			sections = sections[:len(sections)-1]
+		}
+		colon := strings.Index(content, ":")
+		if colon <= 0 || (colon+1 < len(content) && content[colon+1] != ' ') {
+			return nil, fmt.Errorf("line %d: expected \"key: value\"", lineno)
+		}
+		key := strings.TrimSpace(content[:colon])
+		if len(sections) > 0 {
+			key = sections[len(sections)-1].key + "_" + key
+		}
+		raw := strings.TrimSpace(content[colon+1:])
+		switch raw {
+		case "":
+			sections = append(sections, configSection{indent: indent, key: key})
+			continue
+		case "|", "|-":
+			var block []string
+			for i+1 < len(lines) {
+				next := strings.TrimRight(lines[i+1], " \r")
+				if next != "" && len(next)-len(strings.TrimLeft(next, " ")) <= indent {
+					break
+				}
+				block = append(block, next)
+				i++
+			}
+			values[key] = yamlBlock(block, raw == "|")
+			continue
+		}
+		value, err := parseConfigScalar(raw)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineno, err)
+		}
+		values[key] = value
+	}
+	for key, items := range lists {
+		values[key] = strings.Join(items, ",")
+	}
+	return values, nil
+}
+
+// yamlBlock returns the content of a literal block scalar, removing the
+// indentation of its first line.
+func yamlBlock(lines []string, keepNewline bool) string {
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+	indent := len(lines[0]) - len(strings.TrimLeft(lines[0], " "))
+	for i, line := range lines {
+		if len(line) >= indent {
+			lines[i] = line[indent:]
+		} else {
+			lines[i] = strings.TrimLeft(line, " ")
+		}
+	}
+	block := strings.Join(lines, "\n")
+	if keepNewline {
+		block += "\n"
+	}
+	return block
+}
+
+func parseTOMLConfig(data string) (map[string]string, error) {
+	values := make(map[string]string)
+	var section string
+	lines := strings.Split(strings.Replace(data, "\r\n", "\n", -1), "\n")
+	for i := 0; i < len(lines); i++ {
+		lineno := i + 1
+		line := strings.TrimSpace(stripConfigComment(lines[i]))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[[") {
+			return nil, fmt.Errorf("line %d: arrays of tables aren't supported", lineno)
+		}
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("line %d: invalid table header", lineno)
+			}
+			section = tomlKey(line[1 : len(line)-1])
+			continue
+		}
+		eq := strings.Index(line, "=")
+		if eq <= 0 {
+			return nil, fmt.Errorf("line %d: expected \"key = value\"", lineno)
+		}
+		key := tomlKey(line[:eq])
+		if section != "" {
+			key = section + "_" + key
+		}
+		raw := strings.TrimSpace(line[eq+1:])
+		var value string
+		var err error
+		if strings.HasPrefix(raw, `"""`) || strings.HasPrefix(raw, "'''") {
+			// multi-line strings are read from the original lines, as
+			// their content can't hold comments.
+			original := strings.TrimSpace(lines[i])
+			value, i, err = tomlMultiline(strings.TrimSpace(original[strings.Index(original, "=")+1:]), lines, i)
+		} else {
+			value, err = parseConfigScalar(raw)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineno, err)
+		}
+		values[key] = value
+	}
+	return values, nil
+}
+
+// tomlMultiline parses the multi-line string starting with raw, on the line
+// with the given index, returning the string and the index of its last line.
+func tomlMultiline(raw string, lines []string, i int) (string, int, error) {
+	delim := raw[:3]
+	content := raw[3:]
+	for !strings.Contains(content, delim) && i+1 < len(lines) {
+		i++
+		content += "\n" + strings.TrimRight(lines[i], "\r")
+	}
+	end := strings.Index(content, delim)
+	if end < 0 {
+		return "", i, errors.New("unterminated string")
+	}
+	// a newline right after the opening delimiter is trimmed.
+	content = strings.TrimPrefix(content[:end], "\n")
+	if delim == "'''" {
+		return content, i, nil
+	}
+	value, err := unescapeConfigString(content)
+	return value, i, err
+}
+
+func tomlKey(key string) string {
+	key = strings.TrimSpace(key)
+	parts := strings.Split(key, ".")
+	for i, part := range parts {
+		parts[i] = strings.Trim(strings.TrimSpace(part), `"`)
+	}
+	return strings.Join(parts, "_")
+}
+
+// parseConfigScalar parses a single-line value, shared by both formats:
+// double-quoted strings with escapes, single-quoted literal strings, inline
+// lists and plain values.
+func parseConfigScalar(raw string) (string, error) {
+	switch {
+	case strings.HasPrefix(raw, `"`):
+		if len(raw) < 2 || !strings.HasSuffix(raw, `"`) {
+			return "", errors.New("unterminated string")
+		}
+		return unescapeConfigString(raw[1 : len(raw)-1])
+	case strings.HasPrefix(raw, "'"):
+		if len(raw) < 2 || !strings.HasSuffix(raw, "'") {
+			return "", errors.New("unterminated string")
+		}
+		return strings.Replace(raw[1:len(raw)-1], "''", "'", -1), nil
+	case strings.HasPrefix(raw, "["):
+		if !strings.HasSuffix(raw, "]") {
+			return "", errors.New("unterminated list")
+		}
+		var items []string
+		for _, item := range splitConfigList(raw[1 : len(raw)-1]) {
+			value, err := parseConfigScalar(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, value)
+		}
+		return strings.Join(items, ","), nil
+	case strings.HasPrefix(raw, "{"):
+		return "", errors.New("inline tables aren't supported")
+	}
+	return raw, nil
+}
+
+func unescapeConfigString(s string) (string, error) {
+	var buf strings.Builder
+	for len(s) > 0 {
+		if s[0] == '"' {
+			buf.WriteByte('"')
+			s = s[1:]
+			continue
+		}
+		r, _, tail, err := strconv.UnquoteChar(s, '"')
+		if err != nil {
+			return "", fmt.Errorf("invalid escape sequence in %q", s)
+		}
+		buf.WriteRune(r)
+		s = tail
+	}
+	return buf.String(), nil
+}
+
+// splitConfigList splits the items of an inline list on the commas that
+// aren't quoted.
+func splitConfigList(s string) []string {
+	var items []string
+	var quote byte
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ',':
+			items = append(items, strings.TrimSpace(s[start:i]))
+			start = i + 1
+		}
+	}
+	if last := strings.TrimSpace(s[start:]); last != "" {
+		items = append(items, last)
+	}
+	return items
+}
+
+// stripConfigComment removes the comment from the line, if any. Comments
+// start with a "#" at the beginning of the line or after a space, outside
+// of quoted strings (quotes only start a string at the beginning of a
+// value, so apostrophes in plain values are ignored).
+func stripConfigComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case (c == '"' || c == '\'') && (i == 0 || strings.IndexByte(" \t[,:=", line[i-1]) >= 0):
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
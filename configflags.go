@@ -0,0 +1,77 @@
+package main
+
+import (
+	"flag"
+	"strings"
+)
+
+// configFlag is a command-line flag that sets a configuration variable.
+type configFlag struct {
+	value  string
+	isBool bool
+}
+
+func (f *configFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.value
+}
+
+func (f *configFlag) Set(value string) error {
+	f.value = value
+	return nil
+}
+
+func (f *configFlag) IsBoolFlag() bool {
+	return f.isBool
+}
+
+// configFlagName returns the name of the flag that sets the given variable:
+// the name of the variable without the GCS_HELPER_ prefix, in lower case and
+// with dashes (e.g. -bucket-name for GCS_HELPER_BUCKET_NAME).
+func configFlagName(name string) string {
+	name = strings.TrimPrefix(name, "GCS_HELPER_")
+	return strings.ToLower(strings.Replace(name, "_", "-", -1))
+}
+
+// defineLoadFlags defines -config, -env-prefix and the configuration flags
+// in the flag set. The returned function, called after the flags are parsed,
+// loads the configuration with loadConfigFrom.
+func defineLoadFlags(fs *flag.FlagSet) (func() (Config, error), error) {
+	configFile := fs.String("config", "", "path to a YAML or TOML configuration file, overridden by the environment")
+	envPrefix := fs.String("env-prefix", "", "prefix of the environment variables, replacing GCS_HELPER (e.g. MY_BUCKET for MY_BUCKET_BUCKET_NAME)")
+	configFlags, err := defineConfigFlags(fs)
+	if err != nil {
+		return nil, err
+	}
+	return func() (Config, error) {
+		return loadConfigFrom(*configFile, *envPrefix, configFlags())
+	}, nil
+}
+
+// defineConfigFlags defines a flag for each configuration variable in the
+// flag set. The returned function, called after the flags are parsed,
+// returns the values of the variables set with flags, to be passed to
+// loadConfigFrom.
+func defineConfigFlags(fs *flag.FlagSet) (func() map[string]string, error) {
+	vars, err := configVars()
+	if err != nil {
+		return nil, err
+	}
+	flags := make(map[string]string, len(vars))
+	for _, v := range vars {
+		name := configFlagName(v.name)
+		fs.Var(&configFlag{isBool: v.isBool}, name, "sets "+v.name)
+		flags[name] = v.name
+	}
+	return func() map[string]string {
+		values := make(map[string]string)
+		fs.Visit(func(f *flag.Flag) {
+			if name, ok := flags[f.Name]; ok {
+				values[name] = f.Value.String()
+			}
+		})
+		return values
+	}, nil
+}
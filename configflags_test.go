@@ -0,0 +1,135 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDefineConfigFlags(t *testing.T) {
+	fs := flag.NewFlagSet("gcs-helper", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	configFlags, err := defineConfigFlags(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fs.Parse([]string{
+		"-bucket-name", "flag-bucket",
+		"-map-verbose",
+		"-gcs-client-timeout", "5s",
+		"-sign-expiration=2h",
+		"-map-extra-prefixes", "subtitles/,audio/",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"GCS_HELPER_BUCKET_NAME":        "flag-bucket",
+		"GCS_HELPER_MAP_VERBOSE":        "true",
+		"GCS_CLIENT_TIMEOUT":            "5s",
+		"GCS_HELPER_SIGN_EXPIRATION":    "2h",
+		"GCS_HELPER_MAP_EXTRA_PREFIXES": "subtitles/,audio/",
+	}
+	values := configFlags()
+	if !cmp.Equal(values, expected) {
+		t.Errorf("wrong values\n%s", cmp.Diff(values, expected))
+	}
+}
+
+func TestDefineConfigFlagsUnknownFlag(t *testing.T) {
+	fs := flag.NewFlagSet("gcs-helper", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	if _, err := defineConfigFlags(fs); err != nil {
+		t.Fatal(err)
+	}
+	err := fs.Parse([]string{"-bucket-nmae", "typo"})
+	if err == nil || err.Error() != "flag provided but not defined: -bucket-nmae" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestLoadConfigFromFlags(t *testing.T) {
+	filename, cleanup := writeConfigFile(t, "config.yaml", `
+bucket_name: file-bucket
+listen: ":8081"
+log_level: info
+`)
+	defer cleanup()
+	setEnvs(map[string]string{
+		"GCS_HELPER_BUCKET_NAME": "env-bucket",
+		"GCS_HELPER_LOG_LEVEL":   "warn",
+	})
+	config, err := loadConfigFrom(filename, "", map[string]string{
+		"GCS_HELPER_LOG_LEVEL":   "error",
+		"GCS_HELPER_MAP_VERBOSE": "true",
+		"GCS_CLIENT_TIMEOUT":     "5s",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Listen != ":8081" {
+		t.Errorf("wrong listen address\nwant %q\ngot  %q", ":8081", config.Listen)
+	}
+	if config.BucketName != "env-bucket" {
+		t.Errorf("wrong bucket name\nwant %q\ngot  %q", "env-bucket", config.BucketName)
+	}
+	if config.LogLevel != "error" {
+		t.Errorf("flags should override the environment\nwant %q\ngot  %q", "error", config.LogLevel)
+	}
+	if !config.MapVerbose {
+		t.Error("map verbose should be enabled")
+	}
+	if config.ClientConfig.Timeout != 5*time.Second {
+		t.Errorf("wrong client timeout\nwant 5s\ngot  %s", config.ClientConfig.Timeout)
+	}
+	if value := os.Getenv("GCS_HELPER_LOG_LEVEL"); value != "warn" {
+		t.Errorf("the environment should be restored\nwant GCS_HELPER_LOG_LEVEL=%q\ngot  GCS_HELPER_LOG_LEVEL=%q", "warn", value)
+	}
+	if value, ok := os.LookupEnv("GCS_HELPER_MAP_VERBOSE"); ok {
+		t.Errorf("the environment should be restored, got GCS_HELPER_MAP_VERBOSE=%q", value)
+	}
+}
+
+func TestLoadConfigFromFlagsOverridesSecretFile(t *testing.T) {
+	setEnvs(map[string]string{
+		"GCS_HELPER_BUCKET_NAME":       "some-bucket",
+		"GCS_HELPER_UPLOAD_TOKEN_FILE": "/does/not/exist",
+	})
+	config, err := loadConfigFrom("", "", map[string]string{"GCS_HELPER_UPLOAD_TOKEN": "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.UploadToken != "secret" {
+		t.Errorf("wrong upload token\nwant %q\ngot  %q", "secret", config.UploadToken)
+	}
+	if value := os.Getenv("GCS_HELPER_UPLOAD_TOKEN_FILE"); value != "/does/not/exist" {
+		t.Errorf("the environment should be restored, got GCS_HELPER_UPLOAD_TOKEN_FILE=%q", value)
+	}
+}
+
+func TestDefineLoadFlagsEnvPrefix(t *testing.T) {
+	setEnvs(map[string]string{
+		"GCS_HELPER_BUCKET_NAME": "default-bucket",
+		"MY_BUCKET_BUCKET_NAME":  "my-bucket",
+	})
+	fs := flag.NewFlagSet("gcs-helper", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	load, err := defineLoadFlags(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = fs.Parse([]string{"-env-prefix", "my_bucket"}); err != nil {
+		t.Fatal(err)
+	}
+	config, err := load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.BucketName != "my-bucket" {
+		t.Errorf("wrong bucket name\nwant %q\ngot  %q", "my-bucket", config.BucketName)
+	}
+}
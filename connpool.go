@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// gcsConnPool tracks the connections of the transport used for accessing GCS
+// (see httpClient), so the pool can be tuned with GCS_CLIENT_MAX_IDLE_CONNS.
+var gcsConnPool = newConnPool()
+
+// connPool counts the open connections of a transport, and the ones being
+// used by requests. With HTTP/2, a connection is used by several requests
+// at once, so it's active until all of them are done.
+type connPool struct {
+	mu     sync.Mutex
+	open   int
+	active map[net.Conn]int
+}
+
+func newConnPool() *connPool {
+	return &connPool{active: make(map[net.Conn]int)}
+}
+
+// dialContext wraps the given dial function, counting the connections it
+// opens until they're closed.
+func (p *connPool) dialContext(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		p.mu.Lock()
+		p.open++
+		p.mu.Unlock()
+		return &pooledConn{Conn: conn, pool: p}, nil
+	}
+}
+
+// acquire marks the given connection as used by a request, until the
+// returned function is called.
+func (p *connPool) acquire(conn net.Conn) (release func()) {
+	p.mu.Lock()
+	p.active[conn]++
+	p.mu.Unlock()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			if p.active[conn]--; p.active[conn] <= 0 {
+				delete(p.active, conn)
+			}
+		})
+	}
+}
+
+// counts returns the number of connections being used by requests, and the
+// number of idle connections.
+func (p *connPool) counts() (active, idle int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	active = len(p.active)
+	if idle = p.open - active; idle < 0 {
+		idle = 0
+	}
+	return active, idle
+}
+
+func (p *connPool) write(w io.Writer) {
+	active, idle := p.counts()
+	fmt.Fprintf(w, "# HELP gcs_helper_gcs_connections Number of open connections to GCS, by state.\n# TYPE gcs_helper_gcs_connections gauge\n")
+	fmt.Fprintf(w, "gcs_helper_gcs_connections{state=\"active\"} %d\ngcs_helper_gcs_connections{state=\"idle\"} %d\n", active, idle)
+}
+
+type pooledConn struct {
+	net.Conn
+	pool *connPool
+	once sync.Once
+}
+
+func (c *pooledConn) Close() error {
+	c.once.Do(func() {
+		c.pool.mu.Lock()
+		c.pool.open--
+		c.pool.mu.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+// releaseBody is a response body that releases its connection (see
+// connPool.acquire) when it's closed.
+type releaseBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releaseBody) Close() error {
+	b.release()
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestConnPool(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("some content"))
+	}))
+	defer server.Close()
+	transport := &http.Transport{DialContext: gcsConnPool.dialContext((&net.Dialer{}).DialContext)}
+	client := http.Client{Transport: &gcsMetricsTransport{RoundTripper: transport}}
+	activeBefore, idleBefore := gcsConnPool.counts()
+	reusedBefore := gcsConnections.value("true")
+
+	checkCounts := func(step string, expectedActive, expectedIdle int) {
+		t.Helper()
+		active, idle := gcsConnPool.counts()
+		if active-activeBefore != expectedActive || idle-idleBefore != expectedIdle {
+			t.Errorf("%s: wrong connections\nwant %d active and %d idle\ngot  %d active and %d idle", step, expectedActive, expectedIdle, active-activeBefore, idle-idleBefore)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(server.URL + "/my-bucket/video.mp4")
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkCounts("reading the response", 1, 0)
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		checkCounts("after the response", 0, 1)
+	}
+	if got := gcsConnections.value("true") - reusedBefore; got != 1 {
+		t.Errorf("wrong number of reused connections\nwant 1\ngot  %v", got)
+	}
+	transport.CloseIdleConnections()
+	checkCounts("after closing idle connections", 0, 0)
+}
+
+func TestConnPoolWrite(t *testing.T) {
+	pool := newConnPool()
+	pool.open = 3
+	pool.acquire(&net.TCPConn{})
+	var buf bytes.Buffer
+	pool.write(&buf)
+	for _, expected := range []string{
+		"# TYPE gcs_helper_gcs_connections gauge\n",
+		`gcs_helper_gcs_connections{state="active"} 1` + "\n",
+		`gcs_helper_gcs_connections{state="idle"} 2` + "\n",
+	} {
+		if !strings.Contains(buf.String(), expected) {
+			t.Errorf("missing %q in metrics:\n%s", expected, buf.String())
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+// getCopyHandler returns a handler that performs server-side copies of
+// objects. The source object is referenced by the request path and the
+// destination by the "destination" query string parameter. When "move=true"
+// is provided, the source object is deleted after the copy, which requires
+// the source to be under one of GCS_HELPER_DELETE_ALLOWED_PREFIXES.
+func getCopyHandler(c Config, client *storage.Client) http.HandlerFunc {
+	logger := c.logger()
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !authorized(r, c.UploadToken) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		srcBucket, srcName, err := objectLocation(&c, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		query := r.URL.Query()
+		dstName := strings.TrimLeft(query.Get("destination"), "/")
+		if srcName == "" || dstName == "" {
+			http.Error(w, "source and destination are required", http.StatusBadRequest)
+			return
+		}
+		dstBucket := srcBucket
+		if bucket := query.Get("destinationBucket"); bucket != "" {
+			if !c.ProxyBucketOnPath {
+				http.Error(w, "destinationBucket requires GCS_HELPER_PROXY_BUCKET_ON_PATH", http.StatusBadRequest)
+				return
+			}
+			dstBucket = bucket
+		}
+		if dstBucket == srcBucket && dstName == srcName {
+			http.Error(w, "source and destination must be different", http.StatusBadRequest)
+			return
+		}
+		move := query.Get("move") == "true"
+		if move && !deleteAllowed(c.DeleteAllowedPrefixes, srcName) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), c.ProxyTimeout)
+		defer cancel()
+		src := bucketHandle(&c, client, srcBucket).Object(srcName)
+		dst := bucketHandle(&c, client, dstBucket).Object(dstName)
+		attrs, err := dst.CopierFrom(src).Run(ctx)
+		if err == nil && move {
+			err = src.Delete(ctx)
+		}
+		if err != nil {
+			if objectNotFound(err) {
+				http.Error(w, storage.ErrObjectNotExist.Error(), http.StatusNotFound)
+				return
+			}
+			requestLogger(r.Context(), logger).WithError(err).WithField("url", r.URL.RequestURI()).Error("failed to copy object")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(newObjectMetadata(&c, attrs))
+	}
+}
+
+// objectNotFound reports whether the given error indicates that an object
+// (or its bucket) doesn't exist.
+func objectNotFound(err error) bool {
+	if err == storage.ErrObjectNotExist || err == storage.ErrBucketNotExist {
+		return true
+	}
+	if apiErr, ok := err.(*googleapi.Error); ok {
+		return apiErr.Code == http.StatusNotFound
+	}
+	return false
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+func TestServerCopyHandlerValidation(t *testing.T) {
+	addr, cleanup := startServer(t, Config{
+		BucketName:            "my-bucket",
+		CopyPrefix:            "/copy/",
+		DeleteAllowedPrefixes: []string{"musics/music/"},
+		UploadToken:           "secret",
+		ProxyTimeout:          time.Second,
+	})
+	defer cleanup()
+	auth := http.Header{"Authorization": []string{"Bearer secret"}}
+	var tests = []serverTest{
+		{
+			testCase:       "missing destination",
+			method:         http.MethodPost,
+			addr:           addr + "/copy/musics/music/music1.txt",
+			reqHeader:      auth,
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   "source and destination are required\n",
+		},
+		{
+			testCase:       "same source and destination",
+			method:         http.MethodPost,
+			addr:           addr + "/copy/musics/music/music1.txt?destination=musics/music/music1.txt",
+			reqHeader:      auth,
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   "source and destination must be different\n",
+		},
+		{
+			testCase:       "destination bucket without bucket on path",
+			method:         http.MethodPost,
+			addr:           addr + "/copy/musics/music/music1.txt?destination=music1.txt&destinationBucket=your-bucket",
+			reqHeader:      auth,
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   "destinationBucket requires GCS_HELPER_PROXY_BUCKET_ON_PATH\n",
+		},
+		{
+			testCase:       "move outside allowed prefixes",
+			method:         http.MethodPost,
+			addr:           addr + "/copy/videos/video/video1_720p.mp4?destination=videos/final.mp4&move=true",
+			reqHeader:      auth,
+			expectedStatus: http.StatusForbidden,
+			expectedBody:   "forbidden\n",
+		},
+		{
+			testCase:       "missing token",
+			method:         http.MethodPost,
+			addr:           addr + "/copy/musics/music/music1.txt?destination=music1.txt",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			testCase:       "method not allowed",
+			method:         http.MethodGet,
+			addr:           addr + "/copy/musics/music/music1.txt?destination=music1.txt",
+			reqHeader:      auth,
+			expectedStatus: http.StatusMethodNotAllowed,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.testCase, test.run)
+	}
+}
+
+func TestObjectNotFound(t *testing.T) {
+	var tests = []struct {
+		err      error
+		expected bool
+	}{
+		{storage.ErrObjectNotExist, true},
+		{storage.ErrBucketNotExist, true},
+		{&googleapi.Error{Code: http.StatusNotFound}, true},
+		{&googleapi.Error{Code: http.StatusForbidden}, false},
+		{errors.New("something went wrong"), false},
+	}
+	for _, test := range tests {
+		if got := objectNotFound(test.err); got != test.expected {
+			t.Errorf("objectNotFound(%v): want %v, got %v", test.err, test.expected, got)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+)
+
+const dashContentType = "application/dash+xml"
+
+type dashMPD struct {
+	XMLName                   xml.Name   `xml:"urn:mpeg:dash:schema:mpd:2011 MPD"`
+	Type                      string     `xml:"type,attr"`
+	Profiles                  string     `xml:"profiles,attr"`
+	MinBufferTime             string     `xml:"minBufferTime,attr"`
+	MediaPresentationDuration string     `xml:"mediaPresentationDuration,attr,omitempty"`
+	Period                    dashPeriod `xml:"Period"`
+}
+
+type dashPeriod struct {
+	ID             string              `xml:"id,attr"`
+	AdaptationSets []dashAdaptationSet `xml:"AdaptationSet"`
+}
+
+type dashAdaptationSet struct {
+	ID              int                  `xml:"id,attr"`
+	ContentType     string               `xml:"contentType,attr"`
+	MimeType        string               `xml:"mimeType,attr"`
+	Lang            string               `xml:"lang,attr,omitempty"`
+	Label           string               `xml:"Label,omitempty"`
+	Representations []dashRepresentation `xml:"Representation"`
+}
+
+type dashRepresentation struct {
+	ID        string `xml:"id,attr"`
+	Bandwidth int64  `xml:"bandwidth,attr"`
+	Height    int    `xml:"height,attr,omitempty"`
+	BaseURL   string `xml:"BaseURL"`
+}
+
+// renderDASH renders the mapping as a single-period DASH manifest, with
+// signed URLs for the representations. Sequences are grouped into one
+// adaptation set per content type (video, audio or text) and language, and
+// every sequence becomes a representation of its set.
+func renderDASH(c *Config, r *http.Request, m mapping) ([]byte, int, error) {
+	mpd := dashMPD{
+		Type:          "static",
+		Profiles:      "urn:mpeg:dash:profile:full:2011",
+		MinBufferTime: "PT2S",
+		Period:        dashPeriod{ID: "0"},
+	}
+	if len(m.Durations) > 0 && m.Durations[0] > 0 {
+		mpd.MediaPresentationDuration = fmt.Sprintf("PT%.3fS", float64(m.Durations[0])/1000)
+	}
+	sets := make(map[string]int)
+	for i, s := range m.Sequences {
+		if len(s.Clips) == 0 {
+			continue
+		}
+		clip := s.Clips[0]
+		url, status, err := signClipURL(c, r, clip.Path)
+		if err != nil {
+			return nil, status, err
+		}
+		contentType, mimeType := clipMediaType(clip)
+		key := contentType + "/" + s.Language
+		pos, ok := sets[key]
+		if !ok {
+			pos = len(mpd.Period.AdaptationSets)
+			sets[key] = pos
+			mpd.Period.AdaptationSets = append(mpd.Period.AdaptationSets, dashAdaptationSet{
+				ID:          pos,
+				ContentType: contentType,
+				MimeType:    mimeType,
+				Lang:        s.Language,
+			})
+		}
+		set := &mpd.Period.AdaptationSets[pos]
+		if contentType == "text" && set.Label == "" {
+			set.Label = s.Label
+		}
+		representation := dashRepresentation{
+			ID:        strconv.Itoa(i),
+			Bandwidth: clipBandwidth(clip, m.Durations),
+			BaseURL:   url,
+		}
+		if contentType == "video" {
+			representation.Height = resolution(path.Base(clip.Path))
+		}
+		set.Representations = append(set.Representations, representation)
+	}
+	manifest, err := xml.MarshalIndent(mpd, "", "  ")
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	return append([]byte(xml.Header), append(manifest, '\n')...), http.StatusOK, nil
+}
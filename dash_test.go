@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestServerMapDASH(t *testing.T) {
+	addr, cleanup := startServer(t, Config{
+		BucketName:     "my-bucket",
+		MapPrefix:      "/map/",
+		MapDASHPrefix:  "/dash/",
+		ProxyPrefix:    "/proxy/",
+		MapRegexFilter: `(480|720)p\.mp4$|\.vtt$`,
+		Signer:         signerToken,
+		TokenConfig:    testTokenConfig(),
+	})
+	defer cleanup()
+	var tests = []struct {
+		testCase string
+		url      string
+		accept   string
+	}{
+		{"dash prefix", addr + "/dash/videos/video/", ""},
+		{"accept header", addr + "/map/videos/video/", "application/dash+xml"},
+	}
+	for _, test := range tests {
+		t.Run(test.testCase, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, test.url, nil)
+			if test.accept != "" {
+				req.Header.Set("Accept", test.accept)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := ioutil.ReadAll(resp.Body)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("wrong status code\nwant %d\ngot  %d: %s", http.StatusOK, resp.StatusCode, body)
+			}
+			if ct := resp.Header.Get("Content-Type"); ct != dashContentType {
+				t.Errorf("wrong content type\nwant %q\ngot  %q", dashContentType, ct)
+			}
+			var mpd dashMPD
+			if err := xml.Unmarshal(body, &mpd); err != nil {
+				t.Fatal(err)
+			}
+			sets := mpd.Period.AdaptationSets
+			if len(sets) != 2 {
+				t.Fatalf("wrong number of adaptation sets\nwant 2\ngot  %d: %s", len(sets), body)
+			}
+			if sets[0].ContentType != "text" || sets[0].MimeType != "text/vtt" || len(sets[0].Representations) != 1 {
+				t.Errorf("wrong text adaptation set: %#v", sets[0])
+			}
+			if sets[1].ContentType != "video" || len(sets[1].Representations) != 2 {
+				t.Fatalf("wrong video adaptation set: %#v", sets[1])
+			}
+			for i, height := range []int{480, 720} {
+				representation := sets[1].Representations[i]
+				if representation.Height != height {
+					t.Errorf("wrong height\nwant %d\ngot  %d", height, representation.Height)
+				}
+				if !strings.HasPrefix(representation.BaseURL, "https://edge.example.com/videos/video/") || !strings.Contains(representation.BaseURL, "?token=") {
+					t.Errorf("unexpected base url: %s", representation.BaseURL)
+				}
+			}
+		})
+	}
+}
+
+func TestRenderDASH(t *testing.T) {
+	c := Config{Signer: signerToken, TokenConfig: testTokenConfig()}
+	r, _ := http.NewRequest(http.MethodGet, "/videos/", nil)
+	m := mapping{
+		Durations: []int64{10500},
+		Sequences: []sequence{
+			{Clips: []clip{{Type: "source", Path: "/b/videos/movie_360p.mp4", Size: 525000}}},
+			{Language: "en", Clips: []clip{{Type: "source", Path: "/b/videos/movie_en.m4a"}}},
+			{Language: "es", Clips: []clip{{Type: "audio", Path: "/b/videos/movie_es.mp4"}}},
+			{Language: "en", Label: "English", Clips: []clip{{Type: "subtitle", Path: "/b/videos/movie_en.srt"}}},
+			{Clips: []clip{{Type: "source", Path: "/b/videos/movie_720p.mp4"}}},
+			{Clips: nil},
+		},
+	}
+	manifest, status, err := renderDASH(&c, r, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK {
+		t.Errorf("wrong status\nwant %d\ngot  %d", http.StatusOK, status)
+	}
+	var mpd dashMPD
+	if err := xml.Unmarshal(manifest, &mpd); err != nil {
+		t.Fatal(err)
+	}
+	if mpd.MediaPresentationDuration != "PT10.500S" {
+		t.Errorf("wrong duration\nwant %q\ngot  %q", "PT10.500S", mpd.MediaPresentationDuration)
+	}
+	type setSummary struct {
+		contentType string
+		lang        string
+		label       string
+		ids         []string
+	}
+	var got []setSummary
+	for _, set := range mpd.Period.AdaptationSets {
+		summary := setSummary{set.ContentType, set.Lang, set.Label, nil}
+		for _, representation := range set.Representations {
+			summary.ids = append(summary.ids, representation.ID)
+		}
+		got = append(got, summary)
+	}
+	expected := []setSummary{
+		{"video", "", "", []string{"0", "4"}},
+		{"audio", "en", "", []string{"1"}},
+		{"audio", "es", "", []string{"2"}},
+		{"text", "en", "English", []string{"3"}},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("wrong adaptation sets\nwant %#v\ngot  %#v", expected, got)
+	}
+	if bandwidth := mpd.Period.AdaptationSets[0].Representations[0].Bandwidth; bandwidth != 400000 {
+		t.Errorf("wrong bandwidth\nwant %d\ngot  %d", 400000, bandwidth)
+	}
+}
+
+func TestRenderDASHInvalidClipPath(t *testing.T) {
+	c := Config{Signer: signerToken, TokenConfig: testTokenConfig()}
+	r, _ := http.NewRequest(http.MethodGet, "/videos/", nil)
+	m := mapping{Sequences: []sequence{{Clips: []clip{{Path: "relative"}}}}}
+	if _, status, err := renderDASH(&c, r, m); err == nil || status != http.StatusBadRequest {
+		t.Errorf("expected bad request error, got %d (%v)", status, err)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"time"
+)
+
+const redactedValue = "[redacted]"
+
+// redactedConfigVars are the variables whose values aren't exposed by the
+// configuration endpoint. New sensitive options should be added here, as well
+// as to loadSecretFiles.
+var redactedConfigVars = map[string]bool{
+	"GCS_HELPER_UPLOAD_TOKEN":             true,
+	"GCS_HELPER_EXTRA_RESOURCES_TOKEN":    true,
+	"GCS_HELPER_ADMIN_TOKEN":              true,
+	"GCS_HELPER_SIGN_PRIVATE_KEY":         true,
+	"GCS_HELPER_SIGN_KEYS":                true,
+	"GCS_HELPER_CDN_KEY":                  true,
+	"GCS_HELPER_TOKEN_KEY":                true,
+	"GCS_HELPER_MAP_CACHE_REDIS_PASSWORD": true,
+}
+
+// effectiveConfig returns the given configuration keyed by the names of the
+// variables, with durations formatted like in the environment (like "10s")
+// and sensitive values replaced by "[redacted]" when they're set, so it's
+// still possible to tell whether they're set.
+func effectiveConfig(c Config) map[string]interface{} {
+	result := make(map[string]interface{})
+	addConfigValues(result, reflect.ValueOf(c))
+	return result
+}
+
+func addConfigValues(result map[string]interface{}, v reflect.Value) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		value := v.Field(i)
+		name := strings.ToUpper(field.Tag.Get("envconfig"))
+		if name == "" {
+			if field.Type.Kind() == reflect.Struct {
+				addConfigValues(result, value)
+				continue
+			}
+			name = strings.ToUpper(field.Name)
+		}
+		// variables of the nested configs use the full name in their tags.
+		if !strings.HasPrefix(name, "GCS_") {
+			name = defaultEnvPrefix + "_" + name
+		}
+		switch {
+		case redactedConfigVars[name]:
+			if value.Len() > 0 {
+				result[name] = redactedValue
+			} else {
+				result[name] = ""
+			}
+		case field.Type == reflect.TypeOf(time.Duration(0)):
+			result[name] = time.Duration(value.Int()).String()
+		default:
+			result[name] = value.Interface()
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	deleteObjectPath = "object/"
+	deletePrefixPath = "prefix/"
+)
+
+type deleteResult struct {
+	Deleted []string `json:"deleted"`
+}
+
+// getDeleteHandler returns a handler that deletes objects from the bucket.
+// Requests to object/<name> delete a single object, while requests to
+// prefix/<prefix>?confirm=true delete every object under the prefix. Only
+// objects under GCS_HELPER_DELETE_ALLOWED_PREFIXES can be deleted.
+func getDeleteHandler(c Config, client *storage.Client) http.HandlerFunc {
+	logger := c.logger()
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		if r.Method != http.MethodDelete {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !authorized(r, c.UploadToken) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		path := strings.TrimLeft(r.URL.Path, "/")
+		batch := strings.HasPrefix(path, deletePrefixPath)
+		switch {
+		case batch:
+			r.URL.Path = strings.TrimPrefix(path, deletePrefixPath)
+			if r.URL.Query().Get("confirm") != "true" {
+				http.Error(w, "prefix deletes require confirm=true", http.StatusBadRequest)
+				return
+			}
+		case strings.HasPrefix(path, deleteObjectPath):
+			r.URL.Path = strings.TrimPrefix(path, deleteObjectPath)
+		default:
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		bucketName, name, err := objectLocation(&c, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !deleteAllowed(c.DeleteAllowedPrefixes, name) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), c.ProxyTimeout)
+		defer cancel()
+		bucket := bucketHandle(&c, client, bucketName)
+		if !batch {
+			err = bucket.Object(name).Delete(ctx)
+			if err == storage.ErrObjectNotExist {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				requestLogger(r.Context(), logger).WithError(err).WithField("url", r.URL.RequestURI()).Error("failed to delete object")
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		deleted, err := deletePrefix(ctx, bucket, name)
+		if err != nil {
+			requestLogger(r.Context(), logger).WithError(err).WithField("prefix", name).Error("failed to delete objects")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(deleteResult{Deleted: deleted})
+	}
+}
+
+// deleteAllowed reports whether the object with the given name is under one
+// of the allowed prefixes.
+func deleteAllowed(allowedPrefixes []string, name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, prefix := range allowedPrefixes {
+		if prefix != "" && strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// deletePrefix deletes all objects under the given prefix, returning the
+// names of the objects that were deleted.
+func deletePrefix(ctx context.Context, bucket *storage.BucketHandle, prefix string) ([]string, error) {
+	if prefix == "" {
+		return nil, errors.New("prefix is required")
+	}
+	deleted := []string{}
+	iter := bucket.Objects(ctx, &storage.Query{Prefix: prefix})
+	obj, err := iter.Next()
+	for ; err == nil; obj, err = iter.Next() {
+		if err = bucket.Object(obj.Name).Delete(ctx); err != nil && err != storage.ErrObjectNotExist {
+			return deleted, err
+		}
+		deleted = append(deleted, obj.Name)
+	}
+	if err != iterator.Done {
+		return deleted, err
+	}
+	return deleted, nil
+}
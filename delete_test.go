@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestServerDeleteHandler(t *testing.T) {
+	addr, cleanup := startServer(t, Config{
+		BucketName:            "my-bucket",
+		DeletePrefix:          "/delete/",
+		DeleteAllowedPrefixes: []string{"musics/music/"},
+		UploadToken:           "secret",
+		ProxyPrefix:           "/proxy/",
+		ProxyTimeout:          time.Second,
+	})
+	defer cleanup()
+	auth := http.Header{"Authorization": []string{"Bearer secret"}}
+	var tests = []serverTest{
+		{
+			testCase:       "delete object",
+			method:         http.MethodDelete,
+			addr:           addr + "/delete/object/musics/music/music1.txt",
+			reqHeader:      auth,
+			expectedStatus: http.StatusNoContent,
+			expectedBody:   "",
+		},
+		{
+			testCase:       "deleted object is gone",
+			method:         http.MethodGet,
+			addr:           addr + "/proxy/musics/music/music1.txt",
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			testCase:       "delete object - not found",
+			method:         http.MethodDelete,
+			addr:           addr + "/delete/object/musics/music/music1.txt",
+			reqHeader:      auth,
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			testCase:       "delete object - outside allowed prefixes",
+			method:         http.MethodDelete,
+			addr:           addr + "/delete/object/videos/video/video1_720p.mp4",
+			reqHeader:      auth,
+			expectedStatus: http.StatusForbidden,
+			expectedBody:   "forbidden\n",
+		},
+		{
+			testCase:       "delete prefix - missing confirmation",
+			method:         http.MethodDelete,
+			addr:           addr + "/delete/prefix/musics/music/music/",
+			reqHeader:      auth,
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   "prefix deletes require confirm=true\n",
+		},
+		{
+			testCase:       "delete prefix",
+			method:         http.MethodDelete,
+			addr:           addr + "/delete/prefix/musics/music/music/?confirm=true",
+			reqHeader:      auth,
+			expectedStatus: http.StatusOK,
+			expectedBody: map[string]interface{}{
+				"deleted": []interface{}{
+					"musics/music/music/1.txt",
+					"musics/music/music/2.txt",
+					"musics/music/music/3.txt",
+					"musics/music/music/4.mp3",
+				},
+			},
+		},
+		{
+			testCase:       "delete prefix - outside allowed prefixes",
+			method:         http.MethodDelete,
+			addr:           addr + "/delete/prefix/musics/?confirm=true",
+			reqHeader:      auth,
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			testCase:       "missing token",
+			method:         http.MethodDelete,
+			addr:           addr + "/delete/object/musics/music/music2.txt",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			testCase:       "unknown delete path",
+			method:         http.MethodDelete,
+			addr:           addr + "/delete/musics/music/music2.txt",
+			reqHeader:      auth,
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			testCase:       "method not allowed",
+			method:         http.MethodGet,
+			addr:           addr + "/delete/object/musics/music/music2.txt",
+			reqHeader:      auth,
+			expectedStatus: http.StatusMethodNotAllowed,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.testCase, test.run)
+	}
+}
+
+func TestDeleteAllowed(t *testing.T) {
+	allowed := []string{"tmp/", "encodes/drafts/"}
+	var tests = []struct {
+		name     string
+		expected bool
+	}{
+		{"tmp/file.mp4", true},
+		{"encodes/drafts/video/720p.mp4", true},
+		{"encodes/final/720p.mp4", false},
+		{"tmpfile.mp4", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		if got := deleteAllowed(allowed, test.name); got != test.expected {
+			t.Errorf("deleteAllowed(%q): want %v, got %v", test.name, test.expected, got)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// endpointURL parses GCS_HELPER_STORAGE_ENDPOINT, returning nil when it's not
+// set. Endpoints without a scheme, like STORAGE_EMULATOR_HOST=localhost:4443,
+// use plain HTTP, as emulators usually do.
+func (c ClientConfig) endpointURL() (*url.URL, error) {
+	if c.Endpoint == "" {
+		return nil, nil
+	}
+	endpoint := c.Endpoint
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "http://" + endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.New("the scheme must be http or https")
+	}
+	if u.Host == "" || strings.Trim(u.Path, "/") != "" || u.RawQuery != "" {
+		return nil, errors.New("must be a host or the root URL of the server, like localhost:4443 or https://gcs.example.com")
+	}
+	return u, nil
+}
+
+// endpointTransport is an http.RoundTripper that sends all requests to the
+// given endpoint, keeping their paths. The vendored storage client only
+// supports custom endpoints for the JSON API, and always downloads objects
+// from storage.googleapis.com, so the endpoint is set at the transport level,
+// like in the tests (see fakeHTTPClient).
+type endpointTransport struct {
+	endpoint *url.URL
+	http.RoundTripper
+}
+
+func (t *endpointTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r2 := new(http.Request)
+	*r2 = *r
+	u := *r.URL
+	u.Scheme = t.endpoint.Scheme
+	u.Host = t.endpoint.Host
+	r2.URL = &u
+	r2.Host = ""
+	return t.RoundTripper.RoundTrip(r2)
+}
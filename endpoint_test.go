@@ -0,0 +1,105 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientConfigEndpointURL(t *testing.T) {
+	var tests = []struct {
+		endpoint    string
+		expected    string
+		expectedErr bool
+	}{
+		{"", "", false},
+		{"localhost:4443", "http://localhost:4443", false},
+		{"https://gcs.example.com/", "https://gcs.example.com/", false},
+		{"ftp://gcs.example.com", "", true},
+		{"https://gcs.example.com/storage/v1", "", true},
+		{"http://", "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.endpoint, func(t *testing.T) {
+			u, err := ClientConfig{Endpoint: test.endpoint}.endpointURL()
+			if test.expectedErr {
+				if err == nil {
+					t.Error("unexpected <nil> error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got string
+			if u != nil {
+				got = u.String()
+			}
+			if got != test.expected {
+				t.Errorf("wrong endpoint\nwant %q\ngot  %q", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestEndpointTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host + " " + r.URL.RequestURI()))
+	}))
+	defer server.Close()
+	hc, err := httpClient(ClientConfig{Endpoint: server.URL, Anonymous: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := hc.Get("https://storage.googleapis.com/my-bucket/video.mp4?generation=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := server.Listener.Addr().String() + " /my-bucket/video.mp4?generation=1"
+	if string(data) != expected {
+		t.Errorf("wrong request\nwant %q\ngot  %q", expected, string(data))
+	}
+}
+
+func TestLoadConfigStorageEmulatorHost(t *testing.T) {
+	var tests = []struct {
+		testCase          string
+		envs              map[string]string
+		expected          string
+		expectedAnonymous bool
+	}{
+		{"emulator host", map[string]string{"STORAGE_EMULATOR_HOST": "localhost:4443"}, "localhost:4443", true},
+		{
+			"endpoint overrides emulator host",
+			map[string]string{"STORAGE_EMULATOR_HOST": "localhost:4443", "GCS_HELPER_STORAGE_ENDPOINT": "https://gcs.example.com"},
+			"https://gcs.example.com",
+			false,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.testCase, func(t *testing.T) {
+			test.envs["GCS_HELPER_BUCKET_NAME"] = "some-bucket"
+			setEnvs(test.envs)
+			config, err := loadConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.ClientConfig.Endpoint != test.expected {
+				t.Errorf("wrong endpoint\nwant %q\ngot  %q", test.expected, config.ClientConfig.Endpoint)
+			}
+			if config.ClientConfig.Anonymous != test.expectedAnonymous {
+				t.Errorf("wrong anonymous setting\nwant %v\ngot  %v", test.expectedAnonymous, config.ClientConfig.Anonymous)
+			}
+		})
+	}
+	setEnvs(map[string]string{"GCS_HELPER_BUCKET_NAME": "some-bucket", "STORAGE_EMULATOR_HOST": "ftp://localhost"})
+	if _, err := loadConfig(); err == nil {
+		t.Error("unexpected <nil> error for an invalid endpoint")
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+const defaultEnvPrefix = "GCS_HELPER"
+
+var envPrefixRegexp = regexp.MustCompile(`^[A-Z][A-Z0-9_]*$`)
+
+// prefixedConfigVar returns the name of the given variable in the namespace
+// of the given prefix: the name without the GCS_HELPER_ prefix, prefixed
+// with the given one (e.g. MY_BUCKET_BUCKET_NAME and MY_BUCKET_GCS_CLIENT_TIMEOUT
+// for GCS_HELPER_BUCKET_NAME and GCS_CLIENT_TIMEOUT, with the MY_BUCKET
+// prefix).
+func prefixedConfigVar(prefix, name string) string {
+	return prefix + "_" + strings.TrimPrefix(name, defaultEnvPrefix+"_")
+}
+
+// applyEnvPrefix makes the configuration variables of the namespace of the
+// given prefix (see prefixedConfigVar) visible under their default names, so
+// several instances sharing an environment can each read their own
+// namespace. The variables with the default names are ignored, unless the
+// prefix is the default one.
+func applyEnvPrefix(prefix string, env envOverlay) error {
+	prefix = strings.ToUpper(strings.TrimSuffix(prefix, "_"))
+	if prefix == "" || prefix == defaultEnvPrefix {
+		return nil
+	}
+	if !envPrefixRegexp.MatchString(prefix) {
+		return fmt.Errorf("invalid environment prefix %q: must be a letter followed by letters, digits or underscores", prefix)
+	}
+	vars, err := configVars()
+	if err != nil {
+		return err
+	}
+	for _, v := range vars {
+		for _, name := range []string{v.name, v.name + "_FILE"} {
+			if value, ok := os.LookupEnv(prefixedConfigVar(prefix, name)); ok {
+				err = env.set(name, value)
+			} else {
+				err = env.unset(name)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	// the variables of routes (see route) aren't known in advance.
+	for _, kv := range os.Environ() {
+		name := strings.SplitN(kv, "=", 2)[0]
+		if strings.HasPrefix(name, routeEnvPrefix) {
+			if err = env.unset(name); err != nil {
+				return err
+			}
+		}
+	}
+	for _, kv := range os.Environ() {
+		parts := strings.SplitN(kv, "=", 2)
+		if strings.HasPrefix(parts[0], prefix+"_ROUTE_") && len(parts) == 2 {
+			if err = env.set(routeEnvPrefix+strings.TrimPrefix(parts[0], prefix+"_ROUTE_"), parts[1]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
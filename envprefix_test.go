@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPrefixedConfigVar(t *testing.T) {
+	var tests = []struct {
+		name     string
+		expected string
+	}{
+		{"GCS_HELPER_BUCKET_NAME", "MY_BUCKET_BUCKET_NAME"},
+		{"GCS_HELPER_SIGN_PRIVATE_KEY_FILE", "MY_BUCKET_SIGN_PRIVATE_KEY_FILE"},
+		{"GCS_CLIENT_TIMEOUT", "MY_BUCKET_GCS_CLIENT_TIMEOUT"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if name := prefixedConfigVar("MY_BUCKET", test.name); name != test.expected {
+				t.Errorf("wrong name\nwant %q\ngot  %q", test.expected, name)
+			}
+		})
+	}
+}
+
+func TestLoadConfigEnvPrefix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcs-helper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	if err = ioutil.WriteFile(tokenFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	setEnvs(map[string]string{
+		"GCS_HELPER_BUCKET_NAME":       "default-bucket",
+		"GCS_HELPER_LOG_LEVEL":         "error",
+		"GCS_HELPER_UPLOAD_PREFIX":     "/upload/",
+		"GCS_CLIENT_TIMEOUT":           "1s",
+		"MY_BUCKET_BUCKET_NAME":        "my-bucket",
+		"MY_BUCKET_UPLOAD_PREFIX":      "/upload/",
+		"MY_BUCKET_UPLOAD_TOKEN_FILE":  tokenFile,
+		"MY_BUCKET_GCS_CLIENT_TIMEOUT": "5s",
+		"MY_BUCKET_SIGN_EXPIRATION":    "2h",
+		"OTHER_BUCKET_BUCKET_NAME":     "other-bucket",
+	})
+	config, err := loadConfigFrom("", "my_bucket", map[string]string{"GCS_HELPER_MAP_VERBOSE": "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.BucketName != "my-bucket" {
+		t.Errorf("wrong bucket name\nwant %q\ngot  %q", "my-bucket", config.BucketName)
+	}
+	if config.LogLevel != "debug" {
+		t.Errorf("variables outside of the namespace should be ignored\nwant log level %q\ngot  %q", "debug", config.LogLevel)
+	}
+	if config.UploadToken != "secret" {
+		t.Errorf("wrong upload token\nwant %q\ngot  %q", "secret", config.UploadToken)
+	}
+	if config.ClientConfig.Timeout != 5*time.Second {
+		t.Errorf("wrong client timeout\nwant 5s\ngot  %s", config.ClientConfig.Timeout)
+	}
+	if config.SignConfig.Expiration != 2*time.Hour {
+		t.Errorf("wrong sign expiration\nwant 2h\ngot  %s", config.SignConfig.Expiration)
+	}
+	if !config.MapVerbose {
+		t.Error("flags should be applied with a prefix")
+	}
+	if value := os.Getenv("GCS_HELPER_BUCKET_NAME"); value != "default-bucket" {
+		t.Errorf("the environment should be restored\nwant GCS_HELPER_BUCKET_NAME=%q\ngot  GCS_HELPER_BUCKET_NAME=%q", "default-bucket", value)
+	}
+	if value, ok := os.LookupEnv("GCS_HELPER_UPLOAD_TOKEN_FILE"); ok {
+		t.Errorf("the environment should be restored, got GCS_HELPER_UPLOAD_TOKEN_FILE=%q", value)
+	}
+}
+
+func TestLoadConfigInvalidEnvPrefix(t *testing.T) {
+	setEnvs(map[string]string{"GCS_HELPER_BUCKET_NAME": "some-bucket"})
+	_, err := loadConfigFrom("", "my-bucket", nil)
+	expected := `invalid environment prefix "MY-BUCKET": must be a letter followed by letters, digits or underscores`
+	if err == nil || err.Error() != expected {
+		t.Errorf("wrong error\nwant %q\ngot  %v", expected, err)
+	}
+}
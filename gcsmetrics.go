@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// gcsMetricsTransport is an http.RoundTripper that counts the requests sent
+// to GCS by operation and status (see gcsOperation and gcsStatus), including
+// retries, so rising rate limiting can be alerted on and the cost of the API
+// calls can be estimated. It also records which connections of the pool are
+// used (see gcsConnPool), and whether they're reused.
+type gcsMetricsTransport struct {
+	http.RoundTripper
+}
+
+func (t *gcsMetricsTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	var mu sync.Mutex
+	release := func() {}
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			gcsConnections.inc(strconv.FormatBool(info.Reused))
+			mu.Lock()
+			// the transport may retry requests on another connection.
+			release()
+			release = gcsConnPool.acquire(info.Conn)
+			mu.Unlock()
+		},
+	}
+	resp, err := t.RoundTripper.RoundTrip(r.WithContext(httptrace.WithClientTrace(r.Context(), trace)))
+	mu.Lock()
+	defer mu.Unlock()
+	code := 0
+	if err == nil {
+		code = resp.StatusCode
+		resp.Body = &releaseBody{ReadCloser: resp.Body, release: release}
+	} else {
+		release()
+	}
+	gcsRequests.inc(gcsOperation(r), gcsStatus(code))
+	return resp, err
+}
+
+// gcsOperation returns the operation of the given request to GCS, from its
+// method and path, which are the same with custom endpoints: objects are
+// downloaded with the XML API (at /<bucket>/<object>), and the other
+// operations use the JSON API (at /storage/v1/ and /upload/storage/v1/).
+func gcsOperation(r *http.Request) string {
+	path := r.URL.Path
+	if strings.HasPrefix(path, "/upload/") {
+		return "write"
+	}
+	if !strings.HasPrefix(path, "/storage/v1/") {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			return "read"
+		}
+		return "other"
+	}
+	// /storage/v1/b/<bucket>[/o[/<object>[/compose|/rewriteTo/...]]]
+	parts := strings.SplitN(strings.TrimPrefix(path, "/storage/v1/b/"), "/", 3)
+	switch {
+	case len(parts) == 1:
+		return "bucket"
+	case parts[1] != "o":
+		return "other"
+	case len(parts) == 2:
+		if r.Method == http.MethodGet {
+			return "list"
+		}
+		return "write"
+	}
+	switch r.Method {
+	case http.MethodGet:
+		if r.URL.Query().Get("alt") == "media" {
+			return "read"
+		}
+		return "attrs"
+	case http.MethodPost:
+		if strings.Contains(parts[2], "/rewriteTo/") {
+			return "copy"
+		}
+		if strings.HasSuffix(parts[2], "/compose") {
+			return "compose"
+		}
+		return "other"
+	case http.MethodDelete:
+		return "delete"
+	case http.MethodPatch, http.MethodPut:
+		return "update"
+	}
+	return "other"
+}
+
+// gcsStatus returns the class of the given status code of a response of
+// GCS, with 0 for requests that failed without a response.
+func gcsStatus(code int) string {
+	switch {
+	case code == 0:
+		return "error"
+	case code < 400:
+		return "ok"
+	case code == http.StatusForbidden, code == http.StatusNotFound, code == http.StatusTooManyRequests:
+		return strconv.Itoa(code)
+	case code < 500:
+		return "4xx"
+	}
+	return "5xx"
+}
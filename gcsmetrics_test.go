@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGCSOperation(t *testing.T) {
+	var tests = []struct {
+		method   string
+		url      string
+		expected string
+	}{
+		{http.MethodGet, "https://storage.googleapis.com/my-bucket/videos/video1.mp4", "read"},
+		{http.MethodHead, "https://storage.googleapis.com/my-bucket/videos/video1.mp4", "read"},
+		{http.MethodGet, "https://www.googleapis.com/storage/v1/b/my-bucket?alt=json", "bucket"},
+		{http.MethodGet, "https://www.googleapis.com/storage/v1/b/my-bucket/o?prefix=videos%2F", "list"},
+		{http.MethodGet, "https://www.googleapis.com/storage/v1/b/my-bucket/o/videos%2Fvideo1.mp4?alt=json", "attrs"},
+		{http.MethodGet, "https://www.googleapis.com/storage/v1/b/my-bucket/o/videos%2Fvideo1.mp4?alt=media", "read"},
+		{http.MethodDelete, "https://www.googleapis.com/storage/v1/b/my-bucket/o/videos%2Fvideo1.mp4", "delete"},
+		{http.MethodPatch, "https://www.googleapis.com/storage/v1/b/my-bucket/o/videos%2Fvideo1.mp4", "update"},
+		{http.MethodPost, "https://www.googleapis.com/storage/v1/b/my-bucket/o/video1.mp4/rewriteTo/b/other-bucket/o/video2.mp4", "copy"},
+		{http.MethodPost, "https://www.googleapis.com/storage/v1/b/my-bucket/o/videos%2Fall.mp4/compose", "compose"},
+		{http.MethodPost, "https://www.googleapis.com/upload/storage/v1/b/my-bucket/o?uploadType=multipart", "write"},
+		{http.MethodPut, "https://www.googleapis.com/upload/storage/v1/b/my-bucket/o?uploadType=resumable&upload_id=123", "write"},
+		{http.MethodGet, "https://www.googleapis.com/storage/v1/b/my-bucket/iam", "other"},
+		{http.MethodPost, "https://storage.googleapis.com/my-bucket/videos/video1.mp4", "other"},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, test.url, nil)
+		if got := gcsOperation(req); got != test.expected {
+			t.Errorf("%s %s: wrong operation\nwant %q\ngot  %q", test.method, test.url, test.expected, got)
+		}
+	}
+}
+
+func TestGCSStatus(t *testing.T) {
+	var tests = []struct {
+		code     int
+		expected string
+	}{
+		{0, "error"},
+		{http.StatusOK, "ok"},
+		{http.StatusPartialContent, "ok"},
+		{http.StatusNotModified, "ok"},
+		{http.StatusBadRequest, "4xx"},
+		{http.StatusForbidden, "403"},
+		{http.StatusNotFound, "404"},
+		{http.StatusPreconditionFailed, "4xx"},
+		{http.StatusTooManyRequests, "429"},
+		{http.StatusInternalServerError, "5xx"},
+		{http.StatusServiceUnavailable, "5xx"},
+	}
+	for _, test := range tests {
+		if got := gcsStatus(test.code); got != test.expected {
+			t.Errorf("%d: wrong status\nwant %q\ngot  %q", test.code, test.expected, got)
+		}
+	}
+}
+
+type failingTransport struct{}
+
+func (failingTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestGCSMetricsTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+	before := gcsRequests.value("list", "429")
+	client := http.Client{Transport: &gcsMetricsTransport{RoundTripper: http.DefaultTransport}}
+	resp, err := client.Get(server.URL + "/storage/v1/b/my-bucket/o?prefix=videos%2F")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := gcsRequests.value("list", "429") - before; got != 1 {
+		t.Errorf("wrong number of rate limited listings\nwant 1\ngot  %v", got)
+	}
+
+	before = gcsRequests.value("read", "error")
+	client = http.Client{Transport: &gcsMetricsTransport{RoundTripper: failingTransport{}}}
+	if _, err = client.Get(server.URL + "/my-bucket/video.mp4"); err == nil {
+		t.Fatal("unexpected <nil> error")
+	}
+	if got := gcsRequests.value("read", "error") - before; got != 1 {
+		t.Errorf("wrong number of failed reads\nwant 1\ngot  %v", got)
+	}
+}
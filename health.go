@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+const (
+	checkStatusOK     = "ok"
+	checkStatusFailed = "failed"
+)
+
+// readinessCheck is a dependency checked by the readiness endpoint.
+type readinessCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+type checkResult struct {
+	Name     string  `json:"name"`
+	Status   string  `json:"status"`
+	Error    string  `json:"error,omitempty"`
+	Duration float64 `json:"duration"`
+}
+
+type readinessStatus struct {
+	Status string        `json:"status"`
+	Checks []checkResult `json:"checks"`
+}
+
+// isHealthCheck reports whether the given request is a health check, which
+// isn't rate limited nor logged in the access logs.
+func isHealthCheck(c Config, r *http.Request) bool {
+	return r.URL.Path == "/" ||
+		c.LivenessPath != "" && r.URL.Path == c.LivenessPath ||
+		c.ReadinessPath != "" && r.URL.Path == c.ReadinessPath
+}
+
+// getLivenessHandler returns the handler for GCS_HELPER_LIVENESS_PATH, which
+// reports that the process is able to serve requests, without checking its
+// dependencies.
+func getLivenessHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte("ok\n"))
+	}
+}
+
+// getReadinessHandler returns the handler for GCS_HELPER_READINESS_PATH,
+// which checks the dependencies of the server (GCS, the signers and the
+// mapping cache), each with GCS_HELPER_READINESS_TIMEOUT, and reports the
+// result of each check. It responds with 503 when any check fails. The check
+// query parameter restricts the checks to the given ones, like
+// ?check=gcs&check=cache.
+func getReadinessHandler(c Config, client *storage.Client) http.HandlerFunc {
+	checks := readinessChecks(c, client)
+	return func(w http.ResponseWriter, r *http.Request) {
+		selected := checks
+		if names := r.URL.Query()["check"]; len(names) > 0 {
+			selected = nil
+			for _, name := range names {
+				check, ok := findCheck(checks, name)
+				if !ok {
+					http.Error(w, fmt.Sprintf("unknown check %q", name), http.StatusNotFound)
+					return
+				}
+				selected = append(selected, check)
+			}
+		}
+		status := runChecks(r.Context(), selected, c.ReadinessTimeout)
+		w.Header().Set("Content-Type", "application/json")
+		if status.Status != checkStatusOK {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(status)
+	}
+}
+
+// readinessChecks returns the checks of the dependencies used with the given
+// configuration.
+func readinessChecks(c Config, client *storage.Client) []readinessCheck {
+	checks := []readinessCheck{{name: "gcs", check: func(ctx context.Context) error {
+		_, err := bucketHandle(&c, client, c.BucketName).Attrs(ctx)
+		return err
+	}}}
+	if c.SignConfig.enabled() || c.CDNConfig.enabled() {
+		checks = append(checks, readinessCheck{name: "signer", check: func(ctx context.Context) error {
+			return checkSigners(ctx, c)
+		}})
+	}
+	if c.MapCacheBackend == mapCacheRedis {
+		redis := newRedisClient(c.MapCacheRedisAddr, c.MapCacheRedisPassword)
+		checks = append(checks, readinessCheck{name: "cache", check: func(ctx context.Context) error {
+			_, err := redis.do(ctx, "PING")
+			return err
+		}})
+	}
+	return checks
+}
+
+func findCheck(checks []readinessCheck, name string) (readinessCheck, bool) {
+	for _, check := range checks {
+		if check.name == name {
+			return check, true
+		}
+	}
+	return readinessCheck{}, false
+}
+
+// runChecks runs the given checks concurrently, each with the given timeout.
+func runChecks(ctx context.Context, checks []readinessCheck, timeout time.Duration) readinessStatus {
+	status := readinessStatus{Status: checkStatusOK, Checks: make([]checkResult, len(checks))}
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func(i int, check readinessCheck) {
+			defer wg.Done()
+			checkCtx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			start := time.Now()
+			result := checkResult{Name: check.name, Status: checkStatusOK}
+			if err := check.check(checkCtx); err != nil {
+				result.Status = checkStatusFailed
+				result.Error = err.Error()
+			}
+			result.Duration = time.Since(start).Seconds()
+			status.Checks[i] = result
+		}(i, check)
+	}
+	wg.Wait()
+	for _, result := range status.Checks {
+		if result.Status != checkStatusOK {
+			status.Status = checkStatusFailed
+		}
+	}
+	return status
+}
+
+// checkSigners signs some data with the active signing key and the CDN key,
+// like the signing self-test does on startup, so expired keys and keys that
+// can't be used anymore (like service accounts that lost the permission to
+// sign in the iam mode) make the server unready. Signing doesn't support
+// contexts, so the check gives up when the context is done.
+func checkSigners(ctx context.Context, c Config) error {
+	errs := make(chan error, 1)
+	go func() {
+		errs <- signersError(c, time.Now())
+	}()
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func signersError(c Config, now time.Time) error {
+	if c.SignConfig.enabled() {
+		signConfig, err := c.SignConfig.withActiveKey(now)
+		if err != nil {
+			return err
+		}
+		if _, err = signConfig.signBytes([]byte(selfTestObject)); err != nil {
+			return fmt.Errorf("failed to sign with %s: %v", signConfig.GoogleAccessID, err)
+		}
+	}
+	if c.CDNConfig.enabled() {
+		if _, err := c.CDNConfig.sign(selfTestObject); err != nil {
+			return fmt.Errorf("failed to sign with the CDN key: %v", err)
+		}
+	}
+	return nil
+}
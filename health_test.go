@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestServerLiveness(t *testing.T) {
+	addr, cleanup := startServer(t, Config{
+		BucketName:   "my-bucket",
+		ProxyPrefix:  "/proxy/",
+		LivenessPath: "/healthz",
+	})
+	defer cleanup()
+	resp, err := http.Get(addr + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(data) != "ok\n" {
+		t.Errorf("wrong response %d %q", resp.StatusCode, data)
+	}
+}
+
+func TestServerReadiness(t *testing.T) {
+	redis := startFakeRedis(t, "secret")
+	defer redis.stop()
+	cdn := CDNConfig{Type: cdnTypeCloudCDN, URLPrefix: "https://cdn.example.com/", KeyName: "my-key", Key: testCDNKey, Expiration: time.Hour}
+	var tests = []struct {
+		testCase       string
+		config         Config
+		query          string
+		expectedStatus int
+		expectedChecks map[string]string
+	}{
+		{
+			"gcs only",
+			Config{BucketName: "my-bucket"},
+			"",
+			http.StatusOK,
+			map[string]string{"gcs": checkStatusOK},
+		},
+		{
+			"all checks",
+			Config{
+				BucketName:             "my-bucket",
+				SignConfig:             testSignConfig(t),
+				CDNConfig:              cdn,
+				MapCacheBackend:        mapCacheRedis,
+				MapCacheRedisAddr:      redis.addr(),
+				MapCacheRedisPassword:  "secret",
+				MapCacheRedisKeyPrefix: "gcs-helper:map:",
+			},
+			"",
+			http.StatusOK,
+			map[string]string{"gcs": checkStatusOK, "signer": checkStatusOK, "cache": checkStatusOK},
+		},
+		{
+			"missing bucket",
+			Config{BucketName: "missing-bucket"},
+			"",
+			http.StatusServiceUnavailable,
+			map[string]string{"gcs": checkStatusFailed},
+		},
+		{
+			"unavailable cache",
+			Config{BucketName: "my-bucket", MapCacheBackend: mapCacheRedis, MapCacheRedisAddr: "127.0.0.1:1"},
+			"",
+			http.StatusServiceUnavailable,
+			map[string]string{"gcs": checkStatusOK, "cache": checkStatusFailed},
+		},
+		{
+			"selected check",
+			Config{BucketName: "missing-bucket", MapCacheBackend: mapCacheRedis, MapCacheRedisAddr: redis.addr(), MapCacheRedisPassword: "secret"},
+			"?check=cache",
+			http.StatusOK,
+			map[string]string{"cache": checkStatusOK},
+		},
+		{
+			"unknown check",
+			Config{BucketName: "my-bucket"},
+			"?check=signer",
+			http.StatusNotFound,
+			nil,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.testCase, func(t *testing.T) {
+			test.config.ProxyPrefix = "/proxy/"
+			test.config.ReadinessPath = "/readyz"
+			test.config.ReadinessTimeout = time.Second
+			addr, cleanup := startServer(t, test.config)
+			defer cleanup()
+			resp, err := http.Get(addr + "/readyz" + test.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != test.expectedStatus {
+				t.Errorf("wrong status code\nwant %d\ngot  %d", test.expectedStatus, resp.StatusCode)
+			}
+			if test.expectedChecks == nil {
+				return
+			}
+			var status readinessStatus
+			if err = json.NewDecoder(resp.Body).Decode(&status); err != nil {
+				t.Fatal(err)
+			}
+			checks := make(map[string]string, len(status.Checks))
+			for _, check := range status.Checks {
+				checks[check.Name] = check.Status
+				if check.Status == checkStatusFailed && check.Error == "" {
+					t.Errorf("missing error for the %s check", check.Name)
+				}
+			}
+			if len(checks) != len(test.expectedChecks) {
+				t.Errorf("wrong checks\nwant %v\ngot  %v", test.expectedChecks, checks)
+			}
+			for name, expected := range test.expectedChecks {
+				if checks[name] != expected {
+					t.Errorf("wrong status for the %s check\nwant %q\ngot  %q", name, expected, checks[name])
+				}
+			}
+		})
+	}
+}
+
+func TestRunChecksTimeout(t *testing.T) {
+	checks := []readinessCheck{
+		{name: "fast", check: func(ctx context.Context) error { return nil }},
+		{name: "slow", check: func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		}},
+		{name: "broken", check: func(ctx context.Context) error { return errors.New("broken") }},
+	}
+	status := runChecks(context.Background(), checks, 10*time.Millisecond)
+	if status.Status != checkStatusFailed {
+		t.Errorf("wrong status\nwant %q\ngot  %q", checkStatusFailed, status.Status)
+	}
+	expected := []checkResult{
+		{Name: "fast", Status: checkStatusOK},
+		{Name: "slow", Status: checkStatusFailed, Error: context.DeadlineExceeded.Error()},
+		{Name: "broken", Status: checkStatusFailed, Error: "broken"},
+	}
+	for i, result := range status.Checks {
+		result.Duration = 0
+		if result != expected[i] {
+			t.Errorf("wrong result for check %d\nwant %#v\ngot  %#v", i, expected[i], result)
+		}
+	}
+}
+
+func TestSignersErrorExpiredKeys(t *testing.T) {
+	c := Config{SignConfig: testSignConfig(t)}
+	c.SignConfig.Keys = SigningKeys{
+		{GoogleAccessID: c.SignConfig.GoogleAccessID, PrivateKey: c.SignConfig.PrivateKey, NotAfter: time.Now().Add(-time.Hour)},
+	}
+	err := signersError(c, time.Now())
+	if err != errSigningKeysExpired {
+		t.Errorf("wrong error\nwant %v\ngot  %v", errSigningKeysExpired, err)
+	}
+}
+
+func TestHealthChecksNotRateLimited(t *testing.T) {
+	addr, cleanup := startServer(t, Config{
+		BucketName:     "my-bucket",
+		ProxyPrefix:    "/proxy/",
+		LivenessPath:   "/healthz",
+		RateLimit:      1,
+		RateLimitBurst: 1,
+	})
+	defer cleanup()
+	for i := 0; i < 5; i++ {
+		resp, err := http.Get(addr + "/healthz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("wrong status code for request %d\nwant %d\ngot  %d", i, http.StatusOK, resp.StatusCode)
+		}
+	}
+}
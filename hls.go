@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"path"
+)
+
+const hlsContentType = "application/vnd.apple.mpegurl"
+
+// renderHLS renders the mapping as an HLS master playlist, with signed URLs
+// for the renditions. Subtitles (clips with the "subtitle" type, or WebVTT
+// files) are added as EXT-X-MEDIA entries, and every other sequence as a
+// variant stream.
+func renderHLS(c *Config, r *http.Request, m mapping) ([]byte, int, error) {
+	var hasSubtitles bool
+	for _, s := range m.Sequences {
+		if len(s.Clips) > 0 && isSubtitle(s.Clips[0]) {
+			hasSubtitles = true
+		}
+	}
+	var media, variants bytes.Buffer
+	for _, s := range m.Sequences {
+		if len(s.Clips) == 0 {
+			continue
+		}
+		clip := s.Clips[0]
+		url, status, err := signClipURL(c, r, clip.Path)
+		if err != nil {
+			return nil, status, err
+		}
+		if isSubtitle(clip) {
+			name := s.Label
+			if name == "" {
+				name = s.Language
+			}
+			if name == "" {
+				name = path.Base(clip.Path)
+			}
+			fmt.Fprintf(&media, `#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs",NAME=%q,`, name)
+			if s.Language != "" {
+				fmt.Fprintf(&media, "LANGUAGE=%q,", s.Language)
+			}
+			fmt.Fprintf(&media, "AUTOSELECT=YES,URI=%q\n", url)
+			continue
+		}
+		fmt.Fprintf(&variants, "#EXT-X-STREAM-INF:BANDWIDTH=%d", clipBandwidth(clip, m.Durations))
+		if hasSubtitles {
+			variants.WriteString(`,SUBTITLES="subs"`)
+		}
+		fmt.Fprintf(&variants, "\n%s\n", url)
+	}
+	var playlist bytes.Buffer
+	playlist.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n")
+	playlist.Write(media.Bytes())
+	playlist.Write(variants.Bytes())
+	return playlist.Bytes(), http.StatusOK, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func testTokenConfig() TokenConfig {
+	return TokenConfig{
+		URLPrefix:  "https://edge.example.com/",
+		Key:        "token-secret",
+		Param:      "token",
+		Expiration: time.Hour,
+	}
+}
+
+func TestServerMapHLS(t *testing.T) {
+	addr, cleanup := startServer(t, Config{
+		BucketName:     "my-bucket",
+		MapPrefix:      "/map/",
+		MapHLSPrefix:   "/hls/",
+		ProxyPrefix:    "/proxy/",
+		MapRegexFilter: `(480|720|1080)p\.mp4$|\.vtt$`,
+		Signer:         signerToken,
+		TokenConfig:    testTokenConfig(),
+	})
+	defer cleanup()
+	expected := regexp.MustCompile(`^#EXTM3U
+#EXT-X-VERSION:3
+#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs",NAME="77071_1_caption_wg_240p_001f8ea7-749b-4d43-7bd5-b357e4e24f32.vtt",AUTOSELECT=YES,URI="https://edge.example.com/videos/video/77071_1_caption_wg_240p_001f8ea7-749b-4d43-7bd5-b357e4e24f32.vtt\?token=\d+~[0-9a-f]{64}"
+#EXT-X-STREAM-INF:BANDWIDTH=5000000,SUBTITLES="subs"
+https://edge.example.com/videos/video/28043_1_video_1080p.mp4\?token=\d+~[0-9a-f]{64}
+#EXT-X-STREAM-INF:BANDWIDTH=1400000,SUBTITLES="subs"
+https://edge.example.com/videos/video/video1_480p.mp4\?token=\d+~[0-9a-f]{64}
+#EXT-X-STREAM-INF:BANDWIDTH=2800000,SUBTITLES="subs"
+https://edge.example.com/videos/video/video1_720p.mp4\?token=\d+~[0-9a-f]{64}
+$`)
+	var tests = []struct {
+		testCase string
+		url      string
+		accept   string
+	}{
+		{"hls prefix", addr + "/hls/videos/video/", ""},
+		{"accept header", addr + "/map/videos/video/", "application/vnd.apple.mpegurl"},
+	}
+	for _, test := range tests {
+		t.Run(test.testCase, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, test.url, nil)
+			if test.accept != "" {
+				req.Header.Set("Accept", test.accept)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := ioutil.ReadAll(resp.Body)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("wrong status code\nwant %d\ngot  %d: %s", http.StatusOK, resp.StatusCode, body)
+			}
+			if ct := resp.Header.Get("Content-Type"); ct != hlsContentType {
+				t.Errorf("wrong content type\nwant %q\ngot  %q", hlsContentType, ct)
+			}
+			if !expected.Match(body) {
+				t.Errorf("wrong playlist\nwant %s\ngot  %s", expected, body)
+			}
+		})
+	}
+}
+
+func TestMapFormat(t *testing.T) {
+	enabled := Config{Signer: signerToken, TokenConfig: testTokenConfig()}
+	var tests = []struct {
+		testCase string
+		config   Config
+		accept   string
+		expected string
+	}{
+		{"default", enabled, "", mapFormatJSON},
+		{"json", enabled, "application/json", mapFormatJSON},
+		{"hls", enabled, "application/vnd.apple.mpegurl", mapFormatHLS},
+		{"legacy hls type", enabled, "application/x-mpegURL", mapFormatHLS},
+		{"hls without signer", Config{}, "application/vnd.apple.mpegurl", mapFormatJSON},
+		{"dash", enabled, "application/dash+xml", mapFormatDASH},
+		{"dash without signer", Config{}, "application/dash+xml", mapFormatJSON},
+		{"ism", enabled, "application/smil+xml", mapFormatISM},
+		{"v2", Config{}, "application/vnd.gcs-helper.mapping.v2+json", mapFormatV2},
+	}
+	for _, test := range tests {
+		r, _ := http.NewRequest(http.MethodGet, "/videos/video/", nil)
+		r.Header.Set("Accept", test.accept)
+		if got := mapFormat(&test.config, r); got != test.expected {
+			t.Errorf("%s: wrong format\nwant %q\ngot  %q", test.testCase, test.expected, got)
+		}
+	}
+	r, _ := http.NewRequest(http.MethodGet, "/videos/video/", nil)
+	if got := mapFormat(&Config{}, withMapFormat(r, mapFormatHLS)); got != mapFormatHLS {
+		t.Errorf("wrong format\nwant %q\ngot  %q", mapFormatHLS, got)
+	}
+}
+
+func TestClipBandwidth(t *testing.T) {
+	var tests = []struct {
+		clip      clip
+		durations []int64
+		expected  int64
+	}{
+		{clip{Path: "/b/video_720p.mp4", Size: 1000000}, []int64{8000}, 1000000},
+		{clip{Path: "/b/video_720p.mp4"}, nil, 2800000},
+		{clip{Path: "/b/video_2160p.mp4", Size: 1000000}, nil, 16000000},
+		{clip{Path: "/b/video.mp4"}, nil, defaultBandwidth},
+	}
+	for _, test := range tests {
+		if got := clipBandwidth(test.clip, test.durations); got != test.expected {
+			t.Errorf("%s: wrong bandwidth\nwant %d\ngot  %d", test.clip.Path, test.expected, got)
+		}
+	}
+}
+
+func TestSignClipURLInvalidPath(t *testing.T) {
+	c := Config{Signer: signerToken, TokenConfig: testTokenConfig()}
+	r, _ := http.NewRequest(http.MethodGet, "/", nil)
+	for _, p := range []string{"/bucket-only", "relative", "//object"} {
+		if _, status, err := signClipURL(&c, r, p); err == nil || status != http.StatusBadRequest {
+			t.Errorf("%s: expected bad request error, got %d (%v)", p, status, err)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/oauth2/google"
+)
+
+const cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
+// iamCredentialsEndpoint is the base URL of the IAM credentials API.
+var iamCredentialsEndpoint = "https://iamcredentials.googleapis.com/v1/"
+
+// googleClient returns an HTTP client authenticated with the application
+// default credentials, used for calling Google APIs other than GCS.
+func googleClient(ctx context.Context, timeout time.Duration) (*http.Client, error) {
+	client, err := google.DefaultClient(ctx, cloudPlatformScope)
+	if err != nil {
+		return nil, err
+	}
+	client.Timeout = timeout
+	return client, nil
+}
+
+// iamSignBlob signs the given data with the system-managed key of the
+// service account, using the signBlob method of the IAM credentials API.
+//
+// See https://cloud.google.com/iam/docs/reference/credentials/rest/v1/projects.serviceAccounts/signBlob.
+func iamSignBlob(client *http.Client, serviceAccount string, data []byte) ([]byte, error) {
+	if client == nil {
+		return nil, errors.New("IAM signing client is not configured")
+	}
+	body, err := json.Marshal(map[string]string{
+		"payload": base64.StdEncoding.EncodeToString(data),
+	})
+	if err != nil {
+		return nil, err
+	}
+	endpoint := iamCredentialsEndpoint + "projects/-/serviceAccounts/" + url.PathEscape(serviceAccount) + ":signBlob"
+	resp, err := client.Post(endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to sign blob: IAM credentials API returned %d", resp.StatusCode)
+	}
+	var result struct {
+		SignedBlob string `json:"signedBlob"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(result.SignedBlob)
+}
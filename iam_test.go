@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func startFakeIAMServer(t *testing.T) func() {
+	testSignConfig(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/projects/-/serviceAccounts/signer@project.iam.gserviceaccount.com:signBlob" {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		var req struct {
+			Payload string `json:"payload"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		payload, err := base64.StdEncoding.DecodeString(req.Payload)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sum := sha256.Sum256(payload)
+		signature, _ := rsa.SignPKCS1v15(rand.Reader, testKey, crypto.SHA256, sum[:])
+		json.NewEncoder(w).Encode(map[string]string{
+			"keyId":      "key-1",
+			"signedBlob": base64.StdEncoding.EncodeToString(signature),
+		})
+	}))
+	originalEndpoint := iamCredentialsEndpoint
+	iamCredentialsEndpoint = server.URL + "/"
+	return func() {
+		iamCredentialsEndpoint = originalEndpoint
+		server.Close()
+	}
+}
+
+func TestSignedURLIAM(t *testing.T) {
+	cleanup := startFakeIAMServer(t)
+	defer cleanup()
+	c := testSignConfig(t)
+	c.Mode = signModeIAM
+	c.PrivateKey = ""
+	c.iamClient = http.DefaultClient
+	if !c.enabled() {
+		t.Fatal("signing should be enabled without a private key in iam mode")
+	}
+	signed, err := signedURL(c, http.MethodGet, "my-bucket", "videos/video1_720p.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	signature, err := base64.StdEncoding.DecodeString(q.Get("Signature"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte("GET\n\n\n" + q.Get("Expires") + "\n/my-bucket/videos/video1_720p.mp4"))
+	if err = rsa.VerifyPKCS1v15(&testKey.PublicKey, crypto.SHA256, sum[:], signature); err != nil {
+		t.Errorf("invalid signature: %v", err)
+	}
+}
+
+func TestIAMSignBlobErrors(t *testing.T) {
+	cleanup := startFakeIAMServer(t)
+	defer cleanup()
+	if _, err := iamSignBlob(nil, "signer@project.iam.gserviceaccount.com", []byte("data")); err == nil {
+		t.Error("unexpected <nil> error for missing client")
+	}
+	if _, err := iamSignBlob(http.DefaultClient, "unknown@project.iam.gserviceaccount.com", []byte("data")); err == nil {
+		t.Error("unexpected <nil> error for unknown service account")
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	iapHeader      = "X-Goog-IAP-JWT-Assertion"
+	iapIssuer      = "https://cloud.google.com/iap"
+	iapJWKSRefresh = time.Hour
+)
+
+// iapJWKSURL is the JSON Web Key Set with the keys that sign the assertions
+// of Identity-Aware Proxy.
+var iapJWKSURL = "https://www.gstatic.com/iap/verify/public_key-jwk"
+
+// IAPConfig contains the configuration of the verification of the assertions
+// of Identity-Aware Proxy, which is enabled when GCS_HELPER_IAP_AUDIENCE is
+// set.
+type IAPConfig struct {
+	Audience    string    `envconfig:"GCS_HELPER_IAP_AUDIENCE"`
+	PrefixRules PrefixMap `envconfig:"GCS_HELPER_IAP_PREFIX_RULES"`
+}
+
+func (c IAPConfig) enabled() bool {
+	return c.Audience != ""
+}
+
+func (c IAPConfig) validate() error {
+	if !c.enabled() {
+		if len(c.PrefixRules) > 0 {
+			return errors.New("GCS_HELPER_IAP_PREFIX_RULES requires GCS_HELPER_IAP_AUDIENCE")
+		}
+		return nil
+	}
+	if !strings.HasPrefix(c.Audience, "/projects/") {
+		return fmt.Errorf("invalid GCS_HELPER_IAP_AUDIENCE %q: must be like %q or %q", c.Audience, "/projects/123/global/backendServices/456", "/projects/123/apps/my-project")
+	}
+	for prefix, pattern := range c.PrefixRules {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("invalid GCS_HELPER_IAP_PREFIX_RULES rule for %s: %v", prefix, err)
+		}
+	}
+	return nil
+}
+
+// verifier returns the verifier of the assertions, which are tokens signed
+// with ES256 by the keys of Identity-Aware Proxy.
+func (c IAPConfig) verifier(client *http.Client) *jwtVerifier {
+	return newJWTVerifier(JWTConfig{
+		JWKSURL:     iapJWKSURL,
+		JWKSRefresh: iapJWKSRefresh,
+		Issuer:      iapIssuer,
+		Audience:    c.Audience,
+	}, client)
+}
+
+type iapRule struct {
+	prefix string
+	email  *regexp.Regexp
+}
+
+// rules returns the rules of GCS_HELPER_IAP_PREFIX_RULES, with the longest
+// prefixes first.
+func (c IAPConfig) rules() []iapRule {
+	var rules []iapRule
+	for prefix, pattern := range c.PrefixRules {
+		rules = append(rules, iapRule{prefix: prefix, email: regexp.MustCompile(pattern)})
+	}
+	// the longest matching prefix wins.
+	sort.Slice(rules, func(i, j int) bool {
+		return len(rules[i].prefix) > len(rules[j].prefix)
+	})
+	return rules
+}
+
+// iapAllowed reports whether the user with the given email can access the
+// given path, which is the case when the email matches the rule of the
+// longest prefix of the path, or when no rule matches the path.
+func iapAllowed(rules []iapRule, path, email string) bool {
+	path = strings.TrimPrefix(path, "/")
+	for _, rule := range rules {
+		if strings.HasPrefix(path, rule.prefix) {
+			return rule.email.MatchString(email)
+		}
+	}
+	return true
+}
+
+// iapHandler wraps the given handler, requiring requests to have a valid
+// assertion of Identity-Aware Proxy, for the audience of
+// GCS_HELPER_IAP_AUDIENCE, in the x-goog-iap-jwt-assertion header. The
+// identity of the user is added to the logs of the request, and checked
+// against GCS_HELPER_IAP_PREFIX_RULES.
+func iapHandler(c Config, v *jwtVerifier, handler http.HandlerFunc) http.HandlerFunc {
+	logger := c.logger()
+	rules := c.IAPConfig.rules()
+	return func(w http.ResponseWriter, r *http.Request) {
+		assertion := r.Header.Get(iapHeader)
+		if assertion == "" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		claims, err := v.verify(r.Context(), assertion, time.Now())
+		if err != nil {
+			requestLogger(r.Context(), logger).WithError(err).Warn("invalid IAP assertion")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		addLogFields(r.Context(), logrus.Fields{"iapSubject": claims.Subject, "iapEmail": claims.Email})
+		if !iapAllowed(rules, r.URL.Path, claims.Email) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		handler(w, r)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const testIAPAudience = "/projects/123/global/backendServices/456"
+
+// useTestIAPKeys makes the verifiers of IAP assertions use the keys of the
+// given JWKS server.
+func useTestIAPKeys(server *httptest.Server) func() {
+	originalURL := iapJWKSURL
+	iapJWKSURL = server.URL
+	return func() {
+		iapJWKSURL = originalURL
+	}
+}
+
+func testIAPClaims(now time.Time, email string) map[string]interface{} {
+	return map[string]interface{}{
+		"iss":   iapIssuer,
+		"sub":   "accounts.google.com:1234",
+		"email": email,
+		"aud":   testIAPAudience,
+		"iat":   now.Unix(),
+		"exp":   now.Add(10 * time.Minute).Unix(),
+	}
+}
+
+func TestIAPHandler(t *testing.T) {
+	keys := newJWTTestKeys(t)
+	server, _ := startJWKSServer(keys)
+	defer server.Close()
+	defer useTestIAPKeys(server)()
+	var buf bytes.Buffer
+	logger := logrus.New()
+	logger.Out = &buf
+	logger.Formatter = &logrus.JSONFormatter{}
+	config := Config{
+		AccessLog: true,
+		IAPConfig: IAPConfig{
+			Audience: testIAPAudience,
+			PrefixRules: PrefixMap{
+				"private/":         `@example\.com$`,
+				"private/finance/": `^cfo@example\.com$`,
+			},
+		},
+	}
+	handler := accessLogHandler(config, logger, iapHandler(config, config.IAPConfig.verifier(server.Client()), func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	now := time.Now()
+	user := signTestJWT(t, keys, "ES256", "ec-key", testIAPClaims(now, "user@example.com"))
+	cfo := signTestJWT(t, keys, "ES256", "ec-key", testIAPClaims(now, "cfo@example.com"))
+	partner := signTestJWT(t, keys, "ES256", "ec-key", testIAPClaims(now, "someone@partner.com"))
+	wrongAudience := testIAPClaims(now, "user@example.com")
+	wrongAudience["aud"] = "/projects/123/global/backendServices/789"
+	var tests = []struct {
+		path           string
+		assertion      string
+		expectedStatus int
+	}{
+		{"/videos/video1.mp4", user, http.StatusOK},
+		{"/videos/video1.mp4", partner, http.StatusOK},
+		{"/private/video1.mp4", user, http.StatusOK},
+		{"/private/video1.mp4", partner, http.StatusForbidden},
+		{"/private/finance/report.mp4", user, http.StatusForbidden},
+		{"/private/finance/report.mp4", cfo, http.StatusOK},
+		{"/videos/video1.mp4", "", http.StatusUnauthorized},
+		{"/videos/video1.mp4", signTestJWT(t, keys, "ES256", "ec-key", wrongAudience), http.StatusUnauthorized},
+		{"/videos/video1.mp4", user[:len(user)-2], http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, test.path, nil)
+		if test.assertion != "" {
+			req.Header.Set("x-goog-iap-jwt-assertion", test.assertion)
+		}
+		w := httptest.NewRecorder()
+		handler(w, req)
+		if w.Code != test.expectedStatus {
+			t.Errorf("%s: wrong status\nwant %d\ngot  %d", test.path, test.expectedStatus, w.Code)
+		}
+	}
+	var entry map[string]interface{}
+	for _, e := range decodeLogEntries(t, &buf) {
+		if e["msg"] != "invalid IAP assertion" {
+			entry = e
+			break
+		}
+	}
+	if entry["iapEmail"] != "user@example.com" || entry["iapSubject"] != "accounts.google.com:1234" {
+		t.Errorf("missing identity in access log %v", entry)
+	}
+}
+
+func TestIAPServer(t *testing.T) {
+	keys := newJWTTestKeys(t)
+	jwks, _ := startJWKSServer(keys)
+	defer jwks.Close()
+	defer useTestIAPKeys(jwks)()
+	addr, cleanup := startServer(t, Config{
+		BucketName:   "my-bucket",
+		ProxyPrefix:  "/proxy/",
+		ProxyTimeout: time.Second,
+		MapPrefix:    "/map/",
+		LivenessPath: "/healthz",
+		IAPConfig:    IAPConfig{Audience: testIAPAudience},
+	})
+	defer cleanup()
+	assertion := signTestJWT(t, keys, "ES256", "ec-key", testIAPClaims(time.Now(), "user@example.com"))
+	get := func(path, assertion string) int {
+		req, _ := http.NewRequest(http.MethodGet, addr+path, nil)
+		if assertion != "" {
+			req.Header.Set("X-Goog-IAP-JWT-Assertion", assertion)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := get("/proxy/musics/music/music1.txt", assertion); status != http.StatusOK {
+		t.Errorf("wrong status with a valid assertion %d", status)
+	}
+	if status := get("/proxy/musics/music/music1.txt", ""); status != http.StatusUnauthorized {
+		t.Errorf("wrong status without assertion %d", status)
+	}
+	// health checks of the load balancer don't go through IAP.
+	if status := get("/healthz", ""); status != http.StatusOK {
+		t.Errorf("wrong status of the health check %d", status)
+	}
+}
+
+func TestIAPConfigValidate(t *testing.T) {
+	var tests = []struct {
+		config IAPConfig
+		valid  bool
+	}{
+		{IAPConfig{}, true},
+		{IAPConfig{Audience: testIAPAudience}, true},
+		{IAPConfig{Audience: "/projects/123/apps/my-project", PrefixRules: PrefixMap{"private/": `@example\.com$`}}, true},
+		{IAPConfig{Audience: "my-backend"}, false},
+		{IAPConfig{Audience: testIAPAudience, PrefixRules: PrefixMap{"private/": `(`}}, false},
+		{IAPConfig{PrefixRules: PrefixMap{"private/": `@example\.com$`}}, false},
+	}
+	for _, test := range tests {
+		err := test.config.validate()
+		if test.valid && err != nil {
+			t.Errorf("%#v: unexpected error: %v", test.config, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%#v: unexpected <nil> error", test.config)
+		}
+	}
+}
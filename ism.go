@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+)
+
+const ismContentType = "application/smil+xml"
+
+// ismParam is a parameter of an ISM track.
+type ismParam struct {
+	Name      string `xml:"name,attr"`
+	Value     string `xml:"value,attr"`
+	ValueType string `xml:"valuetype,attr"`
+}
+
+// ismTrack is a track of the server manifest. The element name (video, audio
+// or textstream) is set through XMLName.
+type ismTrack struct {
+	XMLName        xml.Name
+	Src            string     `xml:"src,attr"`
+	SystemBitrate  int64      `xml:"systemBitrate,attr"`
+	SystemLanguage string     `xml:"systemLanguage,attr,omitempty"`
+	Params         []ismParam `xml:"param"`
+}
+
+type ismManifest struct {
+	XMLName xml.Name   `xml:"http://www.w3.org/2001/SMIL20/Language smil"`
+	Tracks  []ismTrack `xml:"body>switch>track"`
+}
+
+// ismElements maps the content types returned by clipMediaType to the
+// elements used by Unified Origin server manifests.
+var ismElements = map[string]string{
+	"video": "video",
+	"audio": "audio",
+	"text":  "textstream",
+}
+
+// renderISM renders the mapping as a Unified Origin server manifest (.ism),
+// with one track for each sequence pointing at its signed URL, so Unified
+// Origin can use the mapped files as remote storage.
+func renderISM(c *Config, r *http.Request, m mapping) ([]byte, int, error) {
+	manifest := ismManifest{}
+	for _, s := range m.Sequences {
+		if len(s.Clips) == 0 {
+			continue
+		}
+		clip := s.Clips[0]
+		url, status, err := signClipURL(c, r, clip.Path)
+		if err != nil {
+			return nil, status, err
+		}
+		contentType, _ := clipMediaType(clip)
+		element := ismElements[contentType]
+		track := ismTrack{
+			XMLName:        xml.Name{Local: element},
+			Src:            url,
+			SystemBitrate:  clipBandwidth(clip, m.Durations),
+			SystemLanguage: s.Language,
+			Params: []ismParam{
+				{Name: "trackName", Value: element, ValueType: "data"},
+			},
+		}
+		if s.Label != "" {
+			track.Params = append(track.Params, ismParam{Name: "trackTitle", Value: s.Label, ValueType: "data"})
+		}
+		manifest.Tracks = append(manifest.Tracks, track)
+	}
+	body, err := xml.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	return append([]byte(xml.Header), append(body, '\n')...), http.StatusOK, nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"testing"
+)
+
+func TestServerMapISM(t *testing.T) {
+	addr, cleanup := startServer(t, Config{
+		BucketName:     "my-bucket",
+		MapPrefix:      "/map/",
+		MapISMPrefix:   "/ism/",
+		ProxyPrefix:    "/proxy/",
+		MapRegexFilter: `(480|720)p\.mp4$|\.vtt$`,
+		Signer:         signerToken,
+		TokenConfig:    testTokenConfig(),
+	})
+	defer cleanup()
+	expected := regexp.MustCompile(`^<\?xml version="1.0" encoding="UTF-8"\?>
+<smil xmlns="http://www.w3.org/2001/SMIL20/Language">
+  <body>
+    <switch>
+      <textstream src="https://edge.example.com/videos/video/77071_1_caption_wg_240p_001f8ea7-749b-4d43-7bd5-b357e4e24f32.vtt\?token=\d+~[0-9a-f]{64}" systemBitrate="400000">
+        <param name="trackName" value="textstream" valuetype="data"></param>
+      </textstream>
+      <video src="https://edge.example.com/videos/video/video1_480p.mp4\?token=\d+~[0-9a-f]{64}" systemBitrate="1400000">
+        <param name="trackName" value="video" valuetype="data"></param>
+      </video>
+      <video src="https://edge.example.com/videos/video/video1_720p.mp4\?token=\d+~[0-9a-f]{64}" systemBitrate="2800000">
+        <param name="trackName" value="video" valuetype="data"></param>
+      </video>
+    </switch>
+  </body>
+</smil>
+$`)
+	var tests = []struct {
+		testCase string
+		url      string
+		accept   string
+	}{
+		{"ism prefix", addr + "/ism/videos/video/", ""},
+		{"accept header", addr + "/map/videos/video/", "application/smil+xml"},
+	}
+	for _, test := range tests {
+		t.Run(test.testCase, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, test.url, nil)
+			if test.accept != "" {
+				req.Header.Set("Accept", test.accept)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := ioutil.ReadAll(resp.Body)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("wrong status code\nwant %d\ngot  %d: %s", http.StatusOK, resp.StatusCode, body)
+			}
+			if ct := resp.Header.Get("Content-Type"); ct != ismContentType {
+				t.Errorf("wrong content type\nwant %q\ngot  %q", ismContentType, ct)
+			}
+			if !expected.Match(body) {
+				t.Errorf("wrong manifest\nwant %s\ngot  %s", expected, body)
+			}
+		})
+	}
+}
+
+func TestRenderISMLabels(t *testing.T) {
+	c := Config{Signer: signerToken, TokenConfig: testTokenConfig()}
+	r, _ := http.NewRequest(http.MethodGet, "/videos/", nil)
+	m := mapping{Sequences: []sequence{
+		{Language: "pt", Label: "Português", Clips: []clip{{Type: "audio", Path: "/b/videos/movie_pt.mp4"}}},
+	}}
+	manifest, _, err := renderISM(&c, r, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := regexp.MustCompile(`<audio src="[^"]+" systemBitrate="\d+" systemLanguage="pt">
+\s+<param name="trackName" value="audio" valuetype="data"></param>
+\s+<param name="trackTitle" value="Português" valuetype="data"></param>
+\s+</audio>`)
+	if !expected.Match(manifest) {
+		t.Errorf("wrong manifest\nwant %s\ngot  %s", expected, manifest)
+	}
+}
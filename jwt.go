@@ -0,0 +1,434 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// jwtLeeway is the clock skew tolerated when checking the expiration
+	// and the start of the validity of tokens.
+	jwtLeeway = time.Minute
+	// jwksMinRefreshInterval limits how often the keys are fetched again
+	// when tokens are signed with unknown keys, or after failures.
+	jwksMinRefreshInterval = time.Minute
+	jwksFetchTimeout       = 10 * time.Second
+)
+
+// jwtHandlerNames are the handlers that can require tokens. The other ones
+// already require the bearer tokens of GCS_HELPER_UPLOAD_TOKEN or
+// GCS_HELPER_ADMIN_TOKEN.
+var jwtHandlerNames = map[string]bool{
+	"map":         true,
+	"proxy":       true,
+	"meta":        true,
+	"redirect":    true,
+	"sign":        true,
+	"sign_cookie": true,
+	"list":        true,
+}
+
+// JWTConfig contains the configuration of the validation of the JWT bearer
+// tokens of incoming requests, which is enabled when
+// GCS_HELPER_JWT_JWKS_URL is set.
+type JWTConfig struct {
+	JWKSURL     string        `envconfig:"GCS_HELPER_JWT_JWKS_URL"`
+	JWKSRefresh time.Duration `envconfig:"GCS_HELPER_JWT_JWKS_REFRESH" default:"1h"`
+	Issuer      string        `envconfig:"GCS_HELPER_JWT_ISSUER"`
+	Audience    string        `envconfig:"GCS_HELPER_JWT_AUDIENCE"`
+	PrefixClaim string        `envconfig:"GCS_HELPER_JWT_PREFIX_CLAIM"`
+	Handlers    []string      `envconfig:"GCS_HELPER_JWT_HANDLERS" default:"map"`
+}
+
+func (c JWTConfig) enabled() bool {
+	return c.JWKSURL != ""
+}
+
+func (c JWTConfig) validate() error {
+	if !c.enabled() {
+		return nil
+	}
+	if u, err := url.Parse(c.JWKSURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("invalid GCS_HELPER_JWT_JWKS_URL %q: must be an http or https URL", c.JWKSURL)
+	}
+	if c.Issuer == "" || c.Audience == "" {
+		return errors.New("GCS_HELPER_JWT_JWKS_URL requires GCS_HELPER_JWT_ISSUER and GCS_HELPER_JWT_AUDIENCE")
+	}
+	for _, name := range c.Handlers {
+		if !jwtHandlerNames[name] {
+			return fmt.Errorf("invalid handler in GCS_HELPER_JWT_HANDLERS %q: must be one of map, proxy, meta, redirect, sign, sign_cookie or list", name)
+		}
+	}
+	return nil
+}
+
+// protects reports whether requests to the handler with the given name
+// require a token.
+func (c JWTConfig) protects(name string) bool {
+	if !c.enabled() {
+		return false
+	}
+	for _, n := range c.Handlers {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// jwtClaims are the claims of a token that are checked by gcs-helper. The
+// remaining claims are kept in raw, for GCS_HELPER_JWT_PREFIX_CLAIM.
+type jwtClaims struct {
+	Issuer    string      `json:"iss"`
+	Subject   string      `json:"sub"`
+	Email     string      `json:"email"`
+	Audience  jwtAudience `json:"aud"`
+	ExpiresAt int64       `json:"exp"`
+	NotBefore int64       `json:"nbf"`
+
+	raw map[string]json.RawMessage
+}
+
+// jwtAudience is the aud claim, which is either a string or an array of
+// strings.
+type jwtAudience []string
+
+func (a *jwtAudience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = jwtAudience{single}
+		return nil
+	}
+	var multiple []string
+	if err := json.Unmarshal(data, &multiple); err != nil {
+		return errors.New("invalid aud claim")
+	}
+	*a = multiple
+	return nil
+}
+
+func (a jwtAudience) contains(audience string) bool {
+	for _, aud := range a {
+		if aud == audience {
+			return true
+		}
+	}
+	return false
+}
+
+// stringsClaim returns the values of the given claim, which is either a
+// string or an array of strings.
+func (c jwtClaims) stringsClaim(name string) []string {
+	var values jwtAudience
+	if data, ok := c.raw[name]; !ok || json.Unmarshal(data, &values) != nil {
+		return nil
+	}
+	return values
+}
+
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+}
+
+// jwtVerifier verifies tokens signed with RS256 or ES256 by the keys of a
+// JSON Web Key Set, which are fetched when needed, and again after
+// GCS_HELPER_JWT_JWKS_REFRESH or when tokens are signed with unknown keys.
+type jwtVerifier struct {
+	config JWTConfig
+	client *http.Client
+
+	mu          sync.Mutex
+	keys        map[string]crypto.PublicKey
+	fetchedAt   time.Time
+	attemptedAt time.Time
+	fetchErr    error
+	// fetching is closed when the keys being fetched are available.
+	fetching chan struct{}
+}
+
+func newJWTVerifier(c JWTConfig, client *http.Client) *jwtVerifier {
+	return &jwtVerifier{config: c, client: client}
+}
+
+// verify checks the signature and the claims of the given token, returning
+// its claims.
+func (v *jwtVerifier) verify(ctx context.Context, token string, now time.Time) (jwtClaims, error) {
+	var claims jwtClaims
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, errors.New("malformed token")
+	}
+	var header jwtHeader
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return claims, errors.New("malformed token header")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, errors.New("malformed token signature")
+	}
+	key, err := v.key(ctx, header.KeyID, now)
+	if err != nil {
+		return claims, err
+	}
+	if err = verifyJWTSignature(header.Algorithm, key, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return claims, err
+	}
+	if err = decodeJWTPart(parts[1], &claims); err != nil {
+		return claims, errors.New("malformed token claims")
+	}
+	if err = decodeJWTPart(parts[1], &claims.raw); err != nil {
+		return claims, errors.New("malformed token claims")
+	}
+	switch {
+	case claims.Issuer != v.config.Issuer:
+		return claims, errors.New("wrong issuer")
+	case !claims.Audience.contains(v.config.Audience):
+		return claims, errors.New("wrong audience")
+	case claims.ExpiresAt == 0 || now.Add(-jwtLeeway).Unix() >= claims.ExpiresAt:
+		return claims, errors.New("expired token")
+	case claims.NotBefore != 0 && now.Add(jwtLeeway).Unix() < claims.NotBefore:
+		return claims, errors.New("token not valid yet")
+	}
+	return claims, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed, signature []byte) error {
+	hash := sha256.Sum256(signed)
+	switch alg {
+	case "RS256":
+		if k, ok := key.(*rsa.PublicKey); ok && rsa.VerifyPKCS1v15(k, crypto.SHA256, hash[:], signature) == nil {
+			return nil
+		}
+	case "ES256":
+		k, ok := key.(*ecdsa.PublicKey)
+		if ok && len(signature) == 64 {
+			r := new(big.Int).SetBytes(signature[:32])
+			s := new(big.Int).SetBytes(signature[32:])
+			if ecdsa.Verify(k, hash[:], r, s) {
+				return nil
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	return errors.New("invalid signature")
+}
+
+// key returns the key with the given ID, fetching the keys again when it's
+// unknown, or when they're older than GCS_HELPER_JWT_JWKS_REFRESH. The keys
+// are fetched without holding the lock, by a single request at a time, and
+// at most once per minute, whether the previous attempt failed or not.
+func (v *jwtVerifier) key(ctx context.Context, id string, now time.Time) (crypto.PublicKey, error) {
+	v.mu.Lock()
+	for {
+		key, ok := v.keys[id]
+		if ok && now.Sub(v.fetchedAt) < v.config.JWKSRefresh {
+			v.mu.Unlock()
+			return key, nil
+		}
+		if now.Sub(v.attemptedAt) < jwksMinRefreshInterval {
+			err := v.fetchErr
+			v.mu.Unlock()
+			switch {
+			case ok:
+				// the previous keys are used when the keys can't be
+				// refreshed.
+				return key, nil
+			case err != nil:
+				return nil, fmt.Errorf("failed to fetch keys: %v", err)
+			}
+			return nil, fmt.Errorf("unknown key %q", id)
+		}
+		if v.fetching == nil {
+			break
+		}
+		if ok {
+			v.mu.Unlock()
+			return key, nil
+		}
+		fetching := v.fetching
+		v.mu.Unlock()
+		select {
+		case <-fetching:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		v.mu.Lock()
+	}
+	fetching := make(chan struct{})
+	v.fetching = fetching
+	v.attemptedAt = now
+	v.mu.Unlock()
+
+	// the keys are shared by all requests, so the fetch isn't canceled
+	// with the request that started it.
+	keys, err := fetchJWKS(detachedContext(ctx), v.client, v.config.JWKSURL)
+
+	v.mu.Lock()
+	v.fetching = nil
+	v.fetchErr = err
+	if err == nil {
+		v.keys = keys
+		v.fetchedAt = now
+	}
+	close(fetching)
+	v.mu.Unlock()
+	return v.key(ctx, id, now)
+}
+
+// jsonWebKey is an RSA or P-256 key of a JSON Web Key Set.
+//
+// See https://tools.ietf.org/html/rfc7517.
+type jsonWebKey struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	Use     string `json:"use"`
+	N       string `json:"n"`
+	E       string `json:"e"`
+	Curve   string `json:"crv"`
+	X       string `json:"x"`
+	Y       string `json:"y"`
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	decode := func(value string) (*big.Int, error) {
+		data, err := base64.RawURLEncoding.DecodeString(value)
+		if err != nil || len(data) == 0 {
+			return nil, errors.New("invalid key parameter")
+		}
+		return new(big.Int).SetBytes(data), nil
+	}
+	switch k.KeyType {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil || !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if k.Curve != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Curve)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !elliptic.P256().IsOnCurve(x, y) {
+			return nil, errors.New("invalid point")
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.KeyType)
+}
+
+// fetchJWKS returns the signing keys of the JSON Web Key Set at the given
+// URL by ID, skipping the keys that aren't supported.
+func fetchJWKS(ctx context.Context, client *http.Client, url string) (map[string]crypto.PublicKey, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil, fmt.Errorf("JWKS URL returned %d", resp.StatusCode)
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if key, err := k.publicKey(); err == nil {
+			keys[k.KeyID] = key
+		}
+	}
+	return keys, nil
+}
+
+// jwtHandler wraps the given handler, requiring requests to have a valid
+// token in their Authorization header. When GCS_HELPER_JWT_PREFIX_CLAIM is
+// set, the path of the request must also start with one of the prefixes in
+// the given claim of the token. The subject of the token is added to the
+// logs of the request.
+func jwtHandler(c Config, v *jwtVerifier, handler http.HandlerFunc) http.HandlerFunc {
+	logger := c.logger()
+	return func(w http.ResponseWriter, r *http.Request) {
+		const prefix = "Bearer "
+		header := r.Header.Get("Authorization")
+		if !strings.HasPrefix(header, prefix) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		claims, err := v.verify(r.Context(), header[len(prefix):], time.Now())
+		if err != nil {
+			requestLogger(r.Context(), logger).WithError(err).Debug("invalid token")
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		addLogFields(r.Context(), logrus.Fields{"subject": claims.Subject})
+		if c.JWTConfig.PrefixClaim != "" && !allowedPrefix(r.URL.Path, claims.stringsClaim(c.JWTConfig.PrefixClaim)) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// allowedPrefix reports whether the given path starts with one of the given
+// prefixes.
+func allowedPrefix(path string, prefixes []string) bool {
+	path = strings.TrimPrefix(path, "/")
+	for _, prefix := range prefixes {
+		if prefix != "" && strings.HasPrefix(path, strings.TrimPrefix(prefix, "/")) {
+			return true
+		}
+	}
+	return false
+}
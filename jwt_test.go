@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// jwtTestKeys are the keys of the JSON Web Key Set served by
+// startJWKSServer.
+type jwtTestKeys struct {
+	rsa *rsa.PrivateKey
+	ec  *ecdsa.PrivateKey
+}
+
+func newJWTTestKeys(t *testing.T) jwtTestKeys {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return jwtTestKeys{rsa: rsaKey, ec: ecKey}
+}
+
+// startJWKSServer serves the public keys, with the IDs "rsa-key" and
+// "ec-key", and counts the requests.
+func startJWKSServer(keys jwtTestKeys) (*httptest.Server, *int) {
+	encode := func(b []byte) string {
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	coordinate := func(n *big.Int) string {
+		return encode(paddedBytes(n, 32))
+	}
+	set := map[string][]jsonWebKey{"keys": {
+		{
+			KeyType: "RSA",
+			KeyID:   "rsa-key",
+			Use:     "sig",
+			N:       encode(keys.rsa.N.Bytes()),
+			E:       encode(big.NewInt(int64(keys.rsa.E)).Bytes()),
+		},
+		{
+			KeyType: "EC",
+			KeyID:   "ec-key",
+			Curve:   "P-256",
+			X:       coordinate(keys.ec.X),
+			Y:       coordinate(keys.ec.Y),
+		},
+		{KeyType: "oct", KeyID: "symmetric-key"},
+	}}
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		json.NewEncoder(w).Encode(set)
+	}))
+	return server, &requests
+}
+
+// signTestJWT returns a token with the given claims, signed with the key of
+// the given algorithm.
+func signTestJWT(t *testing.T, keys jwtTestKeys, alg, kid string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	hash := sha256.Sum256([]byte(signed))
+	var signature []byte
+	switch alg {
+	case "RS256":
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, keys.rsa, crypto.SHA256, hash[:]); err != nil {
+			t.Fatal(err)
+		}
+	case "ES256":
+		r, s, err := ecdsa.Sign(rand.Reader, keys.ec, hash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = append(paddedBytes(r, 32), paddedBytes(s, 32)...)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// paddedBytes returns the big-endian bytes of n, left-padded to size.
+func paddedBytes(n *big.Int, size int) []byte {
+	b := n.Bytes()
+	return append(make([]byte, size-len(b)), b...)
+}
+
+func testJWTClaims(now time.Time) map[string]interface{} {
+	return map[string]interface{}{
+		"iss": "https://auth.example.com/",
+		"sub": "user-1",
+		"aud": []string{"other", "gcs-helper"},
+		"exp": now.Add(time.Hour).Unix(),
+		"nbf": now.Add(-time.Minute).Unix(),
+	}
+}
+
+func testJWTConfig(jwksURL string) JWTConfig {
+	return JWTConfig{
+		JWKSURL:     jwksURL,
+		JWKSRefresh: time.Hour,
+		Issuer:      "https://auth.example.com/",
+		Audience:    "gcs-helper",
+		Handlers:    []string{"map"},
+	}
+}
+
+func TestJWTVerifierVerify(t *testing.T) {
+	keys := newJWTTestKeys(t)
+	server, _ := startJWKSServer(keys)
+	defer server.Close()
+	now := time.Now()
+	with := func(name string, value interface{}) map[string]interface{} {
+		claims := testJWTClaims(now)
+		if value == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = value
+		}
+		return claims
+	}
+	var tests = []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{"RS256", signTestJWT(t, keys, "RS256", "rsa-key", testJWTClaims(now)), true},
+		{"ES256", signTestJWT(t, keys, "ES256", "ec-key", testJWTClaims(now)), true},
+		{"single audience", signTestJWT(t, keys, "RS256", "rsa-key", with("aud", "gcs-helper")), true},
+		{"no nbf", signTestJWT(t, keys, "RS256", "rsa-key", with("nbf", nil)), true},
+		{"expiration within leeway", signTestJWT(t, keys, "RS256", "rsa-key", with("exp", now.Add(-30*time.Second).Unix())), true},
+		{"expired", signTestJWT(t, keys, "RS256", "rsa-key", with("exp", now.Add(-time.Hour).Unix())), false},
+		{"no exp", signTestJWT(t, keys, "RS256", "rsa-key", with("exp", nil)), false},
+		{"not valid yet", signTestJWT(t, keys, "RS256", "rsa-key", with("nbf", now.Add(time.Hour).Unix())), false},
+		{"wrong issuer", signTestJWT(t, keys, "RS256", "rsa-key", with("iss", "https://other.example.com/")), false},
+		{"wrong audience", signTestJWT(t, keys, "RS256", "rsa-key", with("aud", "other")), false},
+		{"wrong key", signTestJWT(t, keys, "RS256", "ec-key", testJWTClaims(now)), false},
+		{"unknown key", signTestJWT(t, keys, "RS256", "other-key", testJWTClaims(now)), false},
+		{"unsupported algorithm", signTestJWT(t, keys, "HS256", "symmetric-key", testJWTClaims(now)), false},
+		{"malformed", "not-a-token", false},
+	}
+	v := newJWTVerifier(testJWTConfig(server.URL), server.Client())
+	for _, test := range tests {
+		claims, err := v.verify(context.Background(), test.token, now)
+		if test.valid && err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: unexpected <nil> error", test.name)
+		}
+		if test.valid && claims.Subject != "user-1" {
+			t.Errorf("%s: wrong subject %q", test.name, claims.Subject)
+		}
+	}
+
+	// tampered claims don't match the signature.
+	token := signTestJWT(t, keys, "RS256", "rsa-key", testJWTClaims(now))
+	payload, _ := json.Marshal(with("sub", "admin"))
+	parts := bytes.Split([]byte(token), []byte("."))
+	tampered := string(parts[0]) + "." + base64.RawURLEncoding.EncodeToString(payload) + "." + string(parts[2])
+	if _, err := v.verify(context.Background(), tampered, now); err == nil {
+		t.Error("unexpected <nil> error for a tampered token")
+	}
+}
+
+func TestJWTVerifierKeyRefresh(t *testing.T) {
+	keys := newJWTTestKeys(t)
+	server, requests := startJWKSServer(keys)
+	defer server.Close()
+	now := time.Now()
+	v := newJWTVerifier(testJWTConfig(server.URL), server.Client())
+	token := signTestJWT(t, keys, "RS256", "rsa-key", testJWTClaims(now))
+	for i := 0; i < 3; i++ {
+		if _, err := v.verify(context.Background(), token, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if *requests != 1 {
+		t.Errorf("wrong number of JWKS requests\nwant 1\ngot  %d", *requests)
+	}
+
+	// unknown keys are fetched again at most once per minute.
+	unknown := signTestJWT(t, keys, "RS256", "other-key", testJWTClaims(now))
+	v.verify(context.Background(), unknown, now.Add(30*time.Second))
+	if *requests != 1 {
+		t.Errorf("wrong number of JWKS requests\nwant 1\ngot  %d", *requests)
+	}
+	v.verify(context.Background(), unknown, now.Add(2*time.Minute))
+	if *requests != 2 {
+		t.Errorf("wrong number of JWKS requests\nwant 2\ngot  %d", *requests)
+	}
+
+	// the keys are fetched again after GCS_HELPER_JWT_JWKS_REFRESH, and the
+	// previous ones are used when they can't be fetched.
+	server.Close()
+	later := now.Add(2 * time.Hour)
+	token = signTestJWT(t, keys, "RS256", "rsa-key", testJWTClaims(later))
+	if _, err := v.verify(context.Background(), token, later); err != nil {
+		t.Errorf("unexpected error with the previous keys: %v", err)
+	}
+}
+
+func TestJWTVerifierFailingJWKS(t *testing.T) {
+	keys := newJWTTestKeys(t)
+	var requests int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		<-release
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	now := time.Now()
+	v := newJWTVerifier(testJWTConfig(server.URL), server.Client())
+	token := signTestJWT(t, keys, "RS256", "rsa-key", testJWTClaims(now))
+
+	// concurrent requests share a single fetch.
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := v.verify(context.Background(), token, now)
+			errs <- err
+		}()
+	}
+	for atomic.LoadInt32(&requests) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err == nil {
+			t.Error("unexpected <nil> error when the keys can't be fetched")
+		}
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("wrong number of JWKS requests\nwant 1\ngot  %d", n)
+	}
+
+	// failures back off for a minute.
+	if _, err := v.verify(context.Background(), token, now.Add(30*time.Second)); err == nil {
+		t.Error("unexpected <nil> error when the keys can't be fetched")
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("wrong number of JWKS requests\nwant 1\ngot  %d", n)
+	}
+	v.verify(context.Background(), token, now.Add(2*time.Minute))
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("wrong number of JWKS requests\nwant 2\ngot  %d", n)
+	}
+}
+
+func TestJWTHandler(t *testing.T) {
+	keys := newJWTTestKeys(t)
+	server, _ := startJWKSServer(keys)
+	defer server.Close()
+	var buf bytes.Buffer
+	logger := logrus.New()
+	logger.Out = &buf
+	logger.Formatter = &logrus.JSONFormatter{}
+	config := Config{AccessLog: true, JWTConfig: testJWTConfig(server.URL)}
+	config.JWTConfig.PrefixClaim = "prefixes"
+	v := newJWTVerifier(config.JWTConfig, server.Client())
+	handler := accessLogHandler(config, logger, jwtHandler(config, v, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	now := time.Now()
+	claims := testJWTClaims(now)
+	claims["prefixes"] = []string{"videos/video1/", "/videos/video2/"}
+	token := signTestJWT(t, keys, "ES256", "ec-key", claims)
+	noPrefixes := signTestJWT(t, keys, "ES256", "ec-key", testJWTClaims(now))
+	var tests = []struct {
+		path           string
+		authorization  string
+		expectedStatus int
+		expectedHeader string
+	}{
+		{"/videos/video1/video_720p.mp4", "Bearer " + token, http.StatusOK, ""},
+		{"/videos/video2/video_720p.mp4", "Bearer " + token, http.StatusOK, ""},
+		{"/videos/video3/video_720p.mp4", "Bearer " + token, http.StatusForbidden, ""},
+		{"/videos/video1/video_720p.mp4", "Bearer " + noPrefixes, http.StatusForbidden, ""},
+		{"/videos/video1/video_720p.mp4", "", http.StatusUnauthorized, "Bearer"},
+		{"/videos/video1/video_720p.mp4", "Basic dXNlcjpwYXNz", http.StatusUnauthorized, "Bearer"},
+		{"/videos/video1/video_720p.mp4", "Bearer " + token + "x", http.StatusUnauthorized, `Bearer error="invalid_token"`},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, test.path, nil)
+		if test.authorization != "" {
+			req.Header.Set("Authorization", test.authorization)
+		}
+		w := httptest.NewRecorder()
+		handler(w, req)
+		if w.Code != test.expectedStatus {
+			t.Errorf("%s with %q: wrong status\nwant %d\ngot  %d", test.path, test.authorization, test.expectedStatus, w.Code)
+		}
+		if got := w.Header().Get("WWW-Authenticate"); got != test.expectedHeader {
+			t.Errorf("%s with %q: wrong WWW-Authenticate header\nwant %q\ngot  %q", test.path, test.authorization, test.expectedHeader, got)
+		}
+	}
+	entries := decodeLogEntries(t, &buf)
+	if len(entries) == 0 || entries[0]["subject"] != "user-1" {
+		t.Errorf("missing subject in access log %v", entries)
+	}
+}
+
+func TestJWTConfigValidate(t *testing.T) {
+	var tests = []struct {
+		config JWTConfig
+		valid  bool
+	}{
+		{JWTConfig{}, true},
+		{testJWTConfig("https://auth.example.com/.well-known/jwks.json"), true},
+		{JWTConfig{JWKSURL: "https://auth.example.com/jwks.json", Issuer: "https://auth.example.com/", Audience: "gcs-helper", Handlers: []string{"map", "sign_cookie", "list"}}, true},
+		{JWTConfig{JWKSURL: "https://auth.example.com/jwks.json", Audience: "gcs-helper"}, false},
+		{JWTConfig{JWKSURL: "https://auth.example.com/jwks.json", Issuer: "https://auth.example.com/"}, false},
+		{JWTConfig{JWKSURL: "auth.example.com/jwks.json", Issuer: "https://auth.example.com/", Audience: "gcs-helper"}, false},
+		{JWTConfig{JWKSURL: "https://auth.example.com/jwks.json", Issuer: "https://auth.example.com/", Audience: "gcs-helper", Handlers: []string{"upload"}}, false},
+	}
+	for _, test := range tests {
+		err := test.config.validate()
+		if test.valid && err != nil {
+			t.Errorf("%#v: unexpected error: %v", test.config, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%#v: unexpected <nil> error", test.config)
+		}
+	}
+}
+
+func TestJWTConfigProtects(t *testing.T) {
+	c := testJWTConfig("https://auth.example.com/jwks.json")
+	if !c.protects("map") || c.protects("proxy") {
+		t.Errorf("wrong protected handlers for %v", c.Handlers)
+	}
+	if (JWTConfig{Handlers: []string{"map"}}).protects("map") {
+		t.Error("handlers shouldn't be protected without GCS_HELPER_JWT_JWKS_URL")
+	}
+}
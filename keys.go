@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// SigningKey is one of the keys configured in GCS_HELPER_SIGN_KEYS. Keys
+// without NotAfter never expire.
+type SigningKey struct {
+	GoogleAccessID string    `json:"googleAccessID"`
+	PrivateKey     string    `json:"privateKey"`
+	NotAfter       time.Time `json:"notAfter"`
+
+	parsedKey *rsa.PrivateKey
+}
+
+// SigningKeys is the list of keys used during key rotation, decoded from a
+// JSON array.
+type SigningKeys []SigningKey
+
+// Decode decodes the JSON representation of the keys.
+func (k *SigningKeys) Decode(value string) error {
+	return json.Unmarshal([]byte(value), k)
+}
+
+func (k SigningKeys) validate() error {
+	for i, key := range k {
+		if key.GoogleAccessID == "" || key.PrivateKey == "" {
+			return fmt.Errorf("GCS_HELPER_SIGN_KEYS: key %d requires googleAccessID and privateKey", i)
+		}
+		if _, err := parsePrivateKey([]byte(key.PrivateKey)); err != nil {
+			return fmt.Errorf("GCS_HELPER_SIGN_KEYS: invalid private key %d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// active returns the index of the key that should be used for signing new
+// URLs at the given time: the non-expired key that expires last, with keys
+// that never expire taking precedence. Later keys win ties, so a new key can
+// simply be appended to the list. It returns -1 when all keys are expired.
+func (k SigningKeys) active(now time.Time) int {
+	active := -1
+	for i, key := range k {
+		if !key.NotAfter.IsZero() && !key.NotAfter.After(now) {
+			continue
+		}
+		if active == -1 || key.NotAfter.IsZero() || (!k[active].NotAfter.IsZero() && !key.NotAfter.Before(k[active].NotAfter)) {
+			active = i
+		}
+	}
+	return active
+}
+
+var errSigningKeysExpired = errors.New("all signing keys are expired")
+
+// withActiveKey returns a copy of the configuration that signs using the
+// active key in GCS_HELPER_SIGN_KEYS, if any.
+func (c SignConfig) withActiveKey(now time.Time) (SignConfig, error) {
+	if len(c.Keys) == 0 {
+		return c, nil
+	}
+	i := c.Keys.active(now)
+	if i == -1 {
+		return c, errSigningKeysExpired
+	}
+	c.GoogleAccessID = c.Keys[i].GoogleAccessID
+	c.PrivateKey = c.Keys[i].PrivateKey
+	c.parsedKey = c.Keys[i].parsedKey
+	c.Keys = nil
+	return c, nil
+}
+
+// keyFingerprint returns a short identifier for the given private key, based
+// on the SHA-256 hash of its public key.
+func keyFingerprint(privateKey string) string {
+	key, err := parsePrivateKey([]byte(privateKey))
+	if err != nil {
+		return ""
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:8])
+}
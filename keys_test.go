@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestSigningKeysActive(t *testing.T) {
+	now := time.Date(2018, time.March, 10, 14, 30, 12, 0, time.UTC)
+	var tests = []struct {
+		testCase string
+		notAfter []time.Time
+		expected int
+	}{
+		{
+			"no keys",
+			nil,
+			-1,
+		},
+		{
+			"single key",
+			[]time.Time{{}},
+			0,
+		},
+		{
+			"key without expiration is the newest",
+			[]time.Time{now.Add(time.Hour), {}},
+			1,
+		},
+		{
+			"latest expiration",
+			[]time.Time{now.Add(48 * time.Hour), now.Add(time.Hour)},
+			0,
+		},
+		{
+			"later key wins ties",
+			[]time.Time{{}, {}},
+			1,
+		},
+		{
+			"expired keys are skipped",
+			[]time.Time{now.Add(-time.Hour), now.Add(time.Hour)},
+			1,
+		},
+		{
+			"all keys expired",
+			[]time.Time{now.Add(-time.Hour), now},
+			-1,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.testCase, func(t *testing.T) {
+			var keys SigningKeys
+			for _, notAfter := range test.notAfter {
+				keys = append(keys, SigningKey{NotAfter: notAfter})
+			}
+			if got := keys.active(now); got != test.expected {
+				t.Errorf("wrong active key\nwant %d\ngot  %d", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestSigningKeysDecode(t *testing.T) {
+	var keys SigningKeys
+	err := keys.Decode(`[{"googleAccessID":"old@project.iam.gserviceaccount.com","privateKey":"key-1","notAfter":"2018-03-10T14:30:12Z"},{"googleAccessID":"new@project.iam.gserviceaccount.com","privateKey":"key-2"}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("wrong number of keys\nwant 2\ngot  %d", len(keys))
+	}
+	if expected := time.Date(2018, time.March, 10, 14, 30, 12, 0, time.UTC); !keys[0].NotAfter.Equal(expected) {
+		t.Errorf("wrong notAfter\nwant %s\ngot  %s", expected, keys[0].NotAfter)
+	}
+	if !keys[1].NotAfter.IsZero() {
+		t.Errorf("unexpected notAfter: %s", keys[1].NotAfter)
+	}
+	if err = keys.Decode("not json"); err == nil {
+		t.Error("unexpected <nil> error")
+	}
+}
+
+func TestSignedURLKeyRotation(t *testing.T) {
+	c := testSignConfig(t)
+	newKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newKeyPEM := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(newKey),
+	})
+	c.Keys = SigningKeys{
+		{GoogleAccessID: c.GoogleAccessID, PrivateKey: c.PrivateKey, NotAfter: time.Now().Add(24 * time.Hour)},
+		{GoogleAccessID: "new-signer@project.iam.gserviceaccount.com", PrivateKey: string(newKeyPEM)},
+	}
+	c.GoogleAccessID = ""
+	c.PrivateKey = ""
+	if err = c.validate(); err != nil {
+		t.Fatal(err)
+	}
+	signed, err := signedURL(c, http.MethodGet, "my-bucket", "videos/video1_720p.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accessID := u.Query().Get("GoogleAccessId"); accessID != "new-signer@project.iam.gserviceaccount.com" {
+		t.Errorf("wrong GoogleAccessId\nwant %q\ngot  %q", "new-signer@project.iam.gserviceaccount.com", accessID)
+	}
+
+	c.Keys[1].NotAfter = time.Now().Add(-time.Hour)
+	c.Keys[0].NotAfter = time.Now().Add(-time.Minute)
+	if _, err = signedURL(c, http.MethodGet, "my-bucket", "videos/video1_720p.mp4"); err != errSigningKeysExpired {
+		t.Errorf("wrong error\nwant %v\ngot  %v", errSigningKeysExpired, err)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+type listEntry struct {
+	Type        string     `json:"type"`
+	Name        string     `json:"name"`
+	Size        *int64     `json:"size,omitempty"`
+	ContentType string     `json:"contentType,omitempty"`
+	Updated     *time.Time `json:"updated,omitempty"`
+}
+
+func getListHandler(c Config, client *storage.Client) http.HandlerFunc {
+	bucketHandle := bucketHandle(&c, client, c.BucketName)
+	logger := c.logger()
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		delimiter := "/"
+		if values, ok := r.URL.Query()["delimiter"]; ok {
+			delimiter = values[0]
+		}
+		prefix := strings.TrimLeft(r.URL.Path, "/")
+		ctx, cancel := context.WithTimeout(context.Background(), c.ProxyTimeout)
+		defer cancel()
+		entries, err := listPrefix(ctx, &c, bucketHandle, prefix, delimiter)
+		if err != nil {
+			requestLogger(r.Context(), logger).WithError(err).WithField("prefix", prefix).Error("failed to list objects")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entries)
+	}
+}
+
+func listPrefix(ctx context.Context, c *Config, bucketHandle *storage.BucketHandle, prefix, delimiter string) ([]listEntry, error) {
+	var err error
+	for i := 0; i < maxTry; i++ {
+		if i > 0 && !waitRetry(ctx, i-1) {
+			return nil, ctx.Err()
+		}
+		iter := bucketHandle.Objects(ctx, &storage.Query{
+			Prefix:    prefix,
+			Delimiter: delimiter,
+		})
+		var obj *storage.ObjectAttrs
+		entries := []listEntry{}
+		obj, err = iter.Next()
+		for ; err == nil; obj, err = iter.Next() {
+			if obj.Prefix != "" {
+				entries = append(entries, listEntry{Type: "prefix", Name: obj.Prefix})
+				continue
+			}
+			size, updated := obj.Size, obj.Updated
+			entries = append(entries, listEntry{
+				Type:        "object",
+				Name:        obj.Name,
+				Size:        &size,
+				ContentType: contentType(c, obj),
+				Updated:     &updated,
+			})
+		}
+		if err == iterator.Done {
+			return entries, nil
+		}
+		if ctx.Err() != nil || !retryable(err) {
+			return nil, err
+		}
+	}
+	return nil, err
+}
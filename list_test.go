@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/option"
+)
+
+func TestServerListHandler(t *testing.T) {
+	addr, cleanup := startServer(t, Config{
+		BucketName:   "my-bucket",
+		ListPrefix:   "/list/",
+		ProxyPrefix:  "/proxy/",
+		ProxyTimeout: time.Second,
+		ContentTypes: ExtensionMap{".txt": "text/plain", ".mp3": "audio/mpeg", ".wav": "audio/wav"},
+	})
+	defer cleanup()
+	object := func(name string, size float64, contentType string) map[string]interface{} {
+		return map[string]interface{}{
+			"type":        "object",
+			"name":        name,
+			"size":        size,
+			"contentType": contentType,
+			"updated":     "0001-01-01T00:00:00Z",
+		}
+	}
+	var tests = []serverTest{
+		{
+			testCase:       "list with default delimiter",
+			method:         http.MethodGet,
+			addr:           addr + "/list/musics/music/",
+			expectedStatus: http.StatusOK,
+			expectedHeader: http.Header{"Content-Type": []string{"application/json"}},
+			expectedBody: []interface{}{
+				object("musics/music/music1.txt", 15, "text/plain"),
+				object("musics/music/music2.txt", 16, "text/plain"),
+				object("musics/music/music3.txt", 21, "text/plain"),
+				object("musics/music/music4.mp3", 0, "audio/mpeg"),
+				object("musics/music/music5.wav", 0, "audio/wav"),
+				map[string]interface{}{"type": "prefix", "name": "musics/music/music/"},
+			},
+		},
+		{
+			testCase:       "list without delimiter",
+			method:         http.MethodGet,
+			addr:           addr + "/list/musics/music/music/?delimiter=",
+			expectedStatus: http.StatusOK,
+			expectedBody: []interface{}{
+				object("musics/music/music/1.txt", 0, "text/plain"),
+				object("musics/music/music/2.txt", 0, "text/plain"),
+				object("musics/music/music/3.txt", 0, "text/plain"),
+				object("musics/music/music/4.mp3", 0, "audio/mpeg"),
+			},
+		},
+		{
+			testCase:       "empty list",
+			method:         http.MethodGet,
+			addr:           addr + "/list/nothing/here/",
+			expectedStatus: http.StatusOK,
+			expectedBody:   []interface{}{},
+		},
+		{
+			testCase:       "method not allowed",
+			method:         http.MethodPost,
+			addr:           addr + "/list/musics/",
+			expectedStatus: http.StatusMethodNotAllowed,
+			expectedBody:   "method not allowed\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.testCase, test.run)
+	}
+}
+
+func TestListPrefixPermanentError(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.Error(w, `{"error":{"code":403,"message":"forbidden"}}`, http.StatusForbidden)
+	}))
+	defer server.Close()
+	hc, err := httpClient(ClientConfig{Endpoint: server.URL, Anonymous: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := storage.NewClient(context.Background(), option.WithHTTPClient(hc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Config{}
+	_, err = listPrefix(context.Background(), &c, client.Bucket("my-bucket"), "videos/", "/")
+	if err == nil {
+		t.Fatal("unexpected <nil> error")
+	}
+	if requests != 1 {
+		t.Errorf("permanent error shouldn't be retried\nwant 1 request\ngot  %d", requests)
+	}
+}
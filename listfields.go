@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// prefixesListFields selects the fields of a listing that only needs the
+// sub-prefixes.
+const prefixesListFields = "prefixes,nextPageToken"
+
+type listFieldsKey struct{}
+
+// withListFields returns a context that instructs the transport to request
+// only the given fields (in the syntax of the "fields" parameter of the JSON
+// API) when listing objects. The vendored storage client doesn't support
+// Query.SetAttrSelection and always lists objects with the full projection,
+// including their ACLs and custom metadata.
+func withListFields(ctx context.Context, fields string) context.Context {
+	if fields == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, listFieldsKey{}, fields)
+}
+
+// mapListFields returns the fields requested when listing the objects of a
+// mapping. The generation is always requested, as it's used by the ETag of
+// the mapping, while the size is only needed by verbose mappings, duration
+// probing and the bandwidths of manifests. The remaining metadata is only
+// included in verbose mappings.
+func mapListFields(c Config) string {
+	fields := "name,bucket,generation"
+	if c.MapVerbose || c.MapProbeDurations || c.signerEnabled() {
+		fields += ",size"
+	}
+	if c.MapVerbose {
+		fields += ",updated,contentType,md5Hash"
+	}
+	return "items(" + fields + ")," + prefixesListFields
+}
+
+// listFieldsTransport is an http.RoundTripper that sets the "fields"
+// parameter of object listings marked by withListFields.
+type listFieldsTransport struct {
+	http.RoundTripper
+}
+
+func (t *listFieldsTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	fields, _ := r.Context().Value(listFieldsKey{}).(string)
+	if fields != "" && r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/o") {
+		r2 := new(http.Request)
+		*r2 = *r
+		u := *r.URL
+		query := u.Query()
+		query.Set("fields", fields)
+		query.Set("projection", "noAcl")
+		u.RawQuery = query.Encode()
+		r2.URL = &u
+		r = r2
+	}
+	return t.RoundTripper.RoundTrip(r)
+}
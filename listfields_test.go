@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestListFieldsTransport(t *testing.T) {
+	var query url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+	}))
+	defer server.Close()
+	client := http.Client{
+		Transport: &listFieldsTransport{RoundTripper: http.DefaultTransport},
+	}
+	fields := "items(name,bucket,generation),prefixes,nextPageToken"
+	var tests = []struct {
+		testCase           string
+		method             string
+		path               string
+		ctx                context.Context
+		expectedFields     string
+		expectedProjection string
+	}{
+		{"regular listing", http.MethodGet, "/storage/v1/b/my-bucket/o?projection=full", context.Background(), "", "full"},
+		{"listing with fields", http.MethodGet, "/storage/v1/b/my-bucket/o?projection=full", withListFields(context.Background(), fields), fields, "noAcl"},
+		{"empty fields", http.MethodGet, "/storage/v1/b/my-bucket/o?projection=full", withListFields(context.Background(), ""), "", "full"},
+		{"object request", http.MethodGet, "/storage/v1/b/my-bucket/o/video.mp4?projection=full", withListFields(context.Background(), fields), "", "full"},
+		{"insert request", http.MethodPost, "/storage/v1/b/my-bucket/o?projection=full", withListFields(context.Background(), fields), "", "full"},
+	}
+	for _, test := range tests {
+		t.Run(test.testCase, func(t *testing.T) {
+			req, _ := http.NewRequest(test.method, server.URL+test.path, nil)
+			resp, err := client.Do(req.WithContext(test.ctx))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if got := query.Get("fields"); got != test.expectedFields {
+				t.Errorf("wrong fields\nwant %q\ngot  %q", test.expectedFields, got)
+			}
+			if got := query.Get("projection"); got != test.expectedProjection {
+				t.Errorf("wrong projection\nwant %q\ngot  %q", test.expectedProjection, got)
+			}
+			if req.URL.Query().Get("fields") != "" {
+				t.Error("original request was modified")
+			}
+		})
+	}
+}
+
+func TestMapListFields(t *testing.T) {
+	var tests = []struct {
+		testCase string
+		config   Config
+		expected string
+	}{
+		{
+			"default",
+			Config{},
+			"items(name,bucket,generation),prefixes,nextPageToken",
+		},
+		{
+			"probing durations",
+			Config{MapProbeDurations: true},
+			"items(name,bucket,generation,size),prefixes,nextPageToken",
+		},
+		{
+			"verbose",
+			Config{MapVerbose: true},
+			"items(name,bucket,generation,size,updated,contentType,md5Hash),prefixes,nextPageToken",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.testCase, func(t *testing.T) {
+			if got := mapListFields(test.config); got != test.expected {
+				t.Errorf("wrong fields\nwant %q\ngot  %q", test.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// handlerNames are the names of the handlers whose log level can be set in
+// GCS_HELPER_LOG_LEVELS, as used in the metrics and the access logs.
+var handlerNames = []string{
+	"map", "proxy", "meta", "redirect", "sign", "sign_cookie", "list",
+	"upload", "upload_session", "sign_upload", "delete", "copy", "compose",
+	"admin",
+}
+
+// LevelMap maps handler names to log levels, in the format
+// "proxy=warn,map=debug", overriding GCS_HELPER_LOG_LEVEL for the logs of
+// the given handlers, including their access logs.
+type LevelMap map[string]string
+
+// Decode parses the given value into the map.
+func (m *LevelMap) Decode(value string) error {
+	result := make(LevelMap)
+	for _, item := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(parts) != 2 || !isHandlerName(parts[0]) {
+			return fmt.Errorf("invalid log level item: %q", item)
+		}
+		level, err := logrus.ParseLevel(parts[1])
+		if err != nil {
+			return fmt.Errorf("invalid log level item: %q", item)
+		}
+		result[parts[0]] = level.String()
+	}
+	*m = result
+	return nil
+}
+
+func isHandlerName(name string) bool {
+	for _, n := range handlerNames {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// forHandler returns the configuration of the handler with the given name,
+// which uses its level from GCS_HELPER_LOG_LEVELS, if any.
+func (c Config) forHandler(name string) Config {
+	if level, ok := c.LogLevels[name]; ok {
+		c.LogLevel = level
+	}
+	return c
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLevelMapDecode(t *testing.T) {
+	var tests = []struct {
+		input       string
+		expected    LevelMap
+		expectedErr bool
+	}{
+		{"proxy=warn, map=DEBUG", LevelMap{"proxy": "warning", "map": "debug"}, false},
+		{"sign_cookie=error", LevelMap{"sign_cookie": "error"}, false},
+		{"proxy", nil, true},
+		{"proxy=", nil, true},
+		{"proxy=loud", nil, true},
+		{"stream=warn", nil, true},
+	}
+	for _, test := range tests {
+		var m LevelMap
+		err := m.Decode(test.input)
+		if test.expectedErr {
+			if err == nil {
+				t.Errorf("%q: unexpected <nil> error", test.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", test.input, err)
+		}
+		if !reflect.DeepEqual(m, test.expected) {
+			t.Errorf("%q: wrong map\nwant %#v\ngot  %#v", test.input, test.expected, m)
+		}
+	}
+}
+
+func TestConfigForHandler(t *testing.T) {
+	c := Config{LogLevel: "info", LogLevels: LevelMap{"proxy": "warning"}}
+	if level := c.forHandler("proxy").logger().Level.String(); level != "warning" {
+		t.Errorf("wrong proxy level\nwant %q\ngot  %q", "warning", level)
+	}
+	if level := c.forHandler("map").logger().Level.String(); level != "info" {
+		t.Errorf("wrong map level\nwant %q\ngot  %q", "info", level)
+	}
+}
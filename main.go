@@ -2,64 +2,194 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"cloud.google.com/go/storage"
 	"github.com/google/gops/agent"
+	"golang.org/x/oauth2"
 	"google.golang.org/api/option"
 )
 
-const version = "1.14.0"
-
 func main() {
-	handleFlags()
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			os.Exit(command(os.Args[2:], os.Stdout, os.Stderr))
+		}
+	}
+	load := handleFlags()
 	err := agent.Listen(&agent.Options{NoShutdownCleanup: true})
 	if err != nil {
 		log.Fatalf("could not start gops agent: %v", err)
 	}
 	defer agent.Close()
-	config, err := loadConfig()
+	config, err := load()
 	if err != nil {
 		log.Fatal(err)
 	}
 	logger := config.logger()
-	client, err := storage.NewClient(context.Background(), option.WithHTTPClient(httpClient(config.ClientConfig)))
+	config.warnStrictProblems(logger)
+	if err = setupSigner(context.Background(), &config); err != nil {
+		logger.WithError(err).Fatal("failed to set up signer")
+	}
+	if config.SignConfig.privateKeySecret != nil {
+		go config.SignConfig.privateKeySecret.refreshEvery(config.SignConfig.PrivateKeySecretRefresh, logger)
+	}
+	if err = signingSelfTest(config); err != nil {
+		logger.WithError(err).Fatal("signing self-test failed")
+	}
+	if err = setupTracing(context.Background(), &config, logger); err != nil {
+		logger.WithError(err).Fatal("failed to set up tracing")
+	}
+	if err = setupAudit(context.Background(), &config, logger); err != nil {
+		logger.WithError(err).Fatal("failed to set up audit")
+	}
+	hc, err := httpClient(config.ClientConfig)
+	if err != nil {
+		logger.WithError(err).Fatal("failed to create http client")
+	}
+	client, err := storage.NewClient(context.Background(), option.WithHTTPClient(hc))
 	if err != nil {
 		logger.WithError(err).Fatal("failed to create storage client instance")
 	}
-	handler := getHandler(config, client)
+	handler := newReloadableHandler(config, load, func(c Config) http.Handler {
+		return getHandler(c, client, hc)
+	})
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go handler.reloadOnSignal(hup, logger)
 	listener, err := net.Listen("tcp", config.Listen)
 	if err != nil {
 		logger.WithField("listenAddr", config.Listen).WithError(err).Fatal("failed to start listener")
 	}
 
-	logger.Infof("Listening on %s...", listener.Addr())
-	err = http.Serve(listener, handler)
+	server := httpServer(config.ServerConfig, handler)
+	if config.TLSConfig.enabled() {
+		m := config.TLSConfig.acmeManager()
+		if m != nil && config.TLSConfig.ACMEHTTPListen != "" {
+			go serveACMEChallenges(config.TLSConfig.ACMEHTTPListen, m, logger)
+		}
+		server.TLSConfig, err = config.TLSConfig.serverTLSConfig(m)
+		if err != nil {
+			logger.WithError(err).Fatal("failed to load TLS certificate")
+		}
+		logger.Infof("Listening with TLS on %s...", listener.Addr())
+		err = server.ServeTLS(listener, "", "")
+	} else {
+		logger.Infof("Listening on %s...", listener.Addr())
+		err = server.Serve(listener)
+	}
 	if err != nil {
 		logger.WithError(err).Fatal("failed to start server")
 	}
 }
 
-func httpClient(c ClientConfig) *http.Client {
+// httpClient returns the client used for accessing GCS, authenticated with
+// the application default credentials unless GCS_CLIENT_ANONYMOUS is set.
+// Timeouts set to zero are disabled.
+func httpClient(c ClientConfig) (*http.Client, error) {
+	proxy, err := c.proxyFunc()
+	if err != nil {
+		return nil, err
+	}
+	rootCAs, err := c.rootCAs()
+	if err != nil {
+		return nil, err
+	}
+	ts, err := c.tokenSource()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the credentials: %v", err)
+	}
+	dialer := &net.Dialer{
+		Timeout:   c.DialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	baseTransport := &http.Transport{
+		Proxy:               proxy,
+		DialContext:         gcsConnPool.dialContext(dialer.DialContext),
+		TLSHandshakeTimeout: c.TLSHandshakeTimeout,
+		IdleConnTimeout:     c.IdleConnTimeout,
+		MaxIdleConns:        c.MaxIdleConns,
+	}
+	if rootCAs != nil {
+		baseTransport.TLSClientConfig = &tls.Config{RootCAs: rootCAs}
+	}
+	var authTransport http.RoundTripper = &tracingTransport{RoundTripper: &gcsMetricsTransport{RoundTripper: baseTransport}}
+	if ts != nil {
+		authTransport = &oauth2.Transport{Source: ts, Base: authTransport}
+	}
+	var transport http.RoundTripper = &identityTransport{
+		userAgent:    c.userAgent(),
+		quotaProject: c.QuotaProject,
+		RoundTripper: authTransport,
+	}
+	// the endpoint is validated when loading the configuration.
+	if endpoint, _ := c.endpointURL(); endpoint != nil {
+		transport = &endpointTransport{endpoint: endpoint, RoundTripper: transport}
+	}
 	return &http.Client{
 		Timeout: c.Timeout,
-		Transport: &http.Transport{
-			IdleConnTimeout: c.IdleConnTimeout,
-			MaxIdleConns:    c.MaxIdleConns,
+		Transport: &rawContentTransport{
+			RoundTripper: &listFieldsTransport{
+				RoundTripper: transport,
+			},
 		},
+	}, nil
+}
+
+// httpServer returns the server for the given handler. Timeouts set to zero
+// are disabled, and the default limit of http.Server is used when
+// MaxHeaderBytes is zero. The open connections are counted in the metrics.
+func httpServer(c ServerConfig, handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: c.ReadHeaderTimeout,
+		ReadTimeout:       c.ReadTimeout,
+		WriteTimeout:      c.WriteTimeout,
+		IdleTimeout:       c.IdleTimeout,
+		MaxHeaderBytes:    c.MaxHeaderBytes,
+		ConnState:         trackConnections,
+	}
+}
+
+// setupSigner creates the client used for signing in the iam mode and
+// loads the private key from Secret Manager, when configured.
+func setupSigner(ctx context.Context, c *Config) error {
+	if c.SignConfig.Mode != signModeIAM && c.SignConfig.PrivateKeySecret == "" {
+		return nil
+	}
+	gc, err := googleClient(ctx, c.ClientConfig.Timeout)
+	if err != nil {
+		return fmt.Errorf("failed to create client for signing: %v", err)
 	}
+	c.SignConfig.iamClient = gc
+	if c.SignConfig.PrivateKeySecret != "" {
+		c.SignConfig.privateKeySecret, err = newSecretKey(gc, c.SignConfig.PrivateKeySecret, checkPrivateKey)
+		if err != nil {
+			return fmt.Errorf("failed to load private key from Secret Manager: %v", err)
+		}
+	}
+	return nil
 }
 
-func handleFlags() {
+func handleFlags() func() (Config, error) {
 	printVersion := flag.Bool("version", false, "print version and exit")
+	load, err := defineLoadFlags(flag.CommandLine)
+	if err != nil {
+		log.Fatal(err)
+	}
 	flag.Parse()
 	if *printVersion {
-		fmt.Printf("gcs-helper %s\n", version)
+		fmt.Println(currentBuildInfo())
 		os.Exit(0)
 	}
+	return load
 }
@@ -1,29 +1,238 @@
 package main
 
 import (
+	"context"
+	"encoding/pem"
+	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
+	"golang.org/x/oauth2"
 )
 
+// useTestTokenSource makes the clients of GCS authenticate with the given
+// access token instead of the application default credentials.
+func useTestTokenSource(token string) func() {
+	original := defaultTokenSource
+	defaultTokenSource = func(context.Context, ...string) (oauth2.TokenSource, error) {
+		return oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token}), nil
+	}
+	return func() {
+		defaultTokenSource = original
+	}
+}
+
 func TestHTTPClient(t *testing.T) {
-	hc := httpClient(ClientConfig{
-		Timeout:         time.Minute,
-		IdleConnTimeout: 2 * time.Minute,
-		MaxIdleConns:    10,
+	defer useTestTokenSource("my-token")()
+	hc, err := httpClient(ClientConfig{
+		Timeout:             time.Minute,
+		IdleConnTimeout:     2 * time.Minute,
+		MaxIdleConns:        10,
+		DialTimeout:         5 * time.Second,
+		TLSHandshakeTimeout: 3 * time.Second,
+		UserAgent:           "prod",
+		QuotaProject:        "my-project",
 	})
+	if err != nil {
+		t.Fatal(err)
+	}
 	expectedClient := http.Client{
 		Timeout: time.Minute,
-		Transport: &http.Transport{
-			MaxIdleConns:    10,
-			IdleConnTimeout: 2 * time.Minute,
+		Transport: &rawContentTransport{
+			RoundTripper: &listFieldsTransport{
+				RoundTripper: &identityTransport{
+					userAgent:    "gcs-helper/" + version + " prod",
+					quotaProject: "my-project",
+					RoundTripper: &oauth2.Transport{
+						Base: &tracingTransport{
+							RoundTripper: &gcsMetricsTransport{
+								RoundTripper: &http.Transport{
+									MaxIdleConns:        10,
+									IdleConnTimeout:     2 * time.Minute,
+									TLSHandshakeTimeout: 3 * time.Second,
+								},
+							},
+						},
+					},
+				},
+			},
 		},
 	}
-	ign := cmpopts.IgnoreUnexported(http.Transport{})
+	ign := cmp.Options{
+		cmpopts.IgnoreUnexported(http.Transport{}),
+		cmpopts.IgnoreUnexported(identityTransport{}),
+		cmpopts.IgnoreUnexported(oauth2.Transport{}),
+		cmpopts.IgnoreFields(oauth2.Transport{}, "Source"),
+		cmpopts.IgnoreFields(http.Transport{}, "Proxy", "DialContext"),
+	}
 	if !cmp.Equal(*hc, expectedClient, ign) {
 		t.Errorf("wrong client returned\n%s", cmp.Diff(*hc, expectedClient, ign))
 	}
+	// the unexported fields are checked directly, as comparing them with
+	// cmp.AllowUnexported crashes under the race detector.
+	it := hc.Transport.(*rawContentTransport).RoundTripper.(*listFieldsTransport).RoundTripper.(*identityTransport)
+	if it.userAgent != "gcs-helper/"+version+" prod" {
+		t.Errorf("wrong user agent %q", it.userAgent)
+	}
+	if it.quotaProject != "my-project" {
+		t.Errorf("wrong quota project %q", it.quotaProject)
+	}
+	ot := it.RoundTripper.(*oauth2.Transport)
+	if token, err := ot.Source.Token(); err != nil || token.AccessToken != "my-token" {
+		t.Errorf("the transport should use the application default credentials, got token %v (%v)", token, err)
+	}
+	transport := ot.Base.(*tracingTransport).RoundTripper.(*gcsMetricsTransport).RoundTripper.(*http.Transport)
+	if transport.Proxy == nil || transport.DialContext == nil {
+		t.Error("the transport should use the proxy from the environment and the configured dialer")
+	}
+}
+
+func TestHTTPClientProxy(t *testing.T) {
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("proxied " + r.URL.String()))
+	}))
+	defer proxy.Close()
+	hc, err := httpClient(ClientConfig{Proxy: proxy.URL, Anonymous: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := hc.Get("http://storage.googleapis.com/my-bucket/video.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "proxied http://storage.googleapis.com/my-bucket/video.mp4"
+	if string(data) != expected {
+		t.Errorf("wrong response\nwant %q\ngot  %q", expected, string(data))
+	}
+}
+
+func TestHTTPClientCAFile(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+	caFile, cleanup := writeConfigFile(t, "ca.pem", string(pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: server.Certificate().Raw,
+	})))
+	defer cleanup()
+
+	hc, err := httpClient(ClientConfig{Anonymous: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = hc.Get(server.URL); err == nil {
+		t.Error("unexpected <nil> error for a server with an unknown certificate authority")
+	}
+
+	hc, err = httpClient(ClientConfig{CAFile: caFile, Anonymous: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := hc.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+}
+
+func TestHTTPClientInvalidTransportSettings(t *testing.T) {
+	invalidCAFile, cleanup := writeConfigFile(t, "ca.pem", "not a certificate")
+	defer cleanup()
+	var tests = []ClientConfig{
+		{Proxy: "ftp://proxy.example.com"},
+		{Proxy: "http://"},
+		{CAFile: "/does/not/exist.pem"},
+		{CAFile: invalidCAFile},
+	}
+	for _, test := range tests {
+		if _, err := httpClient(test); err == nil {
+			t.Errorf("%#v: unexpected <nil> error", test)
+		}
+	}
+}
+
+func TestHTTPClientEndpoint(t *testing.T) {
+	hc, err := httpClient(ClientConfig{Endpoint: "localhost:4443", Anonymous: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := hc.Transport.(*rawContentTransport).RoundTripper.(*listFieldsTransport).RoundTripper
+	et, ok := transport.(*endpointTransport)
+	if !ok {
+		t.Fatalf("wrong transport, want *endpointTransport, got %T", transport)
+	}
+	if endpoint := et.endpoint.String(); endpoint != "http://localhost:4443" {
+		t.Errorf("wrong endpoint\nwant %q\ngot  %q", "http://localhost:4443", endpoint)
+	}
+}
+
+func TestHTTPServer(t *testing.T) {
+	c := ServerConfig{
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       time.Minute,
+		WriteTimeout:      time.Hour,
+		IdleTimeout:       30 * time.Second,
+		MaxHeaderBytes:    8192,
+	}
+	handler := http.NotFoundHandler()
+	server := httpServer(c, handler)
+	if server.Handler == nil {
+		t.Error("unexpected <nil> handler")
+	}
+	got := ServerConfig{
+		ReadHeaderTimeout: server.ReadHeaderTimeout,
+		ReadTimeout:       server.ReadTimeout,
+		WriteTimeout:      server.WriteTimeout,
+		IdleTimeout:       server.IdleTimeout,
+		MaxHeaderBytes:    server.MaxHeaderBytes,
+	}
+	if got != c {
+		t.Errorf("wrong server settings\nwant %#v\ngot  %#v", c, got)
+	}
+}
+
+func TestHTTPClientIdentity(t *testing.T) {
+	var header http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+	}))
+	defer server.Close()
+	defer useTestTokenSource("my-token")()
+	hc, err := httpClient(ClientConfig{UserAgent: "staging", QuotaProject: "my-project"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("User-Agent", "google-api-go-client/0.5")
+	resp, err := hc.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	expectedUserAgent := "gcs-helper/" + version + " staging google-api-go-client/0.5"
+	if ua := header.Get("User-Agent"); ua != expectedUserAgent {
+		t.Errorf("wrong User-Agent\nwant %q\ngot  %q", expectedUserAgent, ua)
+	}
+	if auth := header.Get("Authorization"); auth != "Bearer my-token" {
+		t.Errorf("wrong Authorization\nwant %q\ngot  %q", "Bearer my-token", auth)
+	}
+	if project := header.Get("X-Goog-User-Project"); project != "my-project" {
+		t.Errorf("wrong quota project\nwant %q\ngot  %q", "my-project", project)
+	}
+	if ua := req.Header.Get("User-Agent"); ua != "google-api-go-client/0.5" {
+		t.Errorf("the original request shouldn't be modified, got User-Agent %q", ua)
+	}
 }
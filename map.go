@@ -2,33 +2,152 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"net/url"
 	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"cloud.google.com/go/storage"
+	"github.com/sirupsen/logrus"
 	"google.golang.org/api/iterator"
 )
 
 type mapping struct {
+	ClipFrom  int64      `json:"clipFrom,omitempty"`
+	ClipTo    int64      `json:"clipTo,omitempty"`
+	Durations []int64    `json:"durations,omitempty"`
 	Sequences []sequence `json:"sequences"`
+
+	// NextPageToken is set when the listing was limited by
+	// GCS_HELPER_MAP_MAX_OBJECTS or maxResults.
+	NextPageToken string `json:"nextPageToken,omitempty"`
+
+	// etag identifies the listed objects, see mappingETag.
+	etag string
 }
 
 type sequence struct {
-	Clips []clip `json:"clips"`
+	Language string `json:"language,omitempty"`
+	Label    string `json:"label,omitempty"`
+	Clips    []clip `json:"clips"`
 }
 
 type clip struct {
 	Type string `json:"type"`
 	Path string `json:"path"`
+
+	// included only with GCS_HELPER_MAP_VERBOSE.
+	Size       int64      `json:"size,omitempty"`
+	Generation int64      `json:"generation,omitempty"`
+	Updated    *time.Time `json:"updated,omitempty"`
+
+	attrs *storage.ObjectAttrs
+}
+
+const (
+	mapDedupeFirst = "first"
+	mapDedupeLast  = "last"
+)
+
+// hdToken is the rendition token bound to GCS_HELPER_MAP_REGEX_HD_FILTER.
+const hdToken = "__HD"
+
+// mapFilters holds the compiled GCS_HELPER_MAP_REGEX_FILTER and the filters
+// of the rendition tokens. Empty filters match all objects. exclude and
+// labels hold the compiled GCS_HELPER_MAP_REGEX_EXCLUDE and
+// GCS_HELPER_MAP_REGEX_LABEL, and are nil when not set. delimiter, recursive
+// and maxDepth control how prefixes are listed, and fields selects the
+// attributes of the listed objects.
+type mapFilters struct {
+	filter     *regexp.Regexp
+	prefixes   []prefixFilter
+	renditions []renditionFilter
+	exclude    *regexp.Regexp
+	labels     *regexp.Regexp
+	delimiter  string
+	recursive  bool
+	maxDepth   int
+	fields     string
+}
+
+// prefixFilter is the filter used instead of GCS_HELPER_MAP_REGEX_FILTER for
+// objects under the prefix.
+type prefixFilter struct {
+	prefix string
+	filter *regexp.Regexp
+}
+
+// renditionFilter is the filter used when the prefix contains the token.
+type renditionFilter struct {
+	token  string
+	filter *regexp.Regexp
+}
+
+// newMapFilters compiles the map filters. Patterns are validated when the
+// configuration is loaded, so this only fails with hand-built configs.
+func newMapFilters(c Config) mapFilters {
+	filters := mapFilters{filter: regexp.MustCompile(c.MapRegexFilter)}
+	for prefix, pattern := range c.MapPrefixFilters {
+		filters.prefixes = append(filters.prefixes, prefixFilter{
+			prefix: prefix,
+			filter: regexp.MustCompile(pattern),
+		})
+	}
+	// the longest matching prefix wins.
+	sort.Slice(filters.prefixes, func(i, j int) bool {
+		return len(filters.prefixes[i].prefix) > len(filters.prefixes[j].prefix)
+	})
+	for token, pattern := range c.renditionFilters() {
+		filters.renditions = append(filters.renditions, renditionFilter{
+			token:  token,
+			filter: regexp.MustCompile(pattern),
+		})
+	}
+	// longer tokens go first, so "__HDR" isn't handled as "__HD".
+	sort.Slice(filters.renditions, func(i, j int) bool {
+		ti, tj := filters.renditions[i].token, filters.renditions[j].token
+		if len(ti) != len(tj) {
+			return len(ti) > len(tj)
+		}
+		return ti < tj
+	})
+	if c.MapRegexExclude != "" {
+		filters.exclude = regexp.MustCompile(c.MapRegexExclude)
+	}
+	if c.MapRegexLabel != "" {
+		filters.labels = regexp.MustCompile(c.MapRegexLabel)
+	}
+	filters.delimiter = c.MapDelimiter
+	if filters.delimiter == "" {
+		filters.delimiter = "/"
+	}
+	filters.recursive = c.MapRecursive
+	filters.maxDepth = c.MapMaxDepth
+	filters.fields = mapListFields(c)
+	return filters
 }
 
 func getMapHandler(c Config, client *storage.Client) http.HandlerFunc {
-	bucketHandle := client.Bucket(c.BucketName)
+	bucketHandle := bucketHandle(&c, client, c.BucketName)
+	filters := newMapFilters(c)
+	group := newMappingGroup()
+	cache := newMappingCache(c)
+	prober := newDurationProber(c)
 	logger := c.logger()
+	tmpl, err := parseMapTemplate(c)
+	if err != nil {
+		logger.WithError(err).Error("failed to parse map template")
+	}
 	return func(w http.ResponseWriter, r *http.Request) {
 		defer r.Body.Close()
 		if r.Method != http.MethodGet {
@@ -45,42 +164,387 @@ func getMapHandler(c Config, client *storage.Client) http.HandlerFunc {
 			http.Error(w, "prefix cannot be empty", http.StatusBadRequest)
 			return
 		}
-		m, err := getPrefixMapping(prefix, ext, c, bucketHandle)
+		if err := validateGlob(prefix, filters.delimiter); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if name := r.URL.Query().Get("filter"); name != "" {
+			token, ok := filters.namedToken(name)
+			if !ok {
+				http.Error(w, "unknown filter", http.StatusBadRequest)
+				return
+			}
+			if _, ok := filters.rendition(prefix); ok {
+				http.Error(w, "filter cannot be combined with a rendition token", http.StatusBadRequest)
+				return
+			}
+			// the named filter is handled as its token in the path, so
+			// both forms share cached mappings.
+			prefix += token
+		}
+		clipFrom, clipTo, err := clipRange(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		page, err := parseMapPage(r.URL.Query(), c.MapMaxObjects)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ctx := r.Context()
+		if c.MapTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, c.MapTimeout)
+			defer cancel()
+		}
+		m, err := cachedPrefixMapping(ctx, prefix, ext, page, c, filters, cache, group, prober, bucketHandle)
 		if err != nil && err != iterator.Done {
-			logger.WithError(err).WithField("prefix", prefix).Error("failed to map request")
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			requestLogger(r.Context(), logger).WithError(err).WithField("prefix", prefix).Error("failed to map request")
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+		addLogFields(r.Context(), logrus.Fields{"prefix": prefix, "objects": m.objectCount()})
+		if c.Map404OnEmpty && len(m.Sequences) == 0 {
+			http.Error(w, "no clips found", c.MapEmptyStatus)
 			return
 		}
 		m = appendExtraResources(r, c, m)
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(m)
+		m.ClipFrom, m.ClipTo = clipFrom, clipTo
+		if cacheControl, ok := c.CacheControl.lookup(r.URL.Path); ok {
+			w.Header().Set("Cache-Control", cacheControl)
+		}
+		// the format may be negotiated with the Accept header.
+		w.Header().Add("Vary", "Accept")
+		format := mapFormat(&c, r)
+		// signing the clips is traced within the encoding of the response.
+		renderCtx, rs := startSpan(r.Context(), "map.encode", spanKindInternal)
+		defer rs.finish()
+		rs.setAttribute("map.format", format)
+		r = r.WithContext(renderCtx)
+		switch format {
+		case mapFormatHLS:
+			// signed URLs change on every request, so playlists and
+			// manifests have no ETag.
+			playlist, status, err := renderHLS(&c, r, m)
+			if err != nil {
+				requestLogger(r.Context(), logger).WithError(err).WithField("prefix", prefix).Error("failed to render hls playlist")
+				http.Error(w, err.Error(), status)
+				return
+			}
+			w.Header().Set("Content-Type", hlsContentType)
+			w.Write(playlist)
+			return
+		case mapFormatDASH:
+			manifest, status, err := renderDASH(&c, r, m)
+			if err != nil {
+				requestLogger(r.Context(), logger).WithError(err).WithField("prefix", prefix).Error("failed to render dash manifest")
+				http.Error(w, err.Error(), status)
+				return
+			}
+			w.Header().Set("Content-Type", dashContentType)
+			w.Write(manifest)
+			return
+		case mapFormatISM:
+			manifest, status, err := renderISM(&c, r, m)
+			if err != nil {
+				requestLogger(r.Context(), logger).WithError(err).WithField("prefix", prefix).Error("failed to render ism manifest")
+				http.Error(w, err.Error(), status)
+				return
+			}
+			w.Header().Set("Content-Type", ismContentType)
+			w.Write(manifest)
+			return
+		case mapFormatTemplate:
+			if tmpl == nil {
+				http.Error(w, "map template is not configured", http.StatusInternalServerError)
+				return
+			}
+			body, err := renderTemplate(tmpl, &c, r, prefix, m)
+			if err != nil {
+				requestLogger(r.Context(), logger).WithError(err).WithField("prefix", prefix).Error("failed to render map template")
+				http.Error(w, "failed to render map template", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", c.MapTemplateContentType)
+			w.Write(body)
+			return
+		}
+		var body interface{} = m
+		contentType := "application/json"
+		if format == mapFormatV2 {
+			body = newMappingV2(&c, m)
+			contentType = mappingV2ContentType
+		}
+		if etag := responseETag(m, r, format); etag != "" {
+			w.Header().Set("ETag", etag)
+			if matchesETag(r.Header.Get("If-None-Match"), etag) {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", contentType)
+		json.NewEncoder(w).Encode(body)
+	}
+}
+
+// clipRange returns the clipFrom and clipTo query parameters, in
+// milliseconds. Missing parameters are returned as zero.
+func clipRange(query url.Values) (clipFrom, clipTo int64, err error) {
+	if clipFrom, err = clipParam(query, "clipFrom"); err != nil {
+		return 0, 0, err
+	}
+	if clipTo, err = clipParam(query, "clipTo"); err != nil {
+		return 0, 0, err
+	}
+	if clipTo > 0 && clipTo <= clipFrom {
+		return 0, 0, errors.New("clipTo must be greater than clipFrom")
 	}
+	return clipFrom, clipTo, nil
+}
+
+func clipParam(query url.Values, name string) (int64, error) {
+	value := query.Get(name)
+	if value == "" {
+		return 0, nil
+	}
+	ms, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || ms < 0 {
+		return 0, fmt.Errorf("invalid %s", name)
+	}
+	return ms, nil
 }
 
 func appendExtraResources(r *http.Request, config Config, m mapping) mapping {
 	resources := r.URL.Query().Get(config.ExtraResourcesToken)
+	if resources == "" {
+		return m
+	}
+	// the mapping may be shared with other requests (see mappingGroup).
+	m.Sequences = append([]sequence{}, m.Sequences...)
 	for _, resource := range strings.Split(resources, ",") {
 		if resource != "" {
 			m.Sequences = append(m.Sequences, sequence{
-				Clips: []clip{{Type: "source", Path: resource}},
+				Clips: []clip{{Type: clipType(config, resource), Path: resource}},
 			})
 		}
 	}
 	return m
 }
 
-func getPrefixMapping(prefix, ext string, config Config, bucketHandle *storage.BucketHandle) (mapping, error) {
+// cachedPrefixMapping returns the mapping for the given prefix from the
+// cache, when enabled, or lists the objects in GCS, coalescing concurrent
+// requests for the same mapping. Durations are probed before caching, when
+// prober is not nil.
+func cachedPrefixMapping(ctx context.Context, prefix, ext string, page mapPage, config Config, filters mapFilters, cache mappingCache, group *mappingGroup, prober *durationProber, bucketHandle *storage.BucketHandle) (mapping, error) {
+	key := prefix + "\x00" + ext + page.key()
+	ctx, s := startSpan(ctx, "map.mapping", spanKindInternal)
+	defer s.finish()
+	s.setAttribute("map.prefix", prefix)
+	if cache != nil {
+		m, ok := cache.get(ctx, key)
+		cacheRequests.inc("mapping", cacheResult(ok))
+		s.setAttribute("cache.hit", ok)
+		if ok {
+			return m, nil
+		}
+	}
+	start := time.Now()
+	defer func() { addLogDuration(ctx, "listDuration", time.Since(start)) }()
+	return group.do(ctx, key, func(ctx context.Context) (mapping, error) {
+		start := time.Now()
+		listCtx, ls := startSpan(ctx, "map.list", spanKindInternal)
+		m, err := getPrefixMapping(listCtx, prefix, ext, page, config, filters, bucketHandle)
+		if err == nil {
+			gcsListDuration.observeDuration(start)
+			mapObjects.observe(float64(m.objectCount()))
+			ls.setAttribute("map.objects", m.objectCount())
+		}
+		ls.setError(err)
+		ls.finish()
+		if err == nil && prober != nil {
+			probeCtx, ps := startSpan(ctx, "map.probe", spanKindInternal)
+			prober.setDurations(probeCtx, &m, bucketHandle)
+			ps.finish()
+		}
+		if err == nil && cache != nil {
+			ttl := config.MapCacheTTL
+			if len(m.Sequences) == 0 {
+				// prefixes without matches are usually requested by
+				// misconfigured players, and are cached for less time, as
+				// they may be uploaded soon.
+				ttl = config.MapCacheNegativeTTL
+			}
+			if ttl > 0 {
+				cache.set(ctx, key, m, ttl)
+			}
+		}
+		return m, err
+	})
+}
+
+func getPrefixMapping(ctx context.Context, prefix, ext string, page mapPage, config Config, filters mapFilters, bucketHandle *storage.BucketHandle) (mapping, error) {
 	m := mapping{Sequences: []sequence{}}
+	var prefixes []string
 	for _, p := range getPrefixes(prefix, config) {
-		sequences, err := expandPrefix(p, ext, config, bucketHandle)
+		globbed, err := expandGlob(ctx, p, filters.delimiter, bucketHandle)
+		if err != nil {
+			return m, err
+		}
+		prefixes = append(prefixes, globbed...)
+	}
+	token, remaining := page.token, page.size
+	for i := page.prefix; i < len(prefixes); i++ {
+		if page.size > 0 && remaining <= 0 {
+			m.NextPageToken = encodePageToken(i, "")
+			break
+		}
+		sequences, listed, next, err := expandPrefixPage(ctx, prefixes[i], ext, filters, token, remaining, bucketHandle)
 		if err != nil {
 			return m, err
 		}
 		m.Sequences = append(m.Sequences, sequences...)
+		if next != "" {
+			m.NextPageToken = encodePageToken(i, next)
+			break
+		}
+		token = ""
+		remaining -= listed
 	}
+	if config.MapDedupe != "" {
+		m.Sequences = dedupeSequences(m.Sequences, config.MapDedupe)
+	}
+	sortSequences(m.Sequences, config.MapSort, config.MapSortOrder)
+	setClipTypes(m, config)
+	if filters.labels != nil {
+		setSequenceLabels(m, filters.labels)
+	}
+	if config.MapVerbose {
+		setClipAttrs(m)
+	}
+	m.etag = mappingETag(m)
 	return m, nil
 }
 
+// objectCount returns the number of objects in the mapping.
+func (m mapping) objectCount() int {
+	var n int
+	for _, s := range m.Sequences {
+		n += len(s.Clips)
+	}
+	return n
+}
+
+// mappingETag returns a hash of the names and generations of the objects in
+// the mapping, so it changes whenever objects are added, removed or
+// overwritten.
+func mappingETag(m mapping) string {
+	h := sha256.New()
+	for _, s := range m.Sequences {
+		for _, c := range s.Clips {
+			generation := c.Generation
+			if c.attrs != nil {
+				generation = c.attrs.Generation
+			}
+			fmt.Fprintf(h, "%s\x00%d\n", c.Path, generation)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// responseETag returns the entity tag of a map response, which also depends
+// on the query string, as it may add extra resources to the mapping, and on
+// the schema of the response.
+func responseETag(m mapping, r *http.Request, format string) string {
+	if m.etag == "" {
+		return ""
+	}
+	key := m.etag + "?" + r.URL.RawQuery
+	if format != mapFormatJSON {
+		key += "#" + format
+	}
+	sum := sha256.Sum256([]byte(key))
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// dedupeSequences removes sequences with the same file name listed from
+// different prefixes. With the "first" precedence, the sequence from the
+// first prefix (in the order of getPrefixes) is kept, and with "last", the
+// one from the last prefix.
+func dedupeSequences(sequences []sequence, precedence string) []sequence {
+	keep := make(map[string]int, len(sequences))
+	for i, s := range sequences {
+		name := path.Base(s.Clips[0].Path)
+		if _, ok := keep[name]; !ok || precedence == mapDedupeLast {
+			keep[name] = i
+		}
+	}
+	result := make([]sequence, 0, len(keep))
+	for i, s := range sequences {
+		if keep[path.Base(s.Clips[0].Path)] == i {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+// setSequenceLabels sets the language and label of the sequences using the
+// named groups "lang" (or "language") and "label" of the given regex, matched
+// against the file name of their first clip.
+func setSequenceLabels(m mapping, re *regexp.Regexp) {
+	for i, s := range m.Sequences {
+		if len(s.Clips) == 0 {
+			continue
+		}
+		match := re.FindStringSubmatch(path.Base(s.Clips[0].Path))
+		if match == nil {
+			continue
+		}
+		for j, name := range re.SubexpNames() {
+			switch name {
+			case "lang", "language":
+				m.Sequences[i].Language = match[j]
+			case "label":
+				m.Sequences[i].Label = match[j]
+			}
+		}
+	}
+}
+
+// clipType returns the type of the clip with the given path, as configured
+// in GCS_HELPER_MAP_CLIP_TYPES, defaulting to "source".
+func clipType(config Config, clipPath string) string {
+	if t, ok := config.MapClipTypes.lookup(clipPath); ok {
+		return t
+	}
+	return "source"
+}
+
+func setClipTypes(m mapping, config Config) {
+	for _, s := range m.Sequences {
+		for i := range s.Clips {
+			s.Clips[i].Type = clipType(config, s.Clips[i].Path)
+		}
+	}
+}
+
+// setClipAttrs sets the size, generation and update time of the clips that
+// were listed from GCS.
+func setClipAttrs(m mapping) {
+	for _, s := range m.Sequences {
+		for i := range s.Clips {
+			if attrs := s.Clips[i].attrs; attrs != nil {
+				s.Clips[i].Size = attrs.Size
+				s.Clips[i].Generation = attrs.Generation
+				if !attrs.Updated.IsZero() {
+					updated := attrs.Updated.UTC()
+					s.Clips[i].Updated = &updated
+				}
+			}
+		}
+	}
+}
+
 func getPrefixes(originalPrefix string, config Config) []string {
 	prefixes := []string{originalPrefix}
 	_, lastPart := path.Split(originalPrefix)
@@ -90,37 +554,106 @@ func getPrefixes(originalPrefix string, config Config) []string {
 	return prefixes
 }
 
-func expandPrefix(prefix, ext string, config Config, bucketHandle *storage.BucketHandle) ([]sequence, error) {
+// defaultFilter returns the filter used for the given prefix when it doesn't
+// contain a rendition token.
+func (f mapFilters) defaultFilter(prefix string) *regexp.Regexp {
+	for _, p := range f.prefixes {
+		if strings.HasPrefix(prefix, p.prefix) {
+			return p.filter
+		}
+	}
+	return f.filter
+}
+
+// excluded reports whether the file matches GCS_HELPER_MAP_REGEX_EXCLUDE.
+func (f mapFilters) excluded(filename string) bool {
+	return f.exclude != nil && f.exclude.MatchString(filename)
+}
+
+// rendition returns the filter of the rendition token in the given prefix.
+func (f mapFilters) rendition(prefix string) (renditionFilter, bool) {
+	for _, r := range f.renditions {
+		if strings.Contains(prefix, r.token) {
+			return r, true
+		}
+	}
+	return renditionFilter{}, false
+}
+
+// tooDeep reports whether the object is nested more than
+// GCS_HELPER_MAP_MAX_DEPTH levels below the directory of the prefix. Only
+// recursive listings return nested objects.
+func (f mapFilters) tooDeep(prefix, name string) bool {
+	if !f.recursive {
+		return false
+	}
+	var dir string
+	if i := strings.LastIndex(prefix, f.delimiter); i >= 0 {
+		dir = prefix[:i+len(f.delimiter)]
+	}
+	return strings.Count(strings.TrimPrefix(name, dir), f.delimiter) > f.maxDepth
+}
+
+// namedToken returns the rendition token of the filter with the given name,
+// which is the token without the leading underscores, ignoring case.
+func (f mapFilters) namedToken(name string) (string, bool) {
+	for _, r := range f.renditions {
+		if strings.EqualFold(r.token, "__"+name) {
+			return r.token, true
+		}
+	}
+	return "", false
+}
+
+func expandPrefix(ctx context.Context, prefix, ext string, filters mapFilters, bucketHandle *storage.BucketHandle) ([]sequence, error) {
+	sequences, _, _, err := expandPrefixPage(ctx, prefix, ext, filters, "", 0, bucketHandle)
+	return sequences, err
+}
+
+// expandPrefixPage lists up to size objects under the prefix (or all of
+// them, when size is 0), starting at the given GCS page token. It returns the
+// sequences of the matching objects, the number of listed objects and the
+// token of the next page, if any.
+func expandPrefixPage(ctx context.Context, prefix, ext string, filters mapFilters, token string, size int, bucketHandle *storage.BucketHandle) ([]sequence, int, string, error) {
 	var err error
-	var filterRegex string
-	if strings.Contains(prefix, "__HD") {
-		filterRegex = config.MapRegexHDFilter
-		prefix = strings.Replace(prefix, "__HD", "", 1)
+	match := filters.defaultFilter(prefix).MatchString
+	if rendition, ok := filters.rendition(prefix); ok {
+		match = rendition.filter.MatchString
+		prefix = strings.Replace(prefix, rendition.token, "", 1)
 	} else if ext != "" {
-		filterRegex = regexp.QuoteMeta(ext) + "$"
-	} else {
-		filterRegex = config.MapRegexFilter
+		match = func(filename string) bool {
+			return strings.HasSuffix(filename, ext)
+		}
 	}
 	for i := 0; i < maxTry; i++ {
-		iter := bucketHandle.Objects(context.Background(), &storage.Query{
-			Prefix:    prefix,
-			Delimiter: "/",
-		})
-		var obj *storage.ObjectAttrs
+		if i > 0 && !waitRetry(ctx, i-1) {
+			return nil, 0, "", ctx.Err()
+		}
+		query := storage.Query{Prefix: prefix, Delimiter: filters.delimiter}
+		if filters.recursive {
+			query.Delimiter = ""
+		}
+		var listed int
+		var next string
 		sequences := []sequence{}
-		obj, err = iter.Next()
-		for ; err == nil; obj, err = iter.Next() {
+		next, err = listObjects(withListFields(ctx, filters.fields), bucketHandle, &query, token, size, func(obj *storage.ObjectAttrs) {
+			listed++
+			if obj.Prefix != "" || filters.tooDeep(prefix, obj.Name) {
+				return
+			}
 			filename := path.Base(obj.Name)
-			matched, _ := regexp.MatchString(filterRegex, filename)
-			if matched {
+			if match(filename) && !filters.excluded(filename) {
 				sequences = append(sequences, sequence{
-					Clips: []clip{{Type: "source", Path: "/" + obj.Bucket + "/" + obj.Name}},
+					Clips: []clip{{Type: "source", Path: "/" + obj.Bucket + "/" + obj.Name, attrs: obj}},
 				})
 			}
+		})
+		if err == nil {
+			return sequences, listed, next, nil
 		}
-		if err == iterator.Done {
-			return sequences, nil
+		if ctx.Err() != nil || !retryable(err) {
+			return nil, 0, "", err
 		}
 	}
-	return nil, err
+	return nil, 0, "", err
 }
@@ -0,0 +1,608 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/fsouza/fake-gcs-server/fakestorage"
+)
+
+func TestExpandPrefixCanceledContext(t *testing.T) {
+	server := fakestorage.NewServer(getObjects())
+	defer server.Stop()
+	filters := newMapFilters(Config{})
+	bucket := server.Client().Bucket("my-bucket")
+
+	sequences, err := expandPrefix(context.Background(), "musics/music/music", "", filters, bucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sequences) == 0 {
+		t.Fatal("unexpected empty mapping")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = expandPrefix(ctx, "musics/music/music", "", filters, bucket)
+	if err == nil {
+		t.Error("unexpected <nil> error")
+	}
+}
+
+func TestExpandPrefixBucketNotFound(t *testing.T) {
+	server := fakestorage.NewServer(getObjects())
+	defer server.Stop()
+	bucket := server.Client().Bucket("missing-bucket")
+	start := time.Now()
+	_, err := expandPrefix(context.Background(), "musics/music/music", "", newMapFilters(Config{}), bucket)
+	if err == nil {
+		t.Fatal("unexpected <nil> error")
+	}
+	if status := errorStatus(err); status != http.StatusNotFound {
+		t.Errorf("wrong status\nwant %d\ngot  %d", http.StatusNotFound, status)
+	}
+	if elapsed := time.Since(start); elapsed > minRetryDelay {
+		t.Errorf("permanent error retried: took %s", elapsed)
+	}
+}
+
+func TestCachedPrefixMappingNegativeTTL(t *testing.T) {
+	server := fakestorage.NewServer(getObjects())
+	defer server.Stop()
+	bucket := server.Client().Bucket("my-bucket")
+	now := time.Date(2018, time.March, 10, 14, 30, 12, 0, time.UTC)
+	cache := newMemoryMappingCache(10)
+	cache.now = func() time.Time { return now }
+	config := Config{MapCacheTTL: time.Minute, MapCacheNegativeTTL: 5 * time.Second}
+	filters := newMapFilters(config)
+	group := newMappingGroup()
+	ctx := context.Background()
+
+	var tests = []struct {
+		prefix     string
+		expiration time.Duration
+	}{
+		{"musics/music/music", time.Minute},
+		{"musics/missing", 5 * time.Second},
+	}
+	for _, test := range tests {
+		if _, err := cachedPrefixMapping(ctx, test.prefix, "", mapPage{}, config, filters, cache, group, nil, bucket); err != nil {
+			t.Fatal(err)
+		}
+		elem, ok := cache.entries[test.prefix+"\x00"]
+		if !ok {
+			t.Errorf("%s: mapping not cached", test.prefix)
+			continue
+		}
+		expires := elem.Value.(*memoryMappingEntry).expires
+		if expected := now.Add(test.expiration); !expires.Equal(expected) {
+			t.Errorf("%s: wrong expiration\nwant %s\ngot  %s", test.prefix, expected, expires)
+		}
+	}
+}
+
+func TestServerMapEmptyStatus(t *testing.T) {
+	addr, cleanup := startServer(t, Config{
+		BucketName:          "my-bucket",
+		MapPrefix:           "/map/",
+		ProxyPrefix:         "/proxy/",
+		ExtraResourcesToken: "extra",
+		Map404OnEmpty:       true,
+		MapEmptyStatus:      http.StatusNotFound,
+	})
+	defer cleanup()
+	var tests = []serverTest{
+		{
+			testCase:       "map: empty list",
+			method:         http.MethodGet,
+			addr:           addr + "/map/musics/musyc",
+			expectedStatus: http.StatusNotFound,
+			expectedBody:   "no clips found\n",
+		},
+		{
+			testCase:       "map: extra resources only",
+			method:         http.MethodGet,
+			addr:           addr + "/map/musics/musyc?extra=/bucket/file.vtt",
+			expectedStatus: http.StatusNotFound,
+			expectedBody:   "no clips found\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.testCase, test.run)
+	}
+}
+
+func TestGetPrefixMappingVerbose(t *testing.T) {
+	server := fakestorage.NewServer(getObjects())
+	defer server.Stop()
+	bucket := server.Client().Bucket("my-bucket")
+	config := Config{MapVerbose: true}
+	m, err := getPrefixMapping(context.Background(), "musics/music/music1", "", mapPage{}, config, newMapFilters(config), bucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Sequences) != 1 {
+		t.Fatalf("wrong number of sequences\nwant 1\ngot  %d", len(m.Sequences))
+	}
+	if c := m.Sequences[0].Clips[0]; c.Size != 15 {
+		t.Errorf("wrong size\nwant 15\ngot  %d", c.Size)
+	}
+}
+
+func TestSetClipAttrs(t *testing.T) {
+	updated := time.Date(2018, time.March, 10, 14, 30, 12, 0, time.FixedZone("EST", -5*3600))
+	m := mapping{Sequences: []sequence{
+		{Clips: []clip{{Type: "source", Path: "/my-bucket/video_720p.mp4", attrs: &storage.ObjectAttrs{
+			Name:       "video_720p.mp4",
+			Size:       1024,
+			Generation: 1520692212,
+			Updated:    updated,
+		}}}},
+		{Clips: []clip{{Type: "source", Path: "/bucket/file.vtt"}}},
+	}}
+	setClipAttrs(m)
+	data, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"sequences":[{"clips":[{"type":"source","path":"/my-bucket/video_720p.mp4","size":1024,"generation":1520692212,"updated":"2018-03-10T19:30:12Z"}]},{"clips":[{"type":"source","path":"/bucket/file.vtt"}]}]}`
+	if string(data) != expected {
+		t.Errorf("wrong mapping\nwant %s\ngot  %s", expected, data)
+	}
+}
+
+func TestGetPrefixMappingClipTypes(t *testing.T) {
+	server := fakestorage.NewServer(getObjects())
+	defer server.Stop()
+	bucket := server.Client().Bucket("my-bucket")
+	config := Config{
+		ExtraResourcesToken: "extra",
+		MapClipTypes:        ExtensionMap{".vtt": "subtitle", ".srt": "subtitle"},
+	}
+	m, err := getPrefixMapping(context.Background(), "videos/video/77071", "", mapPage{}, config, newMapFilters(config), bucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, _ := http.NewRequest(http.MethodGet, "/map/videos/video/77071?extra=/bucket/file.mp4", nil)
+	m = appendExtraResources(r, config, m)
+	var types []string
+	for _, s := range m.Sequences {
+		types = append(types, s.Clips[0].Type)
+	}
+	expected := []string{"subtitle", "subtitle", "source"}
+	if !reflect.DeepEqual(types, expected) {
+		t.Errorf("wrong clip types\nwant %q\ngot  %q", expected, types)
+	}
+}
+
+func TestSetSequenceLabels(t *testing.T) {
+	re := regexp.MustCompile(`_(?P<label>(?P<lang>[a-z]{2})(-[a-z]+)?)\.vtt$`)
+	m := mapping{Sequences: []sequence{
+		{Clips: []clip{{Type: "source", Path: "/my-bucket/videos/video_720p.mp4"}}},
+		{Clips: []clip{{Type: "source", Path: "/my-bucket/videos/video_en.vtt"}}},
+		{Clips: []clip{{Type: "source", Path: "/my-bucket/videos/video_pt-br.vtt"}}},
+	}}
+	setSequenceLabels(m, re)
+	expected := []sequence{
+		{Clips: m.Sequences[0].Clips},
+		{Language: "en", Label: "en", Clips: m.Sequences[1].Clips},
+		{Language: "pt", Label: "pt-br", Clips: m.Sequences[2].Clips},
+	}
+	if !reflect.DeepEqual(m.Sequences, expected) {
+		t.Errorf("wrong sequences\nwant %#v\ngot  %#v", expected, m.Sequences)
+	}
+}
+
+func TestExpandPrefixRenditionFilters(t *testing.T) {
+	server := fakestorage.NewServer(getObjects())
+	defer server.Stop()
+	bucket := server.Client().Bucket("my-bucket")
+	filters := newMapFilters(Config{
+		MapRegexHDFilter: `(720|1080)p\.mp4$`,
+		MapRenditionFilters: TokenMap{
+			"__SD":  `(240|360|480)p\.mp4$`,
+			"__HDR": `1080p\.mp4$`,
+		},
+	})
+	var tests = []struct {
+		prefix   string
+		expected []string
+	}{
+		{
+			"videos/video/__SD",
+			[]string{"/my-bucket/videos/video/video1_480p.mp4"},
+		},
+		{
+			"videos/video/__HD",
+			[]string{"/my-bucket/videos/video/28043_1_video_1080p.mp4", "/my-bucket/videos/video/video1_720p.mp4"},
+		},
+		{
+			"videos/video/__HDR",
+			[]string{"/my-bucket/videos/video/28043_1_video_1080p.mp4"},
+		},
+	}
+	for _, test := range tests {
+		sequences, err := expandPrefix(context.Background(), test.prefix, "", filters, bucket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var paths []string
+		for _, s := range sequences {
+			paths = append(paths, s.Clips[0].Path)
+		}
+		if !reflect.DeepEqual(paths, test.expected) {
+			t.Errorf("%s: wrong clips\nwant %q\ngot  %q", test.prefix, test.expected, paths)
+		}
+	}
+}
+
+func TestServerMapNamedFilter(t *testing.T) {
+	addr, cleanup := startServer(t, Config{
+		BucketName:          "my-bucket",
+		MapPrefix:           "/map/",
+		ProxyPrefix:         "/proxy/",
+		MapRegexFilter:      `\.mp4$`,
+		MapRegexHDFilter:    `(720|1080)p\.mp4$`,
+		MapRenditionFilters: TokenMap{"__SD": `(240|360|480)p\.mp4$`},
+	})
+	defer cleanup()
+	sdMapping := map[string]interface{}{
+		"sequences": []interface{}{
+			map[string]interface{}{
+				"clips": []interface{}{
+					map[string]interface{}{
+						"type": "source",
+						"path": "/my-bucket/videos/video/video1_480p.mp4",
+					},
+				},
+			},
+		},
+	}
+	var tests = []serverTest{
+		{
+			testCase:       "map: named filter",
+			method:         http.MethodGet,
+			addr:           addr + "/map/videos/video/?filter=sd",
+			expectedStatus: http.StatusOK,
+			expectedBody:   sdMapping,
+		},
+		{
+			testCase:       "map: rendition token",
+			method:         http.MethodGet,
+			addr:           addr + "/map/videos/video/__SD",
+			expectedStatus: http.StatusOK,
+			expectedBody:   sdMapping,
+		},
+		{
+			testCase:       "map: unknown filter",
+			method:         http.MethodGet,
+			addr:           addr + "/map/videos/video/?filter=4k",
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   "unknown filter\n",
+		},
+		{
+			testCase:       "map: named filter and rendition token",
+			method:         http.MethodGet,
+			addr:           addr + "/map/videos/video/__HD?filter=sd",
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   "filter cannot be combined with a rendition token\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.testCase, test.run)
+	}
+}
+
+func TestServerMapClipRange(t *testing.T) {
+	addr, cleanup := startServer(t, Config{
+		BucketName:     "my-bucket",
+		MapPrefix:      "/map/",
+		ProxyPrefix:    "/proxy/",
+		MapRegexFilter: `480p\.mp4$`,
+	})
+	defer cleanup()
+	clipMapping := func(clipFrom, clipTo float64) map[string]interface{} {
+		m := map[string]interface{}{
+			"sequences": []interface{}{
+				map[string]interface{}{
+					"clips": []interface{}{
+						map[string]interface{}{
+							"type": "source",
+							"path": "/my-bucket/videos/video/video1_480p.mp4",
+						},
+					},
+				},
+			},
+		}
+		if clipFrom > 0 {
+			m["clipFrom"] = clipFrom
+		}
+		if clipTo > 0 {
+			m["clipTo"] = clipTo
+		}
+		return m
+	}
+	var tests = []serverTest{
+		{
+			testCase:       "map: clip range",
+			method:         http.MethodGet,
+			addr:           addr + "/map/videos/video/?clipFrom=10000&clipTo=40000",
+			expectedStatus: http.StatusOK,
+			expectedBody:   clipMapping(10000, 40000),
+		},
+		{
+			testCase:       "map: clip from only",
+			method:         http.MethodGet,
+			addr:           addr + "/map/videos/video/?clipFrom=5000",
+			expectedStatus: http.StatusOK,
+			expectedBody:   clipMapping(5000, 0),
+		},
+		{
+			testCase:       "map: clip to only",
+			method:         http.MethodGet,
+			addr:           addr + "/map/videos/video/?clipTo=30000",
+			expectedStatus: http.StatusOK,
+			expectedBody:   clipMapping(0, 30000),
+		},
+		{
+			testCase:       "map: invalid clip from",
+			method:         http.MethodGet,
+			addr:           addr + "/map/videos/video/?clipFrom=1s",
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   "invalid clipFrom\n",
+		},
+		{
+			testCase:       "map: negative clip to",
+			method:         http.MethodGet,
+			addr:           addr + "/map/videos/video/?clipTo=-1",
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   "invalid clipTo\n",
+		},
+		{
+			testCase:       "map: empty clip range",
+			method:         http.MethodGet,
+			addr:           addr + "/map/videos/video/?clipFrom=30000&clipTo=30000",
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   "clipTo must be greater than clipFrom\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.testCase, test.run)
+	}
+}
+
+func TestExpandPrefixPrefixFilters(t *testing.T) {
+	server := fakestorage.NewServer(getObjects())
+	defer server.Stop()
+	bucket := server.Client().Bucket("my-bucket")
+	filters := newMapFilters(Config{
+		MapRegexFilter:   `\.srt$`,
+		MapRegexHDFilter: `1080p\.mp4$`,
+		MapPrefixFilters: PrefixMap{
+			"videos/":            `480p\.mp4$`,
+			"videos/video/77071": `\.vtt$`,
+		},
+	})
+	var tests = []struct {
+		prefix   string
+		expected []string
+	}{
+		{
+			"videos/video/",
+			[]string{"/my-bucket/videos/video/video1_480p.mp4"},
+		},
+		{
+			"videos/video/__HD",
+			[]string{"/my-bucket/videos/video/28043_1_video_1080p.mp4"},
+		},
+		{
+			"videos/video/77071",
+			[]string{"/my-bucket/videos/video/77071_1_caption_wg_240p_001f8ea7-749b-4d43-7bd5-b357e4e24f32.vtt"},
+		},
+		{
+			"subs/video1",
+			[]string{"/my-bucket/subs/video1.srt"},
+		},
+	}
+	for _, test := range tests {
+		sequences, err := expandPrefix(context.Background(), test.prefix, "", filters, bucket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var paths []string
+		for _, s := range sequences {
+			paths = append(paths, s.Clips[0].Path)
+		}
+		if !reflect.DeepEqual(paths, test.expected) {
+			t.Errorf("%s: wrong clips\nwant %q\ngot  %q", test.prefix, test.expected, paths)
+		}
+	}
+}
+
+func TestExpandPrefixExclude(t *testing.T) {
+	server := fakestorage.NewServer(getObjects())
+	defer server.Stop()
+	bucket := server.Client().Bucket("my-bucket")
+	filters := newMapFilters(Config{
+		MapRegexFilter:   `\.mp4$`,
+		MapRegexHDFilter: `(720|1080)p\.mp4$`,
+		MapRegexExclude:  `^video1_`,
+	})
+	for _, prefix := range []string{"videos/video/", "videos/video/__HD"} {
+		sequences, err := expandPrefix(context.Background(), prefix, "", filters, bucket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var paths []string
+		for _, s := range sequences {
+			paths = append(paths, s.Clips[0].Path)
+		}
+		expected := []string{"/my-bucket/videos/video/28043_1_video_1080p.mp4"}
+		if !reflect.DeepEqual(paths, expected) {
+			t.Errorf("%s: wrong clips\nwant %q\ngot  %q", prefix, expected, paths)
+		}
+	}
+}
+
+func TestExpandPrefixRecursive(t *testing.T) {
+	server := fakestorage.NewServer([]fakestorage.Object{
+		{BucketName: "my-bucket", Name: "movies/movie/movie_720p.mp4"},
+		{BucketName: "my-bucket", Name: "movies/movie/extras/movie_trailer.mp4"},
+		{BucketName: "my-bucket", Name: "movies/movie/extras/deep/nested/movie_bts.mp4"},
+	})
+	defer server.Stop()
+	bucket := server.Client().Bucket("my-bucket")
+	var tests = []struct {
+		testCase string
+		config   Config
+		prefix   string
+		expected []string
+	}{
+		{
+			"default delimiter",
+			Config{},
+			"movies/movie/",
+			[]string{"/my-bucket/movies/movie/movie_720p.mp4"},
+		},
+		{
+			"recursive with depth 1",
+			Config{MapRecursive: true, MapMaxDepth: 1},
+			"movies/movie/",
+			[]string{
+				"/my-bucket/movies/movie/extras/movie_trailer.mp4",
+				"/my-bucket/movies/movie/movie_720p.mp4",
+			},
+		},
+		{
+			"recursive with depth 3",
+			Config{MapRecursive: true, MapMaxDepth: 3},
+			"movies/movie/",
+			[]string{
+				"/my-bucket/movies/movie/extras/deep/nested/movie_bts.mp4",
+				"/my-bucket/movies/movie/extras/movie_trailer.mp4",
+				"/my-bucket/movies/movie/movie_720p.mp4",
+			},
+		},
+		{
+			"recursive with partial file name",
+			Config{MapRecursive: true, MapMaxDepth: 0},
+			"movies/movie/movie",
+			[]string{"/my-bucket/movies/movie/movie_720p.mp4"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.testCase, func(t *testing.T) {
+			sequences, err := expandPrefix(context.Background(), test.prefix, "", newMapFilters(test.config), bucket)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var paths []string
+			for _, s := range sequences {
+				paths = append(paths, s.Clips[0].Path)
+			}
+			if !reflect.DeepEqual(paths, test.expected) {
+				t.Errorf("wrong clips\nwant %q\ngot  %q", test.expected, paths)
+			}
+		})
+	}
+}
+
+func TestDedupeSequences(t *testing.T) {
+	sequences := []sequence{
+		{Clips: []clip{{Type: "source", Path: "/my-bucket/videos/video1/video1_720p.mp4"}}},
+		{Clips: []clip{{Type: "source", Path: "/my-bucket/videos/video1/video1_en.vtt"}}},
+		{Clips: []clip{{Type: "source", Path: "/my-bucket/subs/video1/video1_en.vtt"}}},
+		{Clips: []clip{{Type: "source", Path: "/my-bucket/subs/video1/video1_es.vtt"}}},
+		{Clips: []clip{{Type: "source", Path: "/my-bucket/fixes/video1/video1_en.vtt"}}},
+	}
+	var tests = []struct {
+		precedence string
+		expected   []string
+	}{
+		{
+			mapDedupeFirst,
+			[]string{
+				"/my-bucket/videos/video1/video1_720p.mp4",
+				"/my-bucket/videos/video1/video1_en.vtt",
+				"/my-bucket/subs/video1/video1_es.vtt",
+			},
+		},
+		{
+			mapDedupeLast,
+			[]string{
+				"/my-bucket/videos/video1/video1_720p.mp4",
+				"/my-bucket/subs/video1/video1_es.vtt",
+				"/my-bucket/fixes/video1/video1_en.vtt",
+			},
+		},
+	}
+	for _, test := range tests {
+		var paths []string
+		for _, s := range dedupeSequences(sequences, test.precedence) {
+			paths = append(paths, s.Clips[0].Path)
+		}
+		if !reflect.DeepEqual(paths, test.expected) {
+			t.Errorf("%s: wrong clips\nwant %q\ngot  %q", test.precedence, test.expected, paths)
+		}
+	}
+}
+
+func TestServerMapETag(t *testing.T) {
+	addr, cleanup := startServer(t, Config{
+		BucketName:          "my-bucket",
+		MapPrefix:           "/map/",
+		ProxyPrefix:         "/proxy/",
+		ExtraResourcesToken: "extra",
+	})
+	defer cleanup()
+	get := func(url, inm string) *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		if inm != "" {
+			req.Header.Set("If-None-Match", inm)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	resp := get(addr+"/map/videos/video/", "")
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		t.Fatal("missing ETag header")
+	}
+	if resp = get(addr+"/map/videos/video/", etag); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("wrong status code\nwant %d\ngot  %d", http.StatusNotModified, resp.StatusCode)
+	}
+	if resp = get(addr+"/map/videos/video/", `"other"`); resp.StatusCode != http.StatusOK {
+		t.Errorf("wrong status code\nwant %d\ngot  %d", http.StatusOK, resp.StatusCode)
+	}
+	resp = get(addr+"/map/videos/video/?extra=/bucket/file.vtt", etag)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("wrong status code\nwant %d\ngot  %d", http.StatusOK, resp.StatusCode)
+	}
+	if resp.Header.Get("ETag") == etag {
+		t.Error("extra resources didn't change the ETag")
+	}
+}
+
+func TestMappingETag(t *testing.T) {
+	m := func(generation int64) mapping {
+		return mapping{Sequences: []sequence{
+			{Clips: []clip{{Type: "source", Path: "/my-bucket/video_720p.mp4", attrs: &storage.ObjectAttrs{Generation: generation}}}},
+		}}
+	}
+	if mappingETag(m(1)) != mappingETag(m(1)) {
+		t.Error("unstable etag")
+	}
+	if mappingETag(m(1)) == mappingETag(m(2)) {
+		t.Error("overwritten object didn't change the etag")
+	}
+}
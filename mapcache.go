@@ -0,0 +1,146 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	mapCacheMemory = "memory"
+	mapCacheRedis  = "redis"
+)
+
+// mappingCache caches mappings, keyed by prefix and filter, so repeated map
+// requests don't list objects in GCS. Cached mappings must not be modified.
+type mappingCache interface {
+	get(ctx context.Context, key string) (mapping, bool)
+	set(ctx context.Context, key string, m mapping, ttl time.Duration)
+}
+
+// newMappingCache returns the cache configured in GCS_HELPER_MAP_CACHE_*, or
+// nil when caching is disabled.
+func newMappingCache(c Config) mappingCache {
+	if c.MapCacheBackend == mapCacheRedis {
+		return &redisMappingCache{
+			client:    newRedisClient(c.MapCacheRedisAddr, c.MapCacheRedisPassword),
+			keyPrefix: c.MapCacheRedisKeyPrefix,
+			logger:    c.logger(),
+		}
+	}
+	if c.MapCacheSize <= 0 {
+		return nil
+	}
+	return newMemoryMappingCache(c.MapCacheSize)
+}
+
+// memoryMappingCache is an in-memory LRU cache of mappings, where entries
+// also expire after their TTL.
+type memoryMappingCache struct {
+	maxSize int
+	now     func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type memoryMappingEntry struct {
+	key     string
+	m       mapping
+	expires time.Time
+}
+
+func newMemoryMappingCache(maxSize int) *memoryMappingCache {
+	return &memoryMappingCache{
+		maxSize: maxSize,
+		now:     time.Now,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+func (c *memoryMappingCache) get(_ context.Context, key string) (mapping, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return mapping{}, false
+	}
+	entry := elem.Value.(*memoryMappingEntry)
+	if !c.now().Before(entry.expires) {
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+		return mapping{}, false
+	}
+	c.lru.MoveToFront(elem)
+	return entry.m, true
+}
+
+func (c *memoryMappingCache) set(_ context.Context, key string, m mapping, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := &memoryMappingEntry{key: key, m: m, expires: c.now().Add(ttl)}
+	if elem, ok := c.entries[key]; ok {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.maxSize {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*memoryMappingEntry).key)
+	}
+}
+
+// redisMappingCache stores mappings in Redis, so they're shared by all the
+// replicas of gcs-helper. Redis failures are logged and handled as cache
+// misses.
+type redisMappingCache struct {
+	client    *redisClient
+	keyPrefix string
+	logger    *logrus.Logger
+}
+
+// redisMappingEntry is the value stored in Redis, including the unexported
+// fields of the mapping.
+type redisMappingEntry struct {
+	Mapping mapping `json:"mapping"`
+	ETag    string  `json:"etag"`
+}
+
+func (c *redisMappingCache) get(ctx context.Context, key string) (mapping, bool) {
+	reply, err := c.client.do(ctx, "GET", c.keyPrefix+key)
+	if err == errRedisNil {
+		return mapping{}, false
+	}
+	if err != nil {
+		requestLogger(ctx, c.logger).WithError(err).WithField("key", key).Warn("failed to get mapping from redis")
+		return mapping{}, false
+	}
+	data, _ := reply.(string)
+	var entry redisMappingEntry
+	if err = json.Unmarshal([]byte(data), &entry); err != nil || entry.Mapping.Sequences == nil {
+		requestLogger(ctx, c.logger).WithError(err).WithField("key", key).Warn("invalid mapping in redis")
+		return mapping{}, false
+	}
+	entry.Mapping.etag = entry.ETag
+	return entry.Mapping, true
+}
+
+func (c *redisMappingCache) set(ctx context.Context, key string, m mapping, ttl time.Duration) {
+	data, err := json.Marshal(redisMappingEntry{Mapping: m, ETag: m.etag})
+	if err != nil {
+		return
+	}
+	px := strconv.FormatInt(int64(ttl/time.Millisecond), 10)
+	if _, err = c.client.do(ctx, "SET", c.keyPrefix+key, string(data), "PX", px); err != nil {
+		requestLogger(ctx, c.logger).WithError(err).WithField("key", key).Warn("failed to store mapping in redis")
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMemoryMappingCache(t *testing.T) {
+	now := time.Date(2018, time.March, 10, 14, 30, 12, 0, time.UTC)
+	cache := newMemoryMappingCache(2)
+	cache.now = func() time.Time { return now }
+	ctx := context.Background()
+	mappings := make([]mapping, 3)
+	for i := range mappings {
+		mappings[i] = mapping{Sequences: []sequence{{Clips: []clip{{Type: "source", Path: "/my-bucket/video" + strconv.Itoa(i) + ".mp4"}}}}}
+	}
+
+	cache.set(ctx, "video0", mappings[0], time.Minute)
+	cache.set(ctx, "video1", mappings[1], time.Minute)
+	if m, ok := cache.get(ctx, "video0"); !ok || m.Sequences[0].Clips[0].Path != "/my-bucket/video0.mp4" {
+		t.Errorf("wrong cached mapping: %#v (found: %v)", m, ok)
+	}
+
+	// video1 is the least recently used entry, so it's evicted.
+	cache.set(ctx, "video2", mappings[2], time.Minute)
+	if _, ok := cache.get(ctx, "video1"); ok {
+		t.Error("least recently used mapping wasn't evicted")
+	}
+	for _, key := range []string{"video0", "video2"} {
+		if _, ok := cache.get(ctx, key); !ok {
+			t.Errorf("missing mapping for %q", key)
+		}
+	}
+
+	now = now.Add(time.Minute)
+	if _, ok := cache.get(ctx, "video0"); ok {
+		t.Error("expired mapping returned")
+	}
+	if n := cache.lru.Len(); n != 1 {
+		t.Errorf("wrong number of entries after expiration\nwant 1\ngot  %d", n)
+	}
+}
+
+func TestNewMappingCacheDisabled(t *testing.T) {
+	if cache := newMappingCache(Config{MapCacheTTL: time.Minute}); cache != nil {
+		t.Errorf("unexpected cache when GCS_HELPER_MAP_CACHE_SIZE isn't set: %#v", cache)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"path"
+	"strings"
+)
+
+const (
+	mapFormatJSON = "json"
+	mapFormatV2   = "v2"
+	mapFormatHLS  = "hls"
+	mapFormatDASH = "dash"
+	mapFormatISM  = "ism"
+
+	// mapFormatTemplate renders the mapping with GCS_HELPER_MAP_TEMPLATE.
+	mapFormatTemplate = "template"
+)
+
+// estimatedBandwidths are the bandwidths announced for renditions when the size
+// and duration of the file aren't known, by minimum resolution.
+var estimatedBandwidths = []struct {
+	height    int
+	bandwidth int64
+}{
+	{2160, 16000000},
+	{1440, 9000000},
+	{1080, 5000000},
+	{720, 2800000},
+	{480, 1400000},
+	{360, 800000},
+	{240, 400000},
+}
+
+const defaultBandwidth = 1000000
+
+// audioExtensions are the extensions of the clips rendered as audio in
+// manifests, in addition to clips with the "audio" type.
+var audioExtensions = map[string]bool{
+	".aac": true,
+	".m4a": true,
+}
+
+type mapFormatKey struct{}
+
+// withMapFormat returns a copy of the request that instructs the map handler
+// to render the mapping in the given format, regardless of the Accept
+// header.
+func withMapFormat(r *http.Request, format string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), mapFormatKey{}, format))
+}
+
+// mapFormat returns the format the mapping should be rendered in, either set
+// by withMapFormat or negotiated with the Accept header. Formats that
+// include signed URLs are only negotiated when the signer is enabled.
+func mapFormat(c *Config, r *http.Request) string {
+	if format, ok := r.Context().Value(mapFormatKey{}).(string); ok {
+		return format
+	}
+	accept := strings.ToLower(r.Header.Get("Accept"))
+	if strings.Contains(accept, mappingV2ContentType) {
+		return mapFormatV2
+	}
+	if c.signerEnabled() {
+		switch {
+		case strings.Contains(accept, hlsContentType), strings.Contains(accept, "application/x-mpegurl"):
+			return mapFormatHLS
+		case strings.Contains(accept, dashContentType):
+			return mapFormatDASH
+		case strings.Contains(accept, ismContentType):
+			return mapFormatISM
+		}
+	}
+	return mapFormatJSON
+}
+
+// signClipURL signs the URL of a clip, using its path in the format
+// /bucket/object.
+func signClipURL(c *Config, r *http.Request, clipPath string) (string, int, error) {
+	parts := strings.SplitN(strings.TrimPrefix(clipPath, "/"), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", http.StatusBadRequest, errors.New("invalid clip path: " + clipPath)
+	}
+	return signObjectURL(c, r, http.MethodGet, parts[0], parts[1])
+}
+
+func isSubtitle(c clip) bool {
+	if c.Type == "subtitle" {
+		return true
+	}
+	ext := strings.ToLower(path.Ext(c.Path))
+	return ext == ".vtt" || ext == ".webvtt"
+}
+
+// clipBandwidth returns the average bandwidth of the clip, when its size and
+// duration are known, or an estimate based on its resolution.
+func clipBandwidth(c clip, durations []int64) int64 {
+	size := c.Size
+	if c.attrs != nil {
+		size = c.attrs.Size
+	}
+	if size > 0 && len(durations) > 0 && durations[0] > 0 {
+		return size * 8 * 1000 / durations[0]
+	}
+	height := resolution(path.Base(c.Path))
+	for _, b := range estimatedBandwidths {
+		if height >= b.height {
+			return b.bandwidth
+		}
+	}
+	return defaultBandwidth
+}
+
+// clipMediaType returns the content type (video, audio or text) and the MIME
+// type of the clip, as announced in playlists and manifests.
+func clipMediaType(c clip) (contentType, mimeType string) {
+	switch {
+	case isSubtitle(c):
+		return "text", "text/vtt"
+	case c.Type == "audio" || audioExtensions[strings.ToLower(path.Ext(c.Path))]:
+		return "audio", "audio/mp4"
+	}
+	return "video", "video/mp4"
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// maxGlobPrefixes limits the number of prefixes a map request with wildcards
+// can expand to.
+const maxGlobPrefixes = 1000
+
+var errTooManyPrefixes = fmt.Errorf("wildcards match more than %d prefixes", maxGlobPrefixes)
+
+func hasWildcard(s string) bool {
+	return strings.ContainsAny(s, "*?[")
+}
+
+// validateGlob checks the wildcards in the prefix. Wildcards use the syntax
+// of path.Match, and are only supported in directory names (the parts of
+// the prefix followed by the delimiter).
+func validateGlob(prefix, delimiter string) error {
+	dirs := strings.Split(prefix, delimiter)
+	if hasWildcard(dirs[len(dirs)-1]) {
+		return errors.New("wildcards are only supported in directory names")
+	}
+	for _, dir := range dirs[:len(dirs)-1] {
+		if _, err := path.Match(dir, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q", dir)
+		}
+	}
+	return nil
+}
+
+// expandGlob returns the prefixes matching the wildcards in the directory
+// names of the given prefix. Directories with wildcards are matched against
+// the sub-prefixes listed with the delimiter, one level at a time, and the
+// rest of the prefix is appended to the matching directories.
+func expandGlob(ctx context.Context, prefix, delimiter string, bucketHandle *storage.BucketHandle) ([]string, error) {
+	if !hasWildcard(prefix) {
+		return []string{prefix}, nil
+	}
+	dirs := strings.Split(prefix, delimiter)
+	bases := []string{""}
+	for _, dir := range dirs[:len(dirs)-1] {
+		if !hasWildcard(dir) {
+			for i := range bases {
+				bases[i] += dir + delimiter
+			}
+			continue
+		}
+		// only sub-prefixes starting with the literal part of the
+		// pattern are listed.
+		literal := dir[:strings.IndexAny(dir, `*?[\`)]
+		var matches []string
+		for _, base := range bases {
+			prefixes, err := listSubPrefixes(ctx, base+literal, delimiter, bucketHandle)
+			if err != nil {
+				return nil, err
+			}
+			for _, p := range prefixes {
+				name := strings.TrimSuffix(strings.TrimPrefix(p, base), delimiter)
+				if ok, _ := path.Match(dir, name); ok {
+					matches = append(matches, p)
+				}
+			}
+			if len(matches) > maxGlobPrefixes {
+				return nil, errTooManyPrefixes
+			}
+		}
+		bases = matches
+	}
+	for i := range bases {
+		bases[i] += dirs[len(dirs)-1]
+	}
+	return bases, nil
+}
+
+func listSubPrefixes(ctx context.Context, prefix, delimiter string, bucketHandle *storage.BucketHandle) ([]string, error) {
+	var err error
+	for i := 0; i < maxTry; i++ {
+		if i > 0 && !waitRetry(ctx, i-1) {
+			return nil, ctx.Err()
+		}
+		iter := bucketHandle.Objects(withListFields(ctx, prefixesListFields), &storage.Query{
+			Prefix:    prefix,
+			Delimiter: delimiter,
+		})
+		var obj *storage.ObjectAttrs
+		prefixes := []string{}
+		obj, err = iter.Next()
+		for ; err == nil; obj, err = iter.Next() {
+			if obj.Prefix != "" {
+				prefixes = append(prefixes, obj.Prefix)
+			}
+		}
+		if err == iterator.Done {
+			return prefixes, nil
+		}
+		if ctx.Err() != nil || !retryable(err) {
+			return nil, err
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/fsouza/fake-gcs-server/fakestorage"
+)
+
+func globObjects() []fakestorage.Object {
+	return []fakestorage.Object{
+		{BucketName: "my-bucket", Name: "daily/2018-03-01/news_1080p.mp4"},
+		{BucketName: "my-bucket", Name: "daily/2018-03-01/news_480p.mp4"},
+		{BucketName: "my-bucket", Name: "daily/2018-03-02/news_1080p.mp4"},
+		{BucketName: "my-bucket", Name: "daily/2018-04-01/news_1080p.mp4"},
+		{BucketName: "my-bucket", Name: "daily/2018-04-01/extra/news_1080p.mp4"},
+		{BucketName: "my-bucket", Name: "weekly/2018-03-05/news_1080p.mp4"},
+	}
+}
+
+func TestExpandGlob(t *testing.T) {
+	server := fakestorage.NewServer(globObjects())
+	defer server.Stop()
+	bucket := server.Client().Bucket("my-bucket")
+	var tests = []struct {
+		prefix   string
+		expected []string
+	}{
+		{
+			"daily/2018-03-01/news",
+			[]string{"daily/2018-03-01/news"},
+		},
+		{
+			"daily/*/news_1080p.mp4",
+			[]string{
+				"daily/2018-03-01/news_1080p.mp4",
+				"daily/2018-03-02/news_1080p.mp4",
+				"daily/2018-04-01/news_1080p.mp4",
+			},
+		},
+		{
+			"daily/2018-03-*/",
+			[]string{"daily/2018-03-01/", "daily/2018-03-02/"},
+		},
+		{
+			"*/2018-0[3]-0?/news",
+			[]string{
+				"daily/2018-03-01/news",
+				"daily/2018-03-02/news",
+				"weekly/2018-03-05/news",
+			},
+		},
+		{
+			"daily/*/extra/news",
+			[]string{
+				"daily/2018-03-01/extra/news",
+				"daily/2018-03-02/extra/news",
+				"daily/2018-04-01/extra/news",
+			},
+		},
+		{
+			"monthly/*/news",
+			nil,
+		},
+	}
+	for _, test := range tests {
+		prefixes, err := expandGlob(context.Background(), test.prefix, "/", bucket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(prefixes, test.expected) {
+			t.Errorf("%s: wrong prefixes\nwant %q\ngot  %q", test.prefix, test.expected, prefixes)
+		}
+	}
+}
+
+func TestValidateGlob(t *testing.T) {
+	var tests = []struct {
+		prefix string
+		valid  bool
+	}{
+		{"daily/2018-03-01/news", true},
+		{"daily/*/news_1080p.mp4", true},
+		{"daily/[0-9]*/", true},
+		{"daily/2018-03-01/news_*.mp4", false},
+		{"daily/[0-9/news", false},
+	}
+	for _, test := range tests {
+		if err := validateGlob(test.prefix, "/"); (err == nil) != test.valid {
+			t.Errorf("%s: unexpected result: %v", test.prefix, err)
+		}
+	}
+}
+
+func TestServerMapGlob(t *testing.T) {
+	server := fakestorage.NewServer(globObjects())
+	defer server.Stop()
+	httpServer := httptest.NewServer(getHandler(Config{
+		BucketName:     "my-bucket",
+		MapPrefix:      "/map/",
+		ProxyPrefix:    "/proxy/",
+		MapRegexFilter: `1080p\.mp4$`,
+	}, server.Client(), fakeHTTPClient(server)))
+	defer httpServer.Close()
+	addr := httpServer.URL
+	clip := func(path string) interface{} {
+		return map[string]interface{}{
+			"clips": []interface{}{
+				map[string]interface{}{"type": "source", "path": path},
+			},
+		}
+	}
+	var tests = []serverTest{
+		{
+			testCase:       "map: wildcard directory",
+			method:         http.MethodGet,
+			addr:           addr + "/map/daily/2018-03-*/news",
+			expectedStatus: http.StatusOK,
+			expectedBody: map[string]interface{}{
+				"sequences": []interface{}{
+					clip("/my-bucket/daily/2018-03-01/news_1080p.mp4"),
+					clip("/my-bucket/daily/2018-03-02/news_1080p.mp4"),
+				},
+			},
+		},
+		{
+			testCase:       "map: wildcard file name",
+			method:         http.MethodGet,
+			addr:           addr + "/map/daily/2018-03-01/*_1080p.mp4",
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   "wildcards are only supported in directory names\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.testCase, test.run)
+	}
+}
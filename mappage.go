@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+var errInvalidPageToken = errors.New("invalid pageToken")
+
+// mapPage selects the objects listed for a mapping. The zero value lists all
+// of them.
+type mapPage struct {
+	// prefix is the index of the first prefix listed, in the list of
+	// prefixes of the mapping (including extra prefixes and directories
+	// matched by wildcards).
+	prefix int
+
+	// token is the GCS page token to start listing that prefix from.
+	token string
+
+	// size is the maximum number of objects listed, or 0 for no limit.
+	size int
+}
+
+// parseMapPage returns the page requested with the pageToken and maxResults
+// query parameters. The size of the page is capped by
+// GCS_HELPER_MAP_MAX_OBJECTS.
+func parseMapPage(query url.Values, maxObjects int) (mapPage, error) {
+	page := mapPage{size: maxObjects}
+	if value := query.Get("maxResults"); value != "" {
+		size, err := strconv.Atoi(value)
+		if err != nil || size <= 0 {
+			return mapPage{}, errors.New("invalid maxResults")
+		}
+		if page.size == 0 || size < page.size {
+			page.size = size
+		}
+	}
+	if value := query.Get("pageToken"); value != "" {
+		data, err := base64.RawURLEncoding.DecodeString(value)
+		if err != nil {
+			return mapPage{}, errInvalidPageToken
+		}
+		parts := strings.SplitN(string(data), ":", 2)
+		if len(parts) != 2 {
+			return mapPage{}, errInvalidPageToken
+		}
+		page.prefix, err = strconv.Atoi(parts[0])
+		if err != nil || page.prefix < 0 {
+			return mapPage{}, errInvalidPageToken
+		}
+		page.token = parts[1]
+	}
+	return page, nil
+}
+
+// key returns the part of the mapping cache key that identifies the page.
+func (p mapPage) key() string {
+	if p == (mapPage{}) {
+		return ""
+	}
+	return fmt.Sprintf("\x00%d\x00%s\x00%d", p.prefix, p.token, p.size)
+}
+
+// encodePageToken returns the continuation token for listing the prefix
+// with the given index, starting at the GCS page token.
+func encodePageToken(prefix int, token string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(prefix) + ":" + token))
+}
+
+// listObjects calls fn for up to size objects (or all of them, when size is
+// 0) returned by the query, starting at the given GCS page token, and
+// returns the token of the next page, if any.
+func listObjects(ctx context.Context, bucketHandle *storage.BucketHandle, query *storage.Query, token string, size int, fn func(*storage.ObjectAttrs)) (string, error) {
+	iter := bucketHandle.Objects(ctx, query)
+	if size > 0 {
+		var objects []*storage.ObjectAttrs
+		next, err := iterator.NewPager(iter, size, token).NextPage(&objects)
+		if err != nil {
+			return "", err
+		}
+		for _, obj := range objects {
+			fn(obj)
+		}
+		return next, nil
+	}
+	iter.PageInfo().Token = token
+	for {
+		obj, err := iter.Next()
+		if err == iterator.Done {
+			return "", nil
+		}
+		if err != nil {
+			return "", err
+		}
+		fn(obj)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/fsouza/fake-gcs-server/fakestorage"
+)
+
+func TestParseMapPage(t *testing.T) {
+	var tests = []struct {
+		testCase   string
+		query      string
+		maxObjects int
+		expected   mapPage
+	}{
+		{"no pagination", "", 0, mapPage{}},
+		{"max objects", "", 100, mapPage{size: 100}},
+		{"max results", "maxResults=10", 0, mapPage{size: 10}},
+		{"max results under max objects", "maxResults=10", 100, mapPage{size: 10}},
+		{"max results over max objects", "maxResults=1000", 100, mapPage{size: 100}},
+		{"page token", "pageToken=" + encodePageToken(2, "CgRzb21l"), 100, mapPage{prefix: 2, token: "CgRzb21l", size: 100}},
+		{"next prefix token", "pageToken=" + encodePageToken(1, ""), 0, mapPage{prefix: 1}},
+	}
+	for _, test := range tests {
+		query, _ := url.ParseQuery(test.query)
+		page, err := parseMapPage(query, test.maxObjects)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.testCase, err)
+			continue
+		}
+		if page != test.expected {
+			t.Errorf("%s: wrong page\nwant %#v\ngot  %#v", test.testCase, test.expected, page)
+		}
+	}
+}
+
+func TestParseMapPageInvalid(t *testing.T) {
+	for _, query := range []string{
+		"maxResults=0",
+		"maxResults=-5",
+		"maxResults=ten",
+		"pageToken=not%20base64",
+		"pageToken=" + url.QueryEscape("bm8tc2VwYXJhdG9y"),
+		"pageToken=" + encodePageToken(-1, "abc"),
+	} {
+		values, _ := url.ParseQuery(query)
+		if _, err := parseMapPage(values, 0); err == nil {
+			t.Errorf("%s: unexpected <nil> error", query)
+		}
+	}
+}
+
+func TestGetPrefixMappingPages(t *testing.T) {
+	server := fakestorage.NewServer(getObjects())
+	defer server.Stop()
+	bucket := server.Client().Bucket("my-bucket")
+	config := Config{MapExtraPrefixes: []string{"subs/"}}
+	filters := newMapFilters(config)
+
+	// the fake server ignores the page size, so the first prefix is listed
+	// entirely, and the next page starts at the second prefix.
+	first, err := getPrefixMapping(context.Background(), "videos/video/video1", "", mapPage{size: 1}, config, filters, bucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedPaths := []string{
+		"/my-bucket/videos/video/video1_480p.mp4",
+		"/my-bucket/videos/video/video1_720p.mp4",
+	}
+	if paths := mappingPaths(first); !reflect.DeepEqual(paths, expectedPaths) {
+		t.Errorf("wrong clips in the first page\nwant %q\ngot  %q", expectedPaths, paths)
+	}
+	if expected := encodePageToken(1, ""); first.NextPageToken != expected {
+		t.Fatalf("wrong next page token\nwant %q\ngot  %q", expected, first.NextPageToken)
+	}
+
+	query := url.Values{"pageToken": []string{first.NextPageToken}, "maxResults": []string{"1"}}
+	page, err := parseMapPage(query, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := getPrefixMapping(context.Background(), "videos/video/video1", "", page, config, filters, bucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedPaths = []string{"/my-bucket/subs/video1.srt"}
+	if paths := mappingPaths(second); !reflect.DeepEqual(paths, expectedPaths) {
+		t.Errorf("wrong clips in the second page\nwant %q\ngot  %q", expectedPaths, paths)
+	}
+	if second.NextPageToken != "" {
+		t.Errorf("unexpected next page token %q", second.NextPageToken)
+	}
+}
+
+func mappingPaths(m mapping) []string {
+	var paths []string
+	for _, s := range m.Sequences {
+		paths = append(paths, s.Clips[0].Path)
+	}
+	return paths
+}
+
+func TestServerMapInvalidPage(t *testing.T) {
+	addr, cleanup := startServer(t, Config{
+		BucketName:    "my-bucket",
+		MapPrefix:     "/map/",
+		ProxyPrefix:   "/proxy/",
+		MapMaxObjects: 100,
+	})
+	defer cleanup()
+	var tests = []serverTest{
+		{
+			testCase:       "map: invalid max results",
+			method:         http.MethodGet,
+			addr:           addr + "/map/videos/video/?maxResults=0",
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   "invalid maxResults\n",
+		},
+		{
+			testCase:       "map: invalid page token",
+			method:         http.MethodGet,
+			addr:           addr + "/map/videos/video/?pageToken=abc",
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   "invalid pageToken\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.testCase, test.run)
+	}
+}
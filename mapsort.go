@@ -0,0 +1,127 @@
+package main
+
+import (
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	mapSortNatural    = "natural"
+	mapSortResolution = "resolution"
+	mapSortCustom     = "custom"
+)
+
+var resolutionRegexp = regexp.MustCompile(`(\d{3,4})p`)
+
+// sortSequences sorts the sequences by the file name of their first clip,
+// using the mode configured in GCS_HELPER_MAP_SORT:
+//
+//   - natural: numbers in file names are compared by their value, so
+//     "240p" goes before "1080p"
+//   - resolution: from the highest to the lowest resolution, with files
+//     without a resolution going last
+//   - custom: in the order of the first matching substring of
+//     GCS_HELPER_MAP_SORT_ORDER, with unmatched files going last
+//
+// The sort is stable, so sequences that compare equal keep the GCS order.
+func sortSequences(sequences []sequence, mode string, order []string) {
+	names := make([]string, len(sequences))
+	for i, s := range sequences {
+		names[i] = path.Base(s.Clips[0].Path)
+	}
+	var less func(a, b string) bool
+	switch mode {
+	case mapSortNatural:
+		less = naturalLess
+	case mapSortResolution:
+		less = func(a, b string) bool {
+			return resolution(a) > resolution(b)
+		}
+	case mapSortCustom:
+		less = func(a, b string) bool {
+			return customRank(a, order) < customRank(b, order)
+		}
+	default:
+		return
+	}
+	sort.Stable(sequencesByName{sequences, names, less})
+}
+
+type sequencesByName struct {
+	sequences []sequence
+	names     []string
+	less      func(a, b string) bool
+}
+
+func (s sequencesByName) Len() int {
+	return len(s.sequences)
+}
+
+func (s sequencesByName) Less(i, j int) bool {
+	return s.less(s.names[i], s.names[j])
+}
+
+func (s sequencesByName) Swap(i, j int) {
+	s.sequences[i], s.sequences[j] = s.sequences[j], s.sequences[i]
+	s.names[i], s.names[j] = s.names[j], s.names[i]
+}
+
+// resolution returns the last resolution (as in "720p") in the given file
+// name, or 0 when there's none.
+func resolution(name string) int {
+	matches := resolutionRegexp.FindAllStringSubmatch(name, -1)
+	if len(matches) == 0 {
+		return 0
+	}
+	value, _ := strconv.Atoi(matches[len(matches)-1][1])
+	return value
+}
+
+func customRank(name string, order []string) int {
+	for i, item := range order {
+		if strings.Contains(name, item) {
+			return i
+		}
+	}
+	return len(order)
+}
+
+// naturalLess compares the given strings, handling sequences of digits as
+// numbers.
+func naturalLess(a, b string) bool {
+	for a != "" && b != "" {
+		if isDigit(a[0]) && isDigit(b[0]) {
+			na, ra := splitDigits(a)
+			nb, rb := splitDigits(b)
+			ta, tb := strings.TrimLeft(na, "0"), strings.TrimLeft(nb, "0")
+			if len(ta) != len(tb) {
+				return len(ta) < len(tb)
+			}
+			if ta != tb {
+				return ta < tb
+			}
+			a, b = ra, rb
+			continue
+		}
+		if a[0] != b[0] {
+			return a[0] < b[0]
+		}
+		a, b = a[1:], b[1:]
+	}
+	return len(a) < len(b)
+}
+
+func splitDigits(s string) (digits, rest string) {
+	i := 0
+	for i < len(s) && isDigit(s[i]) {
+		i++
+	}
+	return s[:i], s[i:]
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSortSequences(t *testing.T) {
+	names := []string{
+		"video_1080p.mp4",
+		"video_240p.mp4",
+		"video_en.vtt",
+		"video_720p.mp4",
+		"video_2160p.mp4",
+		"video_480p.mp4",
+	}
+	var tests = []struct {
+		mode     string
+		order    []string
+		expected []string
+	}{
+		{
+			"",
+			nil,
+			names,
+		},
+		{
+			mapSortNatural,
+			nil,
+			[]string{"video_240p.mp4", "video_480p.mp4", "video_720p.mp4", "video_1080p.mp4", "video_2160p.mp4", "video_en.vtt"},
+		},
+		{
+			mapSortResolution,
+			nil,
+			[]string{"video_2160p.mp4", "video_1080p.mp4", "video_720p.mp4", "video_480p.mp4", "video_240p.mp4", "video_en.vtt"},
+		},
+		{
+			mapSortCustom,
+			[]string{"720p", ".vtt", "1080p"},
+			[]string{"video_720p.mp4", "video_en.vtt", "video_1080p.mp4", "video_240p.mp4", "video_2160p.mp4", "video_480p.mp4"},
+		},
+	}
+	for _, test := range tests {
+		sequences := make([]sequence, len(names))
+		for i, name := range names {
+			sequences[i] = sequence{Clips: []clip{{Type: "source", Path: "/my-bucket/videos/" + name}}}
+		}
+		sortSequences(sequences, test.mode, test.order)
+		var got []string
+		for _, s := range sequences {
+			got = append(got, s.Clips[0].Path[len("/my-bucket/videos/"):])
+		}
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("%q: wrong order\nwant %q\ngot  %q", test.mode, test.expected, got)
+		}
+	}
+}
+
+func TestNaturalLess(t *testing.T) {
+	var tests = []struct {
+		a, b     string
+		expected bool
+	}{
+		{"video_240p.mp4", "video_1080p.mp4", true},
+		{"video_1080p.mp4", "video_240p.mp4", false},
+		{"part2", "part10", true},
+		{"part02", "part2", false},
+		{"a", "b", true},
+		{"video", "video_1", true},
+		{"same", "same", false},
+	}
+	for _, test := range tests {
+		if got := naturalLess(test.a, test.b); got != test.expected {
+			t.Errorf("naturalLess(%q, %q): wrong result\nwant %v\ngot  %v", test.a, test.b, test.expected, got)
+		}
+	}
+}
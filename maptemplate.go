@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"path"
+	"text/template"
+)
+
+// mapTemplateFuncs are the functions available to GCS_HELPER_MAP_TEMPLATE,
+// in addition to the text/template builtins.
+var mapTemplateFuncs = template.FuncMap{
+	"base": path.Base,
+	"ext":  path.Ext,
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+	"xml": func(s string) (string, error) {
+		var buf bytes.Buffer
+		err := xml.EscapeText(&buf, []byte(s))
+		return buf.String(), err
+	},
+}
+
+// parseMapTemplate parses the template configured in
+// GCS_HELPER_MAP_TEMPLATE, returning nil when it isn't set.
+func parseMapTemplate(c Config) (*template.Template, error) {
+	if c.MapTemplate == "" {
+		return nil, nil
+	}
+	return template.New("map").Funcs(mapTemplateFuncs).Parse(c.MapTemplate)
+}
+
+// mapTemplateData is the value the map template is executed with.
+type mapTemplateData struct {
+	// Prefix is the requested prefix.
+	Prefix string
+
+	// Mapping is the resolved mapping, in the version 2 of the schema.
+	Mapping mappingV2
+
+	config  *Config
+	request *http.Request
+}
+
+// Sign returns the signed URL of the clip with the given path, using the
+// signer configured in GCS_HELPER_SIGNER.
+func (d mapTemplateData) Sign(clipPath string) (string, error) {
+	if !d.config.signerEnabled() {
+		return "", errors.New("signer is not configured")
+	}
+	url, _, err := signClipURL(d.config, d.request, clipPath)
+	return url, err
+}
+
+// renderTemplate renders the mapping with the given template.
+func renderTemplate(tmpl *template.Template, c *Config, r *http.Request, prefix string, m mapping) ([]byte, error) {
+	var buf bytes.Buffer
+	err := tmpl.Execute(&buf, mapTemplateData{
+		Prefix:  prefix,
+		Mapping: newMappingV2(c, m),
+		config:  c,
+		request: r,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"testing"
+	"text/template"
+)
+
+func TestServerMapTemplate(t *testing.T) {
+	addr, cleanup := startServer(t, Config{
+		BucketName:             "my-bucket",
+		MapPrefix:              "/map/",
+		MapTemplatePrefix:      "/tmpl/",
+		ProxyPrefix:            "/proxy/",
+		MapRegexFilter:         `(480|720)p\.mp4$`,
+		MapTemplate:            `<assets prefix="{{xml .Prefix}}">{{range .Mapping.Sequences}}<asset id="{{.ID}}">{{(index .Clips 0).Path}}</asset>{{end}}</assets>`,
+		MapTemplateContentType: "application/xml",
+	})
+	defer cleanup()
+	var tests = []serverTest{
+		{
+			testCase:       "template: render mapping",
+			method:         http.MethodGet,
+			addr:           addr + "/tmpl/videos/video/",
+			expectedStatus: http.StatusOK,
+			expectedHeader: http.Header{"Content-Type": []string{"application/xml"}},
+			expectedBody:   `<assets prefix="videos/video/"><asset id="video1_480p">/my-bucket/videos/video/video1_480p.mp4</asset><asset id="video1_720p">/my-bucket/videos/video/video1_720p.mp4</asset></assets>`,
+		},
+		{
+			testCase:       "map: json mapping",
+			method:         http.MethodGet,
+			addr:           addr + "/map/musics/musyc",
+			expectedStatus: http.StatusOK,
+			expectedHeader: http.Header{"Content-Type": []string{"application/json"}},
+			expectedBody:   map[string]interface{}{"sequences": []interface{}{}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.testCase, test.run)
+	}
+}
+
+func TestRenderTemplateSign(t *testing.T) {
+	tmpl := template.Must(template.New("map").Funcs(mapTemplateFuncs).Parse(
+		`{{range .Mapping.Sequences}}{{$.Sign (index .Clips 0).Path}}{{end}}`,
+	))
+	m := mapping{Sequences: []sequence{{Clips: []clip{{Type: "source", Path: "/my-bucket/videos/movie_720p.mp4"}}}}}
+	r, _ := http.NewRequest(http.MethodGet, "/videos/movie", nil)
+
+	c := Config{Signer: signerToken, TokenConfig: testTokenConfig()}
+	body, err := renderTemplate(tmpl, &c, r, "videos/movie", m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := regexp.MustCompile(`^https://edge\.example\.com/videos/movie_720p\.mp4\?token=\d+~[0-9a-f]{64}$`)
+	if !expected.Match(body) {
+		t.Errorf("wrong body\nwant %s\ngot  %s", expected, body)
+	}
+
+	if _, err = renderTemplate(tmpl, &Config{}, r, "videos/movie", m); err == nil {
+		t.Error("unexpected <nil> error signing without a signer")
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/hex"
+	"path"
+	"strings"
+	"time"
+)
+
+const mappingV2ContentType = "application/vnd.gcs-helper.mapping.v2+json"
+
+// mappingV2 is the version 2 of the mapping schema, negotiated with the
+// Accept header. Unlike the original schema (v1), which only carries what
+// nginx-vod needs, it always includes the durations, the ids and labels of
+// the sequences and the metadata of the clips.
+type mappingV2 struct {
+	Version       int          `json:"version"`
+	ClipFrom      int64        `json:"clipFrom,omitempty"`
+	ClipTo        int64        `json:"clipTo,omitempty"`
+	Durations     []int64      `json:"durations"`
+	Sequences     []sequenceV2 `json:"sequences"`
+	NextPageToken string       `json:"nextPageToken,omitempty"`
+}
+
+type sequenceV2 struct {
+	ID       string   `json:"id"`
+	Language string   `json:"language,omitempty"`
+	Label    string   `json:"label,omitempty"`
+	Clips    []clipV2 `json:"clips"`
+}
+
+type clipV2 struct {
+	Type        string     `json:"type"`
+	Path        string     `json:"path"`
+	ContentType string     `json:"contentType,omitempty"`
+	Size        int64      `json:"size,omitempty"`
+	Generation  int64      `json:"generation,omitempty"`
+	MD5         string     `json:"md5,omitempty"`
+	Updated     *time.Time `json:"updated,omitempty"`
+}
+
+// newMappingV2 converts the mapping to the version 2 of the schema. The
+// metadata of the clips comes from the listed objects or, for mappings
+// loaded from Redis, from the fields set by GCS_HELPER_MAP_VERBOSE, and is
+// omitted when neither is available (e.g. extra resources).
+func newMappingV2(c *Config, m mapping) mappingV2 {
+	v2 := mappingV2{
+		Version:       2,
+		ClipFrom:      m.ClipFrom,
+		ClipTo:        m.ClipTo,
+		Durations:     m.Durations,
+		Sequences:     make([]sequenceV2, 0, len(m.Sequences)),
+		NextPageToken: m.NextPageToken,
+	}
+	if v2.Durations == nil {
+		v2.Durations = []int64{}
+	}
+	for _, s := range m.Sequences {
+		seq := sequenceV2{
+			Language: s.Language,
+			Label:    s.Label,
+			Clips:    make([]clipV2, 0, len(s.Clips)),
+		}
+		for _, clip := range s.Clips {
+			seq.Clips = append(seq.Clips, newClipV2(c, clip))
+		}
+		if len(s.Clips) > 0 {
+			seq.ID = sequenceID(s.Clips[0])
+		}
+		v2.Sequences = append(v2.Sequences, seq)
+	}
+	return v2
+}
+
+func newClipV2(c *Config, clip clip) clipV2 {
+	v2 := clipV2{
+		Type:       clip.Type,
+		Path:       clip.Path,
+		Size:       clip.Size,
+		Generation: clip.Generation,
+		Updated:    clip.Updated,
+	}
+	if attrs := clip.attrs; attrs != nil {
+		v2.ContentType = contentType(c, attrs)
+		v2.Size = attrs.Size
+		v2.Generation = attrs.Generation
+		if len(attrs.MD5) > 0 {
+			v2.MD5 = hex.EncodeToString(attrs.MD5)
+		}
+		if !attrs.Updated.IsZero() {
+			updated := attrs.Updated.UTC()
+			v2.Updated = &updated
+		}
+	}
+	return v2
+}
+
+// sequenceID returns the id of the sequence with the given first clip: the
+// name of its file, without the extension.
+func sequenceID(c clip) string {
+	name := path.Base(c.Path)
+	return strings.TrimSuffix(name, path.Ext(name))
+}
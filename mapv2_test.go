@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+func TestServerMapV2(t *testing.T) {
+	addr, cleanup := startServer(t, Config{
+		BucketName:     "my-bucket",
+		MapPrefix:      "/map/",
+		ProxyPrefix:    "/proxy/",
+		MapRegexFilter: `480p\.mp4$`,
+	})
+	defer cleanup()
+	get := func(accept, inm string) *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, addr+"/map/videos/video/?clipTo=5000", nil)
+		req.Header.Set("Accept", accept)
+		if inm != "" {
+			req.Header.Set("If-None-Match", inm)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	resp := get(mappingV2ContentType, "")
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("wrong status code\nwant %d\ngot  %d", http.StatusOK, resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != mappingV2ContentType {
+		t.Errorf("wrong content type\nwant %q\ngot  %q", mappingV2ContentType, ct)
+	}
+	if vary := resp.Header.Get("Vary"); vary != "Accept" {
+		t.Errorf("wrong Vary header\nwant %q\ngot  %q", "Accept", vary)
+	}
+	var m mappingV2
+	if err := json.NewDecoder(resp.Body).Decode(&m); err != nil {
+		t.Fatal(err)
+	}
+	expected := mappingV2{
+		Version:   2,
+		ClipTo:    5000,
+		Durations: []int64{},
+		Sequences: []sequenceV2{
+			{
+				ID: "video1_480p",
+				Clips: []clipV2{
+					{
+						Type:        "source",
+						Path:        "/my-bucket/videos/video/video1_480p.mp4",
+						ContentType: "video/mp4",
+					},
+				},
+			},
+		},
+	}
+	if !reflect.DeepEqual(m, expected) {
+		t.Errorf("wrong mapping\nwant %#v\ngot  %#v", expected, m)
+	}
+
+	etag := resp.Header.Get("ETag")
+	if resp := get("application/json", etag); resp.StatusCode != http.StatusOK {
+		t.Errorf("v2 etag matched the v1 response: %d", resp.StatusCode)
+	}
+	if resp := get(mappingV2ContentType, etag); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("wrong status code\nwant %d\ngot  %d", http.StatusNotModified, resp.StatusCode)
+	}
+}
+
+func TestNewMappingV2(t *testing.T) {
+	updated := time.Date(2018, time.March, 10, 14, 30, 12, 0, time.UTC)
+	m := mapping{
+		Durations: []int64{62500},
+		Sequences: []sequence{
+			{
+				Language: "en",
+				Label:    "English",
+				Clips: []clip{{
+					Type: "subtitle",
+					Path: "/my-bucket/subs/movie_en.vtt",
+					attrs: &storage.ObjectAttrs{
+						Name:       "subs/movie_en.vtt",
+						Size:       120,
+						Generation: 1520692212,
+						MD5:        []byte{0xca, 0xfe},
+						Updated:    updated,
+					},
+				}},
+			},
+			{
+				Clips: []clip{{
+					Type:       "source",
+					Path:       "/my-bucket/videos/movie_720p.mp4",
+					Size:       2048,
+					Generation: 1520692213,
+				}},
+			},
+		},
+	}
+	expected := mappingV2{
+		Version:   2,
+		Durations: []int64{62500},
+		Sequences: []sequenceV2{
+			{
+				ID:       "movie_en",
+				Language: "en",
+				Label:    "English",
+				Clips: []clipV2{{
+					Type:        "subtitle",
+					Path:        "/my-bucket/subs/movie_en.vtt",
+					ContentType: "text/vtt",
+					Size:        120,
+					Generation:  1520692212,
+					MD5:         "cafe",
+					Updated:     &updated,
+				}},
+			},
+			{
+				ID: "movie_720p",
+				Clips: []clipV2{{
+					Type:       "source",
+					Path:       "/my-bucket/videos/movie_720p.mp4",
+					Size:       2048,
+					Generation: 1520692213,
+				}},
+			},
+		},
+	}
+	if got := newMappingV2(&Config{}, m); !reflect.DeepEqual(got, expected) {
+		t.Errorf("wrong mapping\nwant %#v\ngot  %#v", expected, got)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+type objectMetadata struct {
+	Bucket          string            `json:"bucket"`
+	Name            string            `json:"name"`
+	Size            int64             `json:"size"`
+	ContentType     string            `json:"contentType"`
+	ContentEncoding string            `json:"contentEncoding,omitempty"`
+	CacheControl    string            `json:"cacheControl,omitempty"`
+	Generation      int64             `json:"generation"`
+	MD5             string            `json:"md5,omitempty"`
+	CRC32C          string            `json:"crc32c,omitempty"`
+	Updated         time.Time         `json:"updated"`
+	Metadata        map[string]string `json:"metadata,omitempty"`
+}
+
+func getMetaHandler(c Config, client *storage.Client) http.HandlerFunc {
+	logger := c.logger()
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		obj, err := objectHandle(&c, client, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), c.ProxyTimeout)
+		defer cancel()
+		attrs, err := obj.Attrs(ctx)
+		if err != nil {
+			if err = handleObjectError(err, w); err != nil {
+				requestLogger(r.Context(), logger).WithError(err).WithField("url", r.URL.RequestURI()).Error("failed to load object metadata")
+			}
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(newObjectMetadata(&c, attrs))
+	}
+}
+
+func newObjectMetadata(c *Config, attrs *storage.ObjectAttrs) objectMetadata {
+	return objectMetadata{
+		Bucket:          attrs.Bucket,
+		Name:            attrs.Name,
+		Size:            attrs.Size,
+		ContentType:     contentType(c, attrs),
+		ContentEncoding: attrs.ContentEncoding,
+		CacheControl:    attrs.CacheControl,
+		Generation:      attrs.Generation,
+		MD5:             encodeMD5(attrs),
+		CRC32C:          encodeCRC32C(attrs),
+		Updated:         attrs.Updated,
+		Metadata:        attrs.Metadata,
+	}
+}
+
+// setMetadataHeaders exposes the object attributes that don't map to
+// standard HTTP headers, using the same header names as the GCS XML API.
+func setMetadataHeaders(attrs *storage.ObjectAttrs, w http.ResponseWriter) {
+	if attrs.Generation != 0 {
+		w.Header().Set("X-Goog-Generation", strconv.FormatInt(attrs.Generation, 10))
+	}
+	if crc := encodeCRC32C(attrs); crc != "" {
+		w.Header().Add("X-Goog-Hash", "crc32c="+crc)
+	}
+	if md5 := encodeMD5(attrs); md5 != "" {
+		w.Header().Add("X-Goog-Hash", "md5="+md5)
+	}
+	for name, value := range attrs.Metadata {
+		w.Header().Set("X-Goog-Meta-"+name, value)
+	}
+}
+
+func encodeMD5(attrs *storage.ObjectAttrs) string {
+	if len(attrs.MD5) == 0 {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(attrs.MD5)
+}
+
+func encodeCRC32C(attrs *storage.ObjectAttrs) string {
+	if attrs.CRC32C == 0 {
+		return ""
+	}
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], attrs.CRC32C)
+	return base64.StdEncoding.EncodeToString(b[:])
+}
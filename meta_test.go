@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestServerMetaHandler(t *testing.T) {
+	addr, cleanup := startServer(t, Config{
+		BucketName:   "my-bucket",
+		MetaPrefix:   "/meta/",
+		MapPrefix:    "/map/",
+		ProxyPrefix:  "/proxy/",
+		ProxyTimeout: time.Second,
+		ContentTypes: ExtensionMap{".txt": "text/plain"},
+	})
+	defer cleanup()
+	var tests = []serverTest{
+		{
+			testCase:       "object metadata",
+			method:         http.MethodGet,
+			addr:           addr + "/meta/musics/music/music1.txt",
+			expectedStatus: http.StatusOK,
+			expectedHeader: http.Header{"Content-Type": []string{"application/json"}},
+			expectedBody: map[string]interface{}{
+				"bucket":      "my-bucket",
+				"name":        "musics/music/music1.txt",
+				"size":        float64(15),
+				"contentType": "text/plain",
+				"generation":  float64(0),
+				"updated":     "0001-01-01T00:00:00Z",
+			},
+		},
+		{
+			testCase:       "invalid generation",
+			method:         http.MethodGet,
+			addr:           addr + "/meta/musics/music/music1.txt?generation=-1",
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   "invalid generation\n",
+		},
+		{
+			testCase:       "object not found",
+			method:         http.MethodGet,
+			addr:           addr + "/meta/musics/music/some-music.txt",
+			expectedStatus: http.StatusNotFound,
+			expectedBody:   "storage: object doesn't exist\n",
+		},
+		{
+			testCase:       "method not allowed",
+			method:         http.MethodPost,
+			addr:           addr + "/meta/musics/music/music1.txt",
+			expectedStatus: http.StatusMethodNotAllowed,
+			expectedBody:   "method not allowed\n",
+		},
+		{
+			testCase:       "proxy still works",
+			method:         http.MethodGet,
+			addr:           addr + "/proxy/musics/music/music1.txt",
+			expectedStatus: http.StatusOK,
+			expectedBody:   "some nice music",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.testCase, test.run)
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// The metrics are exposed at GCS_HELPER_METRICS_PATH in the Prometheus text
+// format. They're global, so they're kept when the configuration is
+// reloaded and shared by all routes.
+var (
+	httpRequests = newCounterVec(
+		"gcs_helper_http_requests_total",
+		"Number of HTTP requests, by handler and status code.",
+		"handler", "code",
+	)
+	httpRequestDuration = newHistogramVec(
+		"gcs_helper_http_request_duration_seconds",
+		"Duration of HTTP requests, by handler.",
+		durationBuckets,
+		"handler",
+	)
+	httpRequestsInFlight = newGaugeVec(
+		"gcs_helper_http_requests_in_flight",
+		"Number of HTTP requests being served.",
+	)
+	gcsListDuration = newHistogramVec(
+		"gcs_helper_gcs_list_duration_seconds",
+		"Duration of the listings of GCS objects made for mappings.",
+		durationBuckets,
+	)
+	gcsRequests = newCounterVec(
+		"gcs_helper_gcs_requests_total",
+		"Number of requests sent to GCS, by operation and status.",
+		"operation", "status",
+	)
+	gcsConnections = newCounterVec(
+		"gcs_helper_gcs_connections_used_total",
+		"Number of connections to GCS used by requests, by whether they were reused.",
+		"reused",
+	)
+	mapObjects = newHistogramVec(
+		"gcs_helper_map_objects",
+		"Number of objects matched by each listed mapping.",
+		[]float64{0, 1, 5, 10, 25, 50, 100, 250, 500, 1000},
+	)
+	signOperations = newCounterVec(
+		"gcs_helper_sign_operations_total",
+		"Number of signed URLs, by signer and result.",
+		"signer", "result",
+	)
+	cacheRequests = newCounterVec(
+		"gcs_helper_cache_requests_total",
+		"Number of cache lookups, by cache and result.",
+		"cache", "result",
+	)
+
+	registeredMetrics = []metric{
+		httpRequests,
+		httpRequestDuration,
+		httpRequestsInFlight,
+		gcsListDuration,
+		gcsRequests,
+		gcsConnections,
+		gcsConnPool,
+		mapObjects,
+		signOperations,
+		cacheRequests,
+		auditEvents,
+		httpOpenConnections,
+		runtimeMetrics{},
+	}
+)
+
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type metric interface {
+	write(w io.Writer)
+}
+
+// metricVec is a counter or a gauge, with one value for each combination of
+// label values.
+type metricVec struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]*metricValue
+}
+
+type metricValue struct {
+	labelValues []string
+	value       float64
+}
+
+func newCounterVec(name, help string, labels ...string) *metricVec {
+	return &metricVec{name: name, help: help, kind: "counter", labels: labels, values: make(map[string]*metricValue)}
+}
+
+func newGaugeVec(name, help string, labels ...string) *metricVec {
+	return &metricVec{name: name, help: help, kind: "gauge", labels: labels, values: make(map[string]*metricValue)}
+}
+
+// add adds the given value to the metric with the given label values, which
+// must be in the order of the labels of the metric.
+func (m *metricVec) add(value float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v, ok := m.values[key]
+	if !ok {
+		v = &metricValue{labelValues: labelValues}
+		m.values[key] = v
+	}
+	v.value += value
+}
+
+func (m *metricVec) inc(labelValues ...string) {
+	m.add(1, labelValues...)
+}
+
+// value returns the value of the metric with the given label values.
+func (m *metricVec) value(labelValues ...string) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if v, ok := m.values[strings.Join(labelValues, "\xff")]; ok {
+		return v.value
+	}
+	return 0
+}
+
+func (m *metricVec) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	for _, key := range sortedKeys(m.values) {
+		v := m.values[key]
+		fmt.Fprintf(w, "%s%s %s\n", m.name, formatLabels(m.labels, v.labelValues), formatFloat(v.value))
+	}
+}
+
+// histogramVec is a histogram, with one set of buckets for each combination
+// of label values.
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	values map[string]*histogramValue
+}
+
+type histogramValue struct {
+	labelValues []string
+	counts      []uint64
+	sum         float64
+	count       uint64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, values: make(map[string]*histogramValue)}
+}
+
+// observe records the given value in the histogram with the given label
+// values.
+func (h *histogramVec) observe(value float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	v, ok := h.values[key]
+	if !ok {
+		v = &histogramValue{labelValues: labelValues, counts: make([]uint64, len(h.buckets))}
+		h.values[key] = v
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			v.counts[i]++
+		}
+	}
+	v.sum += value
+	v.count++
+}
+
+func (h *histogramVec) observeDuration(start time.Time, labelValues ...string) {
+	h.observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	bucketLabels := append(append([]string{}, h.labels...), "le")
+	for _, key := range sortedKeys(h.values) {
+		v := h.values[key]
+		for i, bound := range h.buckets {
+			labelValues := append(append([]string{}, v.labelValues...), formatFloat(bound))
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(bucketLabels, labelValues), v.counts[i])
+		}
+		labelValues := append(append([]string{}, v.labelValues...), "+Inf")
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(bucketLabels, labelValues), v.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, v.labelValues), formatFloat(v.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, v.labelValues), v.count)
+	}
+}
+
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch values := m.(type) {
+	case map[string]*metricValue:
+		for key := range values {
+			keys = append(keys, key)
+		}
+	case map[string]*histogramValue:
+		for key := range values {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + `="` + labelValueReplacer.Replace(values[i]) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// getMetricsHandler returns the handler that exposes the metrics.
+func getMetricsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		for _, m := range registeredMetrics {
+			m.write(w)
+		}
+	}
+}
+
+// instrumentHandler wraps the given handler, recording the number, status
+// codes and durations of the requests it serves. The name of the handler is
+// also added to the access logs.
+func instrumentHandler(name string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		addLogFields(r.Context(), logrus.Fields{"handler": name})
+		httpRequestsInFlight.add(1)
+		defer httpRequestsInFlight.add(-1)
+		sw := &statusWriter{ResponseWriter: w}
+		handler(sw, r)
+		httpRequests.inc(name, strconv.Itoa(sw.code()))
+		httpRequestDuration.observeDuration(start, name)
+	}
+}
+
+// statusWriter records the status code and the size of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(data)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// code returns the status code of the response, which is 200 when the
+// handler didn't write anything.
+func (w *statusWriter) code() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+// cacheResult returns the label value of a cache lookup.
+func cacheResult(hit bool) string {
+	if hit {
+		return "hit"
+	}
+	return "miss"
+}
+
+// signResult returns the label value of a signing operation.
+func signResult(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "success"
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricVecWrite(t *testing.T) {
+	m := newCounterVec("test_requests_total", "Number of test requests.", "handler", "code")
+	m.inc("map", "200")
+	m.inc("map", "200")
+	m.add(3, "proxy", `4"04`)
+	var buf bytes.Buffer
+	m.write(&buf)
+	expected := `# HELP test_requests_total Number of test requests.
+# TYPE test_requests_total counter
+test_requests_total{handler="map",code="200"} 2
+test_requests_total{handler="proxy",code="4\"04"} 3
+`
+	if buf.String() != expected {
+		t.Errorf("wrong output\nwant %q\ngot  %q", expected, buf.String())
+	}
+}
+
+func TestHistogramVecWrite(t *testing.T) {
+	h := newHistogramVec("test_duration_seconds", "Duration of tests.", []float64{0.1, 1}, "handler")
+	h.observe(0.05, "map")
+	h.observe(0.5, "map")
+	h.observe(2, "map")
+	var buf bytes.Buffer
+	h.write(&buf)
+	expected := `# HELP test_duration_seconds Duration of tests.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{handler="map",le="0.1"} 1
+test_duration_seconds_bucket{handler="map",le="1"} 2
+test_duration_seconds_bucket{handler="map",le="+Inf"} 3
+test_duration_seconds_sum{handler="map"} 2.55
+test_duration_seconds_count{handler="map"} 3
+`
+	if buf.String() != expected {
+		t.Errorf("wrong output\nwant %q\ngot  %q", expected, buf.String())
+	}
+}
+
+func TestInstrumentHandler(t *testing.T) {
+	handler := instrumentHandler("test_instrument", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "not found", http.StatusNotFound)
+	})
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	httpRequests.mu.Lock()
+	v := httpRequests.values["test_instrument\xff404"]
+	httpRequests.mu.Unlock()
+	if v == nil || v.value != 2 {
+		t.Errorf("wrong request count, got %#v", v)
+	}
+	httpRequestDuration.mu.Lock()
+	d := httpRequestDuration.values["test_instrument"]
+	httpRequestDuration.mu.Unlock()
+	if d == nil || d.count != 2 {
+		t.Errorf("wrong duration count, got %#v", d)
+	}
+}
+
+func TestServerMetrics(t *testing.T) {
+	addr, cleanup := startServer(t, Config{
+		BucketName:   "my-bucket",
+		MapPrefix:    "/map/",
+		ProxyPrefix:  "/proxy/",
+		MetricsPath:  "/metrics",
+		ProxyTimeout: time.Second,
+	})
+	defer cleanup()
+	for _, path := range []string{"/proxy/musics/music/music3.txt", "/map/musics/"} {
+		resp, err := http.Get(addr + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	resp, err := http.Get(addr + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := string(data)
+	for _, expected := range []string{
+		`gcs_helper_http_requests_total{handler="proxy",code="200"}`,
+		`gcs_helper_http_requests_total{handler="map",code="200"}`,
+		`gcs_helper_http_request_duration_seconds_count{handler="map"}`,
+		"gcs_helper_http_requests_in_flight 0",
+		"gcs_helper_gcs_list_duration_seconds_count",
+		"gcs_helper_map_objects_count",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("missing %q in metrics:\n%s", expected, body)
+		}
+	}
+}
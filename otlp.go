@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+const otlpStatusError = 2
+
+// otlpExporter sends spans to an OpenTelemetry collector, using the JSON
+// encoding of OTLP/HTTP.
+//
+// See https://opentelemetry.io/docs/specs/otlp/#otlphttp.
+type otlpExporter struct {
+	url    string
+	client *http.Client
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+// otlpAnyValue is the value of an attribute. 64-bit integers are encoded as
+// strings, like in the protobuf JSON mapping.
+type otlpAnyValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+func otlpValue(value interface{}) otlpAnyValue {
+	switch v := value.(type) {
+	case string:
+		return otlpAnyValue{StringValue: &v}
+	case int:
+		s := strconv.Itoa(v)
+		return otlpAnyValue{IntValue: &s}
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		return otlpAnyValue{IntValue: &s}
+	case bool:
+		return otlpAnyValue{BoolValue: &v}
+	}
+	s := fmt.Sprint(value)
+	return otlpAnyValue{StringValue: &s}
+}
+
+func otlpAttributes(attributes map[string]interface{}) []otlpAttribute {
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	result := make([]otlpAttribute, len(keys))
+	for i, key := range keys {
+		result[i] = otlpAttribute{Key: key, Value: otlpValue(attributes[key])}
+	}
+	return result
+}
+
+func newOTLPSpan(s *span) otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := otlpSpan{
+		TraceID:           hex.EncodeToString(s.context.traceID[:]),
+		SpanID:            hex.EncodeToString(s.context.spanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		Attributes:        otlpAttributes(s.attributes),
+	}
+	if s.parentID != [8]byte{} {
+		result.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	if s.err != nil {
+		result.Status = &otlpStatus{Code: otlpStatusError, Message: s.err.Error()}
+	}
+	return result
+}
+
+func (e *otlpExporter) export(spans []*span) error {
+	scopeSpans := otlpScopeSpans{
+		Scope: otlpScope{Name: "gcs-helper", Version: version},
+		Spans: make([]otlpSpan, len(spans)),
+	}
+	for i, s := range spans {
+		scopeSpans.Spans[i] = newOTLPSpan(s)
+	}
+	body, err := json.Marshal(otlpRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{
+				Attributes: otlpAttributes(map[string]interface{}{"service.name": "gcs-helper"}),
+			},
+			ScopeSpans: []otlpScopeSpans{scopeSpans},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status from %s: %s", e.url, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"strings"
+)
+
+const pprofPath = "debug/pprof"
+
+// servePprof serves the profiles of net/http/pprof at
+// <GCS_HELPER_ADMIN_PREFIX>debug/pprof/, when GCS_HELPER_ADMIN_PPROF is set.
+// The given path is the path of the request, relative to the admin prefix.
+func servePprof(w http.ResponseWriter, r *http.Request, path string) {
+	if path == pprofPath && !strings.HasSuffix(r.URL.Path, "/") {
+		// the links of the index are relative to the directory.
+		http.Redirect(w, r, requestPath(r)+"/", http.StatusMovedPermanently)
+		return
+	}
+	name := strings.TrimPrefix(strings.TrimPrefix(path, pprofPath), "/")
+	switch name {
+	case "cmdline":
+		pprof.Cmdline(w, r)
+	case "profile":
+		pprof.Profile(w, r)
+	case "symbol":
+		pprof.Symbol(w, r)
+	case "trace":
+		pprof.Trace(w, r)
+	default:
+		// the index serves the named profiles (heap, goroutine...), and
+		// expects them under /debug/pprof/.
+		r.URL.Path = "/" + pprofPath + "/" + name
+		pprof.Index(w, r)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestServerAdminPprof(t *testing.T) {
+	var tests = []struct {
+		testCase       string
+		enabled        bool
+		path           string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{"index", true, "/admin/debug/pprof/", http.StatusOK, "heap"},
+		{"index without trailing slash", true, "/admin/debug/pprof", http.StatusOK, "heap"},
+		{"heap profile", true, "/admin/debug/pprof/heap?debug=1", http.StatusOK, "heap profile"},
+		{"goroutines", true, "/admin/debug/pprof/goroutine?debug=1", http.StatusOK, "goroutine profile"},
+		{"cmdline", true, "/admin/debug/pprof/cmdline", http.StatusOK, ""},
+		{"unknown profile", true, "/admin/debug/pprof/whatever", http.StatusNotFound, ""},
+		{"disabled", false, "/admin/debug/pprof/heap?debug=1", http.StatusNotFound, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.testCase, func(t *testing.T) {
+			addr, cleanup := startServer(t, Config{
+				BucketName:  "my-bucket",
+				ProxyPrefix: "/proxy/",
+				AdminPrefix: "/admin/",
+				AdminToken:  "admin-secret",
+				AdminPprof:  test.enabled,
+			})
+			defer cleanup()
+			req, _ := http.NewRequest(http.MethodGet, addr+test.path, nil)
+			req.Header.Set("Authorization", "Bearer admin-secret")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != test.expectedStatus {
+				t.Errorf("wrong status code\nwant %d\ngot  %d", test.expectedStatus, resp.StatusCode)
+			}
+			data, _ := ioutil.ReadAll(resp.Body)
+			if !strings.Contains(string(data), test.expectedBody) {
+				t.Errorf("missing %q in the response:\n%s", test.expectedBody, data)
+			}
+		})
+	}
+}
+
+func TestServerAdminPprofUnauthorized(t *testing.T) {
+	addr, cleanup := startServer(t, Config{
+		BucketName:  "my-bucket",
+		ProxyPrefix: "/proxy/",
+		AdminPrefix: "/admin/",
+		AdminToken:  "admin-secret",
+		AdminPprof:  true,
+	})
+	defer cleanup()
+	resp, err := http.Get(addr + "/admin/debug/pprof/heap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("wrong status code\nwant %d\ngot  %d", http.StatusUnauthorized, resp.StatusCode)
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/sirupsen/logrus"
+)
+
+// maxMP4Boxes limits the number of top-level boxes inspected while looking
+// for the moov box, so malformed files don't trigger unbounded reads.
+const maxMP4Boxes = 64
+
+var errMoovNotFound = errors.New("mp4: moov box not found")
+
+// mp4Extensions are the extensions of the clips that have their duration
+// probed.
+var mp4Extensions = map[string]bool{
+	".m4a": true,
+	".m4v": true,
+	".mov": true,
+	".mp4": true,
+}
+
+// rangeReadFunc reads length bytes of an object, starting at offset.
+type rangeReadFunc func(ctx context.Context, offset, length int64) ([]byte, error)
+
+// durationProber fills in the durations of mappings by reading the moov box
+// of the MP4 clips. Durations are cached by object generation, as the content
+// of a generation never changes.
+type durationProber struct {
+	probeSize int64
+	cache     *durationCache
+	logger    *logrus.Logger
+}
+
+// newDurationProber returns the prober configured in
+// GCS_HELPER_MAP_PROBE_*, or nil when probing is disabled.
+func newDurationProber(c Config) *durationProber {
+	if !c.MapProbeDurations {
+		return nil
+	}
+	return &durationProber{
+		probeSize: c.MapProbeSize,
+		cache:     newDurationCache(c.MapProbeCacheSize),
+		logger:    c.logger(),
+	}
+}
+
+// setDurations sets the durations of the mapping to the duration of its
+// shortest MP4 clip, as every sequence is played in parallel by nginx-vod.
+// Clips that can't be probed are logged and ignored.
+func (p *durationProber) setDurations(ctx context.Context, m *mapping, bucketHandle *storage.BucketHandle) {
+	var shortest time.Duration
+	for _, s := range m.Sequences {
+		for _, c := range s.Clips {
+			if c.attrs == nil || !mp4Extensions[strings.ToLower(path.Ext(c.attrs.Name))] {
+				continue
+			}
+			d, err := p.duration(ctx, c.attrs, bucketHandle)
+			if err != nil {
+				requestLogger(ctx, p.logger).WithError(err).WithField("object", c.attrs.Name).Warn("failed to probe mp4 duration")
+				continue
+			}
+			if shortest == 0 || d < shortest {
+				shortest = d
+			}
+		}
+	}
+	if shortest > 0 {
+		m.Durations = []int64{int64(shortest / time.Millisecond)}
+	}
+}
+
+func (p *durationProber) duration(ctx context.Context, attrs *storage.ObjectAttrs, bucketHandle *storage.BucketHandle) (time.Duration, error) {
+	key := attrs.Name + "#" + strconv.FormatInt(attrs.Generation, 10)
+	d, ok := p.cache.get(key)
+	cacheRequests.inc("duration", cacheResult(ok))
+	if ok {
+		return d, nil
+	}
+	obj := bucketHandle.Object(attrs.Name)
+	if attrs.Generation != 0 {
+		obj = obj.Generation(attrs.Generation)
+	}
+	d, err := mp4Duration(ctx, attrs.Size, p.probeSize, func(ctx context.Context, offset, length int64) ([]byte, error) {
+		reader, err := obj.NewRangeReader(ctx, offset, length)
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		return ioutil.ReadAll(reader)
+	})
+	if err != nil {
+		return 0, err
+	}
+	p.cache.set(key, d)
+	return d, nil
+}
+
+// mp4Duration returns the duration declared in the mvhd box of an MP4 file
+// with the given size. The moov box is usually either at the beginning or
+// at the end of the file, so the first and last probeSize bytes are read
+// once and used for locating it, falling back to range reads of the box
+// headers in between.
+func mp4Duration(ctx context.Context, size, probeSize int64, read rangeReadFunc) (time.Duration, error) {
+	f := mp4File{ctx: ctx, size: size, probeSize: probeSize, read: read}
+	var offset int64
+	for i := 0; i < maxMP4Boxes && offset < size; i++ {
+		header, err := f.readAt(offset, 16)
+		if err != nil {
+			return 0, err
+		}
+		boxType, boxSize, headerSize, err := parseBoxHeader(header, size-offset)
+		if err != nil {
+			return 0, err
+		}
+		if boxType == "moov" {
+			length := boxSize - headerSize
+			if length > probeSize {
+				// mvhd is the first box in moov in practically all files.
+				length = probeSize
+			}
+			body, err := f.readAt(offset+headerSize, length)
+			if err != nil {
+				return 0, err
+			}
+			return moovDuration(body)
+		}
+		offset += boxSize
+	}
+	return 0, errMoovNotFound
+}
+
+// moovDuration returns the duration declared in the mvhd box found in the
+// content of a moov box.
+func moovDuration(moov []byte) (time.Duration, error) {
+	for len(moov) > 0 {
+		boxType, boxSize, headerSize, err := parseBoxHeader(moov, int64(len(moov)))
+		if err != nil {
+			return 0, err
+		}
+		if boxType == "mvhd" {
+			return mvhdDuration(moov[headerSize:boxSize])
+		}
+		moov = moov[boxSize:]
+	}
+	return 0, errors.New("mp4: mvhd box not found")
+}
+
+func mvhdDuration(mvhd []byte) (time.Duration, error) {
+	var timescale, duration uint64
+	switch {
+	case len(mvhd) >= 20 && mvhd[0] == 0:
+		timescale = uint64(binary.BigEndian.Uint32(mvhd[12:16]))
+		duration = uint64(binary.BigEndian.Uint32(mvhd[16:20]))
+		if duration == 0xffffffff {
+			duration = 0
+		}
+	case len(mvhd) >= 32 && mvhd[0] == 1:
+		timescale = uint64(binary.BigEndian.Uint32(mvhd[20:24]))
+		duration = binary.BigEndian.Uint64(mvhd[24:32])
+	default:
+		return 0, errors.New("mp4: invalid mvhd box")
+	}
+	if timescale == 0 || duration == 0 {
+		return 0, errors.New("mp4: unknown duration")
+	}
+	seconds := duration / timescale
+	remainder := duration % timescale
+	return time.Duration(seconds)*time.Second + time.Duration(remainder*uint64(time.Second)/timescale), nil
+}
+
+// parseBoxHeader parses the header of an MP4 box, returning its type, its
+// total size and the size of the header. available is the number of bytes
+// remaining in the parent, used by boxes that extend to its end.
+func parseBoxHeader(data []byte, available int64) (boxType string, boxSize, headerSize int64, err error) {
+	if len(data) < 8 {
+		return "", 0, 0, io.ErrUnexpectedEOF
+	}
+	boxType = string(data[4:8])
+	boxSize = int64(binary.BigEndian.Uint32(data[:4]))
+	headerSize = 8
+	switch boxSize {
+	case 0:
+		boxSize = available
+	case 1:
+		if len(data) < 16 {
+			return "", 0, 0, io.ErrUnexpectedEOF
+		}
+		boxSize = int64(binary.BigEndian.Uint64(data[8:16]))
+		headerSize = 16
+	}
+	if boxSize < headerSize || boxSize > available {
+		return "", 0, 0, fmt.Errorf("mp4: invalid size %d for box %q", boxSize, boxType)
+	}
+	return boxType, boxSize, headerSize, nil
+}
+
+// mp4File reads parts of an MP4 file, keeping its head and tail in memory.
+type mp4File struct {
+	ctx       context.Context
+	size      int64
+	probeSize int64
+	read      rangeReadFunc
+
+	head       []byte
+	tail       []byte
+	tailOffset int64
+}
+
+// readAt returns up to length bytes starting at offset, failing only when
+// fewer than 8 bytes (the size of a box header) are available.
+func (f *mp4File) readAt(offset, length int64) ([]byte, error) {
+	if offset+length > f.size {
+		length = f.size - offset
+	}
+	if f.head == nil && offset+length <= f.probeSize {
+		n := f.probeSize
+		if n > f.size {
+			n = f.size
+		}
+		head, err := f.read(f.ctx, 0, n)
+		if err != nil {
+			return nil, err
+		}
+		f.head = head
+	}
+	if offset+length <= int64(len(f.head)) {
+		return boxData(f.head[offset : offset+length])
+	}
+	if f.tail == nil && offset >= f.size-f.probeSize {
+		if f.tailOffset = f.size - f.probeSize; f.tailOffset < 0 {
+			f.tailOffset = 0
+		}
+		tail, err := f.read(f.ctx, f.tailOffset, f.size-f.tailOffset)
+		if err != nil {
+			return nil, err
+		}
+		f.tail = tail
+	}
+	if f.tail != nil && offset >= f.tailOffset && offset+length <= f.tailOffset+int64(len(f.tail)) {
+		return boxData(f.tail[offset-f.tailOffset : offset-f.tailOffset+length])
+	}
+	data, err := f.read(f.ctx, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	return boxData(data)
+}
+
+func boxData(data []byte) ([]byte, error) {
+	if len(data) < 8 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return data, nil
+}
+
+// durationCache is an in-memory LRU cache of clip durations.
+type durationCache struct {
+	maxSize int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type durationEntry struct {
+	key      string
+	duration time.Duration
+}
+
+func newDurationCache(maxSize int) *durationCache {
+	return &durationCache{
+		maxSize: maxSize,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+func (c *durationCache) get(key string) (time.Duration, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return 0, false
+	}
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*durationEntry).duration, true
+}
+
+func (c *durationCache) set(key string, d time.Duration) {
+	if c.maxSize <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		elem.Value.(*durationEntry).duration = d
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&durationEntry{key: key, duration: d})
+	for c.lru.Len() > c.maxSize {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*durationEntry).key)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fsouza/fake-gcs-server/fakestorage"
+)
+
+func mp4Box(boxType string, content ...[]byte) []byte {
+	body := bytes.Join(content, nil)
+	box := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint32(box, uint32(8+len(body)))
+	copy(box[4:], boxType)
+	return append(box, body...)
+}
+
+func mvhdBox(version byte, timescale uint32, duration uint64) []byte {
+	var body []byte
+	if version == 0 {
+		body = make([]byte, 20)
+		binary.BigEndian.PutUint32(body[12:], timescale)
+		binary.BigEndian.PutUint32(body[16:], uint32(duration))
+	} else {
+		body = make([]byte, 32)
+		binary.BigEndian.PutUint32(body[20:], timescale)
+		binary.BigEndian.PutUint64(body[24:], duration)
+	}
+	body[0] = version
+	return mp4Box("mvhd", body)
+}
+
+func testMP4(moovFirst bool, mdatSize int, mvhd []byte) []byte {
+	ftyp := mp4Box("ftyp", []byte("isom"))
+	moov := mp4Box("moov", mvhd, mp4Box("trak", make([]byte, 32)))
+	mdat := mp4Box("mdat", make([]byte, mdatSize))
+	if moovFirst {
+		return bytes.Join([][]byte{ftyp, moov, mdat}, nil)
+	}
+	return bytes.Join([][]byte{ftyp, mdat, moov}, nil)
+}
+
+type memoryRangeReader struct {
+	data  []byte
+	reads int
+}
+
+func (r *memoryRangeReader) read(_ context.Context, offset, length int64) ([]byte, error) {
+	r.reads++
+	return r.data[offset : offset+length], nil
+}
+
+func TestMP4Duration(t *testing.T) {
+	var tests = []struct {
+		testCase      string
+		file          []byte
+		expected      time.Duration
+		expectedReads int
+	}{
+		{
+			"moov at the beginning",
+			testMP4(true, 4096, mvhdBox(0, 1000, 62500)),
+			62500 * time.Millisecond,
+			1,
+		},
+		{
+			"moov at the end",
+			testMP4(false, 4096, mvhdBox(0, 90000, 135000)),
+			1500 * time.Millisecond,
+			2,
+		},
+		{
+			"version 1 mvhd",
+			testMP4(true, 16, mvhdBox(1, 600, 600*3600*30)),
+			30 * time.Hour,
+			1,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.testCase, func(t *testing.T) {
+			r := memoryRangeReader{data: test.file}
+			d, err := mp4Duration(context.Background(), int64(len(test.file)), 512, r.read)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d != test.expected {
+				t.Errorf("wrong duration\nwant %s\ngot  %s", test.expected, d)
+			}
+			if r.reads != test.expectedReads {
+				t.Errorf("wrong number of reads\nwant %d\ngot  %d", test.expectedReads, r.reads)
+			}
+		})
+	}
+}
+
+func TestMP4DurationInvalidFiles(t *testing.T) {
+	var tests = []struct {
+		testCase string
+		file     []byte
+	}{
+		{"not an mp4", []byte("WEBVTT\n\n00:00.000 --> 00:01.000\nhello\n")},
+		{"no moov", mp4Box("ftyp", []byte("isom"))},
+		{"no mvhd", mp4Box("moov", mp4Box("trak", make([]byte, 8)))},
+		{"unknown duration", mp4Box("moov", mvhdBox(0, 1000, 0xffffffff))},
+		{"zero timescale", mp4Box("moov", mvhdBox(0, 0, 1000))},
+	}
+	for _, test := range tests {
+		t.Run(test.testCase, func(t *testing.T) {
+			r := memoryRangeReader{data: test.file}
+			_, err := mp4Duration(context.Background(), int64(len(test.file)), 512, r.read)
+			if err == nil {
+				t.Error("unexpected <nil> error")
+			}
+		})
+	}
+}
+
+func TestCachedPrefixMappingDurations(t *testing.T) {
+	server := fakestorage.NewServer([]fakestorage.Object{
+		{BucketName: "my-bucket", Name: "videos/movie_360p.mp4", Content: testMP4(true, 64, mvhdBox(0, 1000, 10500))},
+		{BucketName: "my-bucket", Name: "videos/movie_720p.mp4", Content: testMP4(true, 64, mvhdBox(0, 1000, 10000))},
+		{BucketName: "my-bucket", Name: "videos/movie_en.vtt", Content: []byte("WEBVTT\n")},
+	})
+	defer server.Stop()
+	bucket := server.Client().Bucket("my-bucket")
+	config := Config{MapProbeDurations: true, MapProbeSize: 4096, MapProbeCacheSize: 10}
+	prober := newDurationProber(config)
+
+	m, err := cachedPrefixMapping(context.Background(), "videos/movie", "", mapPage{}, config, newMapFilters(config), nil, newMappingGroup(), prober, bucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []int64{10000}; !reflect.DeepEqual(m.Durations, expected) {
+		t.Errorf("wrong durations\nwant %v\ngot  %v", expected, m.Durations)
+	}
+	if _, ok := prober.cache.get("videos/movie_360p.mp4#0"); !ok {
+		t.Error("duration of videos/movie_360p.mp4 wasn't cached")
+	}
+}
+
+func TestDurationCacheEviction(t *testing.T) {
+	cache := newDurationCache(2)
+	cache.set("a#1", time.Second)
+	cache.set("b#1", 2*time.Second)
+	cache.get("a#1")
+	cache.set("c#1", 3*time.Second)
+	if _, ok := cache.get("b#1"); ok {
+		t.Error("least recently used entry wasn't evicted")
+	}
+	if d, ok := cache.get("a#1"); !ok || d != time.Second {
+		t.Errorf("wrong cached duration\nwant %s\ngot  %s", time.Second, d)
+	}
+}
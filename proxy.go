@@ -2,10 +2,13 @@ package main
 
 import (
 	"context"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
+	"path"
 	"strconv"
 	"strings"
 	"time"
@@ -16,6 +19,22 @@ import (
 
 const maxTry = 5
 
+// defaultContentTypes is used to detect the content type of objects stored
+// without one (or stored as application/octet-stream), for extensions that
+// are common in video delivery and usually missing from the system's MIME
+// database.
+var defaultContentTypes = map[string]string{
+	".m3u8": "application/vnd.apple.mpegurl",
+	".m4a":  "audio/mp4",
+	".m4s":  "video/iso.segment",
+	".m4v":  "video/mp4",
+	".mp4":  "video/mp4",
+	".mpd":  "application/dash+xml",
+	".srt":  "application/x-subrip",
+	".ts":   "video/mp2t",
+	".vtt":  "text/vtt",
+}
+
 type codeWrapper struct {
 	code int
 	http.ResponseWriter
@@ -26,6 +45,12 @@ func (w *codeWrapper) WriteHeader(code int) {
 	w.ResponseWriter.WriteHeader(code)
 }
 
+func (w *codeWrapper) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
 func getProxyHandler(c Config, client *storage.Client) http.HandlerFunc {
 	logger := c.logger()
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -39,17 +64,20 @@ func getProxyHandler(c Config, client *storage.Client) http.HandlerFunc {
 			w.WriteHeader(http.StatusOK)
 			return
 		}
+		obj, err := objectHandle(&c, client, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		resp := codeWrapper{ResponseWriter: w}
-		ctx, cancel := context.WithTimeout(context.Background(), c.ProxyTimeout)
+		ctx, cancel := context.WithTimeout(detachedContext(r.Context()), c.ProxyTimeout)
 		defer cancel()
-		obj := objectHandle(&c, client, r)
-		var err error
 
 		switch r.Method {
 		case http.MethodHead:
-			err = writeHeader(ctx, obj, &resp, nil, http.StatusOK)
+			err = handleHead(ctx, &c, obj, &resp, r)
 		case http.MethodGet:
-			err = handleGet(ctx, obj, &resp, r)
+			err = handleGet(ctx, &c, obj, &resp, r)
 		}
 
 		if err != nil || logger.Level <= logrus.DebugLevel {
@@ -65,7 +93,7 @@ func getProxyHandler(c Config, client *storage.Client) http.HandlerFunc {
 					fields["ReqHeader/"+header] = value
 				}
 			}
-			entry := logger.WithFields(fields)
+			entry := requestLogger(r.Context(), logger).WithFields(fields)
 			if err != nil {
 				entry.WithError(err).Error("failed to handle request")
 			} else {
@@ -75,28 +103,86 @@ func getProxyHandler(c Config, client *storage.Client) http.HandlerFunc {
 	}
 }
 
-func writeHeader(ctx context.Context, object *storage.ObjectHandle, w http.ResponseWriter, extra http.Header, status int) error {
-	attrs, err := object.Attrs(ctx)
-	if err != nil {
-		return handleObjectError(err, w)
-	}
-	if attrs.CacheControl != "" {
-		w.Header().Set("Cache-Control", attrs.CacheControl)
-	}
+func writeHeader(c *Config, attrs *storage.ObjectAttrs, w http.ResponseWriter, extra http.Header, status int) {
+	setObjectHeaders(c, attrs, w)
 	w.Header().Set("Accept-Ranges", "bytes")
 	w.Header().Set("Content-Length", strconv.FormatInt(attrs.Size, 10))
-	w.Header().Set("Content-Type", attrs.ContentType)
-	w.Header().Set("Date", time.Now().Format(time.RFC1123))
-	w.Header().Set("Last-Modified", attrs.Updated.Format(time.RFC1123))
+	if attrs.ContentEncoding != "" {
+		w.Header().Set("Content-Encoding", attrs.ContentEncoding)
+	}
 	for name, value := range extra {
 		w.Header().Set(name, value[0])
 	}
 	w.WriteHeader(status)
+}
+
+// setObjectHeaders sets the headers that describe the object, regardless of
+// the range of bytes being served.
+func setObjectHeaders(c *Config, attrs *storage.ObjectAttrs, w http.ResponseWriter) {
+	setValidators(c, attrs, w)
+	w.Header().Set("Content-Type", contentType(c, attrs))
+	w.Header().Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	setMetadataHeaders(attrs, w)
+}
+
+// setValidators sets the headers that are used by clients to revalidate
+// cached copies of the object. They're sent in both full and 304 responses.
+func setValidators(c *Config, attrs *storage.ObjectAttrs, w http.ResponseWriter) {
+	if cacheControl, ok := c.CacheControl.lookup(attrs.Name); ok {
+		w.Header().Set("Cache-Control", cacheControl)
+	} else if attrs.CacheControl != "" {
+		w.Header().Set("Cache-Control", attrs.CacheControl)
+	}
+	if etag := objectETag(attrs); etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	w.Header().Set("Last-Modified", attrs.Updated.UTC().Format(http.TimeFormat))
+}
+
+func handleHead(ctx context.Context, c *Config, object *storage.ObjectHandle, w http.ResponseWriter, r *http.Request) error {
+	start := time.Now()
+	attrs, err := object.Attrs(ctx)
+	addLogDuration(r.Context(), "attrsDuration", time.Since(start))
+	if err != nil {
+		return handleObjectError(err, w)
+	}
+	if notModified(r, attrs) {
+		setValidators(c, attrs, w)
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+	if decompressGzip(c, attrs) {
+		writeDecompressedHeader(c, attrs, w)
+		return nil
+	}
+	writeHeader(c, attrs, w, nil, http.StatusOK)
 	return nil
 }
 
-func handleGet(ctx context.Context, object *storage.ObjectHandle, w http.ResponseWriter, r *http.Request) error {
-	offset, end, length := getRange(r)
+func handleGet(ctx context.Context, c *Config, object *storage.ObjectHandle, w http.ResponseWriter, r *http.Request) error {
+	start := time.Now()
+	attrs, err := object.Attrs(ctx)
+	addLogDuration(r.Context(), "attrsDuration", time.Since(start))
+	if err != nil {
+		return handleObjectError(err, w)
+	}
+	if notModified(r, attrs) {
+		setValidators(c, attrs, w)
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+	if decompressGzip(c, attrs) {
+		return handleDecompressedGet(ctx, c, object, attrs, w)
+	}
+	if attrs.ContentEncoding == "gzip" {
+		ctx = withRawContent(ctx)
+	}
+	offset, end, length, partial, ok := getRange(r, attrs.Size)
+	if !ok {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", attrs.Size))
+		http.Error(w, "requested range not satisfiable", http.StatusRequestedRangeNotSatisfiable)
+		return nil
+	}
 	reader, err := getReader(ctx, object, offset, length, maxTry)
 	if err != nil {
 		return handleObjectError(err, w)
@@ -104,17 +190,111 @@ func handleGet(ctx context.Context, object *storage.ObjectHandle, w http.Respons
 	defer reader.Close()
 	extraHeaders := make(http.Header)
 	extraHeaders.Set("Content-Length", strconv.FormatInt(reader.Remain(), 10))
-	extraHeaders.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, end, reader.Size()))
-	status := http.StatusPartialContent
-	if length == -1 {
-		status = http.StatusOK
+	status := http.StatusOK
+	if partial {
+		extraHeaders.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, end, reader.Size()))
+		status = http.StatusPartialContent
 	}
-	err = writeHeader(ctx, object, w, extraHeaders, status)
-	if err != nil {
+	writeHeader(c, attrs, w, extraHeaders, status)
+	return copyChunks(w, reader, c.ProxyChunkSize)
+}
+
+// contentType returns the content type of the given object. Types configured
+// in GCS_HELPER_CONTENT_TYPES always take precedence, and objects stored
+// without a meaningful content type have it detected from their extension.
+func contentType(c *Config, attrs *storage.ObjectAttrs) string {
+	if ct, ok := c.ContentTypes.lookup(attrs.Name); ok {
+		return ct
+	}
+	if attrs.ContentType != "" && attrs.ContentType != "application/octet-stream" {
+		return attrs.ContentType
+	}
+	ext := strings.ToLower(path.Ext(attrs.Name))
+	if ct, ok := defaultContentTypes[ext]; ok {
+		return ct
+	}
+	if ct := mime.TypeByExtension(ext); ct != "" {
+		return ct
+	}
+	if attrs.ContentType != "" {
+		return attrs.ContentType
+	}
+	return "application/octet-stream"
+}
+
+// objectETag returns the entity tag for the given object, based on its MD5
+// hash or, for composite objects (that don't have an MD5 hash), its
+// generation. An empty string is returned when neither is available.
+func objectETag(attrs *storage.ObjectAttrs) string {
+	switch {
+	case len(attrs.MD5) > 0:
+		return `"` + hex.EncodeToString(attrs.MD5) + `"`
+	case attrs.Generation != 0:
+		return `"` + strconv.FormatInt(attrs.Generation, 10) + `"`
+	}
+	return ""
+}
+
+// notModified reports whether the conditional headers in the request
+// (If-None-Match and If-Modified-Since) indicate that the client already has
+// the current version of the object. If-Modified-Since is ignored when
+// If-None-Match is present, as defined in RFC 7232.
+func notModified(r *http.Request, attrs *storage.ObjectAttrs) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		return matchesETag(inm, objectETag(attrs))
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" && !attrs.Updated.IsZero() {
+		t, err := http.ParseTime(ims)
+		if err != nil {
+			return false
+		}
+		return !attrs.Updated.Truncate(time.Second).After(t)
+	}
+	return false
+}
+
+// matchesETag reports whether the given If-None-Match header matches the
+// entity tag. Weak comparison is used, as defined in RFC 7232.
+func matchesETag(inm, etag string) bool {
+	if etag == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(inm, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// copyChunks streams the content of the reader to the response using a
+// buffer of chunkSize bytes, flushing the response after every chunk so
+// clients start receiving data as soon as it's available.
+func copyChunks(w http.ResponseWriter, reader io.Reader, chunkSize int) error {
+	if chunkSize <= 0 {
+		_, err := io.Copy(w, reader)
 		return err
 	}
-	_, err = io.Copy(w, reader)
-	return err
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := reader.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
 }
 
 func getReader(ctx context.Context, object *storage.ObjectHandle, offset, length int64, try int) (*storage.Reader, error) {
@@ -130,24 +310,58 @@ func getReader(ctx context.Context, object *storage.ObjectHandle, offset, length
 	}
 }
 
-func getRange(r *http.Request) (offset, end, length int64) {
+// getRange returns the range of bytes of an object of the given size that's
+// requested in the Range header: the offset and the length to read (-1 when
+// the range ends with the object), and the last byte of the range, which is
+// clamped to the end of the object. partial is false when the whole object
+// is sent, which is the case for requests without a range, and for ranges
+// that are invalid or that aren't supported (like multiple ranges), as the
+// header may be ignored. ok is false when the range is unsatisfiable,
+// because it starts past the end of the object.
+func getRange(r *http.Request, size int64) (offset, end, length int64, partial, ok bool) {
 	length = -1
-	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
-		parts := strings.SplitN(rangeHeader, "=", 2)
-		if len(parts) == 2 {
-			rangeSpec := strings.SplitN(parts[1], "-", 2)
-			if len(rangeSpec) == 2 {
-				if rangeStart, err := strconv.ParseInt(rangeSpec[0], 10, 64); err == nil {
-					offset = rangeStart
-				}
-				if rangeEnd, err := strconv.ParseInt(rangeSpec[1], 10, 64); err == nil {
-					end = rangeEnd
-					length = end - offset + 1
-				}
-			}
+	spec := strings.TrimSpace(r.Header.Get("Range"))
+	if !strings.HasPrefix(spec, "bytes=") {
+		return 0, 0, -1, false, true
+	}
+	parts := strings.SplitN(strings.TrimPrefix(spec, "bytes="), "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, -1, false, true
+	}
+	if parts[0] == "" {
+		// suffix ranges request the last bytes of the object.
+		suffix, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || suffix < 0 {
+			return 0, 0, -1, false, true
+		}
+		if suffix == 0 {
+			return 0, 0, -1, true, false
+		}
+		if suffix > size {
+			suffix = size
+		}
+		return size - suffix, size - 1, -1, true, size > 0
+	}
+	offset, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || offset < 0 {
+		return 0, 0, -1, false, true
+	}
+	end = size - 1
+	if parts[1] != "" {
+		if end, err = strconv.ParseInt(parts[1], 10, 64); err != nil || end < offset {
+			return 0, 0, -1, false, true
+		}
+		if end > size-1 {
+			end = size - 1
 		}
 	}
-	return offset, end, length
+	if offset >= size {
+		return offset, end, length, true, false
+	}
+	if end < size-1 {
+		length = end - offset + 1
+	}
+	return offset, end, length, true, true
 }
 
 func handleObjectError(err error, w http.ResponseWriter) error {
@@ -161,13 +375,34 @@ func handleObjectError(err error, w http.ResponseWriter) error {
 	return err
 }
 
-func objectHandle(c *Config, client *storage.Client, r *http.Request) *storage.ObjectHandle {
-	bucketName := c.BucketName
-	objectName := strings.TrimLeft(r.URL.Path, "/")
+func objectHandle(c *Config, client *storage.Client, r *http.Request) (*storage.ObjectHandle, error) {
+	bucketName, objectName, err := objectLocation(c, r)
+	if err != nil {
+		return nil, err
+	}
+	obj := bucketHandle(c, client, bucketName).Object(objectName)
+	if generation := r.URL.Query().Get("generation"); generation != "" {
+		gen, err := strconv.ParseInt(generation, 10, 64)
+		if err != nil || gen < 0 {
+			return nil, errors.New("invalid generation")
+		}
+		obj = obj.Generation(gen)
+	}
+	return obj, nil
+}
+
+// objectLocation returns the name of the bucket and the name of the object
+// referenced by the request path.
+func objectLocation(c *Config, r *http.Request) (bucketName, objectName string, err error) {
+	bucketName = c.BucketName
+	objectName = strings.TrimLeft(r.URL.Path, "/")
 	if c.ProxyBucketOnPath {
 		pos := strings.Index(objectName, "/")
+		if pos < 1 || pos == len(objectName)-1 {
+			return "", "", errors.New("bucket and object name are required")
+		}
 		bucketName = objectName[:pos]
 		objectName = objectName[pos+1:]
 	}
-	return client.Bucket(bucketName).Object(objectName)
+	return bucketName, objectName, nil
 }
@@ -2,8 +2,11 @@ package main
 
 import (
 	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
+
+	"cloud.google.com/go/storage"
 )
 
 func TestServerProxyOnly(t *testing.T) {
@@ -11,6 +14,7 @@ func TestServerProxyOnly(t *testing.T) {
 		BucketName:      "my-bucket",
 		ProxyLogHeaders: []string{"Accept", "User-Agent", "Range"},
 		ProxyTimeout:    time.Second,
+		ProxyChunkSize:  4,
 	})
 	defer cleanup()
 	var tests = []serverTest{
@@ -50,6 +54,120 @@ func TestServerProxyOnly(t *testing.T) {
 			},
 			"me nicer",
 		},
+		{
+			"download file - open range",
+			http.MethodGet,
+			addr + "/musics/music/music2.txt",
+			http.Header{
+				"Range": []string{"bytes=5-"},
+			},
+			http.StatusPartialContent,
+			http.Header{
+				"Accept-Ranges":  []string{"bytes"},
+				"Content-Length": []string{"11"},
+				"Content-Range":  []string{"bytes 5-15/16"},
+			},
+			"nicer music",
+		},
+		{
+			"download file - suffix range",
+			http.MethodGet,
+			addr + "/musics/music/music2.txt",
+			http.Header{
+				"Range": []string{"bytes=-5"},
+			},
+			http.StatusPartialContent,
+			http.Header{
+				"Content-Length": []string{"5"},
+				"Content-Range":  []string{"bytes 11-15/16"},
+			},
+			"music",
+		},
+		{
+			"download file - suffix range longer than the object",
+			http.MethodGet,
+			addr + "/musics/music/music2.txt",
+			http.Header{
+				"Range": []string{"bytes=-100"},
+			},
+			http.StatusPartialContent,
+			http.Header{
+				"Content-Length": []string{"16"},
+				"Content-Range":  []string{"bytes 0-15/16"},
+			},
+			"some nicer music",
+		},
+		{
+			"download file - range past the end of the object",
+			http.MethodGet,
+			addr + "/musics/music/music2.txt",
+			http.Header{
+				"Range": []string{"bytes=5-999999"},
+			},
+			http.StatusPartialContent,
+			http.Header{
+				"Content-Length": []string{"11"},
+				"Content-Range":  []string{"bytes 5-15/16"},
+			},
+			"nicer music",
+		},
+		{
+			"download file - range starting past the end of the object",
+			http.MethodGet,
+			addr + "/musics/music/music2.txt",
+			http.Header{
+				"Range": []string{"bytes=16-20"},
+			},
+			http.StatusRequestedRangeNotSatisfiable,
+			http.Header{
+				"Content-Range": []string{"bytes */16"},
+			},
+			"requested range not satisfiable\n",
+		},
+		{
+			"download file - empty suffix range",
+			http.MethodGet,
+			addr + "/musics/music/music2.txt",
+			http.Header{
+				"Range": []string{"bytes=-0"},
+			},
+			http.StatusRequestedRangeNotSatisfiable,
+			http.Header{
+				"Content-Range": []string{"bytes */16"},
+			},
+			"requested range not satisfiable\n",
+		},
+		{
+			"download file - invalid range",
+			http.MethodGet,
+			addr + "/musics/music/music2.txt",
+			http.Header{
+				"Range": []string{"bytes=10-2"},
+			},
+			http.StatusOK,
+			http.Header{
+				"Content-Length": []string{"16"},
+			},
+			"some nicer music",
+		},
+		{
+			"download file - generation",
+			http.MethodGet,
+			addr + "/musics/music/music1.txt?generation=1520692212",
+			nil,
+			http.StatusOK,
+			nil,
+			"some nice music",
+		},
+		{
+			"download file - invalid generation",
+			http.MethodGet,
+			addr + "/musics/music/music1.txt?generation=latest",
+			nil,
+			http.StatusBadRequest,
+			nil,
+			"invalid generation\n",
+		},
 		{
 			"file attrs",
 			http.MethodHead,
@@ -112,6 +230,7 @@ func TestServerProxyHandlerBucketInThePath(t *testing.T) {
 		ExtraResourcesToken: "extra",
 		ProxyPrefix:         "/proxy/",
 		ProxyBucketOnPath:   true,
+		BillingProject:      "my-project",
 		ProxyTimeout:        time.Second,
 		MapRegexFilter:      `(240|360|424|480|720|1080)p(\.mp4|[a-z0-9_-]{37}\.(vtt|srt))$`,
 		MapRegexHDFilter:    `((720|1080)p\.mp4)|(\.(vtt|srt))$`,
@@ -135,6 +254,13 @@ func TestServerProxyHandlerBucketInThePath(t *testing.T) {
 			},
 			expectedBody: "wait what",
 		},
+		{
+			testCase:       "proxy: missing object name",
+			method:         http.MethodGet,
+			addr:           addr + "/proxy/your-bucket",
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   "bucket and object name are required\n",
+		},
 	}
 
 	for _, test := range tests {
@@ -154,3 +280,133 @@ func TestServerProxyHandlerBucketNotFound(t *testing.T) {
 		t.Errorf("wrong status code\nwant %d\ngot  %d", http.StatusNotFound, resp.StatusCode)
 	}
 }
+
+func TestNotModified(t *testing.T) {
+	updated := time.Date(2018, time.March, 10, 14, 30, 12, 500, time.UTC)
+	attrs := &storage.ObjectAttrs{
+		MD5:     []byte{0xde, 0xad, 0xbe, 0xef},
+		Updated: updated,
+	}
+	var tests = []struct {
+		testCase string
+		header   http.Header
+		expected bool
+	}{
+		{
+			"no conditional headers",
+			nil,
+			false,
+		},
+		{
+			"matching etag",
+			http.Header{"If-None-Match": []string{`"deadbeef"`}},
+			true,
+		},
+		{
+			"matching weak etag in list",
+			http.Header{"If-None-Match": []string{`"abc", W/"deadbeef"`}},
+			true,
+		},
+		{
+			"wildcard etag",
+			http.Header{"If-None-Match": []string{"*"}},
+			true,
+		},
+		{
+			"different etag",
+			http.Header{"If-None-Match": []string{`"abc"`}},
+			false,
+		},
+		{
+			"not modified since",
+			http.Header{"If-Modified-Since": []string{updated.Format(http.TimeFormat)}},
+			true,
+		},
+		{
+			"modified since",
+			http.Header{"If-Modified-Since": []string{updated.Add(-time.Hour).Format(http.TimeFormat)}},
+			false,
+		},
+		{
+			"if-none-match takes precedence",
+			http.Header{
+				"If-None-Match":     []string{`"abc"`},
+				"If-Modified-Since": []string{updated.Format(http.TimeFormat)},
+			},
+			false,
+		},
+		{
+			"invalid date",
+			http.Header{"If-Modified-Since": []string{"yesterday"}},
+			false,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.testCase, func(t *testing.T) {
+			r, _ := http.NewRequest(http.MethodGet, "/", nil)
+			r.Header = test.header
+			if r.Header == nil {
+				r.Header = http.Header{}
+			}
+			if got := notModified(r, attrs); got != test.expected {
+				t.Errorf("wrong result\nwant %v\ngot  %v", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestNotModifiedLastModifiedRoundTrip(t *testing.T) {
+	attrs := &storage.ObjectAttrs{
+		Updated: time.Date(2018, time.March, 10, 14, 30, 12, 500, time.FixedZone("BRT", -3*60*60)),
+	}
+	w := httptest.NewRecorder()
+	setValidators(&Config{}, attrs, w)
+	lastModified := w.Header().Get("Last-Modified")
+	if lastModified != "Sat, 10 Mar 2018 17:30:12 GMT" {
+		t.Errorf("wrong Last-Modified header %q", lastModified)
+	}
+	// clients send the Last-Modified header back as If-Modified-Since.
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("If-Modified-Since", lastModified)
+	if !notModified(r, attrs) {
+		t.Errorf("object should not be modified since %q", lastModified)
+	}
+}
+
+func TestObjectETag(t *testing.T) {
+	var tests = []struct {
+		attrs    storage.ObjectAttrs
+		expected string
+	}{
+		{storage.ObjectAttrs{MD5: []byte{0xca, 0xfe}, Generation: 10}, `"cafe"`},
+		{storage.ObjectAttrs{Generation: 1520692212}, `"1520692212"`},
+		{storage.ObjectAttrs{}, ""},
+	}
+	for _, test := range tests {
+		if got := objectETag(&test.attrs); got != test.expected {
+			t.Errorf("wrong etag\nwant %q\ngot  %q", test.expected, got)
+		}
+	}
+}
+
+func TestContentType(t *testing.T) {
+	c := Config{ContentTypes: ExtensionMap{".mp4": "video/x-custom", ".srt": "text/plain"}}
+	var tests = []struct {
+		attrs    storage.ObjectAttrs
+		expected string
+	}{
+		{storage.ObjectAttrs{Name: "video/video_720p.mp4", ContentType: "video/mp4"}, "video/x-custom"},
+		{storage.ObjectAttrs{Name: "captions/en.SRT"}, "text/plain"},
+		{storage.ObjectAttrs{Name: "captions/en.vtt"}, "text/vtt"},
+		{storage.ObjectAttrs{Name: "hls/master.m3u8", ContentType: "application/octet-stream"}, "application/vnd.apple.mpegurl"},
+		{storage.ObjectAttrs{Name: "dash/manifest.mpd", ContentType: "text/xml"}, "text/xml"},
+		{storage.ObjectAttrs{Name: "index.html"}, "text/html; charset=utf-8"},
+		{storage.ObjectAttrs{Name: "some/file.unknown-ext"}, "application/octet-stream"},
+		{storage.ObjectAttrs{Name: "some/file"}, "application/octet-stream"},
+	}
+	for _, test := range tests {
+		if got := contentType(&c, &test.attrs); got != test.expected {
+			t.Errorf("%s: wrong content type\nwant %q\ngot  %q", test.attrs.Name, test.expected, got)
+		}
+	}
+}
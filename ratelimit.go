@@ -0,0 +1,79 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket that allows rate requests per second on
+// average, with bursts of up to burst requests.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+	now   func() time.Time
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:   rate,
+		burst:  float64(burst),
+		now:    time.Now,
+		tokens: float64(burst),
+	}
+}
+
+// allow takes a token from the bucket, returning false and how long until a
+// token is available when it's empty.
+func (l *rateLimiter) allow() (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	if !l.last.IsZero() {
+		l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	}
+	l.last = now
+	if l.tokens >= 1 {
+		l.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+}
+
+// rateLimitBurst returns the configured burst, which defaults to the rate
+// (and at least one request).
+func (c Config) rateLimitBurst() int {
+	if c.RateLimitBurst > 0 {
+		return c.RateLimitBurst
+	}
+	return int(math.Max(1, math.Ceil(c.RateLimit)))
+}
+
+// rateLimitHandler wraps the given handler, rejecting requests with 429 when
+// they exceed GCS_HELPER_RATE_LIMIT. Every handler built by getHandler has
+// its own limiter, so each route and host has its own limit. Health checks
+// aren't limited.
+func rateLimitHandler(c Config, handler http.HandlerFunc) http.HandlerFunc {
+	if c.RateLimit <= 0 {
+		return handler
+	}
+	limiter := newRateLimiter(c.RateLimit, c.rateLimitBurst())
+	return func(w http.ResponseWriter, r *http.Request) {
+		if isHealthCheck(c, r) {
+			handler(w, r)
+			return
+		}
+		if ok, wait := limiter.allow(); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+		handler(w, r)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Date(2018, 3, 10, 14, 30, 0, 0, time.UTC)
+	l := newRateLimiter(2, 3)
+	l.now = func() time.Time { return now }
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.allow(); !ok {
+			t.Fatalf("request %d should be allowed by the burst", i+1)
+		}
+	}
+	ok, wait := l.allow()
+	if ok {
+		t.Fatal("request should exceed the burst")
+	}
+	if wait != 500*time.Millisecond {
+		t.Errorf("wrong wait\nwant 500ms\ngot  %s", wait)
+	}
+	now = now.Add(250 * time.Millisecond)
+	if ok, wait = l.allow(); ok || wait != 250*time.Millisecond {
+		t.Errorf("request should wait for 250ms, got %v and %s", ok, wait)
+	}
+	now = now.Add(250 * time.Millisecond)
+	if ok, _ = l.allow(); !ok {
+		t.Error("request should be allowed after a token is added")
+	}
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		if ok, _ = l.allow(); !ok {
+			t.Fatalf("request %d should be allowed after refilling the bucket", i+1)
+		}
+	}
+	if ok, _ = l.allow(); ok {
+		t.Error("the bucket shouldn't hold more than the burst")
+	}
+}
+
+func TestRateLimitBurst(t *testing.T) {
+	var tests = []struct {
+		config   Config
+		expected int
+	}{
+		{Config{RateLimit: 10}, 10},
+		{Config{RateLimit: 2.5}, 3},
+		{Config{RateLimit: 0.1}, 1},
+		{Config{RateLimit: 10, RateLimitBurst: 50}, 50},
+	}
+	for _, test := range tests {
+		if burst := test.config.rateLimitBurst(); burst != test.expected {
+			t.Errorf("%#v: wrong burst\nwant %d\ngot  %d", test.config, test.expected, burst)
+		}
+	}
+}
+
+func TestRateLimitHandler(t *testing.T) {
+	handler := rateLimitHandler(Config{RateLimit: 0.5, RateLimitBurst: 1}, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	var tests = []struct {
+		testCase           string
+		path               string
+		expectedStatus     int
+		expectedRetryAfter string
+	}{
+		{"first request", "/proxy/file.mp4", http.StatusOK, ""},
+		{"limited request", "/proxy/file.mp4", http.StatusTooManyRequests, "2"},
+		{"healthcheck", "/", http.StatusOK, ""},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodGet, test.path, nil))
+		if w.Code != test.expectedStatus {
+			t.Errorf("%s: wrong status code\nwant %d\ngot  %d", test.testCase, test.expectedStatus, w.Code)
+		}
+		if retryAfter := w.Header().Get("Retry-After"); retryAfter != test.expectedRetryAfter {
+			t.Errorf("%s: wrong Retry-After\nwant %q\ngot  %q", test.testCase, test.expectedRetryAfter, retryAfter)
+		}
+	}
+}
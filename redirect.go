@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+type signedObjectURL struct {
+	URL     string            `json:"url"`
+	Method  string            `json:"method"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Expires time.Time         `json:"expires"`
+}
+
+func getRedirectHandler(c Config) http.HandlerFunc {
+	logger := c.logger()
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		url, status, err := signRequestedURL(&c, r, r.Method)
+		if err != nil {
+			if status == http.StatusInternalServerError {
+				requestLogger(r.Context(), logger).WithError(err).WithField("url", r.URL.RequestURI()).Error("failed to sign url")
+				http.Error(w, "failed to sign url", status)
+				return
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		http.Redirect(w, r, url, http.StatusFound)
+	}
+}
+
+// getSignHandler returns a handler that responds with a signed URL for the
+// object referenced by the path, as JSON or, when "redirect=true" is
+// provided, as a redirect. The signed URL is valid for requests with the
+// method configured in GCS_HELPER_SIGN_METHOD, unless "method" is provided.
+func getSignHandler(c Config) http.HandlerFunc {
+	logger := c.logger()
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		method := c.SignConfig.Method
+		if value := r.URL.Query().Get("method"); value != "" {
+			if value != http.MethodGet && value != http.MethodHead {
+				http.Error(w, "invalid method", http.StatusBadRequest)
+				return
+			}
+			method = value
+		}
+		signed, status, err := signRequestedURL(&c, r, method)
+		if err != nil {
+			if status == http.StatusInternalServerError {
+				requestLogger(r.Context(), logger).WithError(err).WithField("url", r.URL.RequestURI()).Error("failed to sign url")
+				http.Error(w, "failed to sign url", status)
+				return
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		if r.URL.Query().Get("redirect") == "true" {
+			http.Redirect(w, r, signed, http.StatusFound)
+			return
+		}
+		var expires time.Time
+		if c.Signer == signerToken {
+			expires, err = c.TokenConfig.expiration(signed)
+		} else {
+			expires, err = signedURLExpiration(signed)
+		}
+		if err != nil {
+			requestLogger(r.Context(), logger).WithError(err).WithField("url", r.URL.RequestURI()).Error("failed to parse signed url")
+			http.Error(w, "failed to sign url", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		result := signedObjectURL{URL: signed, Method: method, Expires: expires}
+		if c.Signer != signerCDN && c.Signer != signerToken {
+			headers := c.SignConfig.signedHeaders()
+			if len(headers) > 0 {
+				result.Headers = make(map[string]string, len(headers))
+				for name := range headers {
+					result.Headers[name] = headers.Get(name)
+				}
+			}
+		}
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+// signRequestedURL signs a URL for the object referenced by the request, with
+// the signer configured in GCS_HELPER_SIGNER, returning the HTTP status that
+// should be used in case of errors. CDN and token signed URLs are valid for
+// any method.
+func signRequestedURL(c *Config, r *http.Request, method string) (string, int, error) {
+	bucketName, objectName, err := objectLocation(c, r)
+	if err != nil {
+		return "", http.StatusBadRequest, err
+	}
+	return signObjectURL(c, r, method, bucketName, objectName)
+}
+
+// signObjectURL signs a URL for the given object, with the signer configured
+// in GCS_HELPER_SIGNER and the expiration requested in r, and records it in
+// the audit sinks, if any.
+func signObjectURL(c *Config, r *http.Request, method, bucketName, objectName string) (signed string, status int, err error) {
+	start := time.Now()
+	_, s := startSpan(r.Context(), "sign", spanKindInternal)
+	s.setAttribute("signer", c.Signer)
+	defer func() {
+		s.setError(err)
+		s.finish()
+		addLogDuration(r.Context(), "signDuration", time.Since(start))
+	}()
+	switch c.Signer {
+	case signerCDN:
+		expiration, err := parseExpiration(r, c.CDNConfig.Expiration, c.CDNConfig.MaxExpiration)
+		if err != nil {
+			return "", http.StatusBadRequest, err
+		}
+		expires := time.Now().Add(expiration)
+		url, err := c.CDNConfig.signedURL(objectName, expires)
+		if err != nil {
+			return "", http.StatusInternalServerError, err
+		}
+		c.audit(r, auditEvent{Kind: auditKindURL, Signer: c.Signer, Method: method, Bucket: bucketName, Object: objectName, Expires: expires})
+		return url, http.StatusOK, nil
+	case signerToken:
+		expiration, err := parseExpiration(r, c.TokenConfig.Expiration, c.TokenConfig.MaxExpiration)
+		if err != nil {
+			return "", http.StatusBadRequest, err
+		}
+		expires := time.Now().Add(expiration)
+		url, err := c.TokenConfig.signedURL(objectName, expires)
+		if err != nil {
+			return "", http.StatusInternalServerError, err
+		}
+		c.audit(r, auditEvent{Kind: auditKindURL, Signer: c.Signer, Method: method, Bucket: bucketName, Object: objectName, Expires: expires})
+		return url, http.StatusOK, nil
+	}
+	signConfig := c.SignConfig
+	signConfig.Expiration, err = signConfig.requestExpiration(r)
+	if err != nil {
+		return "", http.StatusBadRequest, err
+	}
+	url, err := signedURL(signConfig, method, bucketName, objectName)
+	if err != nil {
+		return "", http.StatusInternalServerError, err
+	}
+	if c.AuditConfig.auditor != nil {
+		// cached URLs expire later than requested (see signedURLCache).
+		expires, err := signedURLExpiration(url)
+		if err != nil {
+			expires = time.Now().Add(signConfig.Expiration)
+		}
+		c.audit(r, auditEvent{Kind: auditKindURL, Signer: c.Signer, Method: method, Bucket: bucketName, Object: objectName, Expires: expires})
+	}
+	url, err = signConfig.rewriteURL(url)
+	if err != nil {
+		return "", http.StatusInternalServerError, err
+	}
+	return url, http.StatusOK, nil
+}
+
+// signedURLExpiration returns the time when the given V2 or V4 signed URL
+// expires.
+func signedURLExpiration(signed string) (time.Time, error) {
+	u, err := url.Parse(signed)
+	if err != nil {
+		return time.Time{}, err
+	}
+	q := u.Query()
+	if expires := q.Get("Expires"); expires != "" {
+		seconds, err := strconv.ParseInt(expires, 10, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.Unix(seconds, 0).UTC(), nil
+	}
+	date, err := time.Parse("20060102T150405Z", q.Get("X-Goog-Date"))
+	if err != nil {
+		return time.Time{}, err
+	}
+	seconds, err := strconv.ParseInt(q.Get("X-Goog-Expires"), 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return date.Add(time.Duration(seconds) * time.Second), nil
+}
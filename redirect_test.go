@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServerRedirectHandler(t *testing.T) {
+	addr, cleanup := startServer(t, Config{
+		BucketName:     "my-bucket",
+		RedirectPrefix: "/redirect/",
+		ProxyPrefix:    "/proxy/",
+		ProxyTimeout:   time.Second,
+		SignConfig:     testSignConfig(t),
+	})
+	defer cleanup()
+	client := http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	var tests = []struct {
+		testCase         string
+		method           string
+		path             string
+		expectedStatus   int
+		expectedLocation string
+	}{
+		{
+			"redirect to signed url",
+			http.MethodGet,
+			"/redirect/videos/video/video1_720p.mp4",
+			http.StatusFound,
+			"/my-bucket/videos/video/video1_720p.mp4",
+		},
+		{
+			"redirect head request",
+			http.MethodHead,
+			"/redirect/videos/video/video1_720p.mp4",
+			http.StatusFound,
+			"/my-bucket/videos/video/video1_720p.mp4",
+		},
+		{
+			"redirect with custom expiration",
+			http.MethodGet,
+			"/redirect/videos/video/video1_720p.mp4?expires=5m",
+			http.StatusFound,
+			"/my-bucket/videos/video/video1_720p.mp4",
+		},
+		{
+			"expiration above the maximum",
+			http.MethodGet,
+			"/redirect/videos/video/video1_720p.mp4?expires=2h",
+			http.StatusBadRequest,
+			"",
+		},
+		{
+			"method not allowed",
+			http.MethodPost,
+			"/redirect/videos/video/video1_720p.mp4",
+			http.StatusMethodNotAllowed,
+			"",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.testCase, func(t *testing.T) {
+			req, _ := http.NewRequest(test.method, addr+test.path, nil)
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != test.expectedStatus {
+				t.Errorf("wrong status code\nwant %d\ngot  %d", test.expectedStatus, resp.StatusCode)
+			}
+			if test.expectedLocation == "" {
+				return
+			}
+			location, err := url.Parse(resp.Header.Get("Location"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if location.Host != "storage.googleapis.com" || location.Path != test.expectedLocation {
+				t.Errorf("wrong location\nwant %q\ngot  %q", test.expectedLocation, location)
+			}
+			if location.Query().Get("Signature") == "" {
+				t.Errorf("missing signature in %q", location)
+			}
+		})
+	}
+}
+
+func TestServerSignHandler(t *testing.T) {
+	addr, cleanup := startServer(t, Config{
+		BucketName:   "my-bucket",
+		SignPrefix:   "/sign/",
+		ProxyTimeout: time.Second,
+		SignConfig:   testSignConfig(t),
+	})
+	defer cleanup()
+	client := http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	var tests = []struct {
+		testCase       string
+		method         string
+		path           string
+		expectedStatus int
+		expectedMethod string
+	}{
+		{
+			"sign url",
+			http.MethodGet,
+			"/sign/videos/video/video1_720p.mp4",
+			http.StatusOK,
+			http.MethodGet,
+		},
+		{
+			"sign url for head requests",
+			http.MethodGet,
+			"/sign/videos/video/video1_720p.mp4?method=HEAD",
+			http.StatusOK,
+			http.MethodHead,
+		},
+		{
+			"redirect",
+			http.MethodGet,
+			"/sign/videos/video/video1_720p.mp4?redirect=true",
+			http.StatusFound,
+			"",
+		},
+		{
+			"invalid method",
+			http.MethodGet,
+			"/sign/videos/video/video1_720p.mp4?method=DELETE",
+			http.StatusBadRequest,
+			"",
+		},
+		{
+			"method not allowed",
+			http.MethodPost,
+			"/sign/videos/video/video1_720p.mp4",
+			http.StatusMethodNotAllowed,
+			"",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.testCase, func(t *testing.T) {
+			req, _ := http.NewRequest(test.method, addr+test.path, nil)
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != test.expectedStatus {
+				t.Fatalf("wrong status code\nwant %d\ngot  %d", test.expectedStatus, resp.StatusCode)
+			}
+			if resp.StatusCode == http.StatusFound {
+				if location := resp.Header.Get("Location"); !strings.HasPrefix(location, "https://storage.googleapis.com/my-bucket/videos/video/video1_720p.mp4?") {
+					t.Errorf("wrong location: %q", location)
+				}
+			}
+			if test.expectedMethod == "" {
+				return
+			}
+			var signed signedObjectURL
+			if err = json.NewDecoder(resp.Body).Decode(&signed); err != nil {
+				t.Fatal(err)
+			}
+			if signed.Method != test.expectedMethod {
+				t.Errorf("wrong method\nwant %q\ngot  %q", test.expectedMethod, signed.Method)
+			}
+			if d := time.Until(signed.Expires); d < 59*time.Minute || d > time.Hour {
+				t.Errorf("wrong expiration: %s", d)
+			}
+		})
+	}
+}
+
+func TestSignedURLExpiration(t *testing.T) {
+	var tests = []struct {
+		url      string
+		expected time.Time
+	}{
+		{
+			"https://storage.googleapis.com/my-bucket/video.mp4?Expires=1520692212&GoogleAccessId=signer&Signature=abc",
+			time.Date(2018, time.March, 10, 14, 30, 12, 0, time.UTC),
+		},
+		{
+			"https://storage.googleapis.com/my-bucket/video.mp4?X-Goog-Date=20180310T143012Z&X-Goog-Expires=3600&X-Goog-Signature=abc",
+			time.Date(2018, time.March, 10, 15, 30, 12, 0, time.UTC),
+		},
+	}
+	for _, test := range tests {
+		expires, err := signedURLExpiration(test.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !expires.Equal(test.expected) {
+			t.Errorf("wrong expiration for %q\nwant %s\ngot  %s", test.url, test.expected, expires)
+		}
+	}
+	if _, err := signedURLExpiration("https://storage.googleapis.com/my-bucket/video.mp4"); err == nil {
+		t.Error("unexpected <nil> error for unsigned url")
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	redisTimeout  = time.Second
+	redisMaxConns = 16
+)
+
+// errRedisNil is returned for nil replies, such as GET on missing keys.
+var errRedisNil = errors.New("redis: nil")
+
+// redisClient is a minimal client for the Redis protocol (RESP), supporting
+// the commands used by the mapping cache. Connections are reused, up to
+// redisMaxConns idle connections.
+type redisClient struct {
+	addr     string
+	password string
+	conns    chan *redisConn
+}
+
+type redisConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func newRedisClient(addr, password string) *redisClient {
+	return &redisClient{addr: addr, password: password, conns: make(chan *redisConn, redisMaxConns)}
+}
+
+// do sends the given command and returns its reply: a string for simple
+// strings and bulk strings, or an int64 for integers.
+func (c *redisClient) do(ctx context.Context, args ...string) (interface{}, error) {
+	conn, err := c.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok || time.Until(deadline) > redisTimeout {
+		deadline = time.Now().Add(redisTimeout)
+	}
+	conn.SetDeadline(deadline)
+	reply, err := conn.do(args...)
+	if err != nil {
+		if _, ok := err.(redisError); !ok && err != errRedisNil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	c.release(conn)
+	return reply, err
+}
+
+func (c *redisClient) conn(ctx context.Context) (*redisConn, error) {
+	select {
+	case conn := <-c.conns:
+		return conn, nil
+	default:
+	}
+	dialer := net.Dialer{Timeout: redisTimeout}
+	netConn, err := dialer.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return nil, err
+	}
+	conn := &redisConn{Conn: netConn, reader: bufio.NewReader(netConn)}
+	if c.password != "" {
+		conn.SetDeadline(time.Now().Add(redisTimeout))
+		if _, err = conn.do("AUTH", c.password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (c *redisClient) release(conn *redisConn) {
+	select {
+	case c.conns <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+// redisError is an error reply sent by the server.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+func (c *redisConn) do(args ...string) (interface{}, error) {
+	var cmd strings.Builder
+	fmt.Fprintf(&cmd, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&cmd, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(c, cmd.String()); err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+func (c *redisConn) readReply() (interface{}, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			return nil, errRedisNil
+		}
+		data := make([]byte, size+2)
+		if _, err = io.ReadFull(c.reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:size]), nil
+	}
+	return nil, fmt.Errorf("redis: unsupported reply %q", line)
+}
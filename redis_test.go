@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is a Redis server that supports the commands used by
+// redisClient, storing values in memory.
+type fakeRedis struct {
+	listener net.Listener
+	password string
+
+	mu       sync.Mutex
+	values   map[string]string
+	ttls     map[string]string
+	commands []string
+}
+
+func startFakeRedis(t *testing.T, password string) *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := fakeRedis{
+		listener: listener,
+		password: password,
+		values:   make(map[string]string),
+		ttls:     make(map[string]string),
+	}
+	go r.serve()
+	return &r
+}
+
+func (r *fakeRedis) addr() string {
+	return r.listener.Addr().String()
+}
+
+func (r *fakeRedis) stop() {
+	r.listener.Close()
+}
+
+func (r *fakeRedis) serve() {
+	for {
+		conn, err := r.listener.Accept()
+		if err != nil {
+			return
+		}
+		go r.handle(conn)
+	}
+}
+
+func (r *fakeRedis) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	authenticated := r.password == ""
+	for {
+		args, err := readFakeRedisCommand(reader)
+		if err != nil {
+			return
+		}
+		r.mu.Lock()
+		r.commands = append(r.commands, strings.ToUpper(args[0]))
+		r.mu.Unlock()
+		switch cmd := strings.ToUpper(args[0]); {
+		case cmd == "AUTH":
+			if args[1] != r.password {
+				io.WriteString(conn, "-WRONGPASS invalid password\r\n")
+				continue
+			}
+			authenticated = true
+			io.WriteString(conn, "+OK\r\n")
+		case !authenticated:
+			io.WriteString(conn, "-NOAUTH Authentication required.\r\n")
+		case cmd == "PING":
+			io.WriteString(conn, "+PONG\r\n")
+		case cmd == "GET":
+			r.mu.Lock()
+			value, ok := r.values[args[1]]
+			r.mu.Unlock()
+			if !ok {
+				io.WriteString(conn, "$-1\r\n")
+				continue
+			}
+			fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(value), value)
+		case cmd == "SET":
+			r.mu.Lock()
+			r.values[args[1]] = args[2]
+			if len(args) == 5 {
+				r.ttls[args[1]] = args[4]
+			}
+			r.mu.Unlock()
+			io.WriteString(conn, "+OK\r\n")
+		default:
+			fmt.Fprintf(conn, "-ERR unknown command '%s'\r\n", args[0])
+		}
+	}
+}
+
+func readFakeRedisCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line)[1:])
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		header, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(header)[1:])
+		if err != nil {
+			return nil, err
+		}
+		arg := make([]byte, size+2)
+		if _, err = io.ReadFull(reader, arg); err != nil {
+			return nil, err
+		}
+		args[i] = string(arg[:size])
+	}
+	return args, nil
+}
+
+func TestRedisClient(t *testing.T) {
+	server := startFakeRedis(t, "secret")
+	defer server.stop()
+	client := newRedisClient(server.addr(), "secret")
+	ctx := context.Background()
+	if _, err := client.do(ctx, "GET", "missing"); err != errRedisNil {
+		t.Errorf("wrong error\nwant %v\ngot  %v", errRedisNil, err)
+	}
+	if _, err := client.do(ctx, "SET", "key", "some\r\nvalue"); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := client.do(ctx, "GET", "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply != "some\r\nvalue" {
+		t.Errorf("wrong reply\nwant %q\ngot  %q", "some\r\nvalue", reply)
+	}
+	if _, err = client.do(ctx, "FLUSHALL"); err == nil {
+		t.Error("unexpected <nil> error")
+	}
+	// the connection is reused, so AUTH is sent only once.
+	server.mu.Lock()
+	commands := strings.Join(server.commands, ",")
+	server.mu.Unlock()
+	if commands != "AUTH,GET,SET,GET,FLUSHALL" {
+		t.Errorf("wrong commands\nwant %q\ngot  %q", "AUTH,GET,SET,GET,FLUSHALL", commands)
+	}
+}
+
+func TestRedisClientWrongPassword(t *testing.T) {
+	server := startFakeRedis(t, "secret")
+	defer server.stop()
+	client := newRedisClient(server.addr(), "wrong")
+	if _, err := client.do(context.Background(), "GET", "key"); err == nil {
+		t.Error("unexpected <nil> error")
+	}
+}
+
+func TestRedisMappingCache(t *testing.T) {
+	server := startFakeRedis(t, "")
+	defer server.stop()
+	cache := newMappingCache(Config{
+		MapCacheBackend:        mapCacheRedis,
+		MapCacheRedisAddr:      server.addr(),
+		MapCacheRedisKeyPrefix: "vod:",
+		MapCacheTTL:            time.Minute,
+	})
+	ctx := context.Background()
+	if _, ok := cache.get(ctx, "videos/video"); ok {
+		t.Error("unexpected cached mapping")
+	}
+	m := mapping{Sequences: []sequence{{Clips: []clip{{Type: "source", Path: "/my-bucket/videos/video_720p.mp4"}}}}}
+	m.etag = mappingETag(m)
+	cache.set(ctx, "videos/video", m, time.Minute)
+	got, ok := cache.get(ctx, "videos/video")
+	if !ok {
+		t.Fatal("mapping not cached")
+	}
+	if len(got.Sequences) != 1 || got.Sequences[0].Clips[0].Path != "/my-bucket/videos/video_720p.mp4" {
+		t.Errorf("wrong cached mapping: %#v", got)
+	}
+	if got.etag != m.etag {
+		t.Errorf("wrong etag\nwant %q\ngot  %q", m.etag, got.etag)
+	}
+	server.mu.Lock()
+	ttl := server.ttls["vod:videos/video"]
+	server.mu.Unlock()
+	if ttl != "60000" {
+		t.Errorf("wrong ttl\nwant %q\ngot  %q", "60000", ttl)
+	}
+}
+
+func TestRedisMappingCacheUnavailable(t *testing.T) {
+	server := startFakeRedis(t, "")
+	addr := server.addr()
+	server.stop()
+	cache := newMappingCache(Config{
+		MapCacheBackend:   mapCacheRedis,
+		MapCacheRedisAddr: addr,
+		MapCacheTTL:       time.Minute,
+		LogLevel:          "panic",
+	})
+	ctx := context.Background()
+	cache.set(ctx, "videos/video", mapping{}, time.Minute)
+	if _, ok := cache.get(ctx, "videos/video"); ok {
+		t.Error("unexpected cached mapping")
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// reloadableHandler serves requests with the handler built from the last
+// loaded configuration. Reloading the configuration builds a new handler,
+// while requests in flight are completed by the handler that accepted them,
+// so long-running streams aren't interrupted.
+type reloadableHandler struct {
+	load  func() (Config, error)
+	build func(Config) http.Handler
+
+	// updateMu serializes the updates of the configuration (reloads,
+	// signing key replacements and bucket switches), so they don't
+	// overwrite each other's changes.
+	updateMu sync.Mutex
+
+	mu      sync.RWMutex
+	config  Config
+	handler http.Handler
+}
+
+// newReloadableHandler returns a handler that serves requests with the
+// handler built from the given configuration, and reloads the configuration
+// with load.
+func newReloadableHandler(c Config, load func() (Config, error), build func(Config) http.Handler) *reloadableHandler {
+	h := &reloadableHandler{load: load, build: build}
+	h.setConfig(c)
+	return h
+}
+
+func (h *reloadableHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.RLock()
+	handler := h.handler
+	h.mu.RUnlock()
+	handler.ServeHTTP(w, r)
+}
+
+func (h *reloadableHandler) setConfig(c Config) {
+	c.reload = h.reload
+	c.setSigningKey = h.setSigningKey
+	c.switchBucket = h.switchBucket
+	handler := h.build(c)
+	h.mu.Lock()
+	h.config = c
+	h.handler = handler
+	h.mu.Unlock()
+}
+
+// reload loads the configuration again and replaces the handler. The
+// settings used when starting the server (see keepStartupSettings) are kept,
+// and the current configuration remains in use when the new one is invalid.
+func (h *reloadableHandler) reload() error {
+	h.updateMu.Lock()
+	defer h.updateMu.Unlock()
+	c, err := h.load()
+	if err != nil {
+		return err
+	}
+	h.mu.RLock()
+	current := h.config
+	h.mu.RUnlock()
+	ignored := keepStartupSettings(current, &c)
+	c.useCandidate = current.useCandidate
+	if err = signingSelfTest(c); err != nil {
+		return err
+	}
+	logger := c.logger()
+	if len(ignored) > 0 {
+		logger.WithField("settings", ignored).Warn("settings can't be changed without restarting, ignoring")
+	}
+	c.warnStrictProblems(logger)
+	h.setConfig(c)
+	logger.Info("configuration reloaded")
+	return nil
+}
+
+// setSigningKey replaces the signing key of the current configuration (and
+// any keys in GCS_HELPER_SIGN_KEYS) with the given key, after checking that
+// it can sign URLs. The key is used until the configuration is reloaded or
+// the server is restarted, so the configured key should be updated as well.
+func (h *reloadableHandler) setSigningKey(key SigningKey) error {
+	if err := checkPrivateKey(key.PrivateKey); err != nil {
+		return fmt.Errorf("invalid private key: %v", err)
+	}
+	h.updateMu.Lock()
+	defer h.updateMu.Unlock()
+	h.mu.RLock()
+	c := h.config
+	h.mu.RUnlock()
+	c.SignConfig.GoogleAccessID = key.GoogleAccessID
+	c.SignConfig.PrivateKey = key.PrivateKey
+	c.SignConfig.Keys = nil
+	c.SignConfig.parseKeys()
+	if err := signingSelfTest(c); err != nil {
+		return err
+	}
+	h.setConfig(c)
+	c.logger().WithFields(logrus.Fields{
+		"googleAccessID": key.GoogleAccessID,
+		"fingerprint":    keyFingerprint(key.PrivateKey),
+	}).Info("signing key replaced")
+	return nil
+}
+
+// switchBucket switches traffic to GCS_HELPER_CANDIDATE_BUCKET_NAME, or back
+// to GCS_HELPER_BUCKET_NAME. The selection is kept when the configuration is
+// reloaded, but not when the server is restarted. Like reloading, switching
+// replaces the handler, so requests in flight are completed with the bucket
+// that accepted them.
+func (h *reloadableHandler) switchBucket(candidate bool) (bucketStatus, error) {
+	h.updateMu.Lock()
+	defer h.updateMu.Unlock()
+	h.mu.RLock()
+	c := h.config
+	h.mu.RUnlock()
+	if candidate && c.CandidateBucketName == "" {
+		return bucketStatus{}, errNoCandidateBucket
+	}
+	c.useCandidate = candidate
+	h.setConfig(c)
+	status := newBucketStatus(c.withActiveBucket())
+	c.logger().WithFields(logrus.Fields{"active": status.Active, "bucket": status.BucketName}).Info("switched bucket")
+	return status, nil
+}
+
+// reloadOnSignal reloads the configuration whenever a signal is received,
+// until the channel is closed.
+func (h *reloadableHandler) reloadOnSignal(signals <-chan os.Signal, logger *logrus.Logger) {
+	for range signals {
+		if err := h.reload(); err != nil {
+			logger.WithError(err).Error("failed to reload configuration")
+		}
+	}
+}
+
+// keepStartupSettings copies the settings that are only used when starting
+// the server from the current configuration to the reloaded one, returning
+// the names of the settings that changed.
+func keepStartupSettings(current Config, c *Config) []string {
+	var ignored []string
+	if c.Listen != current.Listen {
+		ignored = append(ignored, "GCS_HELPER_LISTEN")
+		c.Listen = current.Listen
+	}
+	if c.ClientConfig.Endpoint != current.ClientConfig.Endpoint {
+		ignored = append(ignored, "GCS_HELPER_STORAGE_ENDPOINT")
+		c.ClientConfig.Endpoint = current.ClientConfig.Endpoint
+	}
+	if c.ClientConfig != current.ClientConfig {
+		ignored = append(ignored, "GCS_CLIENT_*")
+		c.ClientConfig = current.ClientConfig
+	}
+	if c.ServerConfig != current.ServerConfig {
+		ignored = append(ignored, "GCS_HELPER_SERVER_*")
+		c.ServerConfig = current.ServerConfig
+	}
+	if !reflect.DeepEqual(c.TLSConfig, current.TLSConfig) {
+		ignored = append(ignored, "GCS_HELPER_TLS_*")
+		c.TLSConfig = current.TLSConfig
+	}
+	if c.SignConfig.Mode != current.SignConfig.Mode {
+		ignored = append(ignored, "GCS_HELPER_SIGN_MODE")
+		c.SignConfig.Mode = current.SignConfig.Mode
+	}
+	if c.SignConfig.PrivateKeySecret != current.SignConfig.PrivateKeySecret || c.SignConfig.PrivateKeySecretRefresh != current.SignConfig.PrivateKeySecretRefresh {
+		ignored = append(ignored, "GCS_HELPER_SIGN_PRIVATE_KEY_SECRET")
+		c.SignConfig.PrivateKeySecret = current.SignConfig.PrivateKeySecret
+		c.SignConfig.PrivateKeySecretRefresh = current.SignConfig.PrivateKeySecretRefresh
+	}
+	if c.TraceConfig.OTLPEndpoint != current.TraceConfig.OTLPEndpoint || c.TraceConfig.CloudProject != current.TraceConfig.CloudProject || c.TraceConfig.SampleRatio != current.TraceConfig.SampleRatio {
+		ignored = append(ignored, "GCS_HELPER_TRACE_*")
+	}
+	c.TraceConfig = current.TraceConfig
+	if c.AuditConfig.File != current.AuditConfig.File || c.AuditConfig.PubSubTopic != current.AuditConfig.PubSubTopic || c.AuditConfig.BigQueryTable != current.AuditConfig.BigQueryTable {
+		ignored = append(ignored, "GCS_HELPER_AUDIT_*")
+	}
+	c.AuditConfig = current.AuditConfig
+	c.SignConfig.iamClient = current.SignConfig.iamClient
+	c.SignConfig.privateKeySecret = current.SignConfig.privateKeySecret
+	return ignored
+}
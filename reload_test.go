@@ -0,0 +1,261 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/fsouza/fake-gcs-server/fakestorage"
+	"github.com/sirupsen/logrus"
+)
+
+func bucketNameHandler(c Config) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(c.BucketName))
+	})
+}
+
+func serveBody(t *testing.T, h http.Handler) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	return w.Body.String()
+}
+
+func TestReloadableHandler(t *testing.T) {
+	next := Config{BucketName: "new-bucket", Listen: ":9090", LogLevel: "error"}
+	var loadErr error
+	h := newReloadableHandler(Config{BucketName: "old-bucket", Listen: ":8080", LogLevel: "error"}, func() (Config, error) {
+		return next, loadErr
+	}, bucketNameHandler)
+	if body := serveBody(t, h); body != "old-bucket" {
+		t.Errorf("wrong body before reload\nwant %q\ngot  %q", "old-bucket", body)
+	}
+	if err := h.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if body := serveBody(t, h); body != "new-bucket" {
+		t.Errorf("wrong body after reload\nwant %q\ngot  %q", "new-bucket", body)
+	}
+	if h.config.Listen != ":8080" {
+		t.Errorf("listen address shouldn't change on reload\nwant %q\ngot  %q", ":8080", h.config.Listen)
+	}
+	if h.config.reload == nil {
+		t.Error("reload should be set in the configuration")
+	}
+
+	loadErr = errors.New("invalid GCS_HELPER_MAP_REGEX_FILTER")
+	next.BucketName = "broken-bucket"
+	if err := h.reload(); err != loadErr {
+		t.Errorf("wrong error\nwant %v\ngot  %v", loadErr, err)
+	}
+	if body := serveBody(t, h); body != "new-bucket" {
+		t.Errorf("configuration shouldn't change on failed reload\nwant %q\ngot  %q", "new-bucket", body)
+	}
+}
+
+func TestReloadOnSignal(t *testing.T) {
+	var loads int
+	h := newReloadableHandler(Config{BucketName: "old-bucket", LogLevel: "error"}, func() (Config, error) {
+		loads++
+		if loads > 1 {
+			return Config{}, errors.New("failed")
+		}
+		return Config{BucketName: "new-bucket", LogLevel: "error"}, nil
+	}, bucketNameHandler)
+	signals := make(chan os.Signal, 2)
+	signals <- os.Interrupt
+	signals <- os.Interrupt
+	close(signals)
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	h.reloadOnSignal(signals, logger)
+	if loads != 2 {
+		t.Errorf("wrong number of reloads\nwant 2\ngot  %d", loads)
+	}
+	if body := serveBody(t, h); body != "new-bucket" {
+		t.Errorf("wrong body after reload\nwant %q\ngot  %q", "new-bucket", body)
+	}
+}
+
+func TestReloadableHandlerConcurrentUpdates(t *testing.T) {
+	signConfig := testSignConfig(t)
+	key := SigningKey{GoogleAccessID: "new@project.iam.gserviceaccount.com", PrivateKey: signConfig.PrivateKey}
+	building := make(chan struct{})
+	release := make(chan struct{})
+	h := newReloadableHandler(Config{
+		BucketName:          "my-bucket",
+		CandidateBucketName: "my-new-bucket",
+		LogLevel:            "error",
+		SignConfig:          signConfig,
+	}, nil, func(c Config) http.Handler {
+		if c.useCandidate && c.SignConfig.GoogleAccessID != key.GoogleAccessID {
+			// the switch is in progress until it's released.
+			close(building)
+			<-release
+		}
+		return bucketNameHandler(c)
+	})
+	switched := make(chan error)
+	go func() {
+		_, err := h.switchBucket(true)
+		switched <- err
+	}()
+	<-building
+	keySet := make(chan error, 1)
+	go func() {
+		keySet <- h.setSigningKey(key)
+	}()
+	// the key can only be replaced after the switch completes.
+	select {
+	case err := <-keySet:
+		t.Errorf("the signing key was replaced during the switch (%v)", err)
+		close(release)
+	case <-time.After(50 * time.Millisecond):
+		close(release)
+		if err := <-keySet; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := <-switched; err != nil {
+		t.Fatal(err)
+	}
+	if !h.config.useCandidate || h.config.SignConfig.GoogleAccessID != key.GoogleAccessID {
+		t.Errorf("lost update: useCandidate=%v, googleAccessID=%q", h.config.useCandidate, h.config.SignConfig.GoogleAccessID)
+	}
+}
+
+func TestKeepStartupSettings(t *testing.T) {
+	current := Config{
+		Listen:       ":8080",
+		ClientConfig: ClientConfig{Timeout: time.Second},
+		ServerConfig: ServerConfig{IdleTimeout: time.Minute},
+		TLSConfig:    TLSConfig{Cert: "cert.pem", Key: "key.pem"},
+		SignConfig:   SignConfig{Mode: signModeIAM, iamClient: http.DefaultClient},
+	}
+	c := Config{
+		Listen:       ":9090",
+		ClientConfig: ClientConfig{Timeout: time.Minute},
+		ServerConfig: ServerConfig{IdleTimeout: time.Hour},
+		TLSConfig:    TLSConfig{Cert: "new-cert.pem", Key: "new-key.pem"},
+		SignConfig:   SignConfig{Mode: "key", Expiration: time.Hour},
+	}
+	ignored := keepStartupSettings(current, &c)
+	expected := []string{"GCS_HELPER_LISTEN", "GCS_CLIENT_*", "GCS_HELPER_SERVER_*", "GCS_HELPER_TLS_*", "GCS_HELPER_SIGN_MODE"}
+	if len(ignored) != len(expected) {
+		t.Fatalf("wrong ignored settings\nwant %v\ngot  %v", expected, ignored)
+	}
+	for i := range expected {
+		if ignored[i] != expected[i] {
+			t.Errorf("wrong ignored settings\nwant %v\ngot  %v", expected, ignored)
+		}
+	}
+	if c.Listen != ":8080" || c.ClientConfig.Timeout != time.Second || c.ServerConfig.IdleTimeout != time.Minute || c.TLSConfig.Cert != "cert.pem" || c.SignConfig.Mode != signModeIAM {
+		t.Errorf("startup settings should be kept, got %#v", c)
+	}
+	if c.SignConfig.iamClient != http.DefaultClient {
+		t.Error("iam client should be kept")
+	}
+	if c.SignConfig.Expiration != time.Hour {
+		t.Errorf("reloadable settings should change\nwant %s\ngot  %s", time.Hour, c.SignConfig.Expiration)
+	}
+}
+
+func TestServerAdminReload(t *testing.T) {
+	server := fakestorage.NewServer(getObjects())
+	defer server.Stop()
+	config := Config{
+		BucketName:   "my-bucket",
+		LogLevel:     "error",
+		AdminPrefix:  "/admin/",
+		AdminToken:   "admin-secret",
+		ProxyPrefix:  "/proxy/",
+		MapPrefix:    "/map/",
+		ProxyTimeout: time.Second,
+	}
+	var loadErr error
+	handler := newReloadableHandler(config, func() (Config, error) {
+		c := config
+		c.ProxyPrefix = "/files/"
+		return c, loadErr
+	}, func(c Config) http.Handler {
+		return getHandler(c, server.Client(), fakeHTTPClient(server))
+	})
+	httpServer := httptest.NewServer(handler)
+	defer httpServer.Close()
+	addr := httpServer.URL
+	auth := http.Header{"Authorization": []string{"Bearer admin-secret"}}
+	var tests = []serverTest{
+		{
+			testCase:       "before reload",
+			method:         http.MethodGet,
+			addr:           addr + "/files/musics/music/music1.txt",
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			testCase:       "wrong method",
+			method:         http.MethodGet,
+			addr:           addr + "/admin/reload",
+			reqHeader:      auth,
+			expectedStatus: http.StatusMethodNotAllowed,
+		},
+		{
+			testCase:       "missing token",
+			method:         http.MethodPost,
+			addr:           addr + "/admin/reload",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			testCase:       "reload",
+			method:         http.MethodPost,
+			addr:           addr + "/admin/reload",
+			reqHeader:      auth,
+			expectedStatus: http.StatusNoContent,
+		},
+		{
+			testCase:       "after reload",
+			method:         http.MethodGet,
+			addr:           addr + "/files/musics/music/music1.txt",
+			expectedStatus: http.StatusOK,
+			expectedBody:   "some nice music",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.testCase, test.run)
+	}
+
+	loadErr = errors.New("invalid GCS_HELPER_MAP_REGEX_FILTER")
+	test := serverTest{
+		testCase:       "failed reload",
+		method:         http.MethodPost,
+		addr:           addr + "/admin/reload",
+		reqHeader:      auth,
+		expectedStatus: http.StatusInternalServerError,
+		expectedBody:   "failed to reload configuration: invalid GCS_HELPER_MAP_REGEX_FILTER\n",
+	}
+	t.Run(test.testCase, test.run)
+}
+
+func TestServerAdminReloadNotSupported(t *testing.T) {
+	addr, cleanup := startServer(t, Config{
+		BucketName:  "my-bucket",
+		LogLevel:    "error",
+		AdminPrefix: "/admin/",
+		AdminToken:  "admin-secret",
+		ProxyPrefix: "/proxy/",
+	})
+	defer cleanup()
+	test := serverTest{
+		testCase:       "reload",
+		method:         http.MethodPost,
+		addr:           addr + "/admin/reload",
+		reqHeader:      http.Header{"Authorization": []string{"Bearer admin-secret"}},
+		expectedStatus: http.StatusNotImplemented,
+		expectedBody:   "reloading isn't supported\n",
+	}
+	test.run(t)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	requestIDHeader    = "X-Request-ID"
+	maxRequestIDLength = 128
+)
+
+type requestIDKey struct{}
+
+// requestIDHandler wraps the given handler, identifying every request with
+// the ID in its X-Request-ID header, set by clients or load balancers, or a
+// new random ID when it's missing or invalid. The ID is returned in the
+// X-Request-ID header of the response, and added to the logs of the request
+// (see requestLogger), along with the trace sent by the client, if any.
+func requestIDHandler(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		ctx := context.WithValue(r.Context(), requestIDKey{}, id)
+		handler(w, r.WithContext(contextWithRemoteSpan(ctx, r)))
+	}
+}
+
+// validRequestID reports whether the given ID can be used as is, which is
+// when it's not too long and only contains visible ASCII characters, so it
+// can't be used for injecting content in logs.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// requestIDFromContext returns the ID of the request of the given context,
+// or an empty string.
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestLogger returns an entry of the given logger with the ID of the
+// request of the given context, so all the logs of a request can be
+// correlated, and with its trace, if any.
+func requestLogger(ctx context.Context, logger *logrus.Logger) *logrus.Entry {
+	entry := logrus.NewEntry(logger)
+	if id := requestIDFromContext(ctx); id != "" {
+		entry = entry.WithField("requestId", id)
+	}
+	if fields := traceLogFields(ctx); fields != nil {
+		entry = entry.WithFields(fields)
+	}
+	return entry
+}
+
+// detachedContext returns a context that isn't canceled with the given
+// context, but keeps its request ID and trace, for requests to GCS that
+// outlive the request that started them or have their own timeout.
+func detachedContext(ctx context.Context) context.Context {
+	detached := contextWithSpan(context.Background(), spanFromContext(ctx))
+	if id := requestIDFromContext(ctx); id != "" {
+		detached = context.WithValue(detached, requestIDKey{}, id)
+	}
+	if sc, ok := ctx.Value(remoteSpanKey{}).(spanContext); ok {
+		detached = context.WithValue(detached, remoteSpanKey{}, sc)
+	}
+	return detached
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestRequestIDHandler(t *testing.T) {
+	var tests = []struct {
+		testCase string
+		header   string
+		keep     bool
+	}{
+		{"no header", "", false},
+		{"valid header", "a1b2-c3d4:e5f6", true},
+		{"too long", strings.Repeat("a", maxRequestIDLength+1), false},
+		{"spaces", "some request", false},
+		{"control characters", "id\nlevel=error", false},
+	}
+	for _, test := range tests {
+		t.Run(test.testCase, func(t *testing.T) {
+			var got string
+			handler := requestIDHandler(func(w http.ResponseWriter, r *http.Request) {
+				got = requestIDFromContext(r.Context())
+			})
+			req := httptest.NewRequest(http.MethodGet, "/map/videos/", nil)
+			if test.header != "" {
+				req.Header.Set("X-Request-ID", test.header)
+			}
+			w := httptest.NewRecorder()
+			handler(w, req)
+			if w.Header().Get("X-Request-ID") != got {
+				t.Errorf("wrong response header\nwant %q\ngot  %q", got, w.Header().Get("X-Request-ID"))
+			}
+			if test.keep && got != test.header {
+				t.Errorf("wrong request id\nwant %q\ngot  %q", test.header, got)
+			}
+			if !test.keep && (got == test.header || len(got) != 32) {
+				t.Errorf("a new request id should be generated, got %q", got)
+			}
+		})
+	}
+}
+
+func TestRequestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := logrus.New()
+	logger.Out = &buf
+	handler := requestIDHandler(func(w http.ResponseWriter, r *http.Request) {
+		// logs of requests made for other requests, like the listings
+		// shared by concurrent map requests, keep the request id.
+		requestLogger(detachedContext(r.Context()), logger).Error("failed to probe mp4 duration")
+	})
+	req := httptest.NewRequest(http.MethodGet, "/map/videos/", nil)
+	req.Header.Set("X-Request-ID", "some-request")
+	handler(httptest.NewRecorder(), req)
+	if !strings.Contains(buf.String(), "requestId=some-request") {
+		t.Errorf("missing request id in log %q", buf.String())
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+// Delays used between retries of GCS requests: the delay doubles after each
+// attempt, up to maxRetryDelay, and a random delay between zero and that
+// value is used (full jitter).
+var (
+	minRetryDelay = 100 * time.Millisecond
+	maxRetryDelay = 2 * time.Second
+)
+
+// retryDelay returns the delay before the given retry (starting at 0).
+func retryDelay(attempt int) time.Duration {
+	delay := maxRetryDelay
+	if attempt < 16 {
+		if d := minRetryDelay << uint(attempt); d < maxRetryDelay {
+			delay = d
+		}
+	}
+	return time.Duration(rand.Int63n(int64(delay) + 1))
+}
+
+// waitRetry waits before the given retry, returning false if the context is
+// done first.
+func waitRetry(ctx context.Context, attempt int) bool {
+	timer := time.NewTimer(retryDelay(attempt))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// retryable reports whether the given GCS error is transient, and the
+// request that caused it should be retried. Errors returned by the API are
+// only retried for rate limiting and server errors, while other errors (such
+// as network errors) are always retried.
+func retryable(err error) bool {
+	switch err {
+	case context.Canceled, context.DeadlineExceeded, storage.ErrBucketNotExist, storage.ErrObjectNotExist:
+		return false
+	}
+	if apiErr, ok := err.(*googleapi.Error); ok {
+		return apiErr.Code == http.StatusTooManyRequests || apiErr.Code >= http.StatusInternalServerError
+	}
+	return true
+}
+
+// errorStatus returns the HTTP status that should be used for responding
+// to requests that failed with the given GCS error.
+func errorStatus(err error) int {
+	switch err {
+	case storage.ErrBucketNotExist, storage.ErrObjectNotExist:
+		return http.StatusNotFound
+	case context.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case errTooManyPrefixes:
+		return http.StatusBadRequest
+	}
+	if apiErr, ok := err.(*googleapi.Error); ok && apiErr.Code >= http.StatusBadRequest {
+		return apiErr.Code
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+func TestRetryDelay(t *testing.T) {
+	for attempt := 0; attempt < 40; attempt++ {
+		limit := maxRetryDelay
+		if attempt < 4 {
+			limit = minRetryDelay << uint(attempt)
+		}
+		if delay := retryDelay(attempt); delay < 0 || delay > limit {
+			t.Errorf("attempt %d: delay %s out of range [0, %s]", attempt, delay, limit)
+		}
+	}
+}
+
+func TestWaitRetryCanceledContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Now()
+	if waitRetry(ctx, 10) {
+		t.Error("unexpected wait with canceled context")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("waited for %s with canceled context", elapsed)
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	var tests = []struct {
+		err      error
+		expected bool
+	}{
+		{&googleapi.Error{Code: http.StatusInternalServerError}, true},
+		{&googleapi.Error{Code: http.StatusServiceUnavailable}, true},
+		{&googleapi.Error{Code: http.StatusTooManyRequests}, true},
+		{&googleapi.Error{Code: http.StatusForbidden}, false},
+		{&googleapi.Error{Code: http.StatusNotFound}, false},
+		{storage.ErrBucketNotExist, false},
+		{context.Canceled, false},
+		{context.DeadlineExceeded, false},
+		{errors.New("connection reset by peer"), true},
+	}
+	for _, test := range tests {
+		if got := retryable(test.err); got != test.expected {
+			t.Errorf("%v: wrong result\nwant %v\ngot  %v", test.err, test.expected, got)
+		}
+	}
+}
+
+func TestErrorStatus(t *testing.T) {
+	var tests = []struct {
+		err      error
+		expected int
+	}{
+		{&googleapi.Error{Code: http.StatusForbidden}, http.StatusForbidden},
+		{&googleapi.Error{Code: http.StatusServiceUnavailable}, http.StatusServiceUnavailable},
+		{storage.ErrBucketNotExist, http.StatusNotFound},
+		{context.DeadlineExceeded, http.StatusGatewayTimeout},
+		{errTooManyPrefixes, http.StatusBadRequest},
+		{errors.New("connection reset by peer"), http.StatusInternalServerError},
+	}
+	for _, test := range tests {
+		if got := errorStatus(test.err); got != test.expected {
+			t.Errorf("%v: wrong status\nwant %d\ngot  %d", test.err, test.expected, got)
+		}
+	}
+}
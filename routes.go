@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/kelseyhightower/envconfig"
+)
+
+const routeEnvPrefix = "GCS_HELPER_ROUTE_"
+
+var routeNameRegexp = regexp.MustCompile(`^[a-z0-9]+$`)
+
+// route is a named configuration, listed in GCS_HELPER_ROUTES, that serves
+// the requests under its path (or selected by GCS_HELPER_TENANT_HEADER), so
+// one deployment can serve several buckets or tenants, each with its own
+// filters, signer and rate limit.
+//
+// The configuration of a route is the default configuration with the
+// variables of its namespace applied on top of it: GCS_HELPER_ROUTE_VOD_*
+// for the "vod" route, like GCS_HELPER_ROUTE_VOD_BUCKET_NAME or
+// GCS_HELPER_ROUTE_VOD_MAP_REGEX_FILTER. Its path is set by
+// GCS_HELPER_ROUTE_VOD_PATH, and defaults to /vod/. The path is removed from
+// the requests before they're handled, so /vod/map/movie/ is a map request
+// with the prefix of the route set to /map/.
+type route struct {
+	name   string
+	path   string
+	config Config
+}
+
+// routeStartupSettings are the variables that can't be set for a route, as
+// they're shared by all routes: the ones only used when starting the server
+// (see keepStartupSettings) and the ones that select the route.
+var routeStartupSettings = []string{
+	"GCS_HELPER_LISTEN",
+	"GCS_HELPER_ROUTES",
+	"GCS_HELPER_TENANT_HEADER",
+	"GCS_HELPER_SIGN_MODE",
+	"GCS_HELPER_SIGN_PRIVATE_KEY_SECRET",
+	"GCS_HELPER_SIGN_PRIVATE_KEY_SECRET_REFRESH",
+	"GCS_CLIENT_TIMEOUT",
+	"GCS_CLIENT_IDLE_CONN_TIMEOUT",
+	"GCS_CLIENT_MAX_IDLE_CONNS",
+	"GCS_CLIENT_DIAL_TIMEOUT",
+	"GCS_CLIENT_TLS_HANDSHAKE_TIMEOUT",
+	"GCS_CLIENT_PROXY",
+	"GCS_CLIENT_CA_FILE",
+	"GCS_CLIENT_USER_AGENT",
+	"GCS_HELPER_QUOTA_PROJECT",
+	"GCS_HELPER_STORAGE_ENDPOINT",
+	"GCS_HELPER_TRACE_OTLP_ENDPOINT",
+	"GCS_HELPER_TRACE_CLOUD_PROJECT",
+	"GCS_HELPER_TRACE_SAMPLE_RATIO",
+	"GCS_HELPER_SERVER_READ_HEADER_TIMEOUT",
+	"GCS_HELPER_SERVER_READ_TIMEOUT",
+	"GCS_HELPER_SERVER_WRITE_TIMEOUT",
+	"GCS_HELPER_SERVER_IDLE_TIMEOUT",
+	"GCS_HELPER_SERVER_MAX_HEADER_BYTES",
+}
+
+// loadRoutes loads the configuration of the routes listed in
+// GCS_HELPER_ROUTES. The environment is restored after loading each route,
+// so routes don't affect each other.
+func loadRoutes(c Config) ([]route, error) {
+	if len(c.Routes) == 0 {
+		return nil, nil
+	}
+	vars, err := configVars()
+	if err != nil {
+		return nil, err
+	}
+	routes := make([]route, 0, len(c.Routes))
+	paths := make(map[string]string, len(c.Routes))
+	for _, name := range c.Routes {
+		if !routeNameRegexp.MatchString(name) {
+			return nil, fmt.Errorf("invalid GCS_HELPER_ROUTES entry %q: must contain only lower case letters and digits", name)
+		}
+		rt, err := loadRoute(name, vars)
+		if err != nil {
+			return nil, err
+		}
+		if other, ok := paths[rt.path]; ok {
+			return nil, fmt.Errorf("routes %q and %q can't use the same path %q", other, name, rt.path)
+		}
+		paths[rt.path] = name
+		routes = append(routes, rt)
+	}
+	return routes, nil
+}
+
+func loadRoute(name string, vars []configVar) (route, error) {
+	prefix := routeEnvPrefix + strings.ToUpper(name)
+	rt := route{name: name, path: "/" + name + "/"}
+	if path, ok := os.LookupEnv(prefix + "_PATH"); ok {
+		rt.path = path
+	}
+	if !strings.HasPrefix(rt.path, "/") || !strings.HasSuffix(rt.path, "/") || rt.path == "/" {
+		return rt, fmt.Errorf("invalid %s_PATH %q: must start and end with /", prefix, rt.path)
+	}
+	for _, name := range routeStartupSettings {
+		if _, ok := os.LookupEnv(prefixedConfigVar(prefix, name)); ok {
+			return rt, fmt.Errorf("%s can't be set for a route, as it's shared by all routes", prefixedConfigVar(prefix, name))
+		}
+	}
+	env := make(envOverlay)
+	defer env.restore()
+	for _, v := range vars {
+		if value, ok := os.LookupEnv(prefixedConfigVar(prefix, v.name)); ok {
+			if err := env.set(v.name, value); err != nil {
+				return rt, err
+			}
+			if err := env.unset(v.name + "_FILE"); err != nil {
+				return rt, err
+			}
+		}
+		if value, ok := os.LookupEnv(prefixedConfigVar(prefix, v.name+"_FILE")); ok {
+			if err := env.set(v.name+"_FILE", value); err != nil {
+				return rt, err
+			}
+			if err := env.unset(v.name); err != nil {
+				return rt, err
+			}
+		}
+	}
+	if err := envconfig.Process("gcs_helper", &rt.config); err != nil {
+		return rt, fmt.Errorf("route %q: %v", name, err)
+	}
+	if err := rt.config.loadSecretFiles(); err != nil {
+		return rt, fmt.Errorf("route %q: %v", name, err)
+	}
+	if err := rt.config.validate(); err != nil {
+		return rt, fmt.Errorf("route %q: %v", name, err)
+	}
+	rt.config.SignConfig.parseKeys()
+	rt.config.Routes = nil
+	// routes with their own bucket don't switch to the candidate bucket of
+	// the default configuration, nor send requests to its canary bucket.
+	if _, ok := os.LookupEnv(prefix + "_BUCKET_NAME"); ok {
+		if _, ok := os.LookupEnv(prefix + "_CANDIDATE_BUCKET_NAME"); !ok {
+			rt.config.CandidateBucketName = ""
+		}
+		if _, ok := os.LookupEnv(prefix + "_CANARY_BUCKET_NAME"); !ok {
+			rt.config.CanaryBucketName = ""
+		}
+	}
+	return rt, nil
+}
+
+// isRouteConfigVar returns whether the given name is a variable of a route,
+// like GCS_HELPER_ROUTE_VOD_BUCKET_NAME, given the names of the variables of
+// the default configuration.
+func isRouteConfigVar(names map[string]bool, name string) bool {
+	if !strings.HasPrefix(name, routeEnvPrefix) {
+		return false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(name, routeEnvPrefix), "_", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return false
+	}
+	v := strings.TrimSuffix(parts[1], "_FILE")
+	return parts[1] == "PATH" || names[defaultEnvPrefix+"_"+v] || names[v]
+}
+
+// routeConfig returns the configuration of the given route, with the state
+// set up on startup, which is shared by all routes.
+func (c Config) routeConfig(rt route) Config {
+	rc := rt.config
+	rc.Listen = c.Listen
+	rc.ClientConfig = c.ClientConfig
+	rc.ServerConfig = c.ServerConfig
+	rc.TLSConfig = c.TLSConfig
+	rc.SignConfig.Mode = c.SignConfig.Mode
+	rc.SignConfig.PrivateKeySecret = c.SignConfig.PrivateKeySecret
+	rc.SignConfig.PrivateKeySecretRefresh = c.SignConfig.PrivateKeySecretRefresh
+	rc.SignConfig.iamClient = c.SignConfig.iamClient
+	rc.SignConfig.privateKeySecret = c.SignConfig.privateKeySecret
+	rc.TraceConfig = c.TraceConfig
+	rc.AuditConfig = c.AuditConfig
+	rc.reload = c.reload
+	rc.useCandidate = c.useCandidate
+	return rc
+}
+
+// getRoutesHandler returns a handler that serves the requests under the path
+// of a route with the handler of the route, and the remaining requests with
+// the handler of the default configuration. When GCS_HELPER_TENANT_HEADER is
+// set, requests with the header are served by the route it names instead,
+// regardless of their path.
+func getRoutesHandler(c Config, client *storage.Client, hc *http.Client) http.HandlerFunc {
+	routes := c.routes
+	handlers := make([]http.HandlerFunc, len(routes))
+	byName := make(map[string]http.HandlerFunc, len(routes))
+	for i, rt := range routes {
+		handlers[i] = getHandler(c.routeConfig(rt), client, hc)
+		byName[rt.name] = handlers[i]
+	}
+	c.routes = nil
+	defaultHandler := getHandler(c, client, hc)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if c.TenantHeader != "" {
+			if tenant := r.Header.Get(c.TenantHeader); tenant != "" {
+				if handler, ok := byName[strings.ToLower(tenant)]; ok {
+					handler(w, r)
+				} else {
+					http.Error(w, "unknown tenant", http.StatusNotFound)
+				}
+				return
+			}
+		}
+		for i, rt := range routes {
+			if strings.HasPrefix(r.URL.Path, rt.path) {
+				r.URL.Path = "/" + strings.TrimPrefix(r.URL.Path, rt.path)
+				handlers[i](w, r)
+				return
+			}
+		}
+		defaultHandler(w, r)
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigRoutes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcs-helper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "key")
+	if err = ioutil.WriteFile(keyFile, []byte("live-key\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	setEnvs(map[string]string{
+		"GCS_HELPER_BUCKET_NAME":                      "default-bucket",
+		"GCS_HELPER_MAP_PREFIX":                       "/map/",
+		"GCS_HELPER_MAP_REGEX_FILTER":                 `\.mp4$`,
+		"GCS_HELPER_ROUTES":                           "vod,live",
+		"GCS_HELPER_ROUTE_VOD_BUCKET_NAME":            "vod-bucket",
+		"GCS_HELPER_ROUTE_LIVE_BUCKET_NAME":           "live-archive",
+		"GCS_HELPER_ROUTE_LIVE_PATH":                  "/archive/live/",
+		"GCS_HELPER_ROUTE_LIVE_MAP_REGEX_FILTER":      `\.ts$`,
+		"GCS_HELPER_ROUTE_LIVE_CDN_URL_PREFIX":        "https://cdn.example.com/",
+		"GCS_HELPER_ROUTE_LIVE_CDN_KEY_NAME":          "live",
+		"GCS_HELPER_ROUTE_LIVE_TOKEN_KEY_FILE":        keyFile,
+		"GCS_HELPER_ROUTE_LIVE_TOKEN_URL_PREFIX":      "https://edge.example.com/",
+		"GCS_HELPER_ROUTE_LIVE_CDN_KEY":               "nZtRohdNF9m3cKM24IcK4w==",
+		"GCS_HELPER_ROUTE_VOD_MAP_CACHE_NEGATIVE_TTL": "1s",
+	})
+	config, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.routes) != 2 {
+		t.Fatalf("wrong number of routes\nwant 2\ngot  %d", len(config.routes))
+	}
+	vod, live := config.routes[0], config.routes[1]
+	if vod.name != "vod" || vod.path != "/vod/" {
+		t.Errorf("wrong vod route\nwant %q at %q\ngot  %q at %q", "vod", "/vod/", vod.name, vod.path)
+	}
+	if live.name != "live" || live.path != "/archive/live/" {
+		t.Errorf("wrong live route\nwant %q at %q\ngot  %q at %q", "live", "/archive/live/", live.name, live.path)
+	}
+	if vod.config.BucketName != "vod-bucket" || live.config.BucketName != "live-archive" {
+		t.Errorf("wrong bucket names, got %q and %q", vod.config.BucketName, live.config.BucketName)
+	}
+	if vod.config.MapRegexFilter != `\.mp4$` {
+		t.Errorf("routes should inherit the default configuration\nwant %q\ngot  %q", `\.mp4$`, vod.config.MapRegexFilter)
+	}
+	if live.config.MapRegexFilter != `\.ts$` {
+		t.Errorf("wrong regex filter\nwant %q\ngot  %q", `\.ts$`, live.config.MapRegexFilter)
+	}
+	if live.config.TokenConfig.Key != "live-key" {
+		t.Errorf("wrong token key\nwant %q\ngot  %q", "live-key", live.config.TokenConfig.Key)
+	}
+	if config.BucketName != "default-bucket" || config.TokenConfig.Key != "" || config.CDNConfig.Key != "" {
+		t.Errorf("routes shouldn't affect the default configuration, got %#v", config)
+	}
+	if len(vod.config.Routes) > 0 || len(live.config.Routes) > 0 {
+		t.Error("routes shouldn't have routes")
+	}
+	if value, ok := os.LookupEnv("GCS_HELPER_TOKEN_KEY_FILE"); ok {
+		t.Errorf("the environment should be restored, got GCS_HELPER_TOKEN_KEY_FILE=%q", value)
+	}
+}
+
+func TestLoadConfigRoutesErrors(t *testing.T) {
+	var tests = []struct {
+		testCase string
+		envs     map[string]string
+		expected string
+	}{
+		{
+			"invalid name",
+			map[string]string{"GCS_HELPER_ROUTES": "video-on-demand"},
+			`invalid GCS_HELPER_ROUTES entry "video-on-demand": must contain only lower case letters and digits`,
+		},
+		{
+			"invalid path",
+			map[string]string{"GCS_HELPER_ROUTES": "vod", "GCS_HELPER_ROUTE_VOD_PATH": "/vod"},
+			`invalid GCS_HELPER_ROUTE_VOD_PATH "/vod": must start and end with /`,
+		},
+		{
+			"duplicate path",
+			map[string]string{"GCS_HELPER_ROUTES": "vod,live", "GCS_HELPER_ROUTE_LIVE_PATH": "/vod/"},
+			`routes "vod" and "live" can't use the same path "/vod/"`,
+		},
+		{
+			"startup setting",
+			map[string]string{"GCS_HELPER_ROUTES": "vod", "GCS_HELPER_ROUTE_VOD_SIGN_MODE": "iam"},
+			"GCS_HELPER_ROUTE_VOD_SIGN_MODE can't be set for a route, as it's shared by all routes",
+		},
+		{
+			"tenant header without routes",
+			map[string]string{"GCS_HELPER_TENANT_HEADER": "X-Tenant"},
+			"GCS_HELPER_TENANT_HEADER requires GCS_HELPER_ROUTES",
+		},
+		{
+			"invalid route configuration",
+			map[string]string{"GCS_HELPER_ROUTES": "vod", "GCS_HELPER_ROUTE_VOD_MAP_REGEX_FILTER": "("},
+			"route \"vod\": invalid GCS_HELPER_MAP_REGEX_FILTER: error parsing regexp: missing closing ): `(`",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.testCase, func(t *testing.T) {
+			test.envs["GCS_HELPER_BUCKET_NAME"] = "some-bucket"
+			setEnvs(test.envs)
+			_, err := loadConfig()
+			if err == nil || err.Error() != test.expected {
+				t.Errorf("wrong error\nwant %q\ngot  %v", test.expected, err)
+			}
+		})
+	}
+}
+
+func TestLoadConfigRoutesFromFileWithEnvPrefix(t *testing.T) {
+	filename, cleanup := writeConfigFile(t, "config.yaml", `
+routes: vod
+route:
+  vod:
+    path: /v/
+`)
+	defer cleanup()
+	setEnvs(map[string]string{
+		"GCS_HELPER_ROUTE_VOD_BUCKET_NAME": "ignored-bucket",
+		"MY_BUCKET_BUCKET_NAME":            "default-bucket",
+		"MY_BUCKET_ROUTE_VOD_BUCKET_NAME":  "vod-bucket",
+	})
+	config, err := loadConfigFrom(filename, "MY_BUCKET", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.routes) != 1 {
+		t.Fatalf("wrong number of routes\nwant 1\ngot  %d", len(config.routes))
+	}
+	if rt := config.routes[0]; rt.path != "/v/" || rt.config.BucketName != "vod-bucket" {
+		t.Errorf("wrong route\nwant %q at %q\ngot  %q at %q", "vod-bucket", "/v/", rt.config.BucketName, rt.path)
+	}
+	if value := os.Getenv("GCS_HELPER_ROUTE_VOD_BUCKET_NAME"); value != "ignored-bucket" {
+		t.Errorf("the environment should be restored, got GCS_HELPER_ROUTE_VOD_BUCKET_NAME=%q", value)
+	}
+}
+
+func TestRoutesHandler(t *testing.T) {
+	addr, cleanup := startServer(t, Config{
+		BucketName:   "my-bucket",
+		ProxyPrefix:  "/proxy/",
+		ProxyTimeout: time.Second,
+		MapPrefix:    "/map/",
+		routes: []route{
+			{
+				name:   "archive",
+				path:   "/archive/",
+				config: Config{BucketName: "your-bucket", ProxyPrefix: "/proxy/", ProxyTimeout: time.Second, MapPrefix: "/map/"},
+			},
+		},
+	})
+	defer cleanup()
+	var tests = []serverTest{
+		{
+			testCase:       "default configuration",
+			method:         http.MethodGet,
+			addr:           addr + "/proxy/musics/music/music3.txt",
+			expectedStatus: http.StatusOK,
+			expectedBody:   "some even nicer music",
+		},
+		{
+			testCase:       "route",
+			method:         http.MethodGet,
+			addr:           addr + "/archive/proxy/musics/music/music3.txt",
+			expectedStatus: http.StatusOK,
+			expectedBody:   "wait what",
+		},
+		{
+			testCase:       "route map",
+			method:         http.MethodGet,
+			addr:           addr + "/archive/map/musics/music/",
+			expectedStatus: http.StatusOK,
+			expectedBody: map[string]interface{}{
+				"sequences": []interface{}{
+					map[string]interface{}{
+						"clips": []interface{}{
+							map[string]interface{}{"type": "source", "path": "/your-bucket/musics/music/music3.txt"},
+						},
+					},
+				},
+			},
+		},
+		{
+			testCase:       "route not found",
+			method:         http.MethodGet,
+			addr:           addr + "/archive/unknown/",
+			expectedStatus: http.StatusNotFound,
+			expectedBody:   "not found\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.testCase, test.run)
+	}
+}
+
+func TestRoutesHandlerTenantHeader(t *testing.T) {
+	addr, cleanup := startServer(t, Config{
+		BucketName:   "my-bucket",
+		ProxyPrefix:  "/proxy/",
+		ProxyTimeout: time.Second,
+		MapPrefix:    "/map/",
+		TenantHeader: "X-Tenant",
+		routes: []route{
+			{
+				name:   "archive",
+				path:   "/archive/",
+				config: Config{BucketName: "your-bucket", ProxyPrefix: "/proxy/", ProxyTimeout: time.Second, MapPrefix: "/map/", RateLimit: 0.001},
+			},
+		},
+	})
+	defer cleanup()
+	var tests = []serverTest{
+		{
+			testCase:       "tenant",
+			method:         http.MethodGet,
+			addr:           addr + "/proxy/musics/music/music3.txt",
+			reqHeader:      http.Header{"X-Tenant": []string{"Archive"}},
+			expectedStatus: http.StatusOK,
+			expectedBody:   "wait what",
+		},
+		{
+			testCase:       "rate limited tenant",
+			method:         http.MethodGet,
+			addr:           addr + "/proxy/musics/music/music3.txt",
+			reqHeader:      http.Header{"X-Tenant": []string{"archive"}},
+			expectedStatus: http.StatusTooManyRequests,
+			expectedBody:   "too many requests\n",
+		},
+		{
+			testCase:       "unknown tenant",
+			method:         http.MethodGet,
+			addr:           addr + "/proxy/musics/music/music3.txt",
+			reqHeader:      http.Header{"X-Tenant": []string{"vod"}},
+			expectedStatus: http.StatusNotFound,
+			expectedBody:   "unknown tenant\n",
+		},
+		{
+			testCase:       "without header",
+			method:         http.MethodGet,
+			addr:           addr + "/proxy/musics/music/music3.txt",
+			expectedStatus: http.StatusOK,
+			expectedBody:   "some even nicer music",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.testCase, test.run)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"runtime"
+)
+
+// httpOpenConnections is updated by the server (see trackConnections).
+var httpOpenConnections = newGaugeVec(
+	"gcs_helper_http_open_connections",
+	"Number of open client connections, including idle keep-alive connections.",
+)
+
+// The goroutines and connections variables are exposed, along with the
+// memstats and cmdline variables published by expvar, at
+// <GCS_HELPER_ADMIN_PREFIX>debug/vars.
+var (
+	_ = publishVar("goroutines", func() interface{} { return runtime.NumGoroutine() })
+	_ = publishVar("connections", func() interface{} { return int64(httpOpenConnections.value()) })
+)
+
+func publishVar(name string, f func() interface{}) expvar.Func {
+	v := expvar.Func(f)
+	expvar.Publish(name, v)
+	return v
+}
+
+// trackConnections counts the open connections of the server, for the
+// http.Server ConnState hook.
+func trackConnections(_ net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		httpOpenConnections.add(1)
+	case http.StateHijacked, http.StateClosed:
+		httpOpenConnections.add(-1)
+	}
+}
+
+// runtimeMetrics exposes the metrics of the Go runtime, with the names used
+// by the Prometheus Go collector, so existing dashboards can be used.
+type runtimeMetrics struct{}
+
+func (runtimeMetrics) write(w io.Writer) {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	metrics := []struct {
+		name  string
+		help  string
+		kind  string
+		value float64
+	}{
+		{"go_goroutines", "Number of goroutines that currently exist.", "gauge", float64(runtime.NumGoroutine())},
+		{"go_memstats_alloc_bytes", "Number of bytes allocated and still in use.", "gauge", float64(stats.Alloc)},
+		{"go_memstats_heap_inuse_bytes", "Number of heap bytes that are in use.", "gauge", float64(stats.HeapInuse)},
+		{"go_memstats_heap_idle_bytes", "Number of heap bytes waiting to be used.", "gauge", float64(stats.HeapIdle)},
+		{"go_memstats_heap_objects", "Number of allocated objects.", "gauge", float64(stats.HeapObjects)},
+		{"go_memstats_sys_bytes", "Number of bytes obtained from system.", "gauge", float64(stats.Sys)},
+		{"go_memstats_mallocs_total", "Total number of mallocs.", "counter", float64(stats.Mallocs)},
+		{"go_memstats_frees_total", "Total number of frees.", "counter", float64(stats.Frees)},
+		{"go_gc_cycles_total", "Number of completed GC cycles.", "counter", float64(stats.NumGC)},
+		{"go_gc_pause_seconds_total", "Total duration of GC pauses.", "counter", float64(stats.PauseTotalNs) / 1e9},
+		{"go_gc_last_pause_seconds", "Duration of the last GC pause.", "gauge", float64(stats.PauseNs[(stats.NumGC+255)%256]) / 1e9},
+	}
+	for _, m := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %s\n", m.name, m.help, m.name, m.kind, m.name, formatFloat(m.value))
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRuntimeMetricsWrite(t *testing.T) {
+	var buf bytes.Buffer
+	runtimeMetrics{}.write(&buf)
+	for _, expected := range []string{
+		"# TYPE go_goroutines gauge\ngo_goroutines ",
+		"# TYPE go_memstats_heap_inuse_bytes gauge\ngo_memstats_heap_inuse_bytes ",
+		"# TYPE go_gc_cycles_total counter\ngo_gc_cycles_total ",
+		"# TYPE go_gc_pause_seconds_total counter\ngo_gc_pause_seconds_total ",
+	} {
+		if !strings.Contains(buf.String(), expected) {
+			t.Errorf("missing %q in metrics:\n%s", expected, buf.String())
+		}
+	}
+}
+
+func TestTrackConnections(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.NotFoundHandler())
+	server.Config.ConnState = trackConnections
+	server.Start()
+	defer server.Close()
+	before := httpOpenConnections.value()
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := httpOpenConnections.value() - before; got != 1 {
+		t.Errorf("wrong number of open connections, want 1, got %v", got)
+	}
+	http.DefaultTransport.(*http.Transport).CloseIdleConnections()
+	// the server sees the connection closed asynchronously.
+	for i := 0; i < 100 && httpOpenConnections.value() != before; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := httpOpenConnections.value() - before; got != 0 {
+		t.Errorf("wrong number of open connections after closing, want 0, got %v", got)
+	}
+}
+
+func TestServerAdminDebugVars(t *testing.T) {
+	addr, cleanup := startServer(t, Config{
+		BucketName:  "my-bucket",
+		ProxyPrefix: "/proxy/",
+		AdminPrefix: "/admin/",
+		AdminToken:  "secret",
+	})
+	defer cleanup()
+	req, _ := http.NewRequest(http.MethodGet, addr+"/admin/debug/vars", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var vars map[string]json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&vars); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"goroutines", "connections", "memstats"} {
+		if _, ok := vars[name]; !ok {
+			t.Errorf("missing %q in debug vars", name)
+		}
+	}
+}
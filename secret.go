@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// secretManagerEndpoint is the base URL of the Secret Manager API.
+var secretManagerEndpoint = "https://secretmanager.googleapis.com/v1/"
+
+// secretKey holds a private key stored in Secret Manager, that can be
+// refreshed while the server is running.
+type secretKey struct {
+	client *http.Client
+	name   string
+	check  func(string) error
+
+	mu        sync.RWMutex
+	key       string
+	parsedKey *rsa.PrivateKey
+}
+
+// newSecretKey loads the secret version with the given resource name
+// (projects/<project>/secrets/<secret>/versions/<version>). When check is
+// not nil, values that it rejects are never used.
+func newSecretKey(client *http.Client, name string, check func(string) error) (*secretKey, error) {
+	s := secretKey{client: client, name: name, check: check}
+	return &s, s.refresh()
+}
+
+func (s *secretKey) get() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.key
+}
+
+// parsed returns the parsed private key, or nil when the secret isn't a
+// valid private key.
+func (s *secretKey) parsed() *rsa.PrivateKey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.parsedKey
+}
+
+func (s *secretKey) refresh() error {
+	data, err := accessSecret(s.client, s.name)
+	if err != nil {
+		return err
+	}
+	if s.check != nil {
+		if err = s.check(string(data)); err != nil {
+			return fmt.Errorf("invalid value in secret %q: %v", s.name, err)
+		}
+	}
+	parsed, _ := parsePrivateKey(data)
+	s.mu.Lock()
+	s.key = string(data)
+	s.parsedKey = parsed
+	s.mu.Unlock()
+	return nil
+}
+
+// refreshEvery reloads the secret in the given interval. Failures are logged
+// and the previous value is kept.
+func (s *secretKey) refreshEvery(interval time.Duration, logger *logrus.Logger) {
+	for range time.Tick(interval) {
+		if err := s.refresh(); err != nil {
+			logger.WithError(err).WithField("secret", s.name).Error("failed to refresh secret")
+		}
+	}
+}
+
+// accessSecret returns the payload of the given secret version.
+//
+// See https://cloud.google.com/secret-manager/docs/reference/rest/v1/projects.secrets.versions/access.
+func accessSecret(client *http.Client, name string) ([]byte, error) {
+	resp, err := client.Get(secretManagerEndpoint + name + ":access")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to access secret %q: Secret Manager API returned %d", name, resp.StatusCode)
+	}
+	var result struct {
+		Payload struct {
+			Data string `json:"data"`
+		} `json:"payload"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(result.Payload.Data)
+}
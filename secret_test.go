@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+const testSecretName = "projects/my-project/secrets/signer/versions/latest"
+
+func startFakeSecretManager(t *testing.T, values ...string) (*int32, func()) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/"+testSecretName+":access" {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		call := int(atomic.AddInt32(&calls, 1)) - 1
+		if call >= len(values) {
+			call = len(values) - 1
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"name":    testSecretName,
+			"payload": map[string]string{"data": base64.StdEncoding.EncodeToString([]byte(values[call]))},
+		})
+	}))
+	originalEndpoint := secretManagerEndpoint
+	secretManagerEndpoint = server.URL + "/"
+	return &calls, func() {
+		secretManagerEndpoint = originalEndpoint
+		server.Close()
+	}
+}
+
+func TestSecretKeyRefresh(t *testing.T) {
+	calls, cleanup := startFakeSecretManager(t, "key-1", "key-2")
+	defer cleanup()
+	s, err := newSecretKey(http.DefaultClient, testSecretName, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key := s.get(); key != "key-1" {
+		t.Errorf("wrong key\nwant %q\ngot  %q", "key-1", key)
+	}
+	if err = s.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if key := s.get(); key != "key-2" {
+		t.Errorf("wrong key after refresh\nwant %q\ngot  %q", "key-2", key)
+	}
+	if n := atomic.LoadInt32(calls); n != 2 {
+		t.Errorf("wrong number of calls\nwant 2\ngot  %d", n)
+	}
+}
+
+func TestSecretKeyRefreshInvalidKey(t *testing.T) {
+	c := testSignConfig(t)
+	_, cleanup := startFakeSecretManager(t, c.PrivateKey, "not a key")
+	defer cleanup()
+	s, err := newSecretKey(http.DefaultClient, testSecretName, checkPrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.refresh(); err == nil {
+		t.Error("unexpected <nil> error")
+	}
+	if key := s.get(); key != c.PrivateKey {
+		t.Errorf("wrong key after failed refresh\nwant %q\ngot  %q", c.PrivateKey, key)
+	}
+	if key := s.parsed(); key == nil || key.N.Cmp(testKey.N) != 0 {
+		t.Error("wrong parsed key after failed refresh")
+	}
+}
+
+func TestSecretKeyNotFound(t *testing.T) {
+	_, cleanup := startFakeSecretManager(t, "key-1")
+	defer cleanup()
+	_, err := newSecretKey(http.DefaultClient, "projects/my-project/secrets/other/versions/1", nil)
+	if err == nil {
+		t.Error("unexpected <nil> error")
+	}
+}
+
+func TestSignBytesWithSecretKey(t *testing.T) {
+	c := testSignConfig(t)
+	_, cleanup := startFakeSecretManager(t, c.PrivateKey)
+	defer cleanup()
+	secret, err := newSecretKey(http.DefaultClient, testSecretName, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.PrivateKey = ""
+	c.PrivateKeySecret = testSecretName
+	c.privateKeySecret = secret
+	if !c.enabled() {
+		t.Fatal("signing should be enabled with a secret key")
+	}
+	signature, err := c.signBytes([]byte("some data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte("some data"))
+	if err = rsa.VerifyPKCS1v15(&testKey.PublicKey, crypto.SHA256, sum[:], signature); err != nil {
+		t.Errorf("invalid signature: %v", err)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// selfTestObject is the name of the object signed by the signing self-test.
+// It doesn't need to exist.
+const selfTestObject = "gcs-helper-self-test"
+
+// serviceAccountCertsURL is the base URL of the certificates of the public
+// keys of service accounts.
+var serviceAccountCertsURL = "https://www.googleapis.com/service_accounts/v1/metadata/x509/"
+
+// signingSelfTest signs a URL with every configured signer, so problems in the
+// signing configuration (such as malformed private keys, JSON keys of another
+// service account, or service accounts that can't be used in the iam mode)
+// are reported on startup, instead of when the first request is signed.
+//
+// A PEM private key that doesn't belong to the service account can't be
+// detected, as signatures are only checked by GCS.
+func signingSelfTest(c Config) error {
+	now := time.Now()
+	if c.SignConfig.enabled() {
+		for _, signConfig := range selfTestSignConfigs(c.SignConfig, now) {
+			if err := checkKeyOwner(signConfig); err != nil {
+				return err
+			}
+			if _, err := signURLAt(signConfig, http.MethodGet, c.BucketName, selfTestObject, now, signConfig.Expiration); err != nil {
+				return fmt.Errorf("failed to sign url with %s: %v", signConfig.GoogleAccessID, err)
+			}
+		}
+	}
+	if c.TokenConfig.enabled() {
+		expires := now.Add(c.TokenConfig.Expiration).Truncate(time.Second)
+		signed, err := c.TokenConfig.signedURL(selfTestObject, expires)
+		if err != nil {
+			return fmt.Errorf("failed to sign token url: %v", err)
+		}
+		if got, err := c.TokenConfig.expiration(signed); err != nil || !got.Equal(expires) {
+			return fmt.Errorf("invalid token url %q", signed)
+		}
+	}
+	if c.CDNConfig.enabled() {
+		if _, err := c.CDNConfig.signedURL(selfTestObject, now.Add(c.CDNConfig.Expiration)); err != nil {
+			return fmt.Errorf("failed to sign CDN url: %v", err)
+		}
+	}
+	for _, rt := range c.routes {
+		if err := signingSelfTest(c.routeConfig(rt)); err != nil {
+			return fmt.Errorf("route %q: %v", rt.name, err)
+		}
+	}
+	return nil
+}
+
+// selfTestSignConfigs returns the configurations that should be tested: one
+// for each key in GCS_HELPER_SIGN_KEYS that didn't expire yet, or the given
+// configuration when keys aren't used.
+func selfTestSignConfigs(c SignConfig, now time.Time) []SignConfig {
+	if len(c.Keys) == 0 {
+		return []SignConfig{c}
+	}
+	var configs []SignConfig
+	for _, key := range c.Keys {
+		if !key.NotAfter.IsZero() && !key.NotAfter.After(now) {
+			continue
+		}
+		keyConfig := c
+		keyConfig.GoogleAccessID = key.GoogleAccessID
+		keyConfig.PrivateKey = key.PrivateKey
+		keyConfig.parsedKey = key.parsedKey
+		keyConfig.Keys = nil
+		configs = append(configs, keyConfig)
+	}
+	return configs
+}
+
+// checkKeyOwner reports whether the private key of the given configuration,
+// when it's a service account JSON key file, belongs to its
+// GCS_HELPER_SIGN_GOOGLE_ACCESS_ID, as signatures made with the key of
+// another account are rejected by GCS.
+func checkKeyOwner(c SignConfig) error {
+	if c.Mode == signModeIAM {
+		return nil
+	}
+	sa, ok := parseServiceAccountKey([]byte(c.privateKey()))
+	if ok && sa.ClientEmail != "" && sa.ClientEmail != c.GoogleAccessID {
+		return fmt.Errorf("the private key of %s belongs to %s", c.GoogleAccessID, sa.ClientEmail)
+	}
+	return nil
+}
+
+// checkPrivateKey reports whether the given private key can be used for
+// signing URLs. It's used for rejecting keys reloaded from Secret Manager.
+func checkPrivateKey(key string) error {
+	parsed, err := parsePrivateKey([]byte(key))
+	if err != nil {
+		return err
+	}
+	return parsed.Validate()
+}
+
+// checkPublishedKeys checks that the private keys of the configuration (and
+// its routes) belong to their service accounts, by comparing them with the
+// published certificates of the accounts. It requires access to Google APIs,
+// so it's only run by validate-config -check-access.
+func checkPublishedKeys(ctx context.Context, c Config, client *http.Client) error {
+	if c.SignConfig.enabled() && c.SignConfig.Mode != signModeIAM {
+		for _, signConfig := range selfTestSignConfigs(c.SignConfig, time.Now()) {
+			if err := checkPublishedKey(ctx, signConfig, client); err != nil {
+				return err
+			}
+		}
+	}
+	for _, rt := range c.routes {
+		if err := checkPublishedKeys(ctx, c.routeConfig(rt), client); err != nil {
+			return fmt.Errorf("route %q: %v", rt.name, err)
+		}
+	}
+	return nil
+}
+
+func checkPublishedKey(ctx context.Context, c SignConfig, client *http.Client) error {
+	key, err := c.signingKey()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodGet, serviceAccountCertsURL+url.PathEscape(c.GoogleAccessID), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to get the certificates of %s: %v", c.GoogleAccessID, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		return fmt.Errorf("failed to get the certificates of %s: status %d", c.GoogleAccessID, resp.StatusCode)
+	}
+	var certs map[string]string
+	if err = json.NewDecoder(resp.Body).Decode(&certs); err != nil {
+		return fmt.Errorf("failed to get the certificates of %s: %v", c.GoogleAccessID, err)
+	}
+	for _, data := range certs {
+		block, _ := pem.Decode([]byte(data))
+		if block == nil {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			continue
+		}
+		if pub, ok := cert.PublicKey.(*rsa.PublicKey); ok && pub.N.Cmp(key.N) == 0 && pub.E == key.E {
+			return nil
+		}
+	}
+	return fmt.Errorf("the private key %s isn't a key of %s", keyFingerprint(c.privateKey()), c.GoogleAccessID)
+}
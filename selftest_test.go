@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// jsonKeyConfig returns the given configuration with its private key in a
+// service account JSON key file of the given account.
+func jsonKeyConfig(t *testing.T, c SignConfig, clientEmail string) SignConfig {
+	key, err := json.Marshal(serviceAccountKey{ClientEmail: clientEmail, PrivateKey: c.PrivateKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.PrivateKey = string(key)
+	return c
+}
+
+func TestSigningSelfTest(t *testing.T) {
+	valid := testSignConfig(t)
+	var tests = []struct {
+		testCase    string
+		config      Config
+		expectError bool
+	}{
+		{
+			"signing not configured",
+			Config{BucketName: "my-bucket"},
+			false,
+		},
+		{
+			"valid key",
+			Config{BucketName: "my-bucket", SignConfig: valid},
+			false,
+		},
+		{
+			"valid json key",
+			Config{BucketName: "my-bucket", SignConfig: jsonKeyConfig(t, valid, valid.GoogleAccessID)},
+			false,
+		},
+		{
+			"json key of another account",
+			Config{BucketName: "my-bucket", SignConfig: jsonKeyConfig(t, valid, "other@project.iam.gserviceaccount.com")},
+			true,
+		},
+		{
+			"malformed key",
+			Config{BucketName: "my-bucket", SignConfig: SignConfig{
+				GoogleAccessID: valid.GoogleAccessID,
+				PrivateKey:     "not a key",
+				Expiration:     time.Hour,
+				Scheme:         signSchemeV2,
+				Mode:           signModeKey,
+			}},
+			true,
+		},
+		{
+			"malformed inactive key",
+			Config{BucketName: "my-bucket", SignConfig: SignConfig{
+				Keys: SigningKeys{
+					{GoogleAccessID: valid.GoogleAccessID, PrivateKey: valid.PrivateKey},
+					{GoogleAccessID: valid.GoogleAccessID, PrivateKey: "not a key", NotAfter: time.Now().Add(time.Hour)},
+				},
+				Expiration: time.Hour,
+				Scheme:     signSchemeV4,
+				Mode:       signModeKey,
+			}},
+			true,
+		},
+		{
+			"expired malformed key",
+			Config{BucketName: "my-bucket", SignConfig: SignConfig{
+				Keys: SigningKeys{
+					{GoogleAccessID: valid.GoogleAccessID, PrivateKey: valid.PrivateKey},
+					{GoogleAccessID: valid.GoogleAccessID, PrivateKey: "not a key", NotAfter: time.Now().Add(-time.Hour)},
+				},
+				Expiration: time.Hour,
+				Scheme:     signSchemeV2,
+				Mode:       signModeKey,
+			}},
+			false,
+		},
+		{
+			"malformed key in route",
+			Config{BucketName: "my-bucket", SignConfig: SignConfig{Mode: signModeKey}, routes: []route{
+				{name: "vod", path: "/vod/", config: Config{BucketName: "vod-bucket", SignConfig: SignConfig{
+					GoogleAccessID: valid.GoogleAccessID,
+					PrivateKey:     "not a key",
+					Expiration:     time.Hour,
+					Scheme:         signSchemeV2,
+				}}},
+			}},
+			true,
+		},
+		{
+			"valid cdn key",
+			Config{BucketName: "my-bucket", CDNConfig: CDNConfig{
+				Type:       cdnTypeCloudCDN,
+				URLPrefix:  "https://cdn.example.com/",
+				KeyName:    "my-key",
+				Key:        testCDNKey,
+				Expiration: time.Hour,
+			}},
+			false,
+		},
+		{
+			"valid token config",
+			Config{BucketName: "my-bucket", TokenConfig: TokenConfig{
+				URLPrefix:  "https://cdn.example.com/",
+				Key:        "secret",
+				Param:      "token",
+				Expiration: time.Hour,
+			}},
+			false,
+		},
+		{
+			"invalid token url prefix",
+			Config{BucketName: "my-bucket", TokenConfig: TokenConfig{
+				URLPrefix:  "https://cdn.example.com/%zz/",
+				Key:        "secret",
+				Param:      "token",
+				Expiration: time.Hour,
+			}},
+			true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.testCase, func(t *testing.T) {
+			err := signingSelfTest(test.config)
+			if test.expectError && err == nil {
+				t.Error("unexpected <nil> error")
+			}
+			if !test.expectError && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestCheckPublishedKeys(t *testing.T) {
+	valid := testSignConfig(t)
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &testKey.PublicKey, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/"+valid.GoogleAccessID {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"key-id": cert})
+	}))
+	defer server.Close()
+	defer func(u string) { serviceAccountCertsURL = u }(serviceAccountCertsURL)
+	serviceAccountCertsURL = server.URL + "/"
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := valid
+	other.PrivateKey = string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(otherKey)}))
+	unknown := valid
+	unknown.GoogleAccessID = "unknown@project.iam.gserviceaccount.com"
+	var tests = []struct {
+		testCase    string
+		config      Config
+		expectError bool
+	}{
+		{"published key", Config{SignConfig: valid}, false},
+		{"key of another account", Config{SignConfig: other}, true},
+		{"unknown account", Config{SignConfig: unknown}, true},
+		{"iam mode", Config{SignConfig: SignConfig{GoogleAccessID: unknown.GoogleAccessID, Mode: signModeIAM}}, false},
+		{
+			"key of another account in route",
+			Config{SignConfig: valid, routes: []route{{name: "vod", path: "/vod/", config: Config{SignConfig: other}}}},
+			true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.testCase, func(t *testing.T) {
+			err := checkPublishedKeys(context.Background(), test.config, server.Client())
+			if test.expectError && err == nil {
+				t.Error("unexpected <nil> error")
+			}
+			if !test.expectError && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
@@ -7,12 +7,110 @@ import (
 	"cloud.google.com/go/storage"
 )
 
-func getHandler(c Config, client *storage.Client) http.HandlerFunc {
-	proxyHandler := getProxyHandler(c, client)
-	mapHandler := getMapHandler(c, client)
+func getHandler(c Config, client *storage.Client, hc *http.Client) http.HandlerFunc {
+	if len(c.HostBuckets) > 0 {
+		return getHostHandler(c, client, hc)
+	}
+	if len(c.routes) > 0 {
+		return getRoutesHandler(c, client, hc)
+	}
+	c = c.withActiveBucket()
+	if c.SignConfig.CacheWindow > 0 {
+		c.SignConfig.urlCache = newSignedURLCache(c.SignConfig)
+	}
+	jwksClient := &http.Client{Timeout: jwksFetchTimeout}
+	verifier := newJWTVerifier(c.JWTConfig, jwksClient)
+	iapVerifier := c.IAPConfig.verifier(jwksClient)
+	protect := func(name string, handler http.HandlerFunc) http.HandlerFunc {
+		if c.JWTConfig.protects(name) {
+			handler = jwtHandler(c.forHandler(name), verifier, handler)
+		}
+		// all the handlers are behind Identity-Aware Proxy, so assertions
+		// are checked before tokens.
+		if c.IAPConfig.enabled() {
+			handler = iapHandler(c.forHandler(name), iapVerifier, handler)
+		}
+		return handler
+	}
+	pc := c.forHandler("proxy")
+	proxyHandler := slowRequestHandler(pc, pc.logger(), instrumentHandler("proxy", protect("proxy", traceHandler(pc, "proxy", canaryHandler(pc, getProxyHandler(pc, client), getProxyHandler(pc.canaryConfig(), client))))))
+	mc := c.forHandler("map")
+	mapHandler := slowRequestHandler(mc, mc.logger(), instrumentHandler("map", protect("map", traceHandler(mc, "map", canaryHandler(mc, getMapHandler(mc, client), getMapHandler(mc.canaryConfig(), client))))))
+	metaHandler := instrumentHandler("meta", protect("meta", getMetaHandler(c.forHandler("meta"), client)))
+	redirectHandler := instrumentHandler("redirect", protect("redirect", getRedirectHandler(c.forHandler("redirect"))))
+	signHandler := instrumentHandler("sign", protect("sign", getSignHandler(c.forHandler("sign"))))
+	signCookieHandler := instrumentHandler("sign_cookie", protect("sign_cookie", getSignCookieHandler(c.forHandler("sign_cookie"))))
+	listHandler := instrumentHandler("list", protect("list", getListHandler(c.forHandler("list"), client)))
+	uploadHandler := instrumentHandler("upload", protect("upload", getUploadHandler(c.forHandler("upload"), client)))
+	uploadSessionHandler := instrumentHandler("upload_session", protect("upload_session", getUploadSessionHandler(c.forHandler("upload_session"), hc)))
+	signUploadHandler := instrumentHandler("sign_upload", protect("sign_upload", getSignUploadHandler(c.forHandler("sign_upload"))))
+	deleteHandler := instrumentHandler("delete", protect("delete", getDeleteHandler(c.forHandler("delete"), client)))
+	copyHandler := instrumentHandler("copy", protect("copy", getCopyHandler(c.forHandler("copy"), client)))
+	composeHandler := instrumentHandler("compose", protect("compose", getComposeHandler(c.forHandler("compose"), client)))
+	adminHandler := instrumentHandler("admin", protect("admin", getAdminHandler(c)))
+	versionHandler := getVersionHandler()
+	metricsHandler := getMetricsHandler()
+	livenessHandler := getLivenessHandler()
+	readinessHandler := getReadinessHandler(c, client)
 
-	return func(w http.ResponseWriter, r *http.Request) {
+	return requestIDHandler(accessLogHandler(c, c.logger(), rateLimitHandler(c, compressHandler(c, func(w http.ResponseWriter, r *http.Request) {
 		switch {
+		case c.VersionPath != "" && r.URL.Path == c.VersionPath:
+			versionHandler(w, r)
+		case c.MetricsPath != "" && r.URL.Path == c.MetricsPath:
+			metricsHandler(w, r)
+		case c.LivenessPath != "" && r.URL.Path == c.LivenessPath:
+			livenessHandler(w, r)
+		case c.ReadinessPath != "" && r.URL.Path == c.ReadinessPath:
+			readinessHandler(w, r)
+		case c.AdminPrefix != "" && strings.HasPrefix(r.URL.Path, c.AdminPrefix):
+			r.URL.Path = strings.Replace(r.URL.Path, c.AdminPrefix, "", 1)
+			adminHandler(w, r)
+		case c.MetaPrefix != "" && strings.HasPrefix(r.URL.Path, c.MetaPrefix):
+			r.URL.Path = strings.Replace(r.URL.Path, c.MetaPrefix, "", 1)
+			metaHandler(w, r)
+		case c.UploadSessionPrefix != "" && strings.HasPrefix(r.URL.Path, c.UploadSessionPrefix):
+			r.URL.Path = strings.Replace(r.URL.Path, c.UploadSessionPrefix, "", 1)
+			uploadSessionHandler(w, r)
+		case c.SignUploadPrefix != "" && strings.HasPrefix(r.URL.Path, c.SignUploadPrefix):
+			r.URL.Path = strings.Replace(r.URL.Path, c.SignUploadPrefix, "", 1)
+			signUploadHandler(w, r)
+		case c.DeletePrefix != "" && strings.HasPrefix(r.URL.Path, c.DeletePrefix):
+			r.URL.Path = strings.Replace(r.URL.Path, c.DeletePrefix, "", 1)
+			deleteHandler(w, r)
+		case c.CopyPrefix != "" && strings.HasPrefix(r.URL.Path, c.CopyPrefix):
+			r.URL.Path = strings.Replace(r.URL.Path, c.CopyPrefix, "", 1)
+			copyHandler(w, r)
+		case c.ComposePrefix != "" && strings.HasPrefix(r.URL.Path, c.ComposePrefix):
+			r.URL.Path = strings.Replace(r.URL.Path, c.ComposePrefix, "", 1)
+			composeHandler(w, r)
+		case c.UploadPrefix != "" && strings.HasPrefix(r.URL.Path, c.UploadPrefix):
+			r.URL.Path = strings.Replace(r.URL.Path, c.UploadPrefix, "", 1)
+			uploadHandler(w, r)
+		case c.ListPrefix != "" && strings.HasPrefix(r.URL.Path, c.ListPrefix):
+			r.URL.Path = strings.Replace(r.URL.Path, c.ListPrefix, "", 1)
+			listHandler(w, r)
+		case c.SignCookiePrefix != "" && strings.HasPrefix(r.URL.Path, c.SignCookiePrefix):
+			r.URL.Path = strings.Replace(r.URL.Path, c.SignCookiePrefix, "", 1)
+			signCookieHandler(w, r)
+		case c.SignPrefix != "" && strings.HasPrefix(r.URL.Path, c.SignPrefix):
+			r.URL.Path = strings.Replace(r.URL.Path, c.SignPrefix, "", 1)
+			signHandler(w, r)
+		case c.RedirectPrefix != "" && strings.HasPrefix(r.URL.Path, c.RedirectPrefix):
+			r.URL.Path = strings.Replace(r.URL.Path, c.RedirectPrefix, "", 1)
+			redirectHandler(w, r)
+		case c.MapHLSPrefix != "" && strings.HasPrefix(r.URL.Path, c.MapHLSPrefix):
+			r.URL.Path = strings.Replace(r.URL.Path, c.MapHLSPrefix, "", 1)
+			mapHandler(w, withMapFormat(r, mapFormatHLS))
+		case c.MapDASHPrefix != "" && strings.HasPrefix(r.URL.Path, c.MapDASHPrefix):
+			r.URL.Path = strings.Replace(r.URL.Path, c.MapDASHPrefix, "", 1)
+			mapHandler(w, withMapFormat(r, mapFormatDASH))
+		case c.MapISMPrefix != "" && strings.HasPrefix(r.URL.Path, c.MapISMPrefix):
+			r.URL.Path = strings.Replace(r.URL.Path, c.MapISMPrefix, "", 1)
+			mapHandler(w, withMapFormat(r, mapFormatISM))
+		case c.MapTemplatePrefix != "" && strings.HasPrefix(r.URL.Path, c.MapTemplatePrefix):
+			r.URL.Path = strings.Replace(r.URL.Path, c.MapTemplatePrefix, "", 1)
+			mapHandler(w, withMapFormat(r, mapFormatTemplate))
 		case strings.HasPrefix(r.URL.Path, c.ProxyPrefix):
 			r.URL.Path = strings.Replace(r.URL.Path, c.ProxyPrefix, "", 1)
 			proxyHandler(w, r)
@@ -25,5 +123,15 @@ func getHandler(c Config, client *storage.Client) http.HandlerFunc {
 		default:
 			http.Error(w, "not found", http.StatusNotFound)
 		}
+	}))))
+}
+
+// bucketHandle returns the handle for the given bucket, billing requests to
+// the configured project when accessing requester-pays buckets.
+func bucketHandle(c *Config, client *storage.Client, name string) *storage.BucketHandle {
+	bucket := client.Bucket(name)
+	if c.BillingProject != "" {
+		bucket = bucket.UserProject(c.BillingProject)
 	}
+	return bucket
 }
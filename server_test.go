@@ -1,16 +1,22 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
+	"cloud.google.com/go/storage"
 	"github.com/fsouza/fake-gcs-server/fakestorage"
 	"github.com/google/go-cmp/cmp"
+	"google.golang.org/api/option"
 )
 
 func TestServerMultiPrefixes(t *testing.T) {
@@ -24,6 +30,7 @@ func TestServerMultiPrefixes(t *testing.T) {
 		MapRegexFilter:      `((240|360|424|480|720|1080)p\.mp4)|\.(vtt|srt)$`,
 		MapRegexHDFilter:    `((720|1080)p\.mp4)|(\.(vtt|srt))$`,
 		MapExtensionSplit:   true,
+		CacheControl:        ExtensionMap{".txt": "max-age=60", ".srt": "max-age=3600"},
 	})
 	defer cleanup()
 	var tests = []serverTest{
@@ -47,6 +54,7 @@ func TestServerMultiPrefixes(t *testing.T) {
 			expectedStatus: http.StatusOK,
 			expectedHeader: http.Header{
 				"Accept-Ranges":  []string{"bytes"},
+				"Cache-Control":  []string{"max-age=60"},
 				"Content-Length": []string{"15"},
 			},
 			expectedBody: "some nice music",
@@ -122,7 +130,10 @@ func TestServerMultiPrefixes(t *testing.T) {
 			method:         http.MethodGet,
 			addr:           addr + "/map/videos/video/video1.srt",
 			expectedStatus: http.StatusOK,
-			expectedHeader: http.Header{"Content-Type": []string{"application/json"}},
+			expectedHeader: http.Header{
+				"Cache-Control": []string{"max-age=3600"},
+				"Content-Type":  []string{"application/json"},
+			},
 			expectedBody: map[string]interface{}{
 				"sequences": []interface{}{
 					map[string]interface{}{
@@ -288,7 +299,7 @@ func (st *serverTest) run(t *testing.T) {
 
 func startServer(t *testing.T, cfg Config) (string, func()) {
 	server := fakestorage.NewServer(getObjects())
-	handler := getHandler(cfg, server.Client())
+	handler := getHandler(cfg, server.Client(), fakeHTTPClient(server))
 	httpServer := httptest.NewServer(handler)
 	return httpServer.URL, func() {
 		httpServer.Close()
@@ -296,6 +307,21 @@ func startServer(t *testing.T, cfg Config) (string, func()) {
 	}
 }
 
+// fakeHTTPClient returns an HTTP client that sends requests to the fake GCS
+// server, regardless of the host in the URL.
+func fakeHTTPClient(server *fakestorage.Server) *http.Client {
+	tlsConfig := tls.Config{InsecureSkipVerify: true}
+	addr := strings.TrimPrefix(server.URL(), "https://")
+	return &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tlsConfig,
+			DialTLS: func(string, string) (net.Conn, error) {
+				return tls.Dial("tcp", addr, &tlsConfig)
+			},
+		},
+	}
+}
+
 func getObjects() []fakestorage.Object {
 	return []fakestorage.Object{
 		{
@@ -372,3 +398,49 @@ func getObjects() []fakestorage.Object {
 		},
 	}
 }
+
+func TestBucketHandleUserProject(t *testing.T) {
+	var requests []*http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r)
+		if strings.HasPrefix(r.URL.Path, "/storage/v1/") {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"bucket":"my-bucket","name":"video.mp4","size":"2"}`))
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+	defer useTestTokenSource("my-token")()
+	hc, err := httpClient(ClientConfig{Endpoint: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := storage.NewClient(context.Background(), option.WithHTTPClient(hc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj := bucketHandle(&Config{BillingProject: "my-project"}, client, "my-bucket").Object("video.mp4")
+	if _, err = obj.Attrs(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	reader, err := obj.NewReader(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader.Close()
+	if len(requests) != 2 {
+		t.Fatalf("wrong number of requests to GCS\nwant 2\ngot  %d", len(requests))
+	}
+	if project := requests[0].URL.Query().Get("userProject"); project != "my-project" {
+		t.Errorf("wrong userProject of the metadata request\nwant %q\ngot  %q", "my-project", project)
+	}
+	if project := requests[1].Header.Get("X-Goog-User-Project"); project != "my-project" {
+		t.Errorf("wrong X-Goog-User-Project of the download\nwant %q\ngot  %q", "my-project", project)
+	}
+	for _, r := range requests {
+		if auth := r.Header.Get("Authorization"); auth != "Bearer my-token" {
+			t.Errorf("%s: requests to requester-pays buckets must be authenticated, got Authorization %q", r.URL.Path, auth)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/storage"
+)
+
+type uploadSession struct {
+	Bucket     string `json:"bucket"`
+	Name       string `json:"name"`
+	SessionURI string `json:"sessionURI"`
+}
+
+type uploadSessionMetadata struct {
+	Name         string            `json:"name"`
+	ContentType  string            `json:"contentType,omitempty"`
+	CacheControl string            `json:"cacheControl,omitempty"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+}
+
+// getUploadSessionHandler returns a handler that initiates GCS resumable
+// upload sessions, so clients can upload the content directly to GCS,
+// while gcs-helper controls authorization, bucket and object naming.
+func getUploadSessionHandler(c Config, hc *http.Client) http.HandlerFunc {
+	logger := c.logger()
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !authorized(r, c.UploadToken) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if length := r.Header.Get("X-Upload-Content-Length"); length != "" {
+			size, err := strconv.ParseInt(length, 10, 64)
+			if err != nil {
+				http.Error(w, "invalid X-Upload-Content-Length", http.StatusBadRequest)
+				return
+			}
+			if size > c.UploadMaxSize {
+				http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+		}
+		bucketName, objectName, err := objectLocation(&c, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), c.ProxyTimeout)
+		defer cancel()
+		sessionURI, err := startUploadSession(ctx, &c, hc, bucketName, objectName, r)
+		if err != nil {
+			requestLogger(r.Context(), logger).WithError(err).WithField("url", r.URL.RequestURI()).Error("failed to start upload session")
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(uploadSession{
+			Bucket:     bucketName,
+			Name:       objectName,
+			SessionURI: sessionURI,
+		})
+	}
+}
+
+func startUploadSession(ctx context.Context, c *Config, hc *http.Client, bucketName, objectName string, r *http.Request) (string, error) {
+	ct := r.Header.Get("X-Upload-Content-Type")
+	if ct == "" {
+		ct = contentType(c, &storage.ObjectAttrs{Name: objectName})
+	}
+	metadata := uploadSessionMetadata{
+		Name:         objectName,
+		ContentType:  ct,
+		CacheControl: r.Header.Get("Cache-Control"),
+	}
+	for name := range r.Header {
+		if strings.HasPrefix(name, metadataHeaderPrefix) && len(name) > len(metadataHeaderPrefix) {
+			if metadata.Metadata == nil {
+				metadata.Metadata = make(map[string]string)
+			}
+			metadata.Metadata[strings.ToLower(name[len(metadataHeaderPrefix):])] = r.Header.Get(name)
+		}
+	}
+	body, err := json.Marshal(metadata)
+	if err != nil {
+		return "", err
+	}
+	query := url.Values{"uploadType": {"resumable"}, "name": {objectName}}
+	if c.BillingProject != "" {
+		query.Set("userProject", c.BillingProject)
+	}
+	u := url.URL{
+		Scheme:   "https",
+		Host:     "storage.googleapis.com",
+		Path:     "/upload/storage/v1/b/" + bucketName + "/o",
+		RawQuery: query.Encode(),
+	}
+	req, err := http.NewRequest(http.MethodPost, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	req.Header.Set("X-Upload-Content-Type", ct)
+	if length := r.Header.Get("X-Upload-Content-Length"); length != "" {
+		req.Header.Set("X-Upload-Content-Length", length)
+	}
+	// the origin is used by GCS for CORS checks on the upload requests sent
+	// by browsers.
+	if origin := r.Header.Get("Origin"); origin != "" {
+		req.Header.Set("Origin", origin)
+	}
+	resp, err := hc.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		data, _ := ioutil.ReadAll(resp.Body)
+		return "", fmt.Errorf("failed to start upload session: %d - %s", resp.StatusCode, data)
+	}
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return "", errors.New("failed to start upload session: missing Location header in the response")
+	}
+	return location, nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fsouza/fake-gcs-server/fakestorage"
+)
+
+func TestServerUploadSessionHandler(t *testing.T) {
+	server := fakestorage.NewServer(getObjects())
+	defer server.Stop()
+	hc := fakeHTTPClient(server)
+	handler := getUploadSessionHandler(Config{
+		BucketName:    "my-bucket",
+		UploadToken:   "secret",
+		UploadMaxSize: 1024,
+		ProxyTimeout:  time.Second,
+	}, hc)
+
+	var tests = []struct {
+		testCase       string
+		method         string
+		header         http.Header
+		expectedStatus int
+	}{
+		{
+			"start session",
+			http.MethodPost,
+			http.Header{
+				"Authorization":           []string{"Bearer secret"},
+				"X-Upload-Content-Length": []string{"21"},
+			},
+			http.StatusCreated,
+		},
+		{
+			"missing token",
+			http.MethodPost,
+			nil,
+			http.StatusUnauthorized,
+		},
+		{
+			"upload too large",
+			http.MethodPost,
+			http.Header{
+				"Authorization":           []string{"Bearer secret"},
+				"X-Upload-Content-Length": []string{"1025"},
+			},
+			http.StatusRequestEntityTooLarge,
+		},
+		{
+			"invalid length",
+			http.MethodPost,
+			http.Header{
+				"Authorization":           []string{"Bearer secret"},
+				"X-Upload-Content-Length": []string{"big"},
+			},
+			http.StatusBadRequest,
+		},
+		{
+			"method not allowed",
+			http.MethodPut,
+			http.Header{"Authorization": []string{"Bearer secret"}},
+			http.StatusMethodNotAllowed,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.testCase, func(t *testing.T) {
+			r := httptest.NewRequest(test.method, "/uploads/session.txt", nil)
+			r.Header = test.header
+			if r.Header == nil {
+				r.Header = http.Header{}
+			}
+			recorder := httptest.NewRecorder()
+			handler(recorder, r)
+			if recorder.Code != test.expectedStatus {
+				t.Fatalf("wrong status code\nwant %d\ngot  %d\n%s", test.expectedStatus, recorder.Code, recorder.Body)
+			}
+			if test.expectedStatus != http.StatusCreated {
+				return
+			}
+			var session uploadSession
+			if err := json.NewDecoder(recorder.Body).Decode(&session); err != nil {
+				t.Fatal(err)
+			}
+			if session.Bucket != "my-bucket" || session.Name != "uploads/session.txt" {
+				t.Errorf("wrong session returned: %#v", session)
+			}
+			req, _ := http.NewRequest(http.MethodPut, session.SessionURI, strings.NewReader("some uploaded content"))
+			resp, err := hc.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			obj, err := server.GetObject("my-bucket", "uploads/session.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(obj.Content) != "some uploaded content" {
+				t.Errorf("wrong content uploaded: %q", obj.Content)
+			}
+		})
+	}
+}
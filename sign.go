@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+const (
+	signingHost = "storage.googleapis.com"
+
+	signSchemeV2 = "v2"
+	signSchemeV4 = "v4"
+
+	signModeKey = "key"
+	signModeIAM = "iam"
+
+	signerGCS   = "gcs"
+	signerCDN   = "cdn"
+	signerToken = "token"
+
+	// maxV4Expiration is the maximum expiration accepted by GCS for V4
+	// signed URLs (7 days).
+	maxV4Expiration = 7 * 24 * time.Hour
+)
+
+// SignConfig contains the configuration used for generating signed URLs.
+type SignConfig struct {
+	GoogleAccessID          string        `envconfig:"GCS_HELPER_SIGN_GOOGLE_ACCESS_ID"`
+	PrivateKey              string        `envconfig:"GCS_HELPER_SIGN_PRIVATE_KEY"`
+	Expiration              time.Duration `envconfig:"GCS_HELPER_SIGN_EXPIRATION" default:"1h"`
+	Scheme                  string        `envconfig:"GCS_HELPER_SIGN_SCHEME" default:"v2"`
+	Mode                    string        `envconfig:"GCS_HELPER_SIGN_MODE" default:"key"`
+	PrivateKeySecret        string        `envconfig:"GCS_HELPER_SIGN_PRIVATE_KEY_SECRET"`
+	PrivateKeySecretRefresh time.Duration `envconfig:"GCS_HELPER_SIGN_PRIVATE_KEY_SECRET_REFRESH" default:"1h"`
+	Keys                    SigningKeys   `envconfig:"GCS_HELPER_SIGN_KEYS"`
+	MaxExpiration           time.Duration `envconfig:"GCS_HELPER_SIGN_MAX_EXPIRATION"`
+	CacheWindow             time.Duration `envconfig:"GCS_HELPER_SIGN_CACHE_WINDOW"`
+	CacheSize               int           `envconfig:"GCS_HELPER_SIGN_CACHE_SIZE" default:"10000"`
+	URLScheme               string        `envconfig:"GCS_HELPER_SIGN_URL_SCHEME"`
+	URLHost                 string        `envconfig:"GCS_HELPER_SIGN_URL_HOST"`
+	Method                  string        `envconfig:"GCS_HELPER_SIGN_METHOD" default:"GET"`
+	Headers                 []string      `envconfig:"GCS_HELPER_SIGN_HEADERS"`
+	ResponseDisposition     string        `envconfig:"GCS_HELPER_SIGN_RESPONSE_CONTENT_DISPOSITION"`
+
+	// iamClient is the authenticated client used for signing in the "iam"
+	// mode. It's set on startup, as it requires the default credentials.
+	iamClient *http.Client
+
+	// privateKeySecret holds the private key loaded from Secret Manager,
+	// when GCS_HELPER_SIGN_PRIVATE_KEY_SECRET is set.
+	privateKeySecret *secretKey
+
+	// parsedKey is PrivateKey, parsed when the configuration is loaded (see
+	// parseKeys), so it's not parsed again for every signature.
+	parsedKey *rsa.PrivateKey
+
+	// urlCache caches signed URLs when GCS_HELPER_SIGN_CACHE_WINDOW is set.
+	// It's shared by all handlers (see getHandler).
+	urlCache *signedURLCache
+}
+
+func (c SignConfig) enabled() bool {
+	if c.Mode == signModeIAM {
+		return c.GoogleAccessID != ""
+	}
+	return len(c.Keys) > 0 || c.GoogleAccessID != "" && (c.PrivateKey != "" || c.PrivateKeySecret != "")
+}
+
+func (c SignConfig) validate() error {
+	if c.Mode != signModeKey && c.Mode != signModeIAM {
+		return fmt.Errorf("invalid GCS_HELPER_SIGN_MODE %q: must be %q or %q", c.Mode, signModeKey, signModeIAM)
+	}
+	if c.PrivateKey != "" && c.PrivateKeySecret != "" {
+		return errors.New("GCS_HELPER_SIGN_PRIVATE_KEY and GCS_HELPER_SIGN_PRIVATE_KEY_SECRET can't be used together")
+	}
+	if c.PrivateKeySecret != "" && c.PrivateKeySecretRefresh <= 0 {
+		return errors.New("GCS_HELPER_SIGN_PRIVATE_KEY_SECRET_REFRESH must be positive")
+	}
+	if len(c.Keys) > 0 && (c.Mode == signModeIAM || c.PrivateKey != "" || c.PrivateKeySecret != "") {
+		return errors.New("GCS_HELPER_SIGN_KEYS can't be combined with other signing keys or the iam mode")
+	}
+	if c.CacheWindow < 0 || c.CacheSize < 0 {
+		return errors.New("GCS_HELPER_SIGN_CACHE_WINDOW and GCS_HELPER_SIGN_CACHE_SIZE can't be negative")
+	}
+	if c.URLScheme != "" && c.URLScheme != "http" && c.URLScheme != "https" {
+		return fmt.Errorf("invalid GCS_HELPER_SIGN_URL_SCHEME %q: must be %q or %q", c.URLScheme, "http", "https")
+	}
+	if c.Method != http.MethodGet && c.Method != http.MethodHead {
+		return fmt.Errorf("invalid GCS_HELPER_SIGN_METHOD %q: must be %q or %q", c.Method, http.MethodGet, http.MethodHead)
+	}
+	for _, header := range c.Headers {
+		parts := strings.SplitN(header, ":", 2)
+		if len(parts) != 2 || !strings.HasPrefix(strings.ToLower(strings.TrimSpace(parts[0])), "x-goog-") {
+			return fmt.Errorf("invalid GCS_HELPER_SIGN_HEADERS entry %q: must be an x-goog-* header in the name:value format", header)
+		}
+	}
+	if strings.Contains(c.URLHost, "/") {
+		return fmt.Errorf("invalid GCS_HELPER_SIGN_URL_HOST %q: must be a hostname", c.URLHost)
+	}
+	if err := c.Keys.validate(); err != nil {
+		return err
+	}
+	switch c.Scheme {
+	case signSchemeV2:
+	case signSchemeV4:
+		if c.Expiration > maxV4Expiration {
+			return fmt.Errorf("GCS_HELPER_SIGN_EXPIRATION must be at most %s when using V4 signing", maxV4Expiration)
+		}
+		if c.MaxExpiration > maxV4Expiration {
+			return fmt.Errorf("GCS_HELPER_SIGN_MAX_EXPIRATION must be at most %s when using V4 signing", maxV4Expiration)
+		}
+		if c.URLHost != "" {
+			return errors.New("GCS_HELPER_SIGN_URL_HOST can't be used with V4 signing, as the host is part of the signature")
+		}
+		if c.Expiration+c.CacheWindow > maxV4Expiration || c.MaxExpiration+c.CacheWindow > maxV4Expiration {
+			return fmt.Errorf("the expiration of cached URLs (including GCS_HELPER_SIGN_CACHE_WINDOW) must be at most %s when using V4 signing", maxV4Expiration)
+		}
+	default:
+		return fmt.Errorf("invalid GCS_HELPER_SIGN_SCHEME %q: must be %q or %q", c.Scheme, signSchemeV2, signSchemeV4)
+	}
+	return nil
+}
+
+// requestExpiration returns the expiration of URLs signed for the given
+// request. Clients may override the configured expiration with the "expires"
+// query string parameter, up to GCS_HELPER_SIGN_MAX_EXPIRATION (or the
+// configured expiration, when the maximum isn't set).
+func (c SignConfig) requestExpiration(r *http.Request) (time.Duration, error) {
+	return parseExpiration(r, c.Expiration, c.MaxExpiration)
+}
+
+func parseExpiration(r *http.Request, expiration, maxExpiration time.Duration) (time.Duration, error) {
+	value := r.URL.Query().Get("expires")
+	if value == "" {
+		return expiration, nil
+	}
+	requested, err := time.ParseDuration(value)
+	if err != nil || requested <= 0 {
+		return 0, errors.New("invalid expires")
+	}
+	if maxExpiration == 0 {
+		maxExpiration = expiration
+	}
+	if requested > maxExpiration {
+		return 0, fmt.Errorf("expires must be at most %s", maxExpiration)
+	}
+	return requested, nil
+}
+
+// rewriteURL replaces the scheme and the host of the given signed URL with
+// GCS_HELPER_SIGN_URL_SCHEME and GCS_HELPER_SIGN_URL_HOST, for serving signed
+// URLs through a proxy or a CDN in front of GCS.
+func (c SignConfig) rewriteURL(signed string) (string, error) {
+	if c.URLScheme == "" && c.URLHost == "" {
+		return signed, nil
+	}
+	u, err := url.Parse(signed)
+	if err != nil {
+		return "", err
+	}
+	if c.URLScheme != "" {
+		u.Scheme = c.URLScheme
+	}
+	if c.URLHost != "" {
+		u.Host = c.URLHost
+	}
+	return u.String(), nil
+}
+
+// signedURL returns a signed URL for the given object, using the configured
+// signing scheme. When GCS_HELPER_SIGN_CACHE_WINDOW is set, URLs are reused
+// within the window.
+func signedURL(c SignConfig, method, bucketName, objectName string) (string, error) {
+	if c.urlCache != nil {
+		return c.urlCache.get(c, method, bucketName, objectName, time.Now())
+	}
+	return signURLAt(c, method, bucketName, objectName, time.Now(), c.Expiration)
+}
+
+// signURLAt signs a URL that is valid from the given time, for the given
+// duration.
+func signURLAt(c SignConfig, method, bucketName, objectName string, now time.Time, expiration time.Duration) (signed string, err error) {
+	defer func() { signOperations.inc("gcs", signResult(err)) }()
+	c, err = c.withActiveKey(now)
+	if err != nil {
+		return "", err
+	}
+	c.Expiration = expiration
+	var query url.Values
+	if c.ResponseDisposition != "" {
+		query = url.Values{"response-content-disposition": {c.ResponseDisposition}}
+	}
+	if c.Scheme == signSchemeV4 {
+		return signedURLV4(c, method, bucketName, objectName, c.signedHeaders(), query, now)
+	}
+	signed, err = storage.SignedURL(bucketName, objectName, &storage.SignedURLOptions{
+		GoogleAccessID: c.GoogleAccessID,
+		SignBytes:      c.signBytes,
+		Method:         method,
+		Expires:        now.Add(expiration),
+		Headers:        c.extensionHeaders(),
+	})
+	if err != nil || query == nil {
+		return signed, err
+	}
+	// V2 signatures don't cover response-* parameters, so they're just
+	// appended to the signed URL.
+	return signed + "&" + strings.Replace(query.Encode(), "+", "%20", -1), nil
+}
+
+// extensionHeaders returns the headers configured in GCS_HELPER_SIGN_HEADERS
+// in the canonical format used in V2 signatures: lowercase names, sorted.
+func (c SignConfig) extensionHeaders() []string {
+	if len(c.Headers) == 0 {
+		return nil
+	}
+	headers := make([]string, 0, len(c.Headers))
+	for _, header := range c.Headers {
+		parts := strings.SplitN(header, ":", 2)
+		headers = append(headers, strings.ToLower(strings.TrimSpace(parts[0]))+":"+strings.TrimSpace(parts[1]))
+	}
+	sort.Strings(headers)
+	return headers
+}
+
+// signedHeaders returns the headers configured in GCS_HELPER_SIGN_HEADERS,
+// that clients must send along with signed URLs.
+func (c SignConfig) signedHeaders() http.Header {
+	if len(c.Headers) == 0 {
+		return nil
+	}
+	headers := make(http.Header, len(c.Headers))
+	for _, header := range c.Headers {
+		parts := strings.SplitN(header, ":", 2)
+		headers.Set(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+	return headers
+}
+
+// privateKey returns the private key used for signing, which is the one
+// loaded from Secret Manager when GCS_HELPER_SIGN_PRIVATE_KEY_SECRET is set.
+func (c SignConfig) privateKey() string {
+	if c.privateKeySecret != nil {
+		return c.privateKeySecret.get()
+	}
+	return c.PrivateKey
+}
+
+// signingKey returns the parsed private key used for signing. Keys that
+// weren't parsed on load, like invalid keys, are parsed on every call.
+func (c SignConfig) signingKey() (*rsa.PrivateKey, error) {
+	if c.privateKeySecret != nil {
+		if key := c.privateKeySecret.parsed(); key != nil {
+			return key, nil
+		}
+	} else if c.parsedKey != nil {
+		return c.parsedKey, nil
+	}
+	return parsePrivateKey([]byte(c.privateKey()))
+}
+
+// parseKeys parses GCS_HELPER_SIGN_PRIVATE_KEY and the keys in
+// GCS_HELPER_SIGN_KEYS. Invalid keys are reported when signing.
+func (c *SignConfig) parseKeys() {
+	c.parsedKey = nil
+	if c.PrivateKey != "" {
+		c.parsedKey, _ = parsePrivateKey([]byte(c.PrivateKey))
+	}
+	for i := range c.Keys {
+		c.Keys[i].parsedKey, _ = parsePrivateKey([]byte(c.Keys[i].PrivateKey))
+	}
+}
+
+// signBytes signs the given data with RSA-SHA256, using either the
+// configured private key or the IAM credentials API.
+func (c SignConfig) signBytes(data []byte) ([]byte, error) {
+	if c.Mode == signModeIAM {
+		return iamSignBlob(c.iamClient, c.GoogleAccessID, data)
+	}
+	key, err := c.signingKey()
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	return rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+}
+
+// signedURLV4 returns a URL signed with the V4 signing process, which
+// requires clients to send the given headers with the request. Parameters in
+// extraQuery (such as response-content-disposition) are signed as well.
+//
+// See https://cloud.google.com/storage/docs/access-control/signing-urls-manually.
+func signedURLV4(c SignConfig, method, bucketName, objectName string, headers http.Header, extraQuery url.Values, now time.Time) (string, error) {
+	if c.Expiration > maxV4Expiration {
+		return "", fmt.Errorf("expiration must be at most %s for V4 signed URLs", maxV4Expiration)
+	}
+	c, err := c.withActiveKey(now)
+	if err != nil {
+		return "", err
+	}
+	now = now.UTC()
+	timestamp := now.Format("20060102T150405Z")
+	scope := now.Format("20060102") + "/auto/storage/goog4_request"
+
+	canonicalHeaders := map[string]string{"host": signingHost}
+	for name, values := range headers {
+		canonicalHeaders[strings.ToLower(name)] = strings.Join(values, ",")
+	}
+	headerNames := make([]string, 0, len(canonicalHeaders))
+	for name := range canonicalHeaders {
+		headerNames = append(headerNames, name)
+	}
+	sort.Strings(headerNames)
+	var headerLines []string
+	for _, name := range headerNames {
+		headerLines = append(headerLines, name+":"+strings.TrimSpace(canonicalHeaders[name]))
+	}
+	signedHeaders := strings.Join(headerNames, ";")
+
+	query := url.Values{
+		"X-Goog-Algorithm":     {"GOOG4-RSA-SHA256"},
+		"X-Goog-Credential":    {c.GoogleAccessID + "/" + scope},
+		"X-Goog-Date":          {timestamp},
+		"X-Goog-Expires":       {strconv.Itoa(int(c.Expiration.Seconds()))},
+		"X-Goog-SignedHeaders": {signedHeaders},
+	}
+	for name, values := range extraQuery {
+		query[name] = values
+	}
+	canonicalQuery := strings.Replace(query.Encode(), "+", "%20", -1)
+	canonicalURI := "/" + escapePath(bucketName) + "/" + escapePath(objectName)
+	canonicalRequest := strings.Join([]string{
+		method,
+		canonicalURI,
+		canonicalQuery,
+		strings.Join(headerLines, "\n") + "\n",
+		signedHeaders,
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"GOOG4-RSA-SHA256",
+		timestamp,
+		scope,
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+	signature, err := c.signBytes([]byte(stringToSign))
+	if err != nil {
+		return "", err
+	}
+	return "https://" + signingHost + canonicalURI + "?" + canonicalQuery + "&X-Goog-Signature=" + hex.EncodeToString(signature), nil
+}
+
+// escapePath escapes each segment of the given path, keeping the slashes.
+func escapePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, segment := range segments {
+		segments[i] = strings.Replace(url.PathEscape(segment), "+", "%2B", -1)
+	}
+	return strings.Join(segments, "/")
+}
+
+// serviceAccountKey is the JSON key file of a service account, as created
+// by the IAM API.
+type serviceAccountKey struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+}
+
+// parseServiceAccountKey returns the JSON key file in the given key, and
+// false when it's not a JSON key file.
+func parseServiceAccountKey(key []byte) (serviceAccountKey, bool) {
+	var sa serviceAccountKey
+	if trimmed := bytes.TrimSpace(key); len(trimmed) == 0 || trimmed[0] != '{' {
+		return sa, false
+	}
+	if err := json.Unmarshal(key, &sa); err != nil || sa.PrivateKey == "" {
+		return sa, false
+	}
+	return sa, true
+}
+
+// parsePrivateKey parses an RSA private key, in either PKCS1 or PKCS8
+// format, optionally wrapped in a PEM container, or the private key of a
+// service account JSON key file.
+func parsePrivateKey(key []byte) (*rsa.PrivateKey, error) {
+	if sa, ok := parseServiceAccountKey(key); ok {
+		key = []byte(sa.PrivateKey)
+	}
+	if block, _ := pem.Decode(key); block != nil {
+		key = block.Bytes
+	}
+	parsedKey, err := x509.ParsePKCS8PrivateKey(key)
+	if err != nil {
+		parsedKey, err = x509.ParsePKCS1PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+	}
+	parsed, ok := parsedKey.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("private key is not an RSA key")
+	}
+	return parsed, nil
+}
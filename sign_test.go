@@ -0,0 +1,318 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testKey *rsa.PrivateKey
+
+func testSignConfig(t *testing.T) SignConfig {
+	if testKey == nil {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testKey = key
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(testKey),
+	})
+	return SignConfig{
+		GoogleAccessID: "signer@project.iam.gserviceaccount.com",
+		PrivateKey:     string(keyPEM),
+		Expiration:     time.Hour,
+		Scheme:         signSchemeV2,
+		Mode:           signModeKey,
+		Method:         http.MethodGet,
+	}
+}
+
+func TestSignedURL(t *testing.T) {
+	c := testSignConfig(t)
+	signed, err := signedURL(c, http.MethodGet, "my-bucket", "videos/video1_720p.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Host != "storage.googleapis.com" || u.Path != "/my-bucket/videos/video1_720p.mp4" {
+		t.Errorf("wrong url returned: %s", signed)
+	}
+	q := u.Query()
+	if accessID := q.Get("GoogleAccessId"); accessID != c.GoogleAccessID {
+		t.Errorf("wrong GoogleAccessId\nwant %q\ngot  %q", c.GoogleAccessID, accessID)
+	}
+	expires, err := strconv.ParseInt(q.Get("Expires"), 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Until(time.Unix(expires, 0)); d < 59*time.Minute || d > time.Hour {
+		t.Errorf("wrong expiration: %s", d)
+	}
+	signature, err := base64.StdEncoding.DecodeString(q.Get("Signature"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte("GET\n\n\n" + q.Get("Expires") + "\n/my-bucket/videos/video1_720p.mp4"))
+	if err = rsa.VerifyPKCS1v15(&testKey.PublicKey, crypto.SHA256, sum[:], signature); err != nil {
+		t.Errorf("invalid signature: %v", err)
+	}
+}
+
+func TestSignedURLV4(t *testing.T) {
+	c := testSignConfig(t)
+	now := time.Date(2018, time.March, 10, 14, 30, 12, 0, time.UTC)
+	headers := http.Header{}
+	headers.Set("Content-Type", "video/mp4")
+	headers.Set("X-Goog-Content-Length-Range", "0,1024")
+	signed, err := signedURLV4(c, http.MethodPut, "my-bucket", "videos/video 1.mp4", headers, nil, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Host != "storage.googleapis.com" || u.EscapedPath() != "/my-bucket/videos/video%201.mp4" {
+		t.Errorf("wrong url returned: %s", signed)
+	}
+	q := u.Query()
+	var tests = []struct {
+		param    string
+		expected string
+	}{
+		{"X-Goog-Algorithm", "GOOG4-RSA-SHA256"},
+		{"X-Goog-Credential", c.GoogleAccessID + "/20180310/auto/storage/goog4_request"},
+		{"X-Goog-Date", "20180310T143012Z"},
+		{"X-Goog-Expires", "3600"},
+		{"X-Goog-SignedHeaders", "content-type;host;x-goog-content-length-range"},
+	}
+	for _, test := range tests {
+		if got := q.Get(test.param); got != test.expected {
+			t.Errorf("wrong %s\nwant %q\ngot  %q", test.param, test.expected, got)
+		}
+	}
+	signature, err := hex.DecodeString(q.Get("X-Goog-Signature"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	canonicalQuery := signed[strings.Index(signed, "?")+1 : strings.Index(signed, "&X-Goog-Signature=")]
+	canonicalRequest := "PUT\n/my-bucket/videos/video%201.mp4\n" + canonicalQuery + "\n" +
+		"content-type:video/mp4\nhost:storage.googleapis.com\nx-goog-content-length-range:0,1024\n\n" +
+		"content-type;host;x-goog-content-length-range\nUNSIGNED-PAYLOAD"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "GOOG4-RSA-SHA256\n20180310T143012Z\n20180310/auto/storage/goog4_request\n" + hex.EncodeToString(requestHash[:])
+	sum := sha256.Sum256([]byte(stringToSign))
+	if err = rsa.VerifyPKCS1v15(&testKey.PublicKey, crypto.SHA256, sum[:], signature); err != nil {
+		t.Errorf("invalid signature: %v", err)
+	}
+}
+
+func TestSignedURLSchemeV4(t *testing.T) {
+	c := testSignConfig(t)
+	c.Scheme = signSchemeV4
+	signed, err := signedURL(c, http.MethodGet, "my-bucket", "videos/video1_720p.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if algorithm := q.Get("X-Goog-Algorithm"); algorithm != "GOOG4-RSA-SHA256" {
+		t.Errorf("wrong algorithm\nwant %q\ngot  %q", "GOOG4-RSA-SHA256", algorithm)
+	}
+	if signedHeaders := q.Get("X-Goog-SignedHeaders"); signedHeaders != "host" {
+		t.Errorf("wrong signed headers\nwant %q\ngot  %q", "host", signedHeaders)
+	}
+	if q.Get("GoogleAccessId") != "" || q.Get("X-Goog-Signature") == "" {
+		t.Errorf("url not signed with V4: %s", signed)
+	}
+}
+
+func TestSignedURLHeaders(t *testing.T) {
+	c := testSignConfig(t)
+	c.Headers = []string{"X-Goog-Meta-Source: encoder", "x-goog-content-sha256:UNSIGNED-PAYLOAD"}
+	c.ResponseDisposition = "attachment; filename=video.mp4"
+	signed, err := signedURL(c, http.MethodHead, "my-bucket", "videos/video1_720p.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if disposition := q.Get("response-content-disposition"); disposition != c.ResponseDisposition {
+		t.Errorf("wrong response-content-disposition\nwant %q\ngot  %q", c.ResponseDisposition, disposition)
+	}
+	signature, err := base64.StdEncoding.DecodeString(q.Get("Signature"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte("HEAD\n\n\n" + q.Get("Expires") + "\n" +
+		"x-goog-content-sha256:UNSIGNED-PAYLOAD\nx-goog-meta-source:encoder\n" +
+		"/my-bucket/videos/video1_720p.mp4"))
+	if err = rsa.VerifyPKCS1v15(&testKey.PublicKey, crypto.SHA256, sum[:], signature); err != nil {
+		t.Errorf("invalid signature: %v", err)
+	}
+}
+
+func TestSignedURLHeadersV4(t *testing.T) {
+	c := testSignConfig(t)
+	c.Scheme = signSchemeV4
+	c.Headers = []string{"x-goog-content-sha256:UNSIGNED-PAYLOAD"}
+	c.ResponseDisposition = "attachment"
+	signed, err := signedURL(c, http.MethodGet, "my-bucket", "videos/video1_720p.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if signedHeaders := q.Get("X-Goog-SignedHeaders"); signedHeaders != "host;x-goog-content-sha256" {
+		t.Errorf("wrong signed headers\nwant %q\ngot  %q", "host;x-goog-content-sha256", signedHeaders)
+	}
+	canonicalQuery := signed[strings.Index(signed, "?")+1 : strings.Index(signed, "&X-Goog-Signature=")]
+	if !strings.Contains(canonicalQuery, "response-content-disposition=attachment") {
+		t.Errorf("response-content-disposition not signed: %s", signed)
+	}
+}
+
+func TestSignedURLV4ExpirationTooLong(t *testing.T) {
+	c := testSignConfig(t)
+	c.Expiration = 8 * 24 * time.Hour
+	_, err := signedURLV4(c, http.MethodPut, "my-bucket", "video.mp4", nil, nil, time.Now())
+	if err == nil {
+		t.Error("unexpected <nil> error")
+	}
+}
+
+func TestSignConfigParseKeys(t *testing.T) {
+	c := testSignConfig(t)
+	c.parseKeys()
+	if c.parsedKey == nil || c.parsedKey.N.Cmp(testKey.N) != 0 {
+		t.Fatal("private key not parsed")
+	}
+	if key, err := c.signingKey(); err != nil || key != c.parsedKey {
+		t.Errorf("signing key not reused\nwant %p\ngot  %p (%v)", c.parsedKey, key, err)
+	}
+
+	c.Keys = SigningKeys{{GoogleAccessID: c.GoogleAccessID, PrivateKey: c.PrivateKey}}
+	c.PrivateKey = ""
+	c.parseKeys()
+	if c.parsedKey != nil {
+		t.Error("private key not cleared")
+	}
+	active, err := c.withActiveKey(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key, err := active.signingKey(); err != nil || key != c.Keys[0].parsedKey {
+		t.Errorf("signing key of GCS_HELPER_SIGN_KEYS not reused\nwant %p\ngot  %p (%v)", c.Keys[0].parsedKey, key, err)
+	}
+
+	c = SignConfig{PrivateKey: "not a key"}
+	c.parseKeys()
+	if _, err = c.signingKey(); err == nil {
+		t.Error("unexpected <nil> error")
+	}
+}
+
+func TestRequestExpiration(t *testing.T) {
+	var tests = []struct {
+		testCase      string
+		maxExpiration time.Duration
+		query         string
+		expected      time.Duration
+		expectError   bool
+	}{
+		{"default", 0, "", time.Hour, false},
+		{"shorter", 0, "expires=5m", 5 * time.Minute, false},
+		{"longer without maximum", 0, "expires=2h", 0, true},
+		{"longer with maximum", 24 * time.Hour, "expires=2h", 2 * time.Hour, false},
+		{"above maximum", 24 * time.Hour, "expires=25h", 0, true},
+		{"invalid", 0, "expires=tomorrow", 0, true},
+		{"negative", 0, "expires=-5m", 0, true},
+	}
+	for _, test := range tests {
+		t.Run(test.testCase, func(t *testing.T) {
+			c := testSignConfig(t)
+			c.MaxExpiration = test.maxExpiration
+			r, _ := http.NewRequest(http.MethodGet, "/video.mp4?"+test.query, nil)
+			expiration, err := c.requestExpiration(r)
+			if test.expectError {
+				if err == nil {
+					t.Error("unexpected <nil> error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expiration != test.expected {
+				t.Errorf("wrong expiration\nwant %s\ngot  %s", test.expected, expiration)
+			}
+		})
+	}
+}
+
+func TestSignConfigRewriteURL(t *testing.T) {
+	const signed = "https://storage.googleapis.com/my-bucket/videos/video%201.mp4?Expires=1520692812&GoogleAccessId=signer&Signature=a%2Bb%3D"
+	var tests = []struct {
+		testCase string
+		scheme   string
+		host     string
+		expected string
+	}{
+		{
+			"no rewrite",
+			"",
+			"",
+			signed,
+		},
+		{
+			"host",
+			"",
+			"cdn.example.com",
+			"https://cdn.example.com/my-bucket/videos/video%201.mp4?Expires=1520692812&GoogleAccessId=signer&Signature=a%2Bb%3D",
+		},
+		{
+			"scheme and host",
+			"http",
+			"localhost:8080",
+			"http://localhost:8080/my-bucket/videos/video%201.mp4?Expires=1520692812&GoogleAccessId=signer&Signature=a%2Bb%3D",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.testCase, func(t *testing.T) {
+			c := SignConfig{URLScheme: test.scheme, URLHost: test.host}
+			got, err := c.rewriteURL(signed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.expected {
+				t.Errorf("wrong url\nwant %q\ngot  %q", test.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+type signedURLKey struct {
+	method     string
+	bucketName string
+	objectName string
+	expiration time.Duration
+}
+
+// signedURLCache caches signed URLs to avoid signing the same URL on every
+// request. Expirations are quantized to windows of GCS_HELPER_SIGN_CACHE_WINDOW:
+// URLs signed within a window share the same start time, and are valid for
+// the requested expiration plus the window, so they're never valid for less
+// than requested.
+type signedURLCache struct {
+	window  time.Duration
+	maxSize int
+
+	mu          sync.Mutex
+	windowStart time.Time
+	urls        map[signedURLKey]string
+}
+
+func newSignedURLCache(c SignConfig) *signedURLCache {
+	return &signedURLCache{
+		window:  c.CacheWindow,
+		maxSize: c.CacheSize,
+		urls:    make(map[signedURLKey]string),
+	}
+}
+
+func (s *signedURLCache) get(c SignConfig, method, bucketName, objectName string, now time.Time) (string, error) {
+	windowStart := now.Truncate(s.window)
+	key := signedURLKey{method: method, bucketName: bucketName, objectName: objectName, expiration: c.Expiration}
+	s.mu.Lock()
+	if !windowStart.Equal(s.windowStart) {
+		// URLs from previous windows are never used again.
+		s.windowStart = windowStart
+		s.urls = make(map[signedURLKey]string)
+	}
+	url, ok := s.urls[key]
+	s.mu.Unlock()
+	cacheRequests.inc("signed_url", cacheResult(ok))
+	if ok {
+		return url, nil
+	}
+	url, err := signURLAt(c, method, bucketName, objectName, windowStart, c.Expiration+s.window)
+	if err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	if windowStart.Equal(s.windowStart) {
+		if s.maxSize > 0 && len(s.urls) >= s.maxSize {
+			s.urls = make(map[signedURLKey]string)
+		}
+		s.urls[key] = url
+	}
+	s.mu.Unlock()
+	return url, nil
+}
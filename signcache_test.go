@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSignedURLCache(t *testing.T) {
+	c := testSignConfig(t)
+	c.CacheWindow = 5 * time.Minute
+	c.CacheSize = 2
+	c.urlCache = newSignedURLCache(c)
+	now := time.Date(2018, time.March, 10, 14, 31, 12, 0, time.UTC)
+
+	first, err := c.urlCache.get(c, http.MethodGet, "my-bucket", "video1.mp4", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := c.urlCache.get(c, http.MethodGet, "my-bucket", "video1.mp4", now.Add(3*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second {
+		t.Errorf("expected the same url within the window\nfirst  %q\nsecond %q", first, second)
+	}
+	u, err := url.Parse(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expires, err := strconv.ParseInt(u.Query().Get("Expires"), 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// window starts at 14:30, so the url is valid until 15:35.
+	if expected := time.Date(2018, time.March, 10, 15, 35, 0, 0, time.UTC); !time.Unix(expires, 0).Equal(expected) {
+		t.Errorf("wrong expiration\nwant %s\ngot  %s", expected, time.Unix(expires, 0).UTC())
+	}
+
+	third, err := c.urlCache.get(c, http.MethodGet, "my-bucket", "video1.mp4", now.Add(4*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third == first {
+		t.Error("expected a new url in the next window")
+	}
+
+	c.Expiration = 5 * time.Minute
+	other, err := c.urlCache.get(c, http.MethodGet, "my-bucket", "video1.mp4", now.Add(4*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == third {
+		t.Error("expected different urls for different expirations")
+	}
+	c.urlCache.get(c, http.MethodGet, "my-bucket", "video2.mp4", now.Add(4*time.Minute))
+	if size := len(c.urlCache.urls); size > c.CacheSize {
+		t.Errorf("cache exceeded its maximum size: %d", size)
+	}
+}
+
+func TestSignedURLUsesCache(t *testing.T) {
+	c := testSignConfig(t)
+	c.CacheWindow = time.Hour
+	c.urlCache = newSignedURLCache(c)
+	first, err := signedURL(c, http.MethodGet, "my-bucket", "video1.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := signedURL(c, http.MethodGet, "my-bucket", "video1.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second {
+		t.Errorf("expected cached url\nfirst  %q\nsecond %q", first, second)
+	}
+}
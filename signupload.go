@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+type signedUpload struct {
+	URL     string            `json:"url"`
+	Method  string            `json:"method"`
+	Headers map[string]string `json:"headers"`
+	Expires time.Time         `json:"expires"`
+}
+
+// getSignUploadHandler returns a handler that generates V4 signed URLs for
+// uploading objects directly to GCS. The signed URLs require the client to
+// send the expected Content-Type and a X-Goog-Content-Length-Range header
+// that limits the size of the upload.
+func getSignUploadHandler(c Config) http.HandlerFunc {
+	logger := c.logger()
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !authorized(r, c.UploadToken) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		maxSize := c.UploadMaxSize
+		if value := r.URL.Query().Get("maxSize"); value != "" {
+			size, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || size < 0 {
+				http.Error(w, "invalid maxSize", http.StatusBadRequest)
+				return
+			}
+			if size > maxSize {
+				http.Error(w, "maxSize exceeds the maximum upload size", http.StatusBadRequest)
+				return
+			}
+			maxSize = size
+		}
+		bucketName, objectName, err := objectLocation(&c, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ct := r.URL.Query().Get("contentType")
+		if ct == "" {
+			ct = contentType(&c, &storage.ObjectAttrs{Name: objectName})
+		}
+		headers := http.Header{}
+		headers.Set("Content-Type", ct)
+		headers.Set("X-Goog-Content-Length-Range", "0,"+strconv.FormatInt(maxSize, 10))
+		now := time.Now()
+		url, err := signedURLV4(c.SignConfig, http.MethodPut, bucketName, objectName, headers, nil, now)
+		if err != nil {
+			requestLogger(r.Context(), logger).WithError(err).WithField("url", r.URL.RequestURI()).Error("failed to sign upload url")
+			http.Error(w, "failed to sign url", http.StatusInternalServerError)
+			return
+		}
+		c.audit(r, auditEvent{Kind: auditKindUpload, Signer: signerGCS, Method: http.MethodPut, Bucket: bucketName, Object: objectName, Expires: now.Add(c.SignConfig.Expiration)})
+		upload := signedUpload{
+			URL:     url,
+			Method:  http.MethodPut,
+			Headers: make(map[string]string, len(headers)),
+			Expires: now.Add(c.SignConfig.Expiration).UTC().Truncate(time.Second),
+		}
+		for name := range headers {
+			upload.Headers[name] = headers.Get(name)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(upload)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestSignUploadHandler(t *testing.T) {
+	handler := getSignUploadHandler(Config{
+		BucketName:    "my-bucket",
+		UploadToken:   "secret",
+		UploadMaxSize: 1024,
+		SignConfig:    testSignConfig(t),
+	})
+
+	var tests = []struct {
+		testCase        string
+		method          string
+		target          string
+		token           string
+		expectedStatus  int
+		expectedHeaders map[string]string
+	}{
+		{
+			"sign upload",
+			http.MethodPost,
+			"/videos/clip.mp4",
+			"secret",
+			http.StatusOK,
+			map[string]string{
+				"Content-Type":                "video/mp4",
+				"X-Goog-Content-Length-Range": "0,1024",
+			},
+		},
+		{
+			"sign upload - custom content type and size",
+			http.MethodPost,
+			"/captions/en.vtt?contentType=text/plain&maxSize=512",
+			"secret",
+			http.StatusOK,
+			map[string]string{
+				"Content-Type":                "text/plain",
+				"X-Goog-Content-Length-Range": "0,512",
+			},
+		},
+		{
+			"size above the maximum",
+			http.MethodPost,
+			"/videos/clip.mp4?maxSize=2048",
+			"secret",
+			http.StatusBadRequest,
+			nil,
+		},
+		{
+			"invalid size",
+			http.MethodPost,
+			"/videos/clip.mp4?maxSize=big",
+			"secret",
+			http.StatusBadRequest,
+			nil,
+		},
+		{
+			"wrong token",
+			http.MethodPost,
+			"/videos/clip.mp4",
+			"not-secret",
+			http.StatusUnauthorized,
+			nil,
+		},
+		{
+			"method not allowed",
+			http.MethodGet,
+			"/videos/clip.mp4",
+			"secret",
+			http.StatusMethodNotAllowed,
+			nil,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.testCase, func(t *testing.T) {
+			r := httptest.NewRequest(test.method, test.target, nil)
+			r.Header.Set("Authorization", "Bearer "+test.token)
+			recorder := httptest.NewRecorder()
+			handler(recorder, r)
+			if recorder.Code != test.expectedStatus {
+				t.Fatalf("wrong status code\nwant %d\ngot  %d", test.expectedStatus, recorder.Code)
+			}
+			if test.expectedStatus != http.StatusOK {
+				return
+			}
+			var upload signedUpload
+			if err := json.NewDecoder(recorder.Body).Decode(&upload); err != nil {
+				t.Fatal(err)
+			}
+			if upload.Method != http.MethodPut {
+				t.Errorf("wrong method\nwant %q\ngot  %q", http.MethodPut, upload.Method)
+			}
+			for name, value := range test.expectedHeaders {
+				if got := upload.Headers[name]; got != value {
+					t.Errorf("wrong header %s\nwant %q\ngot  %q", name, value, got)
+				}
+			}
+			u, err := url.Parse(upload.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expectedPath := "/my-bucket" + r.URL.Path; u.Path != expectedPath {
+				t.Errorf("wrong path\nwant %q\ngot  %q", expectedPath, u.Path)
+			}
+		})
+	}
+}
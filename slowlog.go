@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// slowRequestHandler wraps the given handler, logging a warning for the
+// requests that take longer than GCS_HELPER_SLOW_REQUEST_THRESHOLD, with the
+// breakdown of their duration added by the handlers (see addLogFields and
+// addLogDuration), like the time spent listing and signing and the number of
+// mapped objects, so pathological prefixes are noticed early.
+func slowRequestHandler(c Config, logger *logrus.Logger, handler http.HandlerFunc) http.HandlerFunc {
+	if c.SlowRequestThreshold <= 0 {
+		return handler
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		path := requestPath(r)
+		// the fields are shared with the access log, when enabled.
+		ctx := r.Context()
+		rf, ok := ctx.Value(logFieldsKey{}).(*requestLogFields)
+		if !ok {
+			rf = &requestLogFields{fields: make(logrus.Fields)}
+			ctx = context.WithValue(ctx, logFieldsKey{}, rf)
+		}
+		sw := &statusWriter{ResponseWriter: w}
+		handler(sw, r.WithContext(ctx))
+		duration := time.Since(start)
+		if duration < c.SlowRequestThreshold {
+			return
+		}
+		rf.mu.Lock()
+		fields := make(logrus.Fields, len(rf.fields)+6)
+		for key, value := range rf.fields {
+			fields[key] = value
+		}
+		rf.mu.Unlock()
+		fields["method"] = r.Method
+		fields["path"] = path
+		fields["status"] = sw.code()
+		fields["bytes"] = sw.size
+		fields["duration"] = duration.Seconds()
+		fields["threshold"] = c.SlowRequestThreshold.Seconds()
+		requestLogger(r.Context(), logger).WithFields(fields).Warn("slow request")
+	}
+}
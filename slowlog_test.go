@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fsouza/fake-gcs-server/fakestorage"
+	"github.com/sirupsen/logrus"
+)
+
+func TestSlowRequestLog(t *testing.T) {
+	server := fakestorage.NewServer(getObjects())
+	defer server.Stop()
+	var buf bytes.Buffer
+	logger := logrus.New()
+	logger.Out = &buf
+	logger.Formatter = &logrus.JSONFormatter{}
+	config := Config{
+		BucketName:           "my-bucket",
+		LogLevel:             "error",
+		SlowRequestThreshold: time.Nanosecond,
+	}
+	handler := slowRequestHandler(config, logger, instrumentHandler("map", getMapHandler(config, server.Client())))
+	req := httptest.NewRequest(http.MethodGet, "/map/videos/video/", nil)
+	req.URL.Path = "/videos/video/"
+	handler(httptest.NewRecorder(), req)
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("%v: %s", err, buf.String())
+	}
+	expected := map[string]interface{}{
+		"msg":       "slow request",
+		"level":     "warning",
+		"handler":   "map",
+		"method":    "GET",
+		"path":      "/map/videos/video/",
+		"status":    float64(200),
+		"prefix":    "videos/video/",
+		"objects":   float64(5),
+		"threshold": 1e-9,
+	}
+	for key, value := range expected {
+		if entry[key] != value {
+			t.Errorf("wrong %s\nwant %#v\ngot  %#v", key, value, entry[key])
+		}
+	}
+	for _, key := range []string{"duration", "listDuration"} {
+		if _, ok := entry[key].(float64); !ok {
+			t.Errorf("missing %s in %v", key, entry)
+		}
+	}
+}
+
+func TestSlowRequestLogFastRequest(t *testing.T) {
+	var buf bytes.Buffer
+	logger := logrus.New()
+	logger.Out = &buf
+	for _, threshold := range []time.Duration{0, time.Hour} {
+		handler := slowRequestHandler(Config{SlowRequestThreshold: threshold}, logger, func(w http.ResponseWriter, r *http.Request) {})
+		handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/proxy/video.mp4", nil))
+		if buf.Len() > 0 {
+			t.Errorf("%s: unexpected log %q", threshold, buf.String())
+		}
+	}
+}
+
+func TestAddLogDuration(t *testing.T) {
+	var buf bytes.Buffer
+	logger := logrus.New()
+	logger.Out = &buf
+	logger.Formatter = &logrus.JSONFormatter{}
+	handler := slowRequestHandler(Config{SlowRequestThreshold: time.Nanosecond}, logger, func(w http.ResponseWriter, r *http.Request) {
+		addLogDuration(r.Context(), "signDuration", 250*time.Millisecond)
+		addLogDuration(r.Context(), "signDuration", 500*time.Millisecond)
+	})
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/map/videos/", nil))
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("%v: %s", err, buf.String())
+	}
+	if entry["signDuration"] != 0.75 {
+		t.Errorf("wrong signDuration\nwant %v\ngot  %#v", 0.75, entry["signDuration"])
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// strictProblems returns the settings that are accepted by validate but are
+// most likely mistakes: log levels that fall back to debug, route prefixes
+// that don't match as intended, durations that disable timeouts or expire
+// immediately, and signers with only half of their configuration. With
+// GCS_HELPER_STRICT_CONFIG (the default) they're reported as errors,
+// otherwise they're logged as warnings on startup.
+func (c Config) strictProblems() []string {
+	var problems []string
+	if _, err := logrus.ParseLevel(c.LogLevel); err != nil {
+		problems = append(problems, fmt.Sprintf("invalid GCS_HELPER_LOG_LEVEL: %v", err))
+	}
+	prefixes := []struct {
+		name  string
+		value string
+	}{
+		{"GCS_HELPER_PROXY_PREFIX", c.ProxyPrefix},
+		{"GCS_HELPER_MAP_PREFIX", c.MapPrefix},
+		{"GCS_HELPER_MAP_HLS_PREFIX", c.MapHLSPrefix},
+		{"GCS_HELPER_MAP_DASH_PREFIX", c.MapDASHPrefix},
+		{"GCS_HELPER_MAP_ISM_PREFIX", c.MapISMPrefix},
+		{"GCS_HELPER_MAP_TEMPLATE_PREFIX", c.MapTemplatePrefix},
+		{"GCS_HELPER_META_PREFIX", c.MetaPrefix},
+		{"GCS_HELPER_REDIRECT_PREFIX", c.RedirectPrefix},
+		{"GCS_HELPER_SIGN_PREFIX", c.SignPrefix},
+		{"GCS_HELPER_SIGN_COOKIE_PREFIX", c.SignCookiePrefix},
+		{"GCS_HELPER_LIST_PREFIX", c.ListPrefix},
+		{"GCS_HELPER_UPLOAD_PREFIX", c.UploadPrefix},
+		{"GCS_HELPER_UPLOAD_SESSION_PREFIX", c.UploadSessionPrefix},
+		{"GCS_HELPER_SIGN_UPLOAD_PREFIX", c.SignUploadPrefix},
+		{"GCS_HELPER_DELETE_PREFIX", c.DeletePrefix},
+		{"GCS_HELPER_COPY_PREFIX", c.CopyPrefix},
+		{"GCS_HELPER_COMPOSE_PREFIX", c.ComposePrefix},
+		{"GCS_HELPER_ADMIN_PREFIX", c.AdminPrefix},
+	}
+	for _, prefix := range prefixes {
+		if prefix.value != "" && (!strings.HasPrefix(prefix.value, "/") || !strings.HasSuffix(prefix.value, "/")) {
+			problems = append(problems, fmt.Sprintf("invalid %s %q: must start and end with /, like %q", prefix.name, prefix.value, "/"+strings.Trim(prefix.value, "/")+"/"))
+		}
+	}
+	if c.VersionPath != "" && !strings.HasPrefix(c.VersionPath, "/") {
+		problems = append(problems, fmt.Sprintf("invalid GCS_HELPER_VERSION_PATH %q: must start with /", c.VersionPath))
+	}
+	if c.MetricsPath != "" && !strings.HasPrefix(c.MetricsPath, "/") {
+		problems = append(problems, fmt.Sprintf("invalid GCS_HELPER_METRICS_PATH %q: must start with /", c.MetricsPath))
+	}
+	if c.LivenessPath != "" && !strings.HasPrefix(c.LivenessPath, "/") {
+		problems = append(problems, fmt.Sprintf("invalid GCS_HELPER_LIVENESS_PATH %q: must start with /", c.LivenessPath))
+	}
+	if c.ReadinessPath != "" && !strings.HasPrefix(c.ReadinessPath, "/") {
+		problems = append(problems, fmt.Sprintf("invalid GCS_HELPER_READINESS_PATH %q: must start with /", c.ReadinessPath))
+	}
+	durations := []struct {
+		name     string
+		value    time.Duration
+		positive bool
+	}{
+		{"GCS_HELPER_PROXY_TIMEOUT", c.ProxyTimeout, true},
+		{"GCS_HELPER_READINESS_TIMEOUT", c.ReadinessTimeout, true},
+		{"GCS_HELPER_MAP_TIMEOUT", c.MapTimeout, false},
+		{"GCS_HELPER_SLOW_REQUEST_THRESHOLD", c.SlowRequestThreshold, false},
+		{"GCS_HELPER_MAP_CACHE_TTL", c.MapCacheTTL, false},
+		{"GCS_CLIENT_TIMEOUT", c.ClientConfig.Timeout, true},
+		{"GCS_CLIENT_IDLE_CONN_TIMEOUT", c.ClientConfig.IdleConnTimeout, false},
+		{"GCS_CLIENT_DIAL_TIMEOUT", c.ClientConfig.DialTimeout, false},
+		{"GCS_CLIENT_TLS_HANDSHAKE_TIMEOUT", c.ClientConfig.TLSHandshakeTimeout, false},
+		{"GCS_HELPER_SIGN_EXPIRATION", c.SignConfig.Expiration, true},
+		{"GCS_HELPER_SIGN_MAX_EXPIRATION", c.SignConfig.MaxExpiration, false},
+		{"GCS_HELPER_CDN_EXPIRATION", c.CDNConfig.Expiration, true},
+		{"GCS_HELPER_CDN_MAX_EXPIRATION", c.CDNConfig.MaxExpiration, false},
+		{"GCS_HELPER_TOKEN_EXPIRATION", c.TokenConfig.Expiration, true},
+		{"GCS_HELPER_TOKEN_MAX_EXPIRATION", c.TokenConfig.MaxExpiration, false},
+	}
+	for _, d := range durations {
+		if d.positive && d.value <= 0 {
+			problems = append(problems, fmt.Sprintf("invalid %s %s: must be positive", d.name, d.value))
+		} else if d.value < 0 {
+			problems = append(problems, fmt.Sprintf("invalid %s %s: can't be negative (use 0 to disable it)", d.name, d.value))
+		}
+	}
+	sign := c.SignConfig
+	hasKey := sign.PrivateKey != "" || sign.PrivateKeySecret != ""
+	if sign.Mode == signModeKey && len(sign.Keys) == 0 && (sign.GoogleAccessID != "") != hasKey {
+		problems = append(problems, "incomplete signer: GCS_HELPER_SIGN_GOOGLE_ACCESS_ID and GCS_HELPER_SIGN_PRIVATE_KEY (or GCS_HELPER_SIGN_PRIVATE_KEY_SECRET) must be set together")
+	}
+	if sign.Mode == signModeIAM && sign.GoogleAccessID == "" {
+		problems = append(problems, "incomplete signer: the iam mode of GCS_HELPER_SIGN_MODE requires GCS_HELPER_SIGN_GOOGLE_ACCESS_ID")
+	}
+	if cdn := c.CDNConfig; (cdn.URLPrefix != "" || cdn.KeyName != "" || cdn.Key != "") && !cdn.enabled() {
+		problems = append(problems, "incomplete signer: GCS_HELPER_CDN_URL_PREFIX, GCS_HELPER_CDN_KEY_NAME and GCS_HELPER_CDN_KEY must be set together")
+	}
+	if token := c.TokenConfig; (token.URLPrefix != "" || token.Key != "") && !token.enabled() {
+		problems = append(problems, "incomplete signer: GCS_HELPER_TOKEN_URL_PREFIX and GCS_HELPER_TOKEN_KEY must be set together")
+	}
+	return problems
+}
+
+// validateStrict returns an error listing the problems found by
+// strictProblems, when GCS_HELPER_STRICT_CONFIG is enabled.
+func (c Config) validateStrict() error {
+	if !c.StrictConfig {
+		return nil
+	}
+	problems := c.strictProblems()
+	if len(problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%s (set GCS_HELPER_STRICT_CONFIG=false to only log these problems)", strings.Join(problems, "; "))
+}
+
+// warnStrictProblems logs the problems found by strictProblems when
+// GCS_HELPER_STRICT_CONFIG is disabled.
+func (c Config) warnStrictProblems(logger *logrus.Logger) {
+	if c.StrictConfig {
+		return
+	}
+	for _, problem := range c.strictProblems() {
+		logger.Warn(problem)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestLoadConfigStrict(t *testing.T) {
+	var tests = []struct {
+		testCase string
+		envs     map[string]string
+		expected string
+	}{
+		{
+			"invalid log level",
+			map[string]string{"GCS_HELPER_LOG_LEVEL": "verbose"},
+			`invalid GCS_HELPER_LOG_LEVEL: not a valid logrus Level: "verbose"`,
+		},
+		{
+			"prefix without trailing slash",
+			map[string]string{"GCS_HELPER_PROXY_PREFIX": "/proxy"},
+			`invalid GCS_HELPER_PROXY_PREFIX "/proxy": must start and end with /, like "/proxy/"`,
+		},
+		{
+			"prefix without leading slash",
+			map[string]string{"GCS_HELPER_MAP_PREFIX": "map/"},
+			`invalid GCS_HELPER_MAP_PREFIX "map/": must start and end with /, like "/map/"`,
+		},
+		{
+			"readiness path without leading slash",
+			map[string]string{"GCS_HELPER_READINESS_PATH": "readyz"},
+			`invalid GCS_HELPER_READINESS_PATH "readyz": must start with /`,
+		},
+		{
+			"zero timeout",
+			map[string]string{"GCS_HELPER_PROXY_TIMEOUT": "0s"},
+			"invalid GCS_HELPER_PROXY_TIMEOUT 0s: must be positive",
+		},
+		{
+			"negative map timeout",
+			map[string]string{"GCS_HELPER_MAP_TIMEOUT": "-1s"},
+			"invalid GCS_HELPER_MAP_TIMEOUT -1s: can't be negative (use 0 to disable it)",
+		},
+		{
+			"access id without key",
+			map[string]string{"GCS_HELPER_SIGN_GOOGLE_ACCESS_ID": "signer@project.iam.gserviceaccount.com"},
+			"incomplete signer: GCS_HELPER_SIGN_GOOGLE_ACCESS_ID and GCS_HELPER_SIGN_PRIVATE_KEY (or GCS_HELPER_SIGN_PRIVATE_KEY_SECRET) must be set together",
+		},
+		{
+			"key without access id",
+			map[string]string{"GCS_HELPER_SIGN_PRIVATE_KEY": "some-key"},
+			"incomplete signer: GCS_HELPER_SIGN_GOOGLE_ACCESS_ID and GCS_HELPER_SIGN_PRIVATE_KEY (or GCS_HELPER_SIGN_PRIVATE_KEY_SECRET) must be set together",
+		},
+		{
+			"partial cdn signer",
+			map[string]string{"GCS_HELPER_CDN_URL_PREFIX": "https://cdn.example.com/"},
+			"incomplete signer: GCS_HELPER_CDN_URL_PREFIX, GCS_HELPER_CDN_KEY_NAME and GCS_HELPER_CDN_KEY must be set together",
+		},
+		{
+			"multiple problems",
+			map[string]string{"GCS_HELPER_LOG_LEVEL": "verbose", "GCS_HELPER_TOKEN_KEY": "secret"},
+			`invalid GCS_HELPER_LOG_LEVEL: not a valid logrus Level: "verbose"; incomplete signer: GCS_HELPER_TOKEN_URL_PREFIX and GCS_HELPER_TOKEN_KEY must be set together`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.testCase, func(t *testing.T) {
+			test.envs["GCS_HELPER_BUCKET_NAME"] = "some-bucket"
+			setEnvs(test.envs)
+			_, err := loadConfig()
+			expected := test.expected + " (set GCS_HELPER_STRICT_CONFIG=false to only log these problems)"
+			if err == nil || err.Error() != expected {
+				t.Errorf("wrong error\nwant %q\ngot  %v", expected, err)
+			}
+
+			test.envs["GCS_HELPER_STRICT_CONFIG"] = "false"
+			setEnvs(test.envs)
+			if _, err = loadConfig(); err != nil {
+				t.Errorf("unexpected error without strict validation: %v", err)
+			}
+		})
+	}
+}
+
+func TestWarnStrictProblems(t *testing.T) {
+	var buf bytes.Buffer
+	logger := logrus.New()
+	logger.Out = &buf
+	config := Config{
+		LogLevel:         "debug",
+		ProxyPrefix:      "/proxy",
+		ProxyTimeout:     10 * time.Second,
+		ReadinessTimeout: 2 * time.Second,
+		ClientConfig:     ClientConfig{Timeout: 2 * time.Second},
+		SignConfig:       SignConfig{Mode: signModeKey, Expiration: time.Hour},
+		CDNConfig:        CDNConfig{Expiration: time.Hour},
+		TokenConfig:      TokenConfig{Expiration: time.Hour},
+	}
+	config.warnStrictProblems(logger)
+	if !strings.Contains(buf.String(), "invalid GCS_HELPER_PROXY_PREFIX") {
+		t.Errorf("missing warning for the proxy prefix, got %q", buf.String())
+	}
+
+	buf.Reset()
+	config.StrictConfig = true
+	config.warnStrictProblems(logger)
+	if buf.Len() > 0 {
+		t.Errorf("unexpected warnings with strict validation: %q", buf.String())
+	}
+}
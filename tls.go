@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// TLSConfig contains the configuration of TLS termination, which is enabled
+// when GCS_HELPER_TLS_CERT and GCS_HELPER_TLS_KEY are set, or when
+// GCS_HELPER_TLS_ACME_DOMAINS is set, for certificates obtained
+// automatically with ACME (from Let's Encrypt by default).
+type TLSConfig struct {
+	Cert             string   `envconfig:"GCS_HELPER_TLS_CERT"`
+	Key              string   `envconfig:"GCS_HELPER_TLS_KEY"`
+	MinVersion       string   `envconfig:"GCS_HELPER_TLS_MIN_VERSION" default:"1.2"`
+	ACMEDomains      []string `envconfig:"GCS_HELPER_TLS_ACME_DOMAINS"`
+	ACMECacheDir     string   `envconfig:"GCS_HELPER_TLS_ACME_CACHE_DIR"`
+	ACMEEmail        string   `envconfig:"GCS_HELPER_TLS_ACME_EMAIL"`
+	ACMEDirectoryURL string   `envconfig:"GCS_HELPER_TLS_ACME_DIRECTORY_URL" default:"https://acme-v02.api.letsencrypt.org/directory"`
+	ACMEHTTPListen   string   `envconfig:"GCS_HELPER_TLS_ACME_HTTP_LISTEN"`
+}
+
+// tlsVersions are the values of GCS_HELPER_TLS_MIN_VERSION. TLS 1.0 and 1.1
+// are deprecated (RFC 8996), and 1.3 is added when it's supported (see
+// tls_go112.go).
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+}
+
+// tlsCipherSuites are the cipher suites accepted by the server, which are
+// the ones with forward secrecy and authenticated encryption. They're only
+// used with TLS 1.2 and older versions of the protocol.
+var tlsCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+}
+
+func (c TLSConfig) enabled() bool {
+	return (c.Cert != "" && c.Key != "") || c.acmeEnabled()
+}
+
+func (c TLSConfig) acmeEnabled() bool {
+	return len(c.ACMEDomains) > 0
+}
+
+func (c TLSConfig) validate() error {
+	if (c.Cert != "") != (c.Key != "") {
+		return errors.New("GCS_HELPER_TLS_CERT and GCS_HELPER_TLS_KEY must be set together")
+	}
+	if c.acmeEnabled() {
+		if c.Cert != "" {
+			return errors.New("GCS_HELPER_TLS_ACME_DOMAINS can't be used with GCS_HELPER_TLS_CERT")
+		}
+		if c.ACMECacheDir == "" {
+			return errors.New("GCS_HELPER_TLS_ACME_DOMAINS requires GCS_HELPER_TLS_ACME_CACHE_DIR")
+		}
+		for _, domain := range c.ACMEDomains {
+			if domain == "" || strings.ContainsAny(domain, "*/:") {
+				return fmt.Errorf("invalid domain in GCS_HELPER_TLS_ACME_DOMAINS %q: must be a hostname, without wildcards", domain)
+			}
+		}
+		if u, err := url.Parse(c.ACMEDirectoryURL); err != nil || u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("invalid GCS_HELPER_TLS_ACME_DIRECTORY_URL %q: must be an https URL", c.ACMEDirectoryURL)
+		}
+	}
+	if _, ok := tlsVersions[c.MinVersion]; !ok {
+		var versions []string
+		for version := range tlsVersions {
+			versions = append(versions, strconv.Quote(version))
+		}
+		sort.Strings(versions)
+		return fmt.Errorf("invalid GCS_HELPER_TLS_MIN_VERSION %q: must be %s", c.MinVersion, strings.Join(versions, " or "))
+	}
+	return nil
+}
+
+// acmeManager returns the manager of the certificates obtained with ACME,
+// for the domains of GCS_HELPER_TLS_ACME_DOMAINS only, or nil when ACME is
+// disabled. Certificates are stored in GCS_HELPER_TLS_ACME_CACHE_DIR, so
+// they survive restarts, and renewed before they expire.
+func (c TLSConfig) acmeManager() *autocert.Manager {
+	if !c.acmeEnabled() {
+		return nil
+	}
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(c.ACMEDomains...),
+		Cache:      autocert.DirCache(c.ACMECacheDir),
+		Email:      c.ACMEEmail,
+		Client:     &acme.Client{DirectoryURL: c.ACMEDirectoryURL},
+	}
+}
+
+// serverTLSConfig returns the TLS configuration of the server, which gets
+// its certificates from the given ACME manager, when set, or loads them from
+// GCS_HELPER_TLS_CERT and GCS_HELPER_TLS_KEY.
+func (c TLSConfig) serverTLSConfig(m *autocert.Manager) (*tls.Config, error) {
+	tc := &tls.Config{
+		MinVersion:               tlsVersions[c.MinVersion],
+		CipherSuites:             tlsCipherSuites,
+		PreferServerCipherSuites: true,
+		CurvePreferences:         []tls.CurveID{tls.X25519, tls.CurveP256},
+	}
+	if m != nil {
+		tc.GetCertificate = m.GetCertificate
+		// the tls-alpn-01 challenge is answered on the TLS listener, so
+		// ACME works without GCS_HELPER_TLS_ACME_HTTP_LISTEN.
+		tc.NextProtos = []string{"h2", "http/1.1", acme.ALPNProto}
+		return tc, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+	if err != nil {
+		return nil, err
+	}
+	tc.Certificates = []tls.Certificate{cert}
+	return tc, nil
+}
+
+// serveACMEChallenges answers the http-01 challenges of ACME on the given
+// address, redirecting the other requests to HTTPS, for CAs or networks that
+// don't support the tls-alpn-01 challenge.
+func serveACMEChallenges(addr string, m *autocert.Manager, logger *logrus.Logger) {
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           m.HTTPHandler(nil),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	if err := server.ListenAndServe(); err != nil {
+		logger.WithField("listenAddr", addr).WithError(err).Error("failed to serve ACME challenges")
+	}
+}
@@ -0,0 +1,11 @@
+//go:build go1.12
+// +build go1.12
+
+package main
+
+import "crypto/tls"
+
+func init() {
+	// TLS 1.3 is only supported by Go 1.12 and later versions.
+	tlsVersions["1.3"] = tls.VersionTLS13
+}
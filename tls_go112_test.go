@@ -0,0 +1,49 @@
+//go:build go1.12
+// +build go1.12
+
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestServeTLS13(t *testing.T) {
+	certFile, keyFile, cleanup := writeTestCertificate(t)
+	defer cleanup()
+	c := TLSConfig{Cert: certFile, Key: keyFile, MinVersion: "1.3"}
+	if err := c.validate(); err != nil {
+		t.Fatal(err)
+	}
+	tc, err := c.serverTLSConfig(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httpServer(ServerConfig{}, http.NotFoundHandler())
+	server.TLSConfig = tc
+	go server.ServeTLS(listener, "", "")
+	defer server.Close()
+
+	dial := func(version uint16) (*tls.Conn, error) {
+		return tls.Dial("tcp", listener.Addr().String(), &tls.Config{
+			InsecureSkipVerify: true,
+			MinVersion:         version,
+			MaxVersion:         version,
+		})
+	}
+	conn, err := dial(tls.VersionTLS13)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if conn, err = dial(tls.VersionTLS12); err == nil {
+		conn.Close()
+		t.Error("unexpected <nil> error for a version older than GCS_HELPER_TLS_MIN_VERSION")
+	}
+}
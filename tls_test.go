@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// writeTestCertificate writes a self-signed certificate for 127.0.0.1 and
+// its key, returning their paths.
+func writeTestCertificate(t *testing.T) (certFile, keyFile string, cleanup func()) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "gcs-helper"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, cleanupCert := writeConfigFile(t, "tls.crt", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})))
+	keyFile, cleanupKey := writeConfigFile(t, "tls.key", string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})))
+	return certFile, keyFile, func() {
+		cleanupCert()
+		cleanupKey()
+	}
+}
+
+const acmeDirectory = "https://acme-v02.api.letsencrypt.org/directory"
+
+func TestTLSConfigValidate(t *testing.T) {
+	var tests = []struct {
+		config TLSConfig
+		valid  bool
+	}{
+		{TLSConfig{MinVersion: "1.2"}, true},
+		{TLSConfig{Cert: "tls.crt", Key: "tls.key", MinVersion: "1.0"}, false},
+		{TLSConfig{Cert: "tls.crt", Key: "tls.key", MinVersion: "1.1"}, false},
+		{TLSConfig{Cert: "tls.crt", MinVersion: "1.2"}, false},
+		{TLSConfig{Key: "tls.key", MinVersion: "1.2"}, false},
+		{TLSConfig{Cert: "tls.crt", Key: "tls.key", MinVersion: "2.0"}, false},
+		{TLSConfig{ACMEDomains: []string{"videos.example.com"}, ACMECacheDir: "/var/cache/gcs-helper", ACMEDirectoryURL: acmeDirectory, MinVersion: "1.2"}, true},
+		{TLSConfig{ACMEDomains: []string{"videos.example.com"}, ACMEDirectoryURL: acmeDirectory, MinVersion: "1.2"}, false},
+		{TLSConfig{ACMEDomains: []string{"videos.example.com"}, ACMECacheDir: "/var/cache/gcs-helper", Cert: "tls.crt", Key: "tls.key", ACMEDirectoryURL: acmeDirectory, MinVersion: "1.2"}, false},
+		{TLSConfig{ACMEDomains: []string{"*.example.com"}, ACMECacheDir: "/var/cache/gcs-helper", ACMEDirectoryURL: acmeDirectory, MinVersion: "1.2"}, false},
+		{TLSConfig{ACMEDomains: []string{"videos.example.com"}, ACMECacheDir: "/var/cache/gcs-helper", ACMEDirectoryURL: "http://acme.example.com/directory", MinVersion: "1.2"}, false},
+	}
+	for _, test := range tests {
+		err := test.config.validate()
+		if test.valid && err != nil {
+			t.Errorf("%#v: unexpected error: %v", test.config, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%#v: unexpected <nil> error", test.config)
+		}
+	}
+}
+
+func TestServeTLS(t *testing.T) {
+	certFile, keyFile, cleanup := writeTestCertificate(t)
+	defer cleanup()
+	tc, err := TLSConfig{Cert: certFile, Key: keyFile, MinVersion: "1.2"}.serverTLSConfig(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httpServer(ServerConfig{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	server.TLSConfig = tc
+	go server.ServeTLS(listener, "", "")
+	defer server.Close()
+
+	dial := func(version uint16) (*tls.Conn, error) {
+		return tls.Dial("tcp", listener.Addr().String(), &tls.Config{
+			InsecureSkipVerify: true,
+			MinVersion:         version,
+			MaxVersion:         version,
+		})
+	}
+	conn, err := dial(tls.VersionTLS12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if conn, err = dial(tls.VersionTLS11); err == nil {
+		conn.Close()
+		t.Error("unexpected <nil> error for a version older than GCS_HELPER_TLS_MIN_VERSION")
+	}
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	resp, err := client.Get("https://" + listener.Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("wrong status %d", resp.StatusCode)
+	}
+}
+
+func TestServerTLSConfigMissingFiles(t *testing.T) {
+	if _, err := (TLSConfig{Cert: "missing.crt", Key: "missing.key", MinVersion: "1.2"}).serverTLSConfig(nil); err == nil {
+		t.Error("unexpected <nil> error")
+	}
+}
+
+func TestServerTLSConfigACME(t *testing.T) {
+	c := TLSConfig{
+		ACMEDomains:      []string{"videos.example.com"},
+		ACMECacheDir:     "/var/cache/gcs-helper",
+		ACMEDirectoryURL: acmeDirectory,
+		MinVersion:       "1.2",
+	}
+	if !c.enabled() {
+		t.Error("TLS should be enabled with GCS_HELPER_TLS_ACME_DOMAINS")
+	}
+	m := c.acmeManager()
+	if m == nil {
+		t.Fatal("unexpected <nil> ACME manager")
+	}
+	if m.Client.DirectoryURL != acmeDirectory {
+		t.Errorf("wrong directory %q", m.Client.DirectoryURL)
+	}
+	tc, err := c.serverTLSConfig(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tc.GetCertificate == nil || tc.MinVersion != tls.VersionTLS12 {
+		t.Errorf("wrong TLS configuration %#v", tc)
+	}
+	var alpn bool
+	for _, proto := range tc.NextProtos {
+		alpn = alpn || proto == "acme-tls/1"
+	}
+	if !alpn {
+		t.Errorf("missing tls-alpn-01 protocol in %v", tc.NextProtos)
+	}
+	// certificates are only requested for the allowed domains.
+	if _, err := tc.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.example.com"}); err == nil {
+		t.Error("unexpected <nil> error for a domain that isn't allowed")
+	}
+	if (TLSConfig{}).acmeManager() != nil {
+		t.Error("unexpected ACME manager without GCS_HELPER_TLS_ACME_DOMAINS")
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestTokenSignedURL(t *testing.T) {
+	c := TokenConfig{URLPrefix: "https://edge.example.com/vod", Key: "token-secret", Param: "token"}
+	expires := time.Unix(1520692812, 0)
+	signed, err := c.signedURL("videos/video 1.mp4", expires)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Host != "edge.example.com" || u.EscapedPath() != "/vod/videos/video%201.mp4" {
+		t.Errorf("wrong url returned: %s", signed)
+	}
+	mac := hmac.New(sha256.New, []byte("token-secret"))
+	mac.Write([]byte("1520692812~/vod/videos/video%201.mp4"))
+	expectedToken := "1520692812~" + hex.EncodeToString(mac.Sum(nil))
+	if token := u.Query().Get("token"); token != expectedToken {
+		t.Errorf("wrong token\nwant %q\ngot  %q", expectedToken, token)
+	}
+	got, err := c.expiration(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Equal(expires) {
+		t.Errorf("wrong expiration\nwant %s\ngot  %s", expires.UTC(), got)
+	}
+}
+
+func TestTokenExpirationInvalidToken(t *testing.T) {
+	c := TokenConfig{Param: "token"}
+	if _, err := c.expiration("https://edge.example.com/video.mp4?token=abc"); err == nil {
+		t.Error("unexpected <nil> error")
+	}
+}
+
+func TestServerSignHandlerTokenSigner(t *testing.T) {
+	addr, cleanup := startServer(t, Config{
+		BucketName:   "my-bucket",
+		SignPrefix:   "/sign/",
+		Signer:       signerToken,
+		ProxyTimeout: time.Second,
+		TokenConfig: TokenConfig{
+			URLPrefix:  "https://edge.example.com/",
+			Key:        "token-secret",
+			Param:      "hdnts",
+			Expiration: time.Hour,
+		},
+	})
+	defer cleanup()
+	resp, err := http.Get(addr + "/sign/videos/video/video1_720p.mp4?expires=10m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("wrong status code\nwant %d\ngot  %d", http.StatusOK, resp.StatusCode)
+	}
+	var signed signedObjectURL
+	if err := json.NewDecoder(resp.Body).Decode(&signed); err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(signed.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Host != "edge.example.com" || u.Path != "/videos/video/video1_720p.mp4" || u.Query().Get("hdnts") == "" {
+		t.Errorf("wrong signed url: %s", signed.URL)
+	}
+	if ttl := time.Until(signed.Expires); ttl > 10*time.Minute || ttl < 9*time.Minute {
+		t.Errorf("wrong expiration: %s", signed.Expires)
+	}
+}
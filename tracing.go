@@ -0,0 +1,404 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Kinds of spans, with the values used by OpenTelemetry.
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+const (
+	traceBatchSize     = 512
+	traceQueueSize     = 2048
+	traceFlushInterval = 5 * time.Second
+	traceExportTimeout = 10 * time.Second
+)
+
+// TraceConfig contains the configuration of request tracing, which is
+// enabled when GCS_HELPER_TRACE_OTLP_ENDPOINT (or
+// OTEL_EXPORTER_OTLP_ENDPOINT) or GCS_HELPER_TRACE_CLOUD_PROJECT is set.
+type TraceConfig struct {
+	OTLPEndpoint string  `envconfig:"GCS_HELPER_TRACE_OTLP_ENDPOINT"`
+	CloudProject string  `envconfig:"GCS_HELPER_TRACE_CLOUD_PROJECT"`
+	SampleRatio  float64 `envconfig:"GCS_HELPER_TRACE_SAMPLE_RATIO" default:"1"`
+
+	// tracer is set up on startup (see setupTracing), and shared by all
+	// routes and configurations.
+	tracer *tracer
+}
+
+func (c TraceConfig) validate() error {
+	if c.SampleRatio < 0 || c.SampleRatio > 1 {
+		return fmt.Errorf("invalid GCS_HELPER_TRACE_SAMPLE_RATIO %v: must be between 0 and 1", c.SampleRatio)
+	}
+	if _, err := c.otlpTracesURL(); err != nil {
+		return fmt.Errorf("invalid GCS_HELPER_TRACE_OTLP_ENDPOINT (or OTEL_EXPORTER_OTLP_ENDPOINT): %v", err)
+	}
+	return nil
+}
+
+// otlpTracesURL returns the URL spans are sent to, which is the /v1/traces
+// path of the OTLP endpoint, or an empty string when tracing is disabled.
+func (c TraceConfig) otlpTracesURL() (string, error) {
+	if c.OTLPEndpoint == "" {
+		return "", nil
+	}
+	u, err := url.Parse(c.OTLPEndpoint)
+	if err != nil {
+		return "", err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", errors.New("must be an http or https URL, like http://localhost:4318")
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/v1/traces"
+	return u.String(), nil
+}
+
+type spanContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+	sampled bool
+}
+
+// traceparent returns the W3C Trace Context header of the span.
+//
+// See https://www.w3.org/TR/trace-context/#traceparent-header.
+func (sc spanContext) traceparent() string {
+	flags := "00"
+	if sc.sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(sc.traceID[:]) + "-" + hex.EncodeToString(sc.spanID[:]) + "-" + flags
+}
+
+// parseTraceparent parses a W3C Trace Context header.
+func parseTraceparent(value string) (spanContext, error) {
+	var sc spanContext
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return sc, errors.New("invalid traceparent")
+	}
+	traceID, err := hex.DecodeString(parts[1])
+	if err != nil || len(traceID) != len(sc.traceID) {
+		return sc, errors.New("invalid trace id")
+	}
+	spanID, err := hex.DecodeString(parts[2])
+	if err != nil || len(spanID) != len(sc.spanID) {
+		return sc, errors.New("invalid span id")
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil || len(flags) != 1 {
+		return sc, errors.New("invalid trace flags")
+	}
+	copy(sc.traceID[:], traceID)
+	copy(sc.spanID[:], spanID)
+	if sc.traceID == [16]byte{} || sc.spanID == [8]byte{} {
+		return sc, errors.New("invalid traceparent")
+	}
+	sc.sampled = flags[0]&1 == 1
+	return sc, nil
+}
+
+// span is an operation of a trace. Spans are only exported when sampled, but
+// unsampled spans are still propagated, so the decision is consistent
+// across services. All methods can be called on nil spans, which are
+// returned when tracing is disabled.
+type span struct {
+	tracer   *tracer
+	name     string
+	kind     int
+	context  spanContext
+	parentID [8]byte
+	start    time.Time
+
+	mu         sync.Mutex
+	end        time.Time
+	attributes map[string]interface{}
+	err        error
+}
+
+// setAttribute sets an attribute of the span. Values must be strings,
+// integers or booleans.
+func (s *span) setAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.attributes[key] = value
+	s.mu.Unlock()
+}
+
+// setError marks the span as failed.
+func (s *span) setError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.err = err
+	s.mu.Unlock()
+}
+
+// finish ends the span, queueing it for exporting when it's sampled.
+func (s *span) finish() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.end = time.Now()
+	s.mu.Unlock()
+	if s.context.sampled {
+		s.tracer.queue(s)
+	}
+}
+
+type spanKey struct{}
+
+// spanFromContext returns the current span of the given context, or nil.
+func spanFromContext(ctx context.Context) *span {
+	s, _ := ctx.Value(spanKey{}).(*span)
+	return s
+}
+
+// contextWithSpan returns a copy of the given context with the given span as
+// its current span.
+func contextWithSpan(ctx context.Context, s *span) context.Context {
+	if s == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, spanKey{}, s)
+}
+
+// startSpan starts a child of the current span of the given context. Spans
+// are only created within traced requests (see traceHandler), so it returns
+// nil otherwise.
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *span) {
+	parent := spanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	s := parent.tracer.newSpan(name, kind, parent.context, true)
+	return contextWithSpan(ctx, s), s
+}
+
+// spanExporter sends finished spans to a tracing backend.
+type spanExporter interface {
+	export(spans []*span) error
+}
+
+// tracer creates spans, and exports the sampled ones in batches in the
+// background. It's created on startup (see setupTracing), and shared by all
+// handlers.
+type tracer struct {
+	exporter    spanExporter
+	sampleRatio float64
+	logger      *logrus.Logger
+	spans       chan *span
+}
+
+func newTracer(exporter spanExporter, sampleRatio float64, logger *logrus.Logger) *tracer {
+	return &tracer{
+		exporter:    exporter,
+		sampleRatio: sampleRatio,
+		logger:      logger,
+		spans:       make(chan *span, traceQueueSize),
+	}
+}
+
+// newSpan starts a span with the given parent. Root spans get a new trace
+// ID and are sampled with GCS_HELPER_TRACE_SAMPLE_RATIO, while child spans
+// follow the sampling decision of their parent.
+func (t *tracer) newSpan(name string, kind int, parent spanContext, hasParent bool) *span {
+	s := &span{
+		tracer:     t,
+		name:       name,
+		kind:       kind,
+		start:      time.Now(),
+		attributes: make(map[string]interface{}),
+	}
+	if hasParent {
+		s.context.traceID = parent.traceID
+		s.context.sampled = parent.sampled
+		s.parentID = parent.spanID
+	} else {
+		rand.Read(s.context.traceID[:])
+		s.context.sampled = t.sample()
+	}
+	rand.Read(s.context.spanID[:])
+	return s
+}
+
+func (t *tracer) sample() bool {
+	if t.sampleRatio >= 1 {
+		return true
+	}
+	var b [8]byte
+	rand.Read(b[:])
+	return float64(binary.BigEndian.Uint64(b[:])>>11)/(1<<53) < t.sampleRatio
+}
+
+// queue queues the span for exporting. Spans are dropped when the queue is
+// full, so a slow backend doesn't slow down requests.
+func (t *tracer) queue(s *span) {
+	select {
+	case t.spans <- s:
+	default:
+	}
+}
+
+// run exports the queued spans in batches, until the queue is closed.
+func (t *tracer) run() {
+	ticker := time.NewTicker(traceFlushInterval)
+	defer ticker.Stop()
+	batch := make([]*span, 0, traceBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.exporter.export(batch); err != nil {
+			t.logger.WithError(err).WithField("spans", len(batch)).Error("failed to export spans")
+		}
+		batch = make([]*span, 0, traceBatchSize)
+	}
+	for {
+		select {
+		case s, ok := <-t.spans:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, s)
+			if len(batch) >= traceBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// startServerSpan starts the span of an incoming request, continuing the
+// trace in its traceparent header or, for requests coming from Google Cloud
+// load balancers, in its X-Cloud-Trace-Context header, when present.
+func (t *tracer) startServerSpan(r *http.Request, name string) *span {
+	parent, decided, err := remoteSpanContext(r)
+	if err == nil && !decided {
+		parent.sampled = t.sample()
+	}
+	s := t.newSpan(name, spanKindServer, parent, err == nil)
+	s.setAttribute("http.method", r.Method)
+	s.setAttribute("http.target", r.URL.Path)
+	return s
+}
+
+// remoteSpanContext returns the trace context sent with the given request,
+// in its traceparent header or in its X-Cloud-Trace-Context header. decided
+// reports whether the sampling decision was sent as well.
+func remoteSpanContext(r *http.Request) (sc spanContext, decided bool, err error) {
+	if sc, err = parseTraceparent(r.Header.Get("traceparent")); err == nil {
+		return sc, true, nil
+	}
+	return parseCloudTraceContext(r.Header.Get("X-Cloud-Trace-Context"))
+}
+
+// traceHandler wraps the given handler, tracing the requests it serves when
+// tracing is enabled.
+func traceHandler(c Config, name string, handler http.HandlerFunc) http.HandlerFunc {
+	if c.TraceConfig.tracer == nil {
+		return handler
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		s := c.TraceConfig.tracer.startServerSpan(r, name)
+		defer s.finish()
+		sw, ok := w.(*statusWriter)
+		if !ok {
+			sw = &statusWriter{ResponseWriter: w}
+		}
+		handler(sw, r.WithContext(contextWithSpan(r.Context(), s)))
+		s.setAttribute("http.status_code", int64(sw.code()))
+		if sw.code() >= http.StatusInternalServerError {
+			s.setError(fmt.Errorf("%d %s", sw.code(), http.StatusText(sw.code())))
+		}
+	}
+}
+
+// tracingTransport is an http.RoundTripper that traces the requests made
+// within traced requests, like the requests of the storage client, and
+// propagates the trace to the server.
+type tracingTransport struct {
+	http.RoundTripper
+}
+
+func (t *tracingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	ctx, s := startSpan(r.Context(), r.Method+" "+r.URL.Host, spanKindClient)
+	if s == nil {
+		return t.RoundTripper.RoundTrip(r)
+	}
+	defer s.finish()
+	s.setAttribute("http.method", r.Method)
+	s.setAttribute("http.url", r.URL.Scheme+"://"+r.URL.Host+r.URL.Path)
+	r2 := r.WithContext(ctx)
+	r2.Header = make(http.Header, len(r.Header)+1)
+	for name, values := range r.Header {
+		r2.Header[name] = values
+	}
+	r2.Header.Set("traceparent", s.context.traceparent())
+	r2.Header.Set("X-Cloud-Trace-Context", s.context.cloudTraceContext())
+	resp, err := t.RoundTripper.RoundTrip(r2)
+	if err != nil {
+		s.setError(err)
+		return resp, err
+	}
+	s.setAttribute("http.status_code", int64(resp.StatusCode))
+	if resp.StatusCode >= http.StatusInternalServerError {
+		s.setError(errors.New(resp.Status))
+	}
+	return resp, nil
+}
+
+// setupTracing creates the tracer when tracing is enabled, and starts
+// exporting spans in the background.
+func setupTracing(ctx context.Context, c *Config, logger *logrus.Logger) error {
+	var exporters multiExporter
+	// the endpoint is validated when loading the configuration.
+	if endpoint, _ := c.TraceConfig.otlpTracesURL(); endpoint != "" {
+		exporters = append(exporters, &otlpExporter{
+			url:    endpoint,
+			client: &http.Client{Timeout: traceExportTimeout},
+		})
+	}
+	if c.TraceConfig.CloudProject != "" {
+		gc, err := googleClient(ctx, traceExportTimeout)
+		if err != nil {
+			return fmt.Errorf("failed to create client for Cloud Trace: %v", err)
+		}
+		exporters = append(exporters, &cloudTraceExporter{project: c.TraceConfig.CloudProject, client: gc})
+	}
+	var exporter spanExporter
+	switch len(exporters) {
+	case 0:
+		return nil
+	case 1:
+		exporter = exporters[0]
+	default:
+		exporter = exporters
+	}
+	c.TraceConfig.tracer = newTracer(exporter, c.TraceConfig.SampleRatio, logger)
+	go c.TraceConfig.tracer.run()
+	return nil
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/fsouza/fake-gcs-server/fakestorage"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/option"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	var tests = []struct {
+		input   string
+		traceID string
+		spanID  string
+		sampled bool
+		valid   bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7", false, true},
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-future", "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7", true, true},
+		{"", "", "", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", "", "", false, false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "", "", false, false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", "", "", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", "", "", false, false},
+		{"00-4bf92f3577b34da6-00f067aa0ba902b7-01", "", "", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-x1", "", "", false, false},
+	}
+	for _, test := range tests {
+		sc, err := parseTraceparent(test.input)
+		if !test.valid {
+			if err == nil {
+				t.Errorf("%q: unexpected <nil> error", test.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", test.input, err)
+			continue
+		}
+		if traceID := hex.EncodeToString(sc.traceID[:]); traceID != test.traceID {
+			t.Errorf("%q: wrong trace id\nwant %q\ngot  %q", test.input, test.traceID, traceID)
+		}
+		if spanID := hex.EncodeToString(sc.spanID[:]); spanID != test.spanID {
+			t.Errorf("%q: wrong span id\nwant %q\ngot  %q", test.input, test.spanID, spanID)
+		}
+		if sc.sampled != test.sampled {
+			t.Errorf("%q: wrong sampled flag\nwant %v\ngot  %v", test.input, test.sampled, sc.sampled)
+		}
+	}
+}
+
+func TestTracerSampling(t *testing.T) {
+	tr := newTracer(nil, 0, logrus.New())
+	if s := tr.newSpan("root", spanKindServer, spanContext{}, false); s.context.sampled {
+		t.Error("root spans shouldn't be sampled with a ratio of 0")
+	}
+	parent := spanContext{traceID: [16]byte{1}, spanID: [8]byte{2}, sampled: true}
+	s := tr.newSpan("child", spanKindServer, parent, true)
+	if !s.context.sampled || s.context.traceID != parent.traceID || s.parentID != parent.spanID {
+		t.Errorf("the span should continue the sampled trace of its parent, got %#v", s.context)
+	}
+	tr.sampleRatio = 1
+	if s := tr.newSpan("root", spanKindServer, spanContext{}, false); !s.context.sampled {
+		t.Error("root spans should be sampled with a ratio of 1")
+	}
+}
+
+func TestTraceMapRequest(t *testing.T) {
+	server := fakestorage.NewServer(getObjects())
+	defer server.Stop()
+	hc := &http.Client{Transport: &tracingTransport{RoundTripper: fakeHTTPClient(server).Transport}}
+	client, err := storage.NewClient(context.Background(), option.WithHTTPClient(hc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := newTracer(nil, 1, logrus.New())
+	config := Config{
+		BucketName:   "my-bucket",
+		LogLevel:     "error",
+		MapPrefix:    "/map/",
+		ProxyPrefix:  "/proxy/",
+		ProxyTimeout: time.Second,
+		TraceConfig:  TraceConfig{tracer: tr},
+	}
+	handler := getHandler(config, client, hc)
+	req := httptest.NewRequest(http.MethodGet, "/map/videos/video/", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong status code\nwant %d\ngot  %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+	spans := make(map[string]*span)
+	for len(tr.spans) > 0 {
+		s := <-tr.spans
+		spans[s.name] = s
+	}
+	for _, name := range []string{"map", "map.mapping", "map.list", "map.encode", "GET www.googleapis.com"} {
+		s, ok := spans[name]
+		if !ok {
+			t.Errorf("missing span %q, got %v", name, spans)
+			continue
+		}
+		if traceID := hex.EncodeToString(s.context.traceID[:]); traceID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Errorf("%s: wrong trace id %q", name, traceID)
+		}
+	}
+	if t.Failed() {
+		return
+	}
+	if parentID := hex.EncodeToString(spans["map"].parentID[:]); parentID != "00f067aa0ba902b7" {
+		t.Errorf("the server span should continue the incoming trace, got parent %q", parentID)
+	}
+	if spans["map.list"].parentID != spans["map.mapping"].context.spanID {
+		t.Error("the listing should be traced within the mapping")
+	}
+	if spans["GET www.googleapis.com"].parentID != spans["map.list"].context.spanID {
+		t.Error("the storage requests should be traced within the listing")
+	}
+	if objects := spans["map.list"].attributes["map.objects"]; objects != 5 {
+		t.Errorf("wrong number of listed objects\nwant 5\ngot  %v", objects)
+	}
+	if status := spans["map"].attributes["http.status_code"]; status != int64(http.StatusOK) {
+		t.Errorf("wrong status code attribute %v", status)
+	}
+}
+
+func TestTraceDisabled(t *testing.T) {
+	handler := traceHandler(Config{}, "map", func(w http.ResponseWriter, r *http.Request) {
+		if ctx, s := startSpan(r.Context(), "map.list", spanKindInternal); s != nil || ctx != r.Context() {
+			t.Error("spans shouldn't be created when tracing is disabled")
+		}
+	})
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+}
+
+func TestTracingTransportPropagation(t *testing.T) {
+	var traceparent, cloudTraceContext string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+		cloudTraceContext = r.Header.Get("X-Cloud-Trace-Context")
+	}))
+	defer upstream.Close()
+	hc := &http.Client{Transport: &tracingTransport{RoundTripper: http.DefaultTransport}}
+
+	resp, err := hc.Get(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if traceparent != "" {
+		t.Errorf("requests outside of traces shouldn't have a traceparent, got %q", traceparent)
+	}
+
+	tr := newTracer(nil, 1, logrus.New())
+	parent := tr.newSpan("map", spanKindServer, spanContext{}, false)
+	req, _ := http.NewRequest(http.MethodGet, upstream.URL, nil)
+	resp, err = hc.Do(req.WithContext(contextWithSpan(context.Background(), parent)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if req.Header.Get("traceparent") != "" {
+		t.Error("the original request shouldn't be modified")
+	}
+	sc, err := parseTraceparent(traceparent)
+	if err != nil {
+		t.Fatalf("invalid traceparent %q: %v", traceparent, err)
+	}
+	if sc.traceID != parent.context.traceID || sc.spanID == parent.context.spanID || !sc.sampled {
+		t.Errorf("wrong traceparent %q", traceparent)
+	}
+	cloudSC, _, err := parseCloudTraceContext(cloudTraceContext)
+	if err != nil || cloudSC != sc {
+		t.Errorf("wrong X-Cloud-Trace-Context %q for traceparent %q", cloudTraceContext, traceparent)
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var body otlpRequest
+	var path, contentType string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		contentType = r.Header.Get("Content-Type")
+		json.NewDecoder(r.Body).Decode(&body)
+	}))
+	defer collector.Close()
+	url, err := TraceConfig{OTLPEndpoint: collector.URL + "/"}.otlpTracesURL()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exporter := &otlpExporter{url: url, client: collector.Client()}
+	tr := newTracer(exporter, 1, logrus.New())
+	parent := tr.newSpan("map", spanKindServer, spanContext{}, false)
+	s := tr.newSpan("map.list", spanKindInternal, parent.context, true)
+	s.setAttribute("map.objects", 3)
+	s.setError(context.DeadlineExceeded)
+	s.finish()
+	if err = exporter.export([]*span{<-tr.spans}); err != nil {
+		t.Fatal(err)
+	}
+	if path != "/v1/traces" || contentType != "application/json" {
+		t.Errorf("wrong request: path %q, content type %q", path, contentType)
+	}
+	if len(body.ResourceSpans) != 1 || len(body.ResourceSpans[0].ScopeSpans) != 1 || len(body.ResourceSpans[0].ScopeSpans[0].Spans) != 1 {
+		t.Fatalf("wrong request body %#v", body)
+	}
+	got := body.ResourceSpans[0].ScopeSpans[0].Spans[0]
+	if got.Name != "map.list" || got.Kind != spanKindInternal {
+		t.Errorf("wrong span %#v", got)
+	}
+	if got.TraceID != hex.EncodeToString(parent.context.traceID[:]) || got.ParentSpanID != hex.EncodeToString(parent.context.spanID[:]) {
+		t.Errorf("wrong span ids %#v", got)
+	}
+	if len(got.Attributes) != 1 || got.Attributes[0].Key != "map.objects" || got.Attributes[0].Value.IntValue == nil || *got.Attributes[0].Value.IntValue != "3" {
+		t.Errorf("wrong attributes %#v", got.Attributes)
+	}
+	if got.Status == nil || got.Status.Code != otlpStatusError || got.Status.Message != context.DeadlineExceeded.Error() {
+		t.Errorf("wrong status %#v", got.Status)
+	}
+}
+
+func TestLoadConfigTraceEndpoint(t *testing.T) {
+	var tests = []struct {
+		testCase string
+		envs     map[string]string
+		expected string
+	}{
+		{"not set", map[string]string{}, ""},
+		{"otel endpoint", map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4318"}, "http://collector:4318"},
+		{
+			"both set",
+			map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4318", "GCS_HELPER_TRACE_OTLP_ENDPOINT": "https://traces.example.com"},
+			"https://traces.example.com",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.testCase, func(t *testing.T) {
+			test.envs["GCS_HELPER_BUCKET_NAME"] = "some-bucket"
+			setEnvs(test.envs)
+			config, err := loadConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.TraceConfig.OTLPEndpoint != test.expected {
+				t.Errorf("wrong endpoint\nwant %q\ngot  %q", test.expected, config.TraceConfig.OTLPEndpoint)
+			}
+		})
+	}
+}
+
+func TestLoadConfigInvalidTraceSettings(t *testing.T) {
+	var tests = []struct {
+		testCase string
+		envs     map[string]string
+		expected string
+	}{
+		{
+			"sample ratio out of range",
+			map[string]string{"GCS_HELPER_TRACE_SAMPLE_RATIO": "1.5"},
+			"invalid GCS_HELPER_TRACE_SAMPLE_RATIO 1.5: must be between 0 and 1",
+		},
+		{
+			"endpoint without scheme",
+			map[string]string{"GCS_HELPER_TRACE_OTLP_ENDPOINT": "collector:4318"},
+			"invalid GCS_HELPER_TRACE_OTLP_ENDPOINT (or OTEL_EXPORTER_OTLP_ENDPOINT): must be an http or https URL, like http://localhost:4318",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.testCase, func(t *testing.T) {
+			test.envs["GCS_HELPER_BUCKET_NAME"] = "some-bucket"
+			setEnvs(test.envs)
+			_, err := loadConfig()
+			if err == nil {
+				t.Fatal("unexpected <nil> error")
+			}
+			if err.Error() != test.expected {
+				t.Errorf("wrong error\nwant %q\ngot  %q", test.expected, err.Error())
+			}
+		})
+	}
+}
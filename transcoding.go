@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"cloud.google.com/go/storage"
+)
+
+// Modes for serving objects stored with Content-Encoding: gzip.
+const (
+	// gzipPassthrough serves the compressed bytes as they're stored,
+	// preserving the Content-Encoding header, so range requests refer to
+	// the compressed content.
+	gzipPassthrough = "passthrough"
+
+	// gzipDecompress serves the decompressed content. The size of the
+	// decompressed content isn't known in advance, so range requests are
+	// ignored and the whole object is served.
+	gzipDecompress = "decompress"
+)
+
+type rawContentKey struct{}
+
+// withRawContent returns a context that instructs the transport to request
+// the content of objects as stored in GCS, without decompressive
+// transcoding.
+func withRawContent(ctx context.Context) context.Context {
+	return context.WithValue(ctx, rawContentKey{}, true)
+}
+
+// rawContentTransport is an http.RoundTripper that sends
+// "Accept-Encoding: gzip" on requests marked by withRawContent. When the
+// header is set explicitly, neither GCS nor net/http decompress the response.
+type rawContentTransport struct {
+	http.RoundTripper
+}
+
+func (t *rawContentTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if raw, _ := r.Context().Value(rawContentKey{}).(bool); raw {
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.Header = make(http.Header, len(r.Header)+1)
+		for name, values := range r.Header {
+			r2.Header[name] = values
+		}
+		r2.Header.Set("Accept-Encoding", "gzip")
+		r = r2
+	}
+	return t.RoundTripper.RoundTrip(r)
+}
+
+func decompressGzip(c *Config, attrs *storage.ObjectAttrs) bool {
+	return attrs.ContentEncoding == "gzip" && c.ProxyGzip == gzipDecompress
+}
+
+func writeDecompressedHeader(c *Config, attrs *storage.ObjectAttrs, w http.ResponseWriter) {
+	setObjectHeaders(c, attrs, w)
+	w.Header().Set("Accept-Ranges", "none")
+	w.WriteHeader(http.StatusOK)
+}
+
+func handleDecompressedGet(ctx context.Context, c *Config, object *storage.ObjectHandle, attrs *storage.ObjectAttrs, w http.ResponseWriter) error {
+	reader, err := getReader(ctx, object, 0, -1, maxTry)
+	if err != nil {
+		return handleObjectError(err, w)
+	}
+	defer reader.Close()
+	writeDecompressedHeader(c, attrs, w)
+	return copyChunks(w, reader, c.ProxyChunkSize)
+}
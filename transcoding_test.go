@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRawContentTransport(t *testing.T) {
+	var acceptEncoding string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		acceptEncoding = r.Header.Get("Accept-Encoding")
+	}))
+	defer server.Close()
+	client := http.Client{
+		Transport: &rawContentTransport{RoundTripper: &http.Transport{DisableCompression: true}},
+	}
+	var tests = []struct {
+		testCase string
+		ctx      context.Context
+		expected string
+	}{
+		{"regular request", context.Background(), ""},
+		{"raw content request", withRawContent(context.Background()), "gzip"},
+	}
+	for _, test := range tests {
+		t.Run(test.testCase, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+			resp, err := client.Do(req.WithContext(test.ctx))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if acceptEncoding != test.expected {
+				t.Errorf("wrong Accept-Encoding\nwant %q\ngot  %q", test.expected, acceptEncoding)
+			}
+			if req.Header.Get("Accept-Encoding") != "" {
+				t.Error("original request was modified")
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// defaultTokenSource returns the token source of the application default
+// credentials. It's a variable so tests don't depend on the credentials of
+// the environment.
+var defaultTokenSource = google.DefaultTokenSource
+
+// tokenSource returns the source of the tokens that authenticate the
+// requests sent to GCS, from the application default credentials, or nil
+// when GCS_CLIENT_ANONYMOUS is set.
+func (c ClientConfig) tokenSource() (oauth2.TokenSource, error) {
+	if c.Anonymous {
+		return nil, nil
+	}
+	return defaultTokenSource(context.Background(), storage.ScopeReadWrite)
+}
+
+// proxyFunc returns the proxy function of the transport used for accessing
+// GCS: the proxy in GCS_CLIENT_PROXY, or the one configured in the standard
+// HTTPS_PROXY, HTTP_PROXY and NO_PROXY variables when it's not set.
+func (c ClientConfig) proxyFunc() (func(*http.Request) (*url.URL, error), error) {
+	if c.Proxy == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+	u, err := url.Parse(c.Proxy)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5" {
+		return nil, errors.New("the scheme must be http, https or socks5")
+	}
+	if u.Host == "" {
+		return nil, errors.New("missing host")
+	}
+	return http.ProxyURL(u), nil
+}
+
+// rootCAs returns the system certificate pool with the certificates in
+// GCS_CLIENT_CA_FILE added to it, or nil when it's not set, so the system
+// pool is used.
+func (c ClientConfig) rootCAs() (*x509.CertPool, error) {
+	if c.CAFile == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(c.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no PEM certificates found in %q", c.CAFile)
+	}
+	return pool, nil
+}
+
+// identityTransport is an http.RoundTripper that identifies the requests
+// sent to GCS in audit logs and quota accounting: it prepends gcs-helper and
+// its version (and GCS_CLIENT_USER_AGENT) to the User-Agent of the storage
+// client, and bills quota to GCS_HELPER_QUOTA_PROJECT, when set.
+type identityTransport struct {
+	userAgent    string
+	quotaProject string
+	http.RoundTripper
+}
+
+func (t *identityTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.Header = make(http.Header, len(r.Header)+2)
+	for name, values := range r.Header {
+		r2.Header[name] = values
+	}
+	userAgent := t.userAgent
+	if ua := r.Header.Get("User-Agent"); ua != "" {
+		userAgent += " " + ua
+	}
+	r2.Header.Set("User-Agent", userAgent)
+	if t.quotaProject != "" {
+		r2.Header.Set("X-Goog-User-Project", t.quotaProject)
+	}
+	return t.RoundTripper.RoundTrip(r2)
+}
+
+// userAgent returns the User-Agent of the requests sent to GCS.
+func (c ClientConfig) userAgent() string {
+	ua := "gcs-helper/" + version
+	if c.UserAgent != "" {
+		ua += " " + c.UserAgent
+	}
+	return ua
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"cloud.google.com/go/storage"
+)
+
+const metadataHeaderPrefix = "X-Goog-Meta-"
+
+func getUploadHandler(c Config, client *storage.Client) http.HandlerFunc {
+	logger := c.logger()
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		if r.Method != http.MethodPut {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !authorized(r, c.UploadToken) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.ContentLength > c.UploadMaxSize {
+			http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		obj, err := objectHandle(&c, client, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		attrs, err := uploadObject(ctx, &c, obj, r)
+		if err != nil {
+			if err == errUploadTooLarge {
+				http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			requestLogger(r.Context(), logger).WithError(err).WithField("url", r.URL.RequestURI()).Error("failed to upload object")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(newObjectMetadata(&c, attrs))
+	}
+}
+
+var errUploadTooLarge = errors.New("request body too large")
+
+func uploadObject(ctx context.Context, c *Config, obj *storage.ObjectHandle, r *http.Request) (*storage.ObjectAttrs, error) {
+	writer := obj.NewWriter(ctx)
+	writer.ContentType = r.Header.Get("Content-Type")
+	if writer.ContentType == "" {
+		writer.ContentType = contentType(c, &storage.ObjectAttrs{Name: strings.TrimLeft(r.URL.Path, "/")})
+	}
+	writer.CacheControl = r.Header.Get("Cache-Control")
+	writer.ContentEncoding = r.Header.Get("Content-Encoding")
+	for name := range r.Header {
+		if strings.HasPrefix(name, metadataHeaderPrefix) && len(name) > len(metadataHeaderPrefix) {
+			if writer.Metadata == nil {
+				writer.Metadata = make(map[string]string)
+			}
+			writer.Metadata[strings.ToLower(name[len(metadataHeaderPrefix):])] = r.Header.Get(name)
+		}
+	}
+	// reading one extra byte allows detecting bodies larger than the limit
+	// when the request doesn't include a Content-Length header.
+	n, err := io.Copy(writer, io.LimitReader(r.Body, c.UploadMaxSize+1))
+	if err == nil && n > c.UploadMaxSize {
+		err = errUploadTooLarge
+	}
+	if err != nil {
+		writer.CloseWithError(err)
+		return nil, err
+	}
+	if err = writer.Close(); err != nil {
+		return nil, err
+	}
+	return writer.Attrs(), nil
+}
+
+// authorized reports whether the request carries the given bearer token in
+// the Authorization header.
+func authorized(r *http.Request, token string) bool {
+	const prefix = "Bearer "
+	header := r.Header.Get("Authorization")
+	if token == "" || !strings.HasPrefix(header, prefix) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(header[len(prefix):]), []byte(token)) == 1
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServerUploadHandler(t *testing.T) {
+	addr, cleanup := startServer(t, Config{
+		BucketName:    "my-bucket",
+		UploadPrefix:  "/upload/",
+		UploadToken:   "secret",
+		UploadMaxSize: 32,
+		ProxyPrefix:   "/proxy/",
+		ProxyTimeout:  time.Second,
+	})
+	defer cleanup()
+	var tests = []struct {
+		testCase       string
+		method         string
+		path           string
+		header         http.Header
+		body           string
+		expectedStatus int
+	}{
+		{
+			"upload file",
+			http.MethodPut,
+			"/upload/uploads/file1.txt",
+			http.Header{
+				"Authorization":         []string{"Bearer secret"},
+				"Content-Type":          []string{"text/plain"},
+				"X-Goog-Meta-Uploader":  []string{"tests"},
+				"X-Goog-Meta-Something": []string{"else"},
+			},
+			"some uploaded content",
+			http.StatusCreated,
+		},
+		{
+			"missing token",
+			http.MethodPut,
+			"/upload/uploads/file2.txt",
+			nil,
+			"some uploaded content",
+			http.StatusUnauthorized,
+		},
+		{
+			"invalid token",
+			http.MethodPut,
+			"/upload/uploads/file2.txt",
+			http.Header{"Authorization": []string{"Bearer not-secret"}},
+			"some uploaded content",
+			http.StatusUnauthorized,
+		},
+		{
+			"body too large",
+			http.MethodPut,
+			"/upload/uploads/file2.txt",
+			http.Header{"Authorization": []string{"Bearer secret"}},
+			strings.Repeat("a", 33),
+			http.StatusRequestEntityTooLarge,
+		},
+		{
+			"method not allowed",
+			http.MethodPost,
+			"/upload/uploads/file2.txt",
+			http.Header{"Authorization": []string{"Bearer secret"}},
+			"some uploaded content",
+			http.StatusMethodNotAllowed,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.testCase, func(t *testing.T) {
+			req, _ := http.NewRequest(test.method, addr+test.path, strings.NewReader(test.body))
+			for name := range test.header {
+				req.Header.Set(name, test.header.Get(name))
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != test.expectedStatus {
+				t.Errorf("wrong status code\nwant %d\ngot  %d", test.expectedStatus, resp.StatusCode)
+			}
+		})
+	}
+
+	downloadTest := serverTest{
+		testCase:       "download uploaded file",
+		method:         http.MethodGet,
+		addr:           addr + "/proxy/uploads/file1.txt",
+		expectedStatus: http.StatusOK,
+		expectedBody:   "some uploaded content",
+	}
+	t.Run(downloadTest.testCase, downloadTest.run)
+	notFoundTest := serverTest{
+		testCase:       "rejected file wasn't uploaded",
+		method:         http.MethodGet,
+		addr:           addr + "/proxy/uploads/file2.txt",
+		expectedStatus: http.StatusNotFound,
+	}
+	t.Run(notFoundTest.testCase, notFoundTest.run)
+}
+
+func TestAuthorized(t *testing.T) {
+	var tests = []struct {
+		header   string
+		token    string
+		expected bool
+	}{
+		{"Bearer secret", "secret", true},
+		{"Bearer secret2", "secret", false},
+		{"secret", "secret", false},
+		{"", "secret", false},
+		{"Bearer ", "", false},
+	}
+	for _, test := range tests {
+		r, _ := http.NewRequest(http.MethodPut, "/", nil)
+		r.Header.Set("Authorization", test.header)
+		if got := authorized(r, test.token); got != test.expected {
+			t.Errorf("authorized(%q, %q): want %v, got %v", test.header, test.token, test.expected, got)
+		}
+	}
+}
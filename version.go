@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+)
+
+// Build information. commit and buildDate (and, for builds that aren't
+// releases, version) are set at build time, with
+//
+//	go install -ldflags "-X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	version   = "1.14.0"
+	commit    string
+	buildDate string
+)
+
+type buildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildDate string `json:"buildDate,omitempty"`
+	GoVersion string `json:"goVersion"`
+}
+
+func currentBuildInfo() buildInfo {
+	return buildInfo{
+		Version:   version,
+		Commit:    commit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+	}
+}
+
+func (b buildInfo) String() string {
+	s := "gcs-helper " + b.Version
+	if b.Commit != "" {
+		s += " (commit " + b.Commit
+		if b.BuildDate != "" {
+			s += ", built " + b.BuildDate
+		}
+		s += ")"
+	} else if b.BuildDate != "" {
+		s += " (built " + b.BuildDate + ")"
+	}
+	return s + " " + b.GoVersion
+}
+
+// versionCommand prints the build information, as text or JSON.
+func versionCommand(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("version", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	asJSON := fs.Bool("json", false, "print the build information as JSON")
+	if _, code, ok := parseCommandFlags(fs, args); !ok {
+		return code
+	}
+	info := currentBuildInfo()
+	if *asJSON {
+		json.NewEncoder(stdout).Encode(info)
+	} else {
+		fmt.Fprintln(stdout, info)
+	}
+	return 0
+}
+
+// getVersionHandler returns the handler for GCS_HELPER_VERSION_PATH, which
+// responds with the build information as JSON.
+func getVersionHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-cache")
+		json.NewEncoder(w).Encode(currentBuildInfo())
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"testing"
+)
+
+func TestBuildInfoString(t *testing.T) {
+	var tests = []struct {
+		testCase string
+		info     buildInfo
+		expected string
+	}{
+		{
+			"version only",
+			buildInfo{Version: "1.14.0", GoVersion: "go1.10"},
+			"gcs-helper 1.14.0 go1.10",
+		},
+		{
+			"commit and build date",
+			buildInfo{Version: "1.14.0", Commit: "c051fad", BuildDate: "2018-03-10T14:30:12Z", GoVersion: "go1.10"},
+			"gcs-helper 1.14.0 (commit c051fad, built 2018-03-10T14:30:12Z) go1.10",
+		},
+		{
+			"build date only",
+			buildInfo{Version: "1.14.0", BuildDate: "2018-03-10T14:30:12Z", GoVersion: "go1.10"},
+			"gcs-helper 1.14.0 (built 2018-03-10T14:30:12Z) go1.10",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.testCase, func(t *testing.T) {
+			if got := test.info.String(); got != test.expected {
+				t.Errorf("wrong string\nwant %q\ngot  %q", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestVersionCommand(t *testing.T) {
+	defer func(c, d string) { commit, buildDate = c, d }(commit, buildDate)
+	commit, buildDate = "c051fad", "2018-03-10T14:30:12Z"
+	var stdout, stderr bytes.Buffer
+	if code := versionCommand(nil, &stdout, &stderr); code != 0 {
+		t.Fatalf("wrong exit code\nwant 0\ngot  %d", code)
+	}
+	expected := "gcs-helper " + version + " (commit c051fad, built 2018-03-10T14:30:12Z) " + runtime.Version() + "\n"
+	if stdout.String() != expected {
+		t.Errorf("wrong output\nwant %q\ngot  %q", expected, stdout.String())
+	}
+
+	stdout.Reset()
+	if code := versionCommand([]string{"-json"}, &stdout, &stderr); code != 0 {
+		t.Fatalf("wrong exit code\nwant 0\ngot  %d", code)
+	}
+	var info buildInfo
+	if err := json.Unmarshal(stdout.Bytes(), &info); err != nil {
+		t.Fatal(err)
+	}
+	if info != currentBuildInfo() {
+		t.Errorf("wrong build info\nwant %#v\ngot  %#v", currentBuildInfo(), info)
+	}
+}
+
+func TestServerVersionHandler(t *testing.T) {
+	defer func(c, d string) { commit, buildDate = c, d }(commit, buildDate)
+	commit, buildDate = "c051fad", "2018-03-10T14:30:12Z"
+	addr, cleanup := startServer(t, Config{
+		BucketName:  "my-bucket",
+		ProxyPrefix: "/proxy/",
+		VersionPath: "/version",
+	})
+	defer cleanup()
+	var tests = []serverTest{
+		{
+			testCase:       "version",
+			method:         http.MethodGet,
+			addr:           addr + "/version",
+			expectedStatus: http.StatusOK,
+			expectedHeader: http.Header{"Content-Type": []string{"application/json"}},
+			expectedBody: map[string]interface{}{
+				"version":   version,
+				"commit":    "c051fad",
+				"buildDate": "2018-03-10T14:30:12Z",
+				"goVersion": runtime.Version(),
+			},
+		},
+		{
+			testCase:       "wrong method",
+			method:         http.MethodPost,
+			addr:           addr + "/version",
+			expectedStatus: http.StatusMethodNotAllowed,
+			expectedBody:   "method not allowed\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.testCase, test.run)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"cloud.google.com/go/storage"
+)
+
+// HostMap maps hostnames to bucket names, in the format
+// "videos.example.com=example-videos,*.customer.com=customer-videos".
+// Hostnames are case-insensitive, and wildcards match any subdomain of the
+// given domain.
+type HostMap map[string]string
+
+// Decode parses the given value into the map.
+func (m *HostMap) Decode(value string) error {
+	result := make(HostMap)
+	for _, item := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return fmt.Errorf("invalid host map item: %q", item)
+		}
+		host := strings.ToLower(parts[0])
+		if strings.Contains(strings.TrimPrefix(host, "*."), "*") || strings.ContainsAny(host, "/:") {
+			return fmt.Errorf("invalid host map item: %q", item)
+		}
+		result[host] = parts[1]
+	}
+	*m = result
+	return nil
+}
+
+// lookup returns the bucket of the given host, which may include a port.
+// Exact matches take precedence over wildcards, and longer wildcards over
+// shorter ones.
+func (m HostMap) lookup(host string) (string, bool) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if bucket, ok := m[host]; ok {
+		return bucket, true
+	}
+	for i := strings.Index(host, "."); i >= 0; i = strings.Index(host, ".") {
+		host = host[i+1:]
+		if bucket, ok := m["*."+host]; ok {
+			return bucket, true
+		}
+	}
+	return "", false
+}
+
+// getHostHandler returns a handler that serves each request with the bucket
+// selected by its Host header in GCS_HELPER_HOST_BUCKETS, and requests for
+// other hosts (like health checks) with GCS_HELPER_BUCKET_NAME.
+func getHostHandler(c Config, client *storage.Client, hc *http.Client) http.HandlerFunc {
+	hosts := c.HostBuckets
+	c.HostBuckets = nil
+	handlers := make(map[string]http.HandlerFunc, len(hosts))
+	for _, bucket := range hosts {
+		if _, ok := handlers[bucket]; ok {
+			continue
+		}
+		bc := c
+		bc.BucketName = bucket
+		bc.CandidateBucketName = ""
+		bc.CanaryBucketName = ""
+		handlers[bucket] = getHandler(bc, client, hc)
+	}
+	defaultHandler := getHandler(c, client, hc)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if bucket, ok := hosts.lookup(r.Host); ok {
+			handlers[bucket](w, r)
+			return
+		}
+		defaultHandler(w, r)
+	}
+}
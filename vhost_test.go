@@ -0,0 +1,120 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHostMapDecode(t *testing.T) {
+	var tests = []struct {
+		input       string
+		expected    HostMap
+		expectedErr bool
+	}{
+		{
+			"Videos.Example.com=example-videos, *.customer.com=customer-videos",
+			HostMap{"videos.example.com": "example-videos", "*.customer.com": "customer-videos"},
+			false,
+		},
+		{"videos.example.com", nil, true},
+		{"videos.example.com=", nil, true},
+		{"videos.*.com=example-videos", nil, true},
+		{"videos.example.com:8080=example-videos", nil, true},
+	}
+	for _, test := range tests {
+		var m HostMap
+		err := m.Decode(test.input)
+		if test.expectedErr {
+			if err == nil {
+				t.Errorf("%q: unexpected <nil> error", test.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", test.input, err)
+		}
+		if !reflect.DeepEqual(m, test.expected) {
+			t.Errorf("%q: wrong map\nwant %#v\ngot  %#v", test.input, test.expected, m)
+		}
+	}
+}
+
+func TestHostMapLookup(t *testing.T) {
+	m := HostMap{
+		"videos.example.com":  "example-videos",
+		"*.example.com":       "example",
+		"*.eu.customer.com":   "customer-eu",
+		"*.customer.com":      "customer",
+		"customer.com":        "customer-root",
+		"videos.customer.com": "customer-videos",
+	}
+	var tests = []struct {
+		host     string
+		expected string
+	}{
+		{"videos.example.com", "example-videos"},
+		{"VIDEOS.example.com:8080", "example-videos"},
+		{"videos.example.com.", "example-videos"},
+		{"images.example.com", "example"},
+		{"cdn.images.example.com", "example"},
+		{"cdn.eu.customer.com", "customer-eu"},
+		{"cdn.us.customer.com", "customer"},
+		{"customer.com", "customer-root"},
+		{"videos.customer.com", "customer-videos"},
+		{"example.com", ""},
+		{"10.0.0.1:8080", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.host, func(t *testing.T) {
+			bucket, ok := m.lookup(test.host)
+			if ok != (test.expected != "") || bucket != test.expected {
+				t.Errorf("wrong bucket\nwant %q\ngot  %q (%v)", test.expected, bucket, ok)
+			}
+		})
+	}
+}
+
+func TestHostHandler(t *testing.T) {
+	addr, cleanup := startServer(t, Config{
+		BucketName:   "my-bucket",
+		HostBuckets:  HostMap{"*.example.com": "your-bucket"},
+		ProxyPrefix:  "/proxy/",
+		ProxyTimeout: time.Second,
+	})
+	defer cleanup()
+	var tests = []struct {
+		testCase     string
+		host         string
+		expectedBody string
+	}{
+		{"mapped host", "videos.example.com", "wait what"},
+		{"other host", "videos.example.org", "some even nicer music"},
+	}
+	for _, test := range tests {
+		t.Run(test.testCase, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, addr+"/proxy/musics/music/music3.txt", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Host = test.host
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			data, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("wrong status code\nwant %d\ngot  %d", http.StatusOK, resp.StatusCode)
+			}
+			if string(data) != test.expectedBody {
+				t.Errorf("wrong body\nwant %q\ngot  %q", test.expectedBody, string(data))
+			}
+		})
+	}
+}